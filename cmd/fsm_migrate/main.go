@@ -0,0 +1,32 @@
+// Утилита переносит данные машины состояний в redis из старой раскладки (fsm:id:key) в хэши пользователей (fsm:user:id).
+// Запускать один раз после обновления бота, можно повторно: уже перенесенные ключи пропускаются
+//
+//	go run ./cmd/fsm_migrate -redis 127.0.0.1:6379
+package main
+
+import (
+	"bot_for_modeus/pkg/bot"
+	"bot_for_modeus/pkg/redis"
+	"context"
+	"flag"
+	"github.com/rs/zerolog/log"
+	"os"
+)
+
+func main() {
+	url := flag.String("redis", os.Getenv("REDIS_URL"), "redis address (default REDIS_URL)")
+	flag.Parse()
+
+	if *url == "" {
+		log.Fatal().Msg("redis address is not specified")
+	}
+
+	rdb := redis.NewRedis(*url)
+	defer rdb.Close()
+
+	migrated, err := bot.MigrateRedisStorage(context.Background(), rdb.Conn())
+	if err != nil {
+		log.Fatal().Err(err).Int("migrated", migrated).Msg("fsm migration error")
+	}
+	log.Info().Int("migrated", migrated).Msg("fsm migration finished")
+}
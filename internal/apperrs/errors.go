@@ -0,0 +1,103 @@
+package apperrs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Kind определяет, как ошибку показать пользователю и насколько подробно ее логировать
+type Kind uint8
+
+const (
+	// KindInternal - ошибка у нас (бд, кэш, баг). Пользователь получает номер инцидента, в лог пишется полный контекст
+	KindInternal Kind = iota
+	// KindUser - пользователь ввел что-то не то. Ему показывается подсказка, в лог ничего не пишется
+	KindUser
+	// KindTransient - временная недоступность внешнего сервиса (модеус, парсер). Стоит повторить позже
+	KindTransient
+	// KindAuth - неверные или устаревшие данные для входа в модеус
+	KindAuth
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindUser:
+		return "user"
+	case KindTransient:
+		return "transient"
+	case KindAuth:
+		return "auth"
+	}
+	return "internal"
+}
+
+// Error - ошибка с типом и кодом. Код стабилен (в отличие от текста) и используется в логах и метриках,
+// например, parser.modeus_unavailable.
+//
+// Объявленные в пакетах ошибки (ErrUserNotFound и тд) - это *Error без причины.
+// Wrap добавляет причину, при этом errors.Is по-прежнему находит исходную ошибку по коду
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+	Err     error
+}
+
+func New(kind Kind, code, message string) *Error {
+	return &Error{
+		Kind:    kind,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Wrap возвращает копию ошибки с причиной cause. Исходная (объявленная в пакете) ошибка не меняется
+func (e *Error) Wrap(cause error) *Error {
+	c := *e
+	c.Err = cause
+	return &c
+}
+
+// KindOf возвращает тип первой типизированной ошибки в цепочке. Нетипизированные ошибки считаются внутренними
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+// CodeOf возвращает код первой типизированной ошибки в цепочке или internal
+func CodeOf(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return "internal"
+}
+
+// NewIncidentId возвращает короткий номер инцидента, который пользователь может переслать в поддержку.
+// Тот же номер пишется в лог вместе с ошибкой, поэтому по нему ищется полный контекст
+func NewIncidentId() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
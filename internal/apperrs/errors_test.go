@@ -0,0 +1,60 @@
+package apperrs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	errNotFound := New(KindUser, "user.not_found", "user not found")
+	errUnavailable := New(KindTransient, "parser.unavailable", "parser unavailable")
+	cause := errors.New("connection refused")
+
+	wrapped := errUnavailable.Wrap(cause)
+	assert.True(t, errors.Is(wrapped, errUnavailable))
+	assert.True(t, errors.Is(wrapped, cause))
+	assert.False(t, errors.Is(wrapped, errNotFound))
+	assert.Equal(t, "parser unavailable: connection refused", wrapped.Error())
+	assert.Nil(t, errUnavailable.Err, "Wrap must not modify declared error")
+
+	testCases := []struct {
+		testName   string
+		err        error
+		expectKind Kind
+		expectCode string
+	}{
+		{
+			testName:   "declared error",
+			err:        errNotFound,
+			expectKind: KindUser,
+			expectCode: "user.not_found",
+		},
+		{
+			testName:   "wrapped with fmt",
+			err:        fmt.Errorf("lookup: %w", wrapped),
+			expectKind: KindTransient,
+			expectCode: "parser.unavailable",
+		},
+		{
+			testName:   "untyped error",
+			err:        cause,
+			expectKind: KindInternal,
+			expectCode: "internal",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			assert.Equal(t, tc.expectKind, KindOf(tc.err))
+			assert.Equal(t, tc.expectCode, CodeOf(tc.err))
+		})
+	}
+}
+
+func TestNewIncidentId(t *testing.T) {
+	id := NewIncidentId()
+	assert.Len(t, id, 8)
+	assert.NotEqual(t, id, NewIncidentId())
+}
@@ -5,11 +5,9 @@ import (
 	v2 "bot_for_modeus/internal/handler/v2"
 	"bot_for_modeus/internal/metrics"
 	"bot_for_modeus/internal/model/tgmodel"
-	"bot_for_modeus/internal/repo"
 	"bot_for_modeus/internal/service"
 	"bot_for_modeus/pkg/bot"
 	"bot_for_modeus/pkg/crypter"
-	"bot_for_modeus/pkg/mongo"
 	"bot_for_modeus/pkg/redis"
 	"context"
 	"github.com/joho/godotenv"
@@ -27,22 +25,32 @@ func Run() {
 		log.Fatal().Err(err).Msg("config init error")
 	}
 	logger := setLogger(cfg.Log.Level, cfg.Log.Output)
+	shutdownTracing := setTracing(ctx, cfg.Tracing)
+	defer shutdownTracing()
 
-	// Initializing database
-	mongodb, err := mongo.NewMongo(ctx, cfg.MongoDB.Url, cfg.MongoDB.DB)
-	if err != nil {
-		log.Fatal().Err(err).Msg("database init error")
+	// Initializing database (mongodb, postgres or memory)
+	db := newDatabase(ctx, cfg)
+	defer db.close()
+
+	// redis is needed only for redis fsm storage
+	var rdb redis.Redis
+	if cfg.Bot.Storage == "redis" {
+		rdb = redis.NewRedis(cfg.Redis.Url)
+		defer rdb.Close()
 	}
-	defer mongodb.Disconnect()
+	// fsm storage (redis, memory or bolt)
+	storage := storageOption(ctx, cfg.Bot, rdb)
 
-	// redis database
-	rdb := redis.NewRedis(cfg.Redis.Url)
-	defer rdb.Close()
+	keyring, err := crypter.NewKeyring(cfg.Crypter.KeyId, cfg.Crypter.Keys, crypter.Legacy(cfg.Crypter.Secret))
+	if err != nil {
+		log.Fatal().Err(err).Msg("crypter init error")
+	}
 
 	d := &service.ServicesDependencies{
-		Repos:      repo.NewRepositories(mongodb),
-		Crypter:    crypter.NewCrypter(cfg.Crypter.Secret),
+		Repos:      db.repos,
+		Crypter:    keyring,
 		ParserHost: cfg.Parser.Host,
+		Events:     eventsBus(ctx, rdb),
 	}
 	services := service.NewServices(d)
 
@@ -52,15 +60,27 @@ func Run() {
 		Ctx:       ctx,
 	}
 	// tg client
-	b, err := bot.NewBot(s, bot.SetCommands(tgmodel.UICommands), bot.RedisStorage(ctx, rdb.Conn()), bot.SetLogger(logger))
+	b, err := bot.NewBot(s,
+		bot.SetCommands(tgmodel.UICommands),
+		storage,
+		bot.StorageCodec(storageCodec(cfg.Bot.StorageCodec, cfg.Bot.StorageCompressThreshold)),
+		bot.StateTTL(cfg.Bot.StateTTL),
+		bot.SetLogger(logger),
+	)
 	if err != nil {
 		log.Fatal().Err(err).Msg("tg client init error")
 	}
 	v2.NewHandler(b, services)
+	for _, r := range b.Routes() {
+		log.Debug().Str("method", r.Method).Str("path", r.Path).Msg("route registered")
+	}
 	go b.ListenAndServe()
 
+	go migrateCredentials(ctx, services.User)
+
 	go func() {
-		if err = metrics.Listen(net.JoinHostPort("", "8082")); err != nil {
+		health := newHealth(cfg.Health, b, db, rdb, services.Parser)
+		if err = metrics.Listen(net.JoinHostPort("", "8082"), health); err != nil {
 			log.Fatal().Err(err).Msg("metrics error")
 		}
 	}()
@@ -0,0 +1,34 @@
+package bot
+
+import (
+	"bot_for_modeus/internal/service"
+	"context"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// Как часто обходить пользователей. Должно быть меньше запаса, за который сервис продлевает токены сессий
+const migrateCredentialsInterval = 12 * time.Hour
+
+// Функция при старте и затем периодически меняет старые пароли пользователей на токены, продлевает токены
+// тех, кто давно не заходил, и перешифровывает их текущим ключом после смены секрета (CRYPTER_KEY_ID)
+func migrateCredentials(ctx context.Context, user service.User) {
+	ticker := time.NewTicker(migrateCredentialsInterval)
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		updated, err := user.MigrateCredentials(ctx)
+		if err != nil {
+			log.Err(err).Int("updated", updated).Msg("credentials migration error")
+		} else {
+			log.Info().Int("updated", updated).Dur("duration", time.Since(start)).Msg("credentials migration finished")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package bot
+
+import (
+	"bot_for_modeus/config"
+	"bot_for_modeus/internal/metrics"
+	"bot_for_modeus/internal/parser"
+	"bot_for_modeus/pkg/bot"
+	"bot_for_modeus/pkg/redis"
+	"context"
+	"fmt"
+	"time"
+)
+
+// Функция собирает проверки для /healthz и /readyz. Redis проверяется только если используется (rdb может быть nil),
+// база - только если она внешняя
+func newHealth(cfg config.Health, b *bot.Bot, db database, rdb redis.Redis, p parser.Parser) *metrics.Health {
+	h := metrics.NewHealth()
+
+	h.Liveness("telegram", func(ctx context.Context) error {
+		if cfg.UpdateTimeout <= 0 {
+			return nil
+		}
+		if d := time.Since(b.LastUpdate()); d > cfg.UpdateTimeout {
+			return fmt.Errorf("no updates for %s", d.Truncate(time.Second))
+		}
+		return nil
+	})
+
+	if db.ping != nil {
+		h.Readiness(db.name, db.ping)
+	}
+	if rdb != nil {
+		h.Readiness("redis", rdb.Ping)
+	}
+	h.Readiness("parser", p.Ping)
+	return h
+}
@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"bot_for_modeus/config"
+	"bot_for_modeus/internal/metrics"
+	"bot_for_modeus/internal/repo"
+	"bot_for_modeus/pkg/mongo"
+	"bot_for_modeus/pkg/postgres"
+	"context"
+	"github.com/rs/zerolog/log"
+)
+
+// database - выбранное хранилище пользователей. ping равен nil, если проверять в /readyz нечего
+type database struct {
+	repos *repo.Repositories
+	name  string
+	ping  metrics.Check
+	close func()
+}
+
+func newDatabase(ctx context.Context, cfg *config.Config) database {
+	switch cfg.Repo.Driver {
+	case "mongodb":
+		mongodb, err := mongo.NewMongo(ctx, cfg.MongoDB.Url, cfg.MongoDB.DB)
+		if err != nil {
+			log.Fatal().Err(err).Msg("database init error")
+		}
+		applied, err := repo.Migrate(ctx, mongodb)
+		if err != nil {
+			log.Fatal().Err(err).Msg("database migration error")
+		}
+		log.Info().Int("applied", applied).Msg("database migrations applied")
+		return database{
+			repos: repo.NewRepositories(mongodb),
+			name:  "mongo",
+			ping:  mongodb.Ping,
+			close: mongodb.Disconnect,
+		}
+	case "postgres":
+		pg, err := postgres.NewPostgres(ctx, cfg.Postgres.Url)
+		if err != nil {
+			log.Fatal().Err(err).Msg("database init error")
+		}
+		applied, err := repo.MigratePostgres(ctx, pg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("database migration error")
+		}
+		log.Info().Int("applied", applied).Msg("database migrations applied")
+		return database{
+			repos: repo.NewPostgresRepositories(pg),
+			name:  "postgres",
+			ping:  pg.Ping,
+			close: pg.Close,
+		}
+	case "memory":
+		log.Warn().Msg("memory repository is used, users will be lost on restart")
+		return database{
+			repos: repo.NewMemoryRepositories(),
+			name:  "memory",
+			close: func() {},
+		}
+	}
+	log.Fatal().Str("driver", cfg.Repo.Driver).Msg("unknown repository driver")
+	return database{}
+}
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"bot_for_modeus/config"
+	"bot_for_modeus/internal/events"
+	"bot_for_modeus/pkg/bot"
+	"bot_for_modeus/pkg/redis"
+	"context"
+	"github.com/rs/zerolog/log"
+)
+
+// Функция возвращает опцию хранилища состояний.
+// Redis поднимается только если выбран в качестве хранилища (см. Run), небольшим инсталляциям хватит memory или bolt
+func storageOption(ctx context.Context, cfg config.Bot, rdb redis.Redis) bot.Option {
+	switch cfg.Storage {
+	case "redis":
+		return bot.RedisStorage(ctx, rdb.Conn())
+	case "memory":
+		return bot.MemoryStorage(cfg.StorageLimit)
+	case "bolt":
+		// Файл закрывается вместе с ботом (см. bot.Shutdown)
+		return bot.BoltStorage(cfg.StoragePath)
+	}
+	log.Fatal().Str("storage", cfg.Storage).Msg("unknown storage")
+	return nil
+}
+
+// Реплики бота могут работать только с общим redis, поэтому события об изменении данных рассылаются через него.
+// Без redis бот работает в одном экземпляре и событиям достаточно шины в памяти
+func eventsBus(ctx context.Context, rdb redis.Redis) events.Bus {
+	if rdb == nil {
+		return events.NewLocalBus()
+	}
+	return events.NewRedisBus(ctx, rdb.Conn())
+}
+
+// Смена кодека на работающем инстансе делает уже сохраненные в redis данные нечитаемыми
+// (кроме json <-> sonic, у них одинаковый формат). Такие данные просто перезапросятся, но состояния пользователей сбросятся
+func storageCodec(name string, compressThreshold int) bot.Codec {
+	var codec bot.Codec
+	switch name {
+	case "json":
+		codec = bot.JSONCodec
+	case "sonic":
+		codec = bot.SonicCodec
+	case "msgpack":
+		codec = bot.MsgpackCodec
+	default:
+		log.Fatal().Str("codec", name).Msg("unknown storage codec")
+	}
+	if compressThreshold > 0 {
+		codec = bot.Compressed(codec, compressThreshold)
+	}
+	return codec
+}
@@ -0,0 +1,36 @@
+package bot
+
+import (
+	"bot_for_modeus/config"
+	"bot_for_modeus/pkg/tracing"
+	"context"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"time"
+)
+
+const tracingShutdownTimeout = time.Second * 5
+
+// Функция настраивает глобальный провайдер трассировки и возвращает функцию, которая отправляет оставшиеся спаны при остановке.
+// Без endpoint провайдер не настраивается и все спаны остаются noop
+func setTracing(ctx context.Context, cfg config.Tracing) func() {
+	if cfg.Endpoint == "" {
+		return func() {}
+	}
+	tp, err := tracing.NewProvider(ctx, cfg.Endpoint, tracing.ServiceName(cfg.ServiceName), tracing.SampleRatio(cfg.SampleRatio))
+	if err != nil {
+		log.Fatal().Err(err).Msg("tracing init error")
+	}
+	otel.SetTracerProvider(tp)
+	// traceparent передается в парсер (см. parser.makeRequest)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			log.Err(err).Msg("tracing shutdown error")
+		}
+	}
+}
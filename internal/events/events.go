@@ -0,0 +1,64 @@
+package events
+
+import (
+	"context"
+	"sync"
+)
+
+// Type тип изменения данных пользователя
+type Type string
+
+const (
+	UserCreated        Type = "user_created"
+	UserUpdated        Type = "user_updated"
+	UserDeleted        Type = "user_deleted"
+	CredentialsChanged Type = "credentials_changed"
+	FriendAdded        Type = "friend_added"
+	FriendRemoved      Type = "friend_removed"
+	// FriendUpdated - друга переименовали или переставили в списке
+	FriendUpdated Type = "friend_updated"
+)
+
+// Event публикуется сервисным слоем после успешного изменения данных пользователя в бд.
+// Подписчики (например, инвалидация кэша в хэндлерах) сами решают, что делать с изменением
+type Event struct {
+	Type   Type  `json:"type"`
+	UserId int64 `json:"user_id"`
+}
+
+type Handler func(ctx context.Context, e Event)
+
+type Bus interface {
+	Publish(ctx context.Context, e Event) error
+	Subscribe(h Handler)
+}
+
+// localBus доставляет события подписчикам синхронно внутри процесса.
+// Синхронность важна: к моменту возврата из Publish кэш уже инвалидирован, поэтому следующий запрос пользователя увидит новые данные
+type localBus struct {
+	sync.RWMutex
+	handlers []Handler
+}
+
+func NewLocalBus() Bus {
+	return &localBus{}
+}
+
+func (b *localBus) Publish(ctx context.Context, e Event) error {
+	b.dispatch(ctx, e)
+	return nil
+}
+
+func (b *localBus) Subscribe(h Handler) {
+	b.Lock()
+	defer b.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+func (b *localBus) dispatch(ctx context.Context, e Event) {
+	b.RLock()
+	defer b.RUnlock()
+	for _, h := range b.handlers {
+		h(ctx, e)
+	}
+}
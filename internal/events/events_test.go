@@ -0,0 +1,26 @@
+package events
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLocalBus(t *testing.T) {
+	bus := NewLocalBus()
+
+	var first, second []Event
+	bus.Subscribe(func(ctx context.Context, e Event) {
+		first = append(first, e)
+	})
+	bus.Subscribe(func(ctx context.Context, e Event) {
+		second = append(second, e)
+	})
+
+	e := Event{Type: FriendAdded, UserId: 1}
+	assert.Nil(t, bus.Publish(context.Background(), e))
+
+	// подписчики вызываются синхронно, поэтому события уже доставлены
+	assert.Equal(t, []Event{e}, first)
+	assert.Equal(t, []Event{e}, second)
+}
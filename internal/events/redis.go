@@ -0,0 +1,78 @@
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/bytedance/sonic"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultRedisChannel = "bot:events"
+
+// redisBus рассылает события всем репликам бота через redis pub/sub.
+// Локальные подписчики вызываются синхронно (как в localBus), а свои же сообщения из канала пропускаются,
+// поэтому реплика, которая изменила данные, не ждет доставки через redis
+type redisBus struct {
+	*localBus
+	rdb      *redis.Client
+	channel  string
+	instance string
+}
+
+type redisMessage struct {
+	Event
+	Instance string `json:"instance"`
+}
+
+// NewRedisBus подписывается на канал событий и слушает его, пока не завершится ctx
+func NewRedisBus(ctx context.Context, rdb *redis.Client) Bus {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	b := &redisBus{
+		localBus: &localBus{},
+		rdb:      rdb,
+		channel:  defaultRedisChannel,
+		instance: hex.EncodeToString(id),
+	}
+	sub := rdb.Subscribe(ctx, b.channel)
+	go b.listen(ctx, sub)
+	return b
+}
+
+func (b *redisBus) Publish(ctx context.Context, e Event) error {
+	b.dispatch(ctx, e)
+
+	msg, err := sonic.Marshal(redisMessage{Event: e, Instance: b.instance})
+	if err != nil {
+		return err
+	}
+	return b.rdb.Publish(ctx, b.channel, msg).Err()
+}
+
+func (b *redisBus) listen(ctx context.Context, sub *redis.PubSub) {
+	defer func() { _ = sub.Close() }()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			var msg redisMessage
+			if err := sonic.UnmarshalString(m.Payload, &msg); err != nil {
+				log.Err(err).Str("payload", m.Payload).Msg("events/listen error unmarshal event")
+				continue
+			}
+			if msg.Instance == b.instance {
+				continue
+			}
+			b.dispatch(ctx, msg.Event)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package v2
+
+import (
+	"bot_for_modeus/internal/events"
+	"bot_for_modeus/pkg/bot"
+	"context"
+	"github.com/rs/zerolog/log"
+)
+
+// Какие данные из кэша устаревают при изменении данных пользователя.
+// Семестры по id (keySemester.With) не сбрасываются: ключ зависит от id семестра, а не от пользователя, и быстро истекает сам
+var invalidatedKeys = map[events.Type][]string{
+	events.UserCreated:        {keyUser.Name(), keyFriends.Name()},
+	events.UserUpdated:        {keyUser.Name(), keySemesters.Name()},
+	events.UserDeleted:        {keyUser.Name(), keyFriends.Name(), keySemesters.Name()},
+	events.CredentialsChanged: {keyUser.Name()},
+	events.FriendAdded:        {keyFriends.Name()},
+	events.FriendRemoved:      {keyFriends.Name()},
+	events.FriendUpdated:      {keyFriends.Name()},
+}
+
+// invalidateCache удаляет из кэша данные, которые устарели после изменения в бд.
+// Сервис публикует событие уже после записи, а локальные подписчики вызываются синхронно,
+// поэтому следующее чтение (например, lookupUser) пойдет в бд и закэширует новые данные
+func invalidateCache(b *bot.Bot) events.Handler {
+	return func(ctx context.Context, e events.Event) {
+		keys, ok := invalidatedKeys[e.Type]
+		if !ok {
+			return
+		}
+		if err := b.DelData(e.UserId, keys...); err != nil {
+			log.Err(err).Int64("user_id", e.UserId).Str("type", string(e.Type)).Msg("handler/invalidateCache error delete data")
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package v2
 
-import "errors"
+import "bot_for_modeus/internal/apperrs"
 
 var (
-	ErrIncorrectInput = errors.New("incorrect input")
+	ErrIncorrectInput          = apperrs.New(apperrs.KindUser, "handler.incorrect_input", "incorrect input")
+	ErrIncorrectLoginPassInput = apperrs.New(apperrs.KindUser, "handler.incorrect_login_password_input", "incorrect login and password input")
+	// ErrSemesterNotFound - семестра из коллбэка больше нет в модеусе (например, кнопка из старого сообщения)
+	ErrSemesterNotFound = apperrs.New(apperrs.KindUser, "handler.semester_not_found", "semester not found")
 )
@@ -7,11 +7,19 @@ import (
 	"bot_for_modeus/pkg/bot"
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"html"
+	"slices"
+	"strings"
 )
 
+// Ввод, который сбрасывает имя друга, чтобы снова показывалось ФИО
+const resetNickname = "-"
+
 type friendsRouter struct {
-	user   service.User
-	parser parser.Parser
+	user         service.User
+	parser       parser.Parser
+	addFriend    *bot.Scene
+	renameFriend *bot.Scene
 }
 
 func newFriendsRouter(b bot.Router, user service.User, parser parser.Parser) {
@@ -20,18 +28,28 @@ func newFriendsRouter(b bot.Router, user service.User, parser parser.Parser) {
 		parser: parser,
 	}
 
+	r.addFriend = bot.NewScene(sceneAddFriend, bot.SceneTimeout(sceneTimeout, sceneExpired), bot.SceneData(keyStudents.Name())).
+		Step(stepInputFriend, r.stateAddFriend, bot.Validate(validateTextInput), bot.Prompt(r.promptAddFriend)).
+		Step(stepChooseFindFriend, r.stateChooseFindFriend, bot.Validate(validateCallbackInput))
+
+	r.renameFriend = bot.NewScene(sceneRenameFriend, bot.SceneTimeout(sceneTimeout, sceneExpired), bot.SceneData(keyRenameFriend.Name())).
+		Step(stepInputNickname, r.stateRenameFriend, bot.Validate(validateTextInput), bot.Prompt(r.promptRenameFriend))
+
 	b = b.Group(metricsMiddleware("friends"))
 
 	b.Command("/friends", r.cmdFriends)
 	b.Message(tgmodel.FriendsButton, r.cmdFriends)
 	b.Callback("/choose_friend_back", r.callbackChooseFriendBack)
-	b.AddTree(bot.OnCallback, "/friends/choose/:schedule_id", r.callbackChooseFriend)
-	b.AddTree(bot.OnCallback, "/friends/delete/:schedule_id", r.callbackDeleteFriend)
-	b.AddTree(bot.OnCallback, "/friends/:type/:date/:schedule_id", r.callbackFriendsSchedule)
+	b.AddTree(bot.OnCallback, "/friends/choose/:friend_id<uuid>", r.callbackChooseFriend)
+	b.AddTree(bot.OnCallback, "/friends/delete/:friend_id<uuid>", r.callbackDeleteFriend)
+	b.AddTree(bot.OnCallback, "/friends/rename/:friend_id<uuid>", r.callbackRenameFriend)
+	b.AddTree(bot.OnCallback, "/friends/up/:friend_id<uuid>", r.callbackMoveFriendUp)
+	b.AddTree(bot.OnCallback, "/friends/down/:friend_id<uuid>", r.callbackMoveFriendDown)
+	b.AddTree(bot.OnCallback, "/friends/:type/:date<date>/:schedule_id<uuid>", r.callbackFriendsSchedule)
 
 	b.Callback("/add_friend", r.callbackAddFriend)
-	b.State(stateAddFriend, r.stateAddFriend)
-	b.State(stateChooseFindFriend, r.stateChooseFindFriend)
+	b.Scene(r.addFriend)
+	b.Scene(r.renameFriend)
 }
 
 func (r *friendsRouter) cmdFriends(c bot.Context) error {
@@ -60,80 +78,188 @@ func (r *friendsRouter) callbackChooseFriendBack(c bot.Context) error {
 }
 
 func (r *friendsRouter) callbackChooseFriend(c bot.Context) error {
-	scheduleId := c.Param("schedule_id")
-	fullName, err := getFullName(c, r.parser, scheduleId)
+	text, kb, err := r.friendAction(c, c.Param("friend_id"))
 	if err != nil {
 		return err
 	}
-	return c.EditMessageWithInlineKB(fmt.Sprintf(txtChooseFriendAction, fullName), tgmodel.ChooseFriendAction(scheduleId))
+	return c.EditMessageWithInlineKB(text, kb)
 }
 
-func (r *friendsRouter) callbackChooseFriendActionBack(c bot.Context) error {
-	scheduleId := c.Param("schedule_id")
-	fullName, err := getFullName(c, r.parser, scheduleId)
+// friendAction - сообщение с другом и кнопками действий с ним
+func (r *friendsRouter) friendAction(c bot.Context, friendId string) (string, [][]tgbotapi.InlineKeyboardButton, error) {
+	friends, err := lookupFriends(c, r.user)
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+	f, i, err := findFriend(friends, friendId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := f.FullName
+	if f.Nickname != "" {
+		name = fmt.Sprintf("%s (%s)", html.EscapeString(f.Nickname), f.FullName)
 	}
-	return c.EditMessageWithInlineKB(fmt.Sprintf(txtChooseFriendAction, fullName), tgmodel.ChooseFriendAction(scheduleId))
+	text := fmt.Sprintf(txtChooseFriendAction, name, i+1, len(friends))
+	return text, tgmodel.ChooseFriendAction(f.Id, f.ScheduleId, i, len(friends)), nil
 }
 
 func (r *friendsRouter) callbackDeleteFriend(c bot.Context) error {
-	scheduleId := c.Param("schedule_id")
+	friends, err := lookupFriends(c, r.user)
+	if err != nil {
+		return err
+	}
+	f, _, err := findFriend(friends, c.Param("friend_id"))
+	if err != nil {
+		return err
+	}
+
+	// Кэш друзей сбрасывается подписчиком на события сервиса (см. invalidateCache)
+	if err = r.user.DeleteFriend(c.Context(), c.UserId(), f.Id); err != nil {
+		return err
+	}
+
+	return c.EditMessageWithInlineKB(fmt.Sprintf("<b>%s</b> удален из друзей!", html.EscapeString(friendName(f))), tgmodel.BackButton("/choose_friend_back"))
+}
+
+func (r *friendsRouter) callbackMoveFriendUp(c bot.Context) error {
+	return r.moveFriend(c, -1)
+}
 
-	// Сначала надо удалить всех друзей из кэша, а потом из бд, чтобы гарантировать консистентность данных.
-	// Есть риск того, что сломаться может где-то "посередине" и данные в кэше и бд будут расходиться.
-	// Например, удалили из бд, но при изменении в кэше произошла ошибка и старое значение осталось - печальный исход.
-	// Поэтому удаляем сразу всех
+func (r *friendsRouter) callbackMoveFriendDown(c bot.Context) error {
+	return r.moveFriend(c, 1)
+}
 
-	if err := c.DelData("friends"); err != nil {
+// moveFriend сдвигает друга на shift мест и показывает его с обновленными кнопками, чтобы можно было двигать дальше
+func (r *friendsRouter) moveFriend(c bot.Context, shift int) error {
+	friends, err := lookupFriends(c, r.user)
+	if err != nil {
+		return err
+	}
+	f, i, err := findFriend(friends, c.Param("friend_id"))
+	if err != nil {
+		return err
+	}
+	if err = r.user.MoveFriend(c.Context(), c.UserId(), f.Id, i+shift); err != nil {
 		return err
 	}
 
-	err := r.user.DeleteFriend(c.Context(), service.FriendInput{
-		UserId:     c.UserId(),
-		ScheduleId: scheduleId,
-	})
+	text, kb, err := r.friendAction(c, f.Id)
 	if err != nil {
 		return err
 	}
+	return c.EditMessageWithInlineKB(text, kb)
+}
 
-	fullName, err := getFullName(c, r.parser, scheduleId)
+// Кнопка "назад" ведет к другу, если он еще в списке. В коллбэке расписания есть только scheduleId (ограничение в 64 байта),
+// но он уникален среди друзей пользователя
+func (r *friendsRouter) callbackFriendsSchedule(c bot.Context) error {
+	friends, err := lookupFriends(c, r.user)
+	if err != nil {
+		return err
+	}
+	back := "/choose_friend_back"
+	if i := slices.IndexFunc(friends, func(f service.FriendOutput) bool { return f.ScheduleId == c.Param("schedule_id") }); i >= 0 {
+		back = "/friends/choose/" + friends[i].Id
+	}
+	return studentSchedule(c, r.parser, "friends", tgmodel.BackButton(back))
+}
+
+func (r *friendsRouter) callbackRenameFriend(c bot.Context) error {
+	friends, err := lookupFriends(c, r.user)
+	if err != nil {
+		return err
+	}
+	f, _, err := findFriend(friends, c.Param("friend_id"))
 	if err != nil {
 		return err
 	}
 
-	return c.EditMessageWithInlineKB(fmt.Sprintf("<b>%s</b> удален из друзей!", fullName), tgmodel.BackButton("/choose_friend_back"))
+	// Данные сцены удаляются при входе, поэтому id друга сохраняем уже после Enter
+	if err = r.renameFriend.Enter(c); err != nil {
+		return err
+	}
+	if err = keyRenameFriend.Set(c, f.Id); err != nil {
+		return err
+	}
+	return r.promptRenameFriend(c)
 }
 
-func (r *friendsRouter) callbackFriendsSchedule(c bot.Context) error {
-	return studentSchedule(c, r.parser, "friends", tgmodel.BackButton("/friends/choose/"+c.Param("schedule_id")))
+func (r *friendsRouter) promptRenameFriend(c bot.Context) error {
+	friendId, err := keyRenameFriend.Get(c)
+	if err != nil {
+		return err
+	}
+	friends, err := lookupFriends(c, r.user)
+	if err != nil {
+		return err
+	}
+	f, _, err := findFriend(friends, friendId)
+	if err != nil {
+		return err
+	}
+	text := fmt.Sprintf(txtRenameFriend, f.FullName, service.MaxNicknameLength, resetNickname)
+	return c.EditMessageWithInlineKB(text, tgmodel.BackButton("/friends/choose/"+f.Id))
+}
+
+func (r *friendsRouter) stateRenameFriend(c bot.Context) error {
+	friendId, err := keyRenameFriend.Get(c)
+	if err != nil {
+		return err
+	}
+	nickname := c.Text()
+	if strings.TrimSpace(nickname) == resetNickname {
+		nickname = ""
+	}
+	if err = r.user.RenameFriend(c.Context(), c.UserId(), friendId, nickname); err != nil {
+		return err
+	}
+	if err = r.renameFriend.Leave(c); err != nil {
+		return err
+	}
+
+	text, kb, err := r.friendAction(c, friendId)
+	if err != nil {
+		return err
+	}
+	return c.SendMessageWithInlineKB("Имя друга изменено!\n\n"+text, kb)
 }
 
 func (r *friendsRouter) callbackAddFriend(c bot.Context) error {
-	if err := c.EditMessageWithInlineKB("Введите ФИО друга, которого хотите добавить", tgmodel.BackButton("/choose_friend_back")); err != nil {
+	friends, err := lookupFriends(c, r.user)
+	if err != nil {
+		return err
+	}
+	// Проверяем лимит сразу, чтобы пользователь не искал друга, которого все равно нельзя добавить
+	if len(friends) >= service.MaxFriends {
+		return service.ErrFriendsLimit
+	}
+
+	if err = r.promptAddFriend(c); err != nil {
 		return err
 	}
-	return c.SetState(stateAddFriend)
+	return r.addFriend.Enter(c)
+}
+
+func (r *friendsRouter) promptAddFriend(c bot.Context) error {
+	return c.EditMessageWithInlineKB("Введите ФИО друга, которого хотите добавить", tgmodel.BackButton("/choose_friend_back"))
 }
 
 func (r *friendsRouter) stateAddFriend(c bot.Context) error {
-	if len(c.Text()) > 200 {
-		return ErrIncorrectInput
-	}
-	students, err := r.parser.FindStudents(c.Text())
+	students, err := r.parser.FindStudents(c.Context(), c.Text())
 	if err != nil {
 		return err
 	}
-	if err = c.SetData("students", students); err != nil {
+	if err = keyStudents.Set(c, students); err != nil {
 		return err
 	}
 
 	text, kb := formatStudents(students)
-	kb = append(kb, tgmodel.BackButton("/add_friend")...)
+	kb = append(kb, tgmodel.BackButton(r.addFriend.BackCallback())...)
 	if err = c.SendMessageWithInlineKB(text, kb); err != nil {
 		return err
 	}
-	return c.SetState(stateChooseFindFriend)
+	return r.addFriend.Next(c)
 }
 
 func (r *friendsRouter) stateChooseFindFriend(c bot.Context) error {
@@ -142,19 +268,18 @@ func (r *friendsRouter) stateChooseFindFriend(c bot.Context) error {
 		return err
 	}
 
-	// Удаляем друзей из кэша, чтобы гарантировать консистентность (более подробно в функции callbackDeleteFriend)
-	if err = c.DelData("students", "friends"); err != nil {
-		return err
-	}
-
-	if err = r.user.AddFriend(c.Context(), service.FriendInput{
+	f, err := r.user.AddFriend(c.Context(), service.FriendInput{
 		UserId:     c.UserId(),
 		FullName:   s.FullName,
 		ScheduleId: s.ScheduleId,
-	}); err != nil {
+	})
+	if err != nil {
+		return err
+	}
+	if err = r.addFriend.Leave(c); err != nil {
 		return err
 	}
 
-	kb := [][]tgbotapi.InlineKeyboardButton{tgmodel.ChooseFriendAction(s.ScheduleId)[0][:2]}
+	kb := [][]tgbotapi.InlineKeyboardButton{tgmodel.ChooseFriendAction(f.Id, f.ScheduleId, 0, 1)[0]}
 	return c.EditMessageWithInlineKB(fmt.Sprintf("<b>%s</b> добавлен в друзья!\nВыберите действие", s.FullName), kb)
 }
@@ -1,6 +1,7 @@
 package v2
 
 import (
+	"bot_for_modeus/internal/model/tgmodel"
 	"bot_for_modeus/internal/service"
 	"bot_for_modeus/pkg/bot"
 )
@@ -10,15 +11,29 @@ func NewHandler(b *bot.Bot, services *service.Services) {
 	b.Use(recoverMiddleware, loggingMiddleware())
 
 	b.Command("/test", test)
+	b.Cancel("/cancel", cancel, metricsMiddleware("user"))
+	b.Fallback(fallback)
+	b.Pagination(pagesExpired)
+
+	services.Events.Subscribe(invalidateCache(b))
 
 	newHelpRouter(b, services.Parser)
 	newStudentRouter(b, services.Parser)
-	newUserRouter(b, services.User, services.Parser)
+	u := newUserRouter(b, services.User, services.Parser)
 	newFriendsRouter(b, services.User, services.Parser)
 	newScheduleRouter(b, services.User, services.Parser)
-	newSettingsRouter(b, services.User, services.Parser)
+	newSettingsRouter(b, services.User, services.Parser, u.registration)
 }
 
 func test(c bot.Context) error {
 	return c.SendMessage("ok")
 }
+
+func cancel(c bot.Context) error {
+	return c.SendMessageWithReplyKB(txtCancel, tgmodel.RowCommands)
+}
+
+// Сюда попадают сообщения, для которых нет ни команды, ни актуального состояния (например, оно истекло)
+func fallback(c bot.Context) error {
+	return c.SendMessage(txtFallback)
+}
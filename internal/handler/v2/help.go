@@ -77,7 +77,7 @@ func (r *helpRouter) callbackFAQ(c bot.Context) error {
 }
 
 func (r *helpRouter) callbackBuildings(c bot.Context) error {
-	buildings, err := r.parser.FindBuildings()
+	buildings, err := r.parser.FindBuildings(c.Context())
 	if err != nil {
 		return err
 	}
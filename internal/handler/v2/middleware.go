@@ -1,6 +1,7 @@
 package v2
 
 import (
+	"bot_for_modeus/internal/apperrs"
 	"bot_for_modeus/internal/metrics"
 	"bot_for_modeus/internal/model/tgmodel"
 	"bot_for_modeus/internal/parser"
@@ -10,6 +11,8 @@ import (
 	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"os"
 	"time"
 )
@@ -21,7 +24,15 @@ func loggingMiddleware() bot.MiddlewareFunc {
 		return func(c bot.Context) error {
 			start := time.Now()
 			err := next(c)
-			logger.Err(err).Int64("user_id", c.UserId()).Float64("duration", time.Since(start).Seconds()).Msg("update from user")
+
+			e := logger.Err(err).Int64("user_id", c.UserId()).Float64("duration", time.Since(start).Seconds())
+			var incident *incidentError
+			if errors.As(err, &incident) {
+				// Пользователю уже ответили с номером инцидента (см. errorMiddleware)
+				e.Str("incident_id", incident.id).Msg("update from user")
+				return nil
+			}
+			e.Msg("update from user")
 			if err != nil {
 				return c.SendMessage(txtError)
 			}
@@ -30,16 +41,49 @@ func loggingMiddleware() bot.MiddlewareFunc {
 	}
 }
 
+// incidentError - внутренняя ошибка, о которой пользователю уже сообщили номер инцидента.
+// Возвращается дальше по цепочке, чтобы мидлвари метрик и логирования ее учли
+type incidentError struct {
+	id  string
+	err error
+}
+
+func (e *incidentError) Error() string {
+	return "incident " + e.id + ": " + e.err.Error()
+}
+
+func (e *incidentError) Unwrap() error {
+	return e.err
+}
+
+// errorMiddleware превращает ошибки в ответ пользователю.
+// Для известных ошибок есть свои тексты, остальные обрабатываются по типу (см. apperrs.Kind):
+// пользовательские и ошибки авторизации - подсказка, временные - просьба повторить позже,
+// внутренние - номер инцидента, который пишется в лог вместе с полным контекстом ошибки.
+// Об incidentError пользователю уже сообщили, поэтому она пропускается как есть и мидлварь можно вкладывать
 func errorMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 	return func(c bot.Context) error {
 		err := next(c)
+		if err == nil {
+			return nil
+		}
+		var incident *incidentError
 		switch {
+		case errors.As(err, &incident):
+			return err
+
 		case errors.Is(err, ErrIncorrectInput):
 			return c.SendMessage(txtWarn)
 
+		case errors.Is(err, ErrIncorrectLoginPassInput), errors.Is(err, service.ErrUserIncorrectLogin):
+			return c.SendMessage(txtIncorrectLoginPassInput)
+
 		case errors.Is(err, parser.ErrModeusUnavailable):
 			return c.SendMessageWithInlineKB(txtModeusUnavailable, tgmodel.ScheduleLink)
 
+		case errors.Is(err, parser.ErrTokenExpired):
+			return c.SendMessageWithInlineKB(txtTokenExpired, tgmodel.ReLoginButtons)
+
 		case errors.Is(err, parser.ErrIncorrectLoginPassword):
 			return c.SendMessage(txtIncorrectLoginPass)
 
@@ -48,9 +92,56 @@ func errorMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 
 		case errors.Is(err, service.ErrUserNotFound):
 			return c.SendMessage(txtUserNotFound)
+
+		case errors.Is(err, service.ErrFriendNotFound):
+			return c.SendMessage(txtFriendNotFound)
+
+		case errors.Is(err, service.ErrFriendAlreadyExists):
+			return c.SendMessage(txtFriendAlreadyExists)
+
+		case errors.Is(err, service.ErrFriendsLimit):
+			return c.SendMessage(fmt.Sprintf(txtFriendsLimit, service.MaxFriends))
+
+		case errors.Is(err, service.ErrFriendIncorrectNickname):
+			return c.SendMessage(fmt.Sprintf(txtIncorrectNickname, service.MaxNicknameLength))
+		}
+
+		switch apperrs.KindOf(err) {
+		case apperrs.KindUser:
+			return c.SendMessage(txtWarn)
+
+		case apperrs.KindAuth:
+			return c.SendMessage(txtIncorrectLoginPass)
+
+		case apperrs.KindTransient:
+			log.Warn().Err(err).Str("code", apperrs.CodeOf(err)).Int64("user_id", c.UserId()).Msg("handler/errorMiddleware transient error")
+			return c.SendMessage(txtTransientError)
 		}
-		return err
+		return reportIncident(c, err)
+	}
+}
+
+// reportIncident логирует внутреннюю ошибку под новым номером инцидента и отправляет этот номер пользователю.
+// Текст сообщения в лог не пишем: это может быть ввод логина и пароля. Для коллбэков пишем данные кнопки (маршрут)
+func reportIncident(c bot.Context, err error) error {
+	id := apperrs.NewIncidentId()
+
+	e := log.Error().Err(err).Str("incident_id", id).Str("code", apperrs.CodeOf(err)).Int64("user_id", c.UserId())
+	if u := c.Update(); u.CallbackQuery != nil {
+		e = e.Str("callback", u.CallbackQuery.Data)
+	} else if u.Message != nil && u.Message.IsCommand() {
+		e = e.Str("command", u.Message.Command())
+	}
+	if sc := trace.SpanContextFromContext(c.Context()); sc.HasTraceID() {
+		e = e.Str("trace_id", sc.TraceID().String())
+		trace.SpanFromContext(c.Context()).SetAttributes(attribute.String("incident_id", id))
+	}
+	e.Msg("handler/errorMiddleware internal error")
+
+	if sendErr := c.SendMessage(fmt.Sprintf(txtIncident, id)); sendErr != nil {
+		return sendErr
 	}
+	return &incidentError{id: id, err: err}
 }
 
 // Panic-recovery мидлварь, чтобы в случае непредвиденной ошибки бот не падал, а писал лог
@@ -7,7 +7,6 @@ import (
 	"bot_for_modeus/pkg/bot"
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"strconv"
 	"time"
 )
 
@@ -29,7 +28,7 @@ func newScheduleRouter(b bot.Router, user service.User, parser parser.Parser) {
 		g.Message(tgmodel.DayScheduleButton, r.cmdDaySchedule)
 		g.Command("/week_schedule", r.cmdWeekSchedule)
 		g.Message(tgmodel.WeekScheduleButton, r.cmdWeekSchedule)
-		g.AddTree(bot.OnCallback, "/user/:type/:date/:schedule_id", r.callbackUserSchedule)
+		g.AddTree(bot.OnCallback, "/user/:type/:date<date>/:schedule_id", r.callbackUserSchedule)
 	}
 	{
 		g := b.Group(metricsMiddleware("grades"))
@@ -39,23 +38,23 @@ func newScheduleRouter(b bot.Router, user service.User, parser parser.Parser) {
 		g.AddTree(bot.OnCallback, "/grades/semester/change/:semester_id", r.callbackChangeSemester)
 		g.AddTree(bot.OnCallback, "/grades/semester/:semester_id/subjects", r.callbackChooseSemesterSubject)
 		g.AddTree(bot.OnCallback, "/grades/semester/:semester_id", r.callbackSemesterGrades)
-		g.AddTree(bot.OnCallback, "/grades/subjects/:subject_id/:index", r.callbackSubjectDetailedInfo)
+		g.AddTree(bot.OnCallback, "/grades/subjects/:subject_id/:semester_id", r.callbackSubjectDetailedInfo)
 	}
 }
 
 func (r *scheduleRouter) cmdDaySchedule(c bot.Context) error {
-	gi, err := lookupGI(c, r.user, false)
+	ref, err := lookupUser(c, r.user)
 	if err != nil {
 		return err
 	}
 
-	text, kb, err := studentDaySchedule(r.parser, time.Now(), gi.ScheduleId, "user")
+	text, kb, err := studentDaySchedule(c.Context(), r.parser, time.Now(), ref.ScheduleId, "user")
 	if err != nil {
 		return err
 	}
 
 	// Кнопка оценок на день доступна только для пользователей с логином и паролем
-	if gi.Login != "" && gi.Password != "" {
+	if ref.LoggedIn {
 		kb = append(kb, tgmodel.WatchDayGradesButton(time.Now())...)
 	}
 
@@ -63,16 +62,16 @@ func (r *scheduleRouter) cmdDaySchedule(c bot.Context) error {
 }
 
 func (r *scheduleRouter) cmdWeekSchedule(c bot.Context) error {
-	gi, err := lookupGI(c, r.user, false)
+	ref, err := lookupUser(c, r.user)
 	if err != nil {
 		return err
 	}
 
-	text, kb, err := studentWeekSchedule(r.parser, time.Now(), gi.ScheduleId, "user")
+	text, kb, err := studentWeekSchedule(c.Context(), r.parser, time.Now(), ref.ScheduleId, "user")
 	if err != nil {
 		return err
 	}
-	return c.SendMessageWithInlineKB(text, kb)
+	return c.SendPages(text, kb)
 }
 
 func (r *scheduleRouter) callbackUserSchedule(c bot.Context) error {
@@ -81,7 +80,7 @@ func (r *scheduleRouter) callbackUserSchedule(c bot.Context) error {
 		return err
 	}
 
-	gi, err := lookupGI(c, r.user, false)
+	ref, err := lookupUser(c, r.user)
 	if err != nil {
 		return err
 	}
@@ -93,27 +92,27 @@ func (r *scheduleRouter) callbackUserSchedule(c bot.Context) error {
 
 	switch t {
 	case "day":
-		text, kb, err = studentDaySchedule(r.parser, day, gi.ScheduleId, "user")
+		text, kb, err = studentDaySchedule(c.Context(), r.parser, day, ref.ScheduleId, "user")
 		if err != nil {
 			return err
 		}
 		// доступно только пользователем с логином и паролем
-		if gi.Login != "" && gi.Password != "" {
+		if ref.LoggedIn {
 			kb = append(kb, tgmodel.WatchDayGradesButton(day)...)
 		}
 	case "week":
-		text, kb, err = studentWeekSchedule(r.parser, day, gi.ScheduleId, "user")
+		text, kb, err = studentWeekSchedule(c.Context(), r.parser, day, ref.ScheduleId, "user")
 	case "grades":
-		// на всякий случай, хотя фактически невозможно
-		if gi.Login == "" || gi.Password == "" {
-			kb = append(tgmodel.BackButton("/user/day/"+day.Format(time.DateOnly)+"/"+gi.ScheduleId), tgmodel.GradesLink...)
-			return c.EditMessageWithInlineKB(txtRequiredLoginPass, kb)
-		}
-		gi.Password, err = r.user.Decrypt(gi.Password) // здесь явно дешифруем, потому что по умолчанию в зашифрованном виде
+		gi, err := lookupGI(c, r.user) // здесь нужен токен, поэтому читаем учетные данные из бд
 		if err != nil {
 			return err
 		}
-		grades, e := r.parser.DayGrades(day, gi)
+		// кнопка есть только после входа, но сессия могла истечь
+		if gi.Token == "" {
+			kb = append(tgmodel.BackButton("/user/day/"+day.Format(time.DateOnly)+"/"+ref.ScheduleId), tgmodel.GradesLink...)
+			return c.EditMessageWithInlineKB(txtRequiredLoginPass, kb)
+		}
+		grades, e := r.parser.DayGrades(c.Context(), day, gi)
 		if e != nil {
 			return e
 		}
@@ -127,15 +126,16 @@ func (r *scheduleRouter) callbackUserSchedule(c bot.Context) error {
 		}
 		kb = tgmodel.DayGradesButtons(day)
 	}
-	return c.EditMessageWithInlineKB(text, kb)
+	// Расписание на неделю может не влезть в одно сообщение
+	return c.EditPages(text, kb)
 }
 
 func (r *scheduleRouter) cmdGrades(c bot.Context) error {
-	gi, err := lookupGI(c, r.user, true)
+	gi, err := lookupGI(c, r.user)
 	if err != nil {
 		return err
 	}
-	if gi.Login == "" || gi.Password == "" {
+	if gi.Login == "" || gi.Token == "" {
 		return c.SendMessageWithInlineKB(txtRequiredLoginPass, tgmodel.GradesLink)
 	}
 
@@ -147,25 +147,24 @@ func (r *scheduleRouter) cmdGrades(c bot.Context) error {
 	// Были вопросы насчет кэширования текста тут, потому что логичным является
 	// использовать команду /grades для "перезагрузки" текущего состояния оценок.
 	// Но решил добавить кэширование во избежание злоупотребления командой и снижения нагрузки на модеус
-	var text string
-	if err = c.GetData("semester_grades:"+semester.Id, &text); err == nil {
+	if text, e := keySemesterGrades.With(semester.Id).Get(c); e == nil {
 		return c.SendMessageWithInlineKB(text, tgmodel.GradesButtons(semester.Id))
 	}
 
-	grades, err := r.parser.SemesterTotalGrades(gi, semester)
+	grades, err := r.parser.SemesterTotalGrades(c.Context(), gi, semester)
 	if err != nil {
 		return err
 	}
-	text = "Вот все оценки по изучаемым дисциплинам в текущем семестре:"
+	text := "Вот все оценки по изучаемым дисциплинам в текущем семестре:"
 	for _, subjectGrades := range grades {
 		text += "\n" + fmt.Sprintf(formatSemesterGrades, subjectGrades.Status, subjectGrades.Name, subjectGrades.CurrentResult, subjectGrades.SemesterResult, subjectGrades.PresentRate, subjectGrades.AbsentRate, subjectGrades.UndefinedRate) + "\n"
 	}
-	_ = c.SetTempData("semester_grades:"+semester.Id, text, textCacheTimeout)
+	_ = keySemesterGrades.With(semester.Id).Set(c, text)
 	return c.SendMessageWithInlineKB(text, tgmodel.GradesButtons(semester.Id))
 }
 
 func (r *scheduleRouter) callbackChangeSemester(c bot.Context) error {
-	gi, err := lookupGI(c, r.user, true)
+	gi, err := lookupGI(c, r.user)
 	if err != nil {
 		return err
 	}
@@ -188,12 +187,11 @@ func (r *scheduleRouter) callbackChangeSemester(c bot.Context) error {
 }
 
 func (r *scheduleRouter) callbackSemesterGrades(c bot.Context) error {
-	var text string
-	if err := c.GetData("semester_grades:"+c.Param("semester_id"), &text); err == nil {
+	if text, err := keySemesterGrades.With(c.Param("semester_id")).Get(c); err == nil {
 		return c.EditMessageWithInlineKB(text, tgmodel.GradesButtons(c.Param("semester_id")))
 	}
 
-	gi, err := lookupGI(c, r.user, true)
+	gi, err := lookupGI(c, r.user)
 	if err != nil {
 		return err
 	}
@@ -203,23 +201,23 @@ func (r *scheduleRouter) callbackSemesterGrades(c bot.Context) error {
 		return err
 	}
 
-	grades, err := r.parser.SemesterTotalGrades(gi, semester)
+	grades, err := r.parser.SemesterTotalGrades(c.Context(), gi, semester)
 	if err != nil {
 		return err
 	}
 
-	text = fmt.Sprintf("Вот все оценки по изучаемым дисциплинам в %dм семестре (%s - %s):", semester.Number, parseSemesterDate(semester.StartDate), parseSemesterDate(semester.EndDate))
+	text := fmt.Sprintf("Вот все оценки по изучаемым дисциплинам в %dм семестре (%s - %s):", semester.Number, parseSemesterDate(semester.StartDate), parseSemesterDate(semester.EndDate))
 	for _, g := range grades {
 		text += "\n" + fmt.Sprintf(formatSemesterGrades, g.Status, g.Name, g.CurrentResult, g.SemesterResult, g.PresentRate, g.AbsentRate, g.UndefinedRate) + "\n"
 	}
-	_ = c.SetTempData("semester_grades:"+semester.Id, text, textCacheTimeout)
+	_ = keySemesterGrades.With(semester.Id).Set(c, text)
 	return c.EditMessageWithInlineKB(text, tgmodel.GradesButtons(semester.Id))
 }
 
 func (r *scheduleRouter) callbackChooseSemesterSubject(c bot.Context) error {
 	semesterId := c.Param("semester_id")
 
-	gi, err := lookupGI(c, r.user, true)
+	gi, err := lookupGI(c, r.user)
 	if err != nil {
 		return err
 	}
@@ -227,23 +225,22 @@ func (r *scheduleRouter) callbackChooseSemesterSubject(c bot.Context) error {
 	if err != nil {
 		return err
 	}
-	var subjects map[string]string
 
 	// `subjects` сначала смотрим в кэше. Если не нашли/ошибка, то придется спрашивать у модеуса. Не забываем кэшировать
-	if err = c.GetData("semester_subjects:"+semesterId, &subjects); err != nil {
-		subjects, err = r.parser.FindSemesterSubjects(gi, semester)
+	subjects, err := keySemesterSubjects.With(semesterId).Get(c)
+	if err != nil {
+		subjects, err = r.parser.FindSemesterSubjects(c.Context(), gi, semester)
 		if err != nil {
 			return err
 		}
-		_ = c.SetTempData("semester_subjects:"+semesterId, subjects, defaultCacheTimeout)
+		_ = keySemesterSubjects.With(semesterId).Set(c, subjects)
 	}
 
-	// коллбэк на просмотр посещений по предмету в формате /grades/subjects/:subject_id/:index
-	// можно было бы вместо index (номер семестра) запихнуть semesterId, но увы и ах: размер CallbackData <= 64 байта
+	// коллбэк на просмотр посещений по предмету в формате /grades/subjects/:subject_id/:semester_id
+	// Такие данные не влезают в 64 байта, поэтому их сжимает кодек коллбэков (см. pkg/bot/callback.go)
 	buttons := make(map[string]string, len(subjects))
 	for k, v := range subjects {
-		key := fmt.Sprintf("/grades/subjects/%s/%d", k, semester.Number)
-		buttons[key] = v
+		buttons["/grades/subjects/"+k+"/"+semester.Id] = v
 	}
 	kb := append(tgmodel.InlineRowButtons(buttons, 1), tgmodel.BackButton("/grades/semester/"+semester.Id)...)
 	return c.EditMessageWithInlineKB("Выберите предмет:", kb)
@@ -251,54 +248,22 @@ func (r *scheduleRouter) callbackChooseSemesterSubject(c bot.Context) error {
 
 func (r *scheduleRouter) callbackSubjectDetailedInfo(c bot.Context) error {
 	// TODO кэшировать?
-	gi, err := lookupGI(c, r.user, true)
+	gi, err := lookupGI(c, r.user)
 	if err != nil {
 		return err
 	}
-	semesters, err := lookupSemesters(c, r.parser, gi)
+	s, err := lookupSemester(c, r.parser, gi, c.Param("semester_id"))
 	if err != nil {
 		return err
 	}
-	s := semesters[len(semesters)-1] // делаем по умолчанию последний, чтобы не возвращать ошибку
 
-	// Из коллбэка находим номер семестра, идем циклом в попытке найти совпадение...
-	// P.S. цикл в обратную сторону, потому что чаще смотрят информацию о парах последнего (текущего) семестра
-	if index, err := strconv.Atoi(c.Param("index")); err == nil {
-		for i := len(semesters) - 1; i >= 0; i-- {
-			if semesters[i].Number == index {
-				s = semesters[i]
-				break
-			}
-		}
-	}
-
-	subjectLessons, err := r.parser.SubjectDetailedInfo(gi, s, c.Param("subject_id"))
+	subjectLessons, err := r.parser.SubjectDetailedInfo(c.Context(), gi, s, c.Param("subject_id"))
 	if err != nil {
 		return err
 	}
-	var messages []string
 	text := "Вот все оценки за проведенные пары по выбранному предмету:"
-	textLength := len(text)
 	for _, lesson := range subjectLessons {
-		n := "\n" + fmt.Sprintf(formatLessonGrades, lesson.Name, lesson.Type, lesson.Time, lesson.Attendance, lesson.Grades)
-		textLength += len(n)
-		if textLength > 4096 {
-			messages = append(messages, text)
-			textLength = 0
-			text = ""
-		}
-		text += n
-	}
-	if textLength != 0 {
-		messages = append(messages, text)
-	}
-	if err = c.EditMessage(messages[0]); err != nil {
-		return err
-	}
-	for i := 1; i < len(messages)-1; i++ {
-		if err = c.SendMessage(messages[i]); err != nil {
-			return err
-		}
+		text += "\n" + fmt.Sprintf(formatLessonGrades, lesson.Name, lesson.Type, lesson.Time, lesson.Attendance, lesson.Grades)
 	}
-	return c.SendMessageWithInlineKB(messages[len(messages)-1], tgmodel.BackButton(fmt.Sprintf("/grades/semester/%s/subjects", s.Id)))
+	return c.EditPages(text, tgmodel.BackButton(fmt.Sprintf("/grades/semester/%s/subjects", s.Id)))
 }
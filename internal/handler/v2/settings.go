@@ -12,14 +12,16 @@ var (
 )
 
 type settingsRouter struct {
-	user   service.User
-	parser parser.Parser
+	user         service.User
+	parser       parser.Parser
+	registration *bot.Scene
 }
 
-func newSettingsRouter(b bot.Router, user service.User, parser parser.Parser) {
+func newSettingsRouter(b bot.Router, user service.User, parser parser.Parser, registration *bot.Scene) {
 	r := &settingsRouter{
-		user:   user,
-		parser: parser,
+		user:         user,
+		parser:       parser,
+		registration: registration,
 	}
 
 	b = b.Group(metricsMiddleware("settings"))
@@ -37,7 +39,7 @@ func (r *settingsRouter) cmdSettings(c bot.Context) error {
 }
 
 func (r *settingsRouter) callbackSettingsBack(c bot.Context) error {
-	_ = c.DelData("state")
+	_ = c.DelState()
 	return c.EditMessageWithInlineKB(txtSettings, tgmodel.SettingsButtons)
 }
 
@@ -52,14 +54,15 @@ func (r *settingsRouter) stateAddLoginPassword(c bot.Context) error {
 	if err := addLoginPassword(c, r.user); err != nil {
 		return err
 	}
-	_ = c.DelData("state")
-	_, _ = lookupGI(c, r.user, false) // перезаписываем grades_input в кэше
-	return c.SendMessageWithReplyKB("Логин и пароль успешно добавлены!", tgmodel.RowCommands)
+	_ = c.DelState()
+	_, _ = lookupUser(c, r.user) // перезаписываем ссылку на пользователя в кэше
+	return c.SendMessageWithReplyKB(txtLoggedIn, tgmodel.RowCommands)
 }
 
 func (r *settingsRouter) callbackUpdateFullName(c bot.Context) error {
 	if err := c.EditMessageWithInlineKB("Введите новое ФИО без ошибок", kbSettingsBack); err != nil {
 		return err
 	}
-	return c.SetState(stateInputFullName)
+	// Изменение ФИО проходит по той же сцене, что и регистрация
+	return r.registration.Goto(c, stepInputFullName)
 }
@@ -9,7 +9,8 @@ import (
 )
 
 type studentRouter struct {
-	parser parser.Parser
+	parser       parser.Parser
+	otherStudent *bot.Scene
 }
 
 func newStudentRouter(b bot.Router, parser parser.Parser) {
@@ -17,78 +18,70 @@ func newStudentRouter(b bot.Router, parser parser.Parser) {
 		parser: parser,
 	}
 
-	b = b.Group(metricsMiddleware("other_student"), errorMiddleware)
+	r.otherStudent = bot.NewScene(sceneOtherStudent, bot.SceneTimeout(sceneTimeout, sceneExpired), bot.SceneData(keyOtherStudents.Name())).
+		Step(stepInputOtherStudent, r.stateInputOtherStudent, bot.Validate(validateTextInput), bot.Prompt(r.promptInputOtherStudent)).
+		Step(stepChooseOtherStudent, r.stateChooseOtherStudent, bot.Validate(validateCallbackInput))
+
+	b = b.Group(metricsMiddleware("other_student"))
 
 	b.Command("/other_student", r.cmdOtherStudent)
 	b.Message(tgmodel.OtherStudentButton, r.cmdOtherStudent)
-	b.Callback("/other_student_back", r.callbackOtherStudentBack)
-	b.State(stateInputOtherStudent, r.stateInputOtherStudent)
+	b.Scene(r.otherStudent)
 	b.Callback("/choose_other_student_back", r.callbackChooseOtherStudentBack)
-	b.State(stateChooseOtherStudent, r.stateChooseOtherStudent)
 
-	b.AddTree(bot.OnCallback, "/student/action/:schedule_id", r.callbackChooseOtherStudentActionBack)
-	b.AddTree(bot.OnCallback, "/student/:type/:date/:schedule_id", r.callbackOtherStudentSchedule)
+	b.AddTree(bot.OnCallback, "/student/action/:schedule_id<uuid>", r.callbackChooseOtherStudentActionBack)
+	b.AddTree(bot.OnCallback, "/student/:type/:date<date>/:schedule_id<uuid>", r.callbackOtherStudentSchedule)
 }
 
 func (r *studentRouter) cmdOtherStudent(c bot.Context) error {
 	if err := c.SendMessage(txtInputOtherStudent); err != nil {
 		return err
 	}
-	return c.SetState(stateInputOtherStudent)
+	return r.otherStudent.Enter(c)
 }
 
-func (r *studentRouter) callbackOtherStudentBack(c bot.Context) error {
-	if err := c.EditMessage(txtInputOtherStudent); err != nil {
-		return err
-	}
-	return c.SetState(stateInputOtherStudent)
+func (r *studentRouter) promptInputOtherStudent(c bot.Context) error {
+	return c.EditMessage(txtInputOtherStudent)
 }
 
 func (r *studentRouter) stateInputOtherStudent(c bot.Context) error {
-	if len(c.Text()) > 200 {
-		return ErrIncorrectInput
-	}
-	students, err := r.parser.FindStudents(c.Text())
+	students, err := r.parser.FindStudents(c.Context(), c.Text())
 	if err != nil {
 		return err
 	}
-	if err = c.SetData("other_students", students); err != nil {
+	if err = keyOtherStudents.Set(c, students); err != nil {
 		return err
 	}
 
 	text, kb := formatStudents(students)
-	kb = append(kb, tgmodel.BackButton("/other_student_back")...)
+	kb = append(kb, tgmodel.BackButton(r.otherStudent.BackCallback())...)
 	if err = c.SendMessageWithInlineKB(text, kb); err != nil {
 		return err
 	}
-	return c.SetState(stateChooseOtherStudent)
+	return r.otherStudent.Next(c)
 }
 
 func (r *studentRouter) callbackChooseOtherStudentBack(c bot.Context) error {
-	var students []parser.Student
-	if err := c.GetData("other_students", &students); err != nil {
+	students, err := keyOtherStudents.Get(c)
+	if err != nil {
 		return err
 	}
 	text, kb := formatStudents(students)
-	kb = append(kb, tgmodel.BackButton("/other_student_back")...)
+	kb = append(kb, tgmodel.BackButton(r.otherStudent.BackCallback())...)
 	if err := c.EditMessageWithInlineKB(text, kb); err != nil {
 		return err
 	}
-	return c.SetState(stateChooseOtherStudent)
+	return r.otherStudent.Goto(c, stepChooseOtherStudent)
 }
 
 func (r *studentRouter) stateChooseOtherStudent(c bot.Context) error {
-	var students []parser.Student
-	if err := c.GetData("other_students", &students); err != nil {
+	students, err := keyOtherStudents.Get(c)
+	if err != nil {
 		return err
 	}
-	cb := c.Update().CallbackQuery
-	if cb == nil {
-		return c.SendMessage(txtWarn)
-	}
-	num, err := strconv.Atoi(cb.Data)
-	if err != nil || num > len(students) {
-		return c.SendMessage(txtWarn)
+	num, err := strconv.Atoi(c.Text())
+	if err != nil || num < 1 || num > len(students) {
+		return ErrIncorrectInput
 	}
 	s := students[num-1]
 
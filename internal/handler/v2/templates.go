@@ -1,23 +1,35 @@
 package v2
 
 const (
-	stateInputFullName               = "stateInputFullName"
-	stateChooseStudent               = "stateChooseStudent"
-	stateActionAfterCreate           = "stateActionAfterCreate"
-	stateAddLoginPasswordAfterCreate = "stateAddLoginPasswordAfterCreate"
-	stateAddLoginPassword            = "stateAddLoginPassword"
-	stateConfirmDelete               = "stateConfirmDelete"
-
-	stateAddFriend        = "stateAddFriend"
-	stateChooseFindFriend = "stateChooseFindFriend"
-
-	stateInputOtherStudent  = "stateInputOtherStudent"
-	stateChooseOtherStudent = "stateChooseOtherStudent"
+	stateAddLoginPassword = "stateAddLoginPassword"
+	stateConfirmDelete    = "stateConfirmDelete"
+)
+
+// Сцены (многошаговые сценарии) и их шаги
+const (
+	sceneRegistration               = "registration"
+	stepInputFullName               = "inputFullName"
+	stepChooseStudent               = "chooseStudent"
+	stepActionAfterCreate           = "actionAfterCreate"
+	stepAddLoginPasswordAfterCreate = "addLoginPasswordAfterCreate"
+
+	sceneAddFriend       = "addFriend"
+	stepInputFriend      = "inputFriend"
+	stepChooseFindFriend = "chooseFindFriend"
+
+	sceneRenameFriend = "renameFriend"
+	stepInputNickname = "inputNickname"
+
+	sceneOtherStudent      = "otherStudent"
+	stepInputOtherStudent  = "inputOtherStudent"
+	stepChooseOtherStudent = "chooseOtherStudent"
 )
 
 const (
 	txtError             = "Ой! У нас произошла ошибка! Пожалуйста, воспользуйтесь сервисом позже или напишите в поддержку: /help -> Поддержка"
 	txtModeusUnavailable = "Ой! Кажется, какие-то проблемы с модеусом!\nВы можете <b>посмотреть на сайте</b>, либо воспользоваться сервисом позже.\nЕсли ошибка уже давно, <b>обратитесь в поддержку</b> /help"
+	txtTransientError    = "Ой! Сервис временно недоступен 😔\nПожалуйста, попробуйте еще раз через пару минут"
+	txtIncident          = "Ой! У нас произошла ошибка!\nПожалуйста, воспользуйтесь сервисом позже или напишите в поддержку (/help -> Поддержка) и укажите номер ошибки: <code>%s</code>"
 
 	txtStart              = "👋 Привет!\nЯ умею получать расписание и оценки из модеуса!\nНапишите Ваше <b>ФИО без ошибок, как указано в модеусе</b>, чтобы мы смогли найти Вас!"
 	txtStudentNotFound    = "Ой! Никого не могу найти с ФИО \"%s\".\nПожалуйста, <b>введите ФИО точно как указано в модеусе</b> (возможно ошибка с буквами е и ё)"
@@ -25,19 +37,36 @@ const (
 	txtUserAfterCreate    = "<b>Нажмите на любую из кнопок на клавиатуре или меню, чтобы воспользоваться ботом!\n\nРекомендуем ознакомится с гайдом, который мы сделали для удобства использования!</b>"
 	txtAddLoginPassword   = "Пожалуйста, укажите через пробел сначала логин, потом пароль от учетной записи модеуса"
 	txtRequiredLoginPass  = "<b>Требуется логин и пароль</b> от модеуса для входа в систему\n\n/settings -> \"Добавить логин и пароль\""
+	txtLoggedIn           = "Вход в модеус выполнен! Пароль не сохраняется: бот хранит только токен сессии"
+	txtTokenExpired       = "Ой! <b>Сессия модеуса истекла</b> 😔\nПожалуйста, войдите заново, чтобы снова смотреть оценки и рейтинги"
 	txtIncorrectLoginPass = "Ой! Кажется, <b>Вы ввели логин или пароль с ошибкой</b>!\nПожалуйста измените его в настройках! (/settings)"
 	txtUserNotFound       = "Ой! Мы не можем найти информацию от Вас 👀!\nПожалуйста, <b>перезапустите бота</b>, нажав команду /start"
+	txtCancel             = "Действие отменено 👌\nВыберите нужную команду в меню или на клавиатуре"
+	txtFallback           = "Ой! Я не понимаю, что нужно сделать 🤔\nВоспользуйтесь <b>меню команд</b> или <b>кнопками клавиатуры</b>. Если что-то пошло не так, нажмите /cancel"
+	txtSceneExpired       = "Ой! Время ожидания ввода истекло.\nПожалуйста, <b>начните заново</b>: выберите нужную команду в меню"
+	txtPagesExpired       = "Ой! Это сообщение устарело, поэтому листать его больше нельзя.\nПожалуйста, запросите информацию заново"
 
 	txtSettings = "⚙️ <b>Настройки</b>.\n\n" +
 		"- <b>Добавить логин и пароль</b>: открывает доступ к оценкам и рейтингам\n\n" +
 		"- <b>Изменить ФИО</b>: обновляем ФИО, если указали его с ошибкой"
 	txtIncorrectLoginPassInput = "Ой! Кажется, Вы ввели логин и пароль с ошибкой! Пожалуйста, введите через пробел сначала логин, потом пароль"
 
-	txtConfirmDelete = "<b><i>Вы уверены, что хотите остановить бота</i></b>?\nВся информация <b>будет удалена</b>.\nДля повторного использования нужно будет нажать /start и ввести данные заново."
-	txtUserDeleted   = "Бот остановлен, данные удалены.\nДля повторного использования нажмите /start."
+	txtConfirmDelete  = "<b><i>Вы уверены, что хотите остановить бота</i></b>?\nВся информация <b>будет удалена</b>.\nДля повторного использования нужно будет нажать /start и ввести данные заново."
+	txtUserDeleted    = "Бот остановлен.\n\n%s\nДля повторного использования нажмите /start."
+	txtUserNotDeleted = "Ой! <b>Удалить удалось не все</b>.\n\n%s\nПожалуйста, повторите /stop позже или напишите в поддержку: /help -> Поддержка"
+	txtMyData         = "📦 <b>Ваши данные</b>, которые хранит бот.\nПароль не хранится, а токен сессии модеуса в выгрузку не попадает"
+
+	txtStepDone    = "✅ "
+	txtStepFailed  = "❌ "
+	txtStepSkipped = "➖ "
 
-	txtFriends            = "👨‍🎓👩‍🎓 <b>Друзья</b>.\n\nВыберите друга, расписание которого хотите получить"
-	txtChooseFriendAction = formatFullName + "Выберите действие с другом:"
+	txtFriends             = "👨‍🎓👩‍🎓 <b>Друзья</b>.\n\nВыберите друга, расписание которого хотите получить.\nВ меню друга можно задать ему имя и поменять его место в списке"
+	txtChooseFriendAction  = formatFullName + "Место в списке: %d из %d\n\nВыберите действие с другом:"
+	txtRenameFriend        = "Введите имя для <b>%s</b> (не длиннее %d символов).\nЧтобы вместо имени снова показывалось ФИО, отправьте <b>%s</b>"
+	txtFriendNotFound      = "Ой! Этого друга уже нет в списке 👀\nОткройте список друзей заново: /friends"
+	txtFriendAlreadyExists = "Этот студент уже есть в Ваших друзьях 👌\nВыберите другого студента"
+	txtFriendsLimit        = "Ой! Можно сохранить не больше %d друзей.\nУдалите кого-нибудь из списка, чтобы добавить нового"
+	txtIncorrectNickname   = "Ой! Имя друга должно быть не длиннее %d символов. Пожалуйста, введите другое имя"
 
 	txtInputOtherStudent        = "Введите ФИО студента, расписание которого хотите узнать"
 	txtChooseOtherStudentAction = "Вы выбрали: <b>%s</b>\nВыберите расписание, которое хотите получить:"
@@ -5,43 +5,52 @@ import (
 	"bot_for_modeus/internal/parser"
 	"bot_for_modeus/internal/service"
 	"bot_for_modeus/pkg/bot"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/rs/zerolog/log"
+	"strings"
 )
 
 type userRouter struct {
-	user   service.User
-	parser parser.Parser
+	user         service.User
+	parser       parser.Parser
+	registration *bot.Scene
 }
 
-func newUserRouter(b bot.Router, user service.User, parser parser.Parser) {
+func newUserRouter(b bot.Router, user service.User, parser parser.Parser) *userRouter {
 	r := &userRouter{
 		user:   user,
 		parser: parser,
 	}
 
+	// Сцена регистрации: ФИО -> выбор студента -> добавить ли логин и пароль -> логин и пароль
+	r.registration = bot.NewScene(sceneRegistration, bot.SceneTimeout(sceneTimeout, sceneExpired), bot.SceneData(keyStudents.Name())).
+		Step(stepInputFullName, r.stateInputFullName, bot.Validate(validateTextInput), bot.Prompt(r.promptInputFullName)).
+		Step(stepChooseStudent, r.stateChooseStudent, bot.Validate(validateCallbackInput)).
+		Step(stepActionAfterCreate, r.stateActionAfterCreate, bot.Validate(validateCallbackInput)).
+		Step(stepAddLoginPasswordAfterCreate, r.stateAddLoginPasswordAfterCreate)
+
 	b = b.Group(metricsMiddleware("user"))
 
 	b.Command("/start", r.cmdStart)
 	b.Command("/kb", r.cmdKB)
-	b.Callback("/cmd_start_back", r.callbackStartBack)
-	b.State(stateInputFullName, r.stateInputFullName)
-	b.State(stateChooseStudent, r.stateChooseStudent)
-	b.State(stateActionAfterCreate, r.stateActionAfterCreate)
-	b.State(stateAddLoginPasswordAfterCreate, r.stateAddLoginPasswordAfterCreate)
+	b.Scene(r.registration)
 	b.Command("/stop", r.cmdStop)
 	b.State(stateConfirmDelete, r.stateConfirmDelete)
+	b.Command("/my_data", r.cmdMyData)
 
 	b.Command("/me", r.cmdMe)
 	b.Message(tgmodel.MeButton, r.cmdMe)
 	b.Callback("/me_back", r.callbackMeBack)
 	b.Callback("/about_me", r.callbackAboutMe)
 	b.Callback("/ratings", r.callbackRatings)
+	return r
 }
 
 func (r *userRouter) cmdStart(c bot.Context) error {
 	_ = c.Clear()
-	if err := c.SetState(stateInputFullName); err != nil {
+	if err := r.registration.Enter(c); err != nil {
 		return err
 	}
 	return c.SendMessageWithReplyKB(txtStart, tgmodel.RowCommands)
@@ -51,31 +60,25 @@ func (r *userRouter) cmdKB(c bot.Context) error {
 	return c.SendMessageWithReplyKB("👋", tgmodel.RowCommands)
 }
 
-func (r *userRouter) callbackStartBack(c bot.Context) error {
-	if err := c.EditMessage("Пожалуйста, введите Ваше ФИО как указано в системе модеус"); err != nil {
-		return err
-	}
-	return c.SetState(stateInputFullName)
+func (r *userRouter) promptInputFullName(c bot.Context) error {
+	return c.EditMessage("Пожалуйста, введите Ваше ФИО как указано в системе модеус")
 }
 
 func (r *userRouter) stateInputFullName(c bot.Context) error {
-	if len(c.Text()) > 200 {
-		return ErrIncorrectInput
-	}
-	students, err := r.parser.FindStudents(c.Text())
+	students, err := r.parser.FindStudents(c.Context(), c.Text())
 	if err != nil {
 		return err
 	}
-	if err = c.SetData("students", students); err != nil {
+	if err = keyStudents.Set(c, students); err != nil {
 		return err
 	}
 	text, kb := formatStudents(students)
 	// кнопка назад для того, чтобы заново ввести ФИО
-	kb = append(kb, tgmodel.BackButton("/cmd_start_back")...)
+	kb = append(kb, tgmodel.BackButton(r.registration.BackCallback())...)
 	if err = c.SendMessageWithInlineKB(text, kb); err != nil {
 		return err
 	}
-	return c.SetState(stateChooseStudent)
+	return r.registration.Next(c)
 }
 
 func (r *userRouter) stateChooseStudent(c bot.Context) error {
@@ -90,36 +93,34 @@ func (r *userRouter) stateChooseStudent(c bot.Context) error {
 		ScheduleId: s.ScheduleId,
 		GradesId:   s.GradesId,
 	}
-	if err = r.user.Create(c.Context(), input); err != nil {
-		// если пользователь уже существует, то просто обновляем информацию о нем
-		if errors.Is(err, service.ErrUserAlreadyExists) {
-			if e := c.DelData("grades_input"); e != nil {
-				return e
-			}
-			if e := r.user.UpdateInfo(c.Context(), input); e != nil {
-				return e
-			}
-			_, _ = lookupGI(c, r.user, false) // перезаписываем grades_input в кэше
-			return c.EditMessage("Информация о пользователе успешно обновлена!")
-		}
+	created, err := r.user.Create(c.Context(), input)
+	if err != nil {
 		return err
 	}
+	// если пользователь уже существовал, то информация о нем просто обновилась
+	if !created {
+		_, _ = lookupUser(c, r.user) // перезаписываем ссылку на пользователя в кэше
+		if err = r.registration.Leave(c); err != nil {
+			return err
+		}
+		return c.EditMessage("Информация о пользователе успешно обновлена!")
+	}
 
 	if err = c.EditMessageWithInlineKB(txtUserCreated, tgmodel.YesOrNoButtons); err != nil {
 		return err
 	}
-	return c.SetState(stateActionAfterCreate)
+	return r.registration.Next(c)
 }
 
 func (r *userRouter) stateActionAfterCreate(c bot.Context) error {
-	if err := c.DelData("students", "state"); err != nil {
-		return err
-	}
 	if c.Text() == "да" {
 		if err := c.EditMessage(txtAddLoginPassword); err != nil {
 			return err
 		}
-		return c.SetState(stateAddLoginPasswordAfterCreate)
+		return r.registration.Next(c)
+	}
+	if err := r.registration.Leave(c); err != nil {
+		return err
 	}
 	return c.EditMessageWithInlineKB("Пользователь успешно создан!\n\n"+txtUserAfterCreate, tgmodel.GuideButtons)
 }
@@ -128,7 +129,10 @@ func (r *userRouter) stateAddLoginPasswordAfterCreate(c bot.Context) error {
 	if err := addLoginPassword(c, r.user); err != nil {
 		return err
 	}
-	return c.SendMessageWithInlineKB("Логин и пароль успешно сохранены!\n\n"+txtUserAfterCreate, tgmodel.GuideButtons)
+	if err := r.registration.Leave(c); err != nil {
+		return err
+	}
+	return c.SendMessageWithInlineKB(txtLoggedIn+"\n\n"+txtUserAfterCreate, tgmodel.GuideButtons)
 }
 
 func (r *userRouter) cmdStop(c bot.Context) error {
@@ -138,26 +142,110 @@ func (r *userRouter) cmdStop(c bot.Context) error {
 	return c.SetState(stateConfirmDelete)
 }
 
+// stateConfirmDelete удаляет все данные пользователя и сообщает результат каждого шага.
+// Шаги не прерывают друг друга: даже если модеус недоступен, профиль и данные диалога все равно удаляются
 func (r *userRouter) stateConfirmDelete(c bot.Context) error {
 	if c.Text() != "да" {
+		_ = c.DelState()
 		return c.EditMessage("Пользователь не удален!")
 	}
 	u, err := r.user.Find(c.Context(), c.UserId())
 	if err != nil {
 		return err
 	}
-	if u.Login != "" {
-		if err = r.parser.DeleteToken(u.Login); err != nil {
-			return err
+
+	var (
+		report strings.Builder
+		failed bool
+	)
+	step := func(err error, done, fail string) {
+		if err != nil {
+			failed = true
+			report.WriteString(txtStepFailed + fail + "\n")
+			return
 		}
+		report.WriteString(txtStepDone + done + "\n")
+	}
+
+	if u.Login == "" {
+		report.WriteString(txtStepSkipped + "Вход в модеус не выполнялся\n")
+	} else {
+		err = r.parser.DeleteToken(c.Context(), u.Login)
+		if err != nil {
+			log.Err(err).Int64("user_id", c.UserId()).Msg("handler/stateConfirmDelete error revoke token")
+		}
+		step(err, "Сессия модеуса завершена", "Не удалось завершить сессию модеуса, она истечет сама")
+	}
+
+	err = r.user.Delete(c.Context(), c.UserId())
+	if err != nil {
+		log.Err(err).Int64("user_id", c.UserId()).Msg("handler/stateConfirmDelete error delete user")
+	}
+	step(err, "Профиль, логин и друзья удалены", "Не удалось удалить профиль")
+
+	err = c.Clear()
+	if err != nil {
+		log.Err(err).Int64("user_id", c.UserId()).Msg("handler/stateConfirmDelete error clear storage")
+	}
+	step(err, "Данные диалога и кэш удалены", "Не удалось удалить данные диалога")
+
+	if failed {
+		return c.EditMessage(fmt.Sprintf(txtUserNotDeleted, report.String()))
+	}
+	return c.EditMessage(fmt.Sprintf(txtUserDeleted, report.String()))
+}
+
+// myData - выгрузка всех данных пользователя для /my_data. Пароль и токен сессии в нее не попадают
+type myData struct {
+	UserId     int64                  `json:"user_id"`
+	FullName   string                 `json:"full_name"`
+	Login      string                 `json:"login,omitempty"`
+	LoggedIn   bool                   `json:"logged_in"`
+	ScheduleId string                 `json:"schedule_id"`
+	GradesId   string                 `json:"grades_id"`
+	Friends    []service.FriendOutput `json:"friends"`
+	Settings   map[string]string      `json:"settings,omitempty"`
+	Storage    myDataStorage          `json:"storage"`
+}
+
+// myDataStorage - что лежит о пользователе в хранилище бота (состояние диалога и ключи кэша)
+type myDataStorage struct {
+	State string   `json:"state,omitempty"`
+	Keys  []string `json:"keys"`
+}
+
+func (r *userRouter) cmdMyData(c bot.Context) error {
+	u, err := r.user.Find(c.Context(), c.UserId())
+	if err != nil {
+		return err
 	}
-	if err = c.Clear(); err != nil {
+	keys, err := c.Keys()
+	if err != nil {
 		return err
 	}
-	if err = r.user.Delete(c.Context(), c.UserId()); err != nil {
+	state, err := c.GetState()
+	if err != nil && !errors.Is(err, bot.ErrKeyNotExists) {
+		return err
+	}
+
+	data, err := json.MarshalIndent(myData{
+		UserId:     c.UserId(),
+		FullName:   u.FullName,
+		Login:      u.Login,
+		LoggedIn:   u.Token != "",
+		ScheduleId: u.ScheduleId,
+		GradesId:   u.GradesId,
+		Friends:    u.Friends,
+		Settings:   u.Settings,
+		Storage: myDataStorage{
+			State: state,
+			Keys:  keys,
+		},
+	}, "", "  ")
+	if err != nil {
 		return err
 	}
-	return c.EditMessage(txtUserDeleted)
+	return c.SendDocument("my_data.json", data, txtMyData)
 }
 
 var (
@@ -173,11 +261,11 @@ func (r *userRouter) callbackMeBack(c bot.Context) error {
 }
 
 func (r *userRouter) callbackAboutMe(c bot.Context) error {
-	gi, err := lookupGI(c, r.user, false)
+	ref, err := lookupUser(c, r.user)
 	if err != nil {
 		return err
 	}
-	info, err := r.parser.FindStudentById(gi.ScheduleId)
+	info, err := r.parser.FindStudentById(c.Context(), ref.ScheduleId)
 	if err != nil {
 		return err
 	}
@@ -187,16 +275,16 @@ func (r *userRouter) callbackAboutMe(c bot.Context) error {
 }
 
 func (r *userRouter) callbackRatings(c bot.Context) error {
-	gi, err := lookupGI(c, r.user, true)
+	gi, err := lookupGI(c, r.user)
 	if err != nil {
 		return err
 	}
-	if gi.Login == "" || gi.Password == "" {
+	if gi.Login == "" || gi.Token == "" {
 		kb := append(tgmodel.GradesLink, kbMeBack...)
 		return c.EditMessageWithInlineKB(txtRequiredLoginPass, kb)
 	}
 
-	cgpa, ratings, err := r.parser.Ratings(gi)
+	cgpa, ratings, err := r.parser.Ratings(c.Context(), gi)
 	if err != nil {
 		return err
 	}
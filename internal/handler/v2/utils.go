@@ -1,14 +1,17 @@
 package v2
 
 import (
+	"bot_for_modeus/internal/metrics"
 	"bot_for_modeus/internal/model/tgmodel"
 	"bot_for_modeus/internal/parser"
 	"bot_for_modeus/internal/service"
 	"bot_for_modeus/pkg/bot"
+	"bot_for_modeus/pkg/secret"
 	"context"
 	"errors"
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,12 +20,34 @@ import (
 // Для данных, которые в кэше используются в качестве ускорения работы, вешаем таймауты хранения.
 // Нам не нужно хранить данные пользователей в кэше, которые единожды воспользовались ботом и больше не используют
 const (
-	defaultCacheTimeout     = time.Hour
-	textCacheTimeout        = time.Minute * 12
-	gradesInputCacheTimeout = time.Hour * 24 * 14
-	fullNameCacheTimeout    = time.Hour * 24 * 7
-	friendsCacheTimeout     = time.Hour * 24 * 7
-	semesterCacheTimeout    = time.Hour * 12
+	defaultCacheTimeout  = time.Hour
+	textCacheTimeout     = time.Minute * 12
+	userCacheTimeout     = time.Hour * 24 * 14
+	fullNameCacheTimeout = time.Hour * 24 * 7
+	friendsCacheTimeout  = time.Hour * 24 * 7
+	semesterCacheTimeout = time.Hour * 12
+)
+
+// Время, за которое пользователь должен пройти очередной шаг сцены. Иначе сцена сбрасывается
+const sceneTimeout = time.Hour
+
+// Ключи данных пользователя в хранилище. Производные ключи (например, семестр по id) получаются через With
+var (
+	keyUser             = bot.NewKey[userRef]("user", userCacheTimeout)
+	keyFriends          = bot.NewKey[[]service.FriendOutput]("friends", friendsCacheTimeout)
+	keySemesters        = bot.NewKey[[]parser.Semester]("semesters", semesterCacheTimeout)
+	keySemester         = bot.NewKey[parser.Semester]("semester", semesterCacheTimeout)
+	keySemesterGrades   = bot.NewKey[string]("semester_grades", textCacheTimeout)
+	keySemesterSubjects = bot.NewKey[map[string]string]("semester_subjects", defaultCacheTimeout)
+
+	// Найденные по ФИО студенты, из которых пользователь выбирает нужного. Удаляются вместе со сценой
+	keyStudents      = bot.NewKey[[]parser.Student]("students", 0)
+	keyOtherStudents = bot.NewKey[[]parser.Student]("other_students", 0)
+	// Друг, которого переименовывает пользователь. Удаляется вместе со сценой
+	keyRenameFriend = bot.NewKey[string]("rename_friend", 0)
+
+	// Раньше в кэше лежали логин и зашифрованный пароль (grades_input). Удаляется при промахе keyUser (см. lookupUser)
+	keyLegacyGradesInput = bot.NewKey[struct{}]("grades_input", 0)
 )
 
 var (
@@ -63,8 +88,8 @@ func formatStudents(students []parser.Student) (string, [][]tgbotapi.InlineKeybo
 }
 
 func findStudent(c bot.Context) (parser.Student, error) {
-	var students []parser.Student
-	if err := c.GetData("students", &students); err != nil {
+	students, err := keyStudents.Get(c)
+	if err != nil {
 		return parser.Student{}, err
 	}
 	cb := c.Update().CallbackQuery
@@ -72,41 +97,60 @@ func findStudent(c bot.Context) (parser.Student, error) {
 		return parser.Student{}, ErrIncorrectInput
 	}
 	num, err := strconv.Atoi(cb.Data)
-	if err != nil || num > len(students) {
+	if err != nil || num < 1 || num > len(students) {
 		return parser.Student{}, ErrIncorrectInput
 	}
 
 	return students[num-1], nil
 }
 
+// Валидация шагов сцен, где ожидается текст от пользователя (например, ФИО)
+func validateTextInput(c bot.Context) error {
+	if c.Update().Message == nil || len(c.Text()) > 200 {
+		return ErrIncorrectInput
+	}
+	return nil
+}
+
+// Валидация шагов сцен, где ожидается нажатие инлайн кнопки
+func validateCallbackInput(c bot.Context) error {
+	if c.Update().CallbackQuery == nil {
+		return ErrIncorrectInput
+	}
+	return nil
+}
+
+// Общий обработчик истекшей сцены
+func sceneExpired(c bot.Context) error {
+	return c.SendMessage(txtSceneExpired)
+}
+
+func pagesExpired(c bot.Context) error {
+	return c.SendMessage(txtPagesExpired)
+}
+
 // Функция парсит данные из параметров пути
 // Паттерн ввода в формате тип/дата/scheduleId, например day/2006-01-02/aaaaaaaa-0000-0000-0000-aaaaaaaaaaaa,
 // который в дальнейшем используется для получения расписания на 2 января 2006 для пользователя с uuid "aaaaaaaa-0000-0000-0000-aaaaaaaaaaaa".
 // Ввод week/2006-01-02/uuid будет использован для получения расписания на неделю, начинающуюся с этой даты.
-// Ввод grades/2006-01-02/uuid будет использован для получения оценок на эту дату
+// Ввод grades/2006-01-02/uuid будет использован для получения оценок на эту дату.
+// Формат даты (и uuid для чужого расписания) проверяет маршрут (:date<date>, :schedule_id<uuid>)
 func parseCallbackDate(c bot.Context) (t string, day time.Time, scheduleId string, err error) {
-	cb := c.Update().CallbackQuery
-	if cb == nil {
-		return "", time.Time{}, "", ErrIncorrectInput
-	}
-
-	var d string
-	t, d, scheduleId = c.Param("type"), c.Param("date"), c.Param("schedule_id")
-
-	if t == "" || d == "" || scheduleId == "" {
+	if c.Update().CallbackQuery == nil {
 		return "", time.Time{}, "", ErrIncorrectInput
 	}
 
-	day, err = time.Parse(time.DateOnly, d)
-	if err != nil {
+	t, scheduleId = c.Param("type"), c.Param("schedule_id")
+	day, err = c.ParamDate("date")
+	if err != nil || t == "" || scheduleId == "" {
 		return "", time.Time{}, "", ErrIncorrectInput
 	}
 	return
 }
 
-func studentDaySchedule(parser parser.Parser, now time.Time, scheduleId, prefix string) (string, [][]tgbotapi.InlineKeyboardButton, error) {
+func studentDaySchedule(ctx context.Context, parser parser.Parser, now time.Time, scheduleId, prefix string) (string, [][]tgbotapi.InlineKeyboardButton, error) {
 	now = now.In(defaultLocation)
-	schedule, err := parser.DaySchedule(scheduleId, now)
+	schedule, err := parser.DaySchedule(ctx, scheduleId, now)
 	if err != nil {
 		return "", nil, err
 	}
@@ -121,9 +165,9 @@ func studentDaySchedule(parser parser.Parser, now time.Time, scheduleId, prefix
 	return text, tgmodel.DayScheduleButtons(now, scheduleId, prefix), nil
 }
 
-func studentWeekSchedule(parser parser.Parser, now time.Time, scheduleId, prefix string) (string, [][]tgbotapi.InlineKeyboardButton, error) {
+func studentWeekSchedule(ctx context.Context, parser parser.Parser, now time.Time, scheduleId, prefix string) (string, [][]tgbotapi.InlineKeyboardButton, error) {
 	now = now.In(defaultLocation)
-	schedule, err := parser.WeekSchedule(scheduleId, now)
+	schedule, err := parser.WeekSchedule(ctx, scheduleId, now)
 	if err != nil {
 		return "", nil, err
 	}
@@ -166,24 +210,25 @@ func studentSchedule(c bot.Context, p parser.Parser, prefix string, backKB [][]t
 	)
 	switch t {
 	case "day":
-		text, kb, err = studentDaySchedule(p, day, scheduleId, prefix)
+		text, kb, err = studentDaySchedule(c.Context(), p, day, scheduleId, prefix)
 		if err != nil {
 			return err
 		}
 	case "week":
-		text, kb, err = studentWeekSchedule(p, day, scheduleId, prefix)
+		text, kb, err = studentWeekSchedule(c.Context(), p, day, scheduleId, prefix)
 		if err != nil {
 			return err
 		}
 	default:
-		return errors.New("studentSchedule unexpected error")
+		return ErrIncorrectInput
 	}
 
 	text = fmt.Sprintf(formatFullName, fullName) + text
 	if backKB != nil {
 		kb = append(kb, backKB...)
 	}
-	return c.EditMessageWithInlineKB(text, kb)
+	// Расписание на неделю может не влезть в одно сообщение
+	return c.EditPages(text, kb)
 }
 
 // Вынес клавиатуру с друзьями сюда, чтобы сразу работать с FriendOutput, а не tgmodel.Button
@@ -193,17 +238,37 @@ func friendsButtons(friends []service.FriendOutput) [][]tgbotapi.InlineKeyboardB
 	buttons = append(buttons, []tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData("Добавить друга", "/add_friend")})
 
 	for _, f := range friends {
-		buttons = append(buttons, []tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData(f.FullName, "/friends/choose/"+f.ScheduleId)})
+		buttons = append(buttons, []tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData(friendName(f), "/friends/choose/"+f.Id)})
 	}
 	return buttons
 }
 
+// friendName - имя, которое задал пользователь, а если его нет, то ФИО
+func friendName(f service.FriendOutput) string {
+	if f.Nickname != "" {
+		return f.Nickname
+	}
+	return f.FullName
+}
+
+// findFriend возвращает друга и его место в списке.
+// Если друга уже нет (например, нажата кнопка старого сообщения), возвращает service.ErrFriendNotFound
+func findFriend(friends []service.FriendOutput, friendId string) (service.FriendOutput, int, error) {
+	i := slices.IndexFunc(friends, func(f service.FriendOutput) bool { return f.Id == friendId })
+	if i < 0 {
+		return service.FriendOutput{}, 0, service.ErrFriendNotFound
+	}
+	return friends[i], i, nil
+}
+
 // Отдельно сохраняем все когда-либо использованные пользователем ФИО.
 // К сожалению, телеграм имеет ограничение на размер callback data (64 байта) (сделали хотя бы 1kb!!!!).
 // Поэтому идея сделать коллбэк на расписание в формате "тип/дата/scheduleId/ФИО" обернулась крахом.
 // Было принято решение scheduleId оставить, а ФИО вынести в общие данные
 func getFullName(c bot.Context, p parser.Parser, scheduleId string) (fullName string, err error) {
-	if err = c.GetCommonData("full_name:"+scheduleId, &fullName); err == nil {
+	err = c.GetCommonData("full_name:"+scheduleId, &fullName)
+	observeCache("full_name", err)
+	if err == nil {
 		return
 	}
 
@@ -215,7 +280,7 @@ func getFullName(c bot.Context, p parser.Parser, scheduleId string) (fullName st
 	defer cancel()
 
 	result, err := c.DoOnce(ctx, "full_name:"+scheduleId, func() (any, error) {
-		s, err := p.FindStudentById(scheduleId)
+		s, err := p.FindStudentById(c.Context(), scheduleId)
 		if err != nil {
 			return nil, err
 		}
@@ -228,80 +293,119 @@ func getFullName(c bot.Context, p parser.Parser, scheduleId string) (fullName st
 	return result.(string), nil
 }
 
-// Функция возвращает основную структуру для работы с пользователем - GradesInput (в которой scheduleId, gradesId, login, password).
-// Флаг decrypt для явного указания необходимости дешифровать пароль (если есть)
-// Без этого каждый вызов будет занимать на ~14.5 мс (см. бенчмарк pkg/crypter/crypter_test.go BenchmarkCrypter_Decrypt)
-// больше из-за постоянного дешифрования пароля даже там, где он не нужен
-func lookupGI(c bot.Context, u service.User, decrypt bool) (gi parser.GradesInput, err error) {
-	err = c.GetData("grades_input", &gi)
+// observeCache учитывает результат поиска в кэше в метриках. Ключ передается без производной части (id семестра и тд)
+func observeCache(key string, err error) {
+	switch {
+	case err == nil:
+		metrics.CacheLookup(key, metrics.CacheHit)
+	case errors.Is(err, bot.ErrKeyNotExists):
+		metrics.CacheLookup(key, metrics.CacheMiss)
+	default:
+		metrics.CacheLookup(key, metrics.CacheError)
+	}
+}
+
+// userRef - ссылка на пользователя в кэше: id для поиска расписания и оценок и признак входа в модеус.
+// Логин и токен в кэш не попадают, их при необходимости читает из бд lookupGI
+type userRef struct {
+	ScheduleId string `json:"schedule_id"`
+	GradesId   string `json:"grades_id"`
+	LoggedIn   bool   `json:"logged_in"`
+}
+
+func newUserRef(u service.UserOutput) userRef {
+	return userRef{
+		ScheduleId: u.ScheduleId,
+		GradesId:   u.GradesId,
+		LoggedIn:   u.Token != "",
+	}
+}
+
+// Функция возвращает ссылку на пользователя из кэша, а при промахе читает пользователя из бд и кэширует ссылку.
+// Подходит везде, где не нужны учетные данные (расписание, кнопки, доступные после входа)
+func lookupUser(c bot.Context, u service.User) (ref userRef, err error) {
+	ref, err = keyUser.Get(c)
+	observeCache(keyUser.Name(), err)
 	if err == nil {
-		if gi.Password != "" && decrypt {
-			gi.Password, err = u.Decrypt(gi.Password)
-			if err != nil {
-				return parser.GradesInput{}, err
-			}
-		}
 		return
 	}
 	if !errors.Is(err, bot.ErrKeyNotExists) {
-		return parser.GradesInput{}, err
+		return userRef{}, err
 	}
 
+	user, err := u.Find(c.Context(), c.UserId())
+	if err != nil {
+		return userRef{}, err
+	}
+	ref = newUserRef(user)
+	// Тут необязательно возвращать ошибку, поскольку ссылка у нас есть,
+	// однако нагрузка на бд возрастет с количеством несохраненных ссылок в кэш
+	_ = keyUser.Set(c, ref)
+	_ = keyLegacyGradesInput.Del(c)
+	return ref, nil
+}
+
+// Функция возвращает данные для запросов оценок с расшифрованным токеном. Пустой Token - пользователь не вошел в модеус.
+// Учетные данные не кэшируются и каждый раз читаются из бд, заодно обновляется ссылка на пользователя в кэше
+func lookupGI(c bot.Context, u service.User) (parser.GradesInput, error) {
 	user, err := u.Find(c.Context(), c.UserId())
 	if err != nil {
 		return parser.GradesInput{}, err
 	}
+	_ = keyUser.Set(c, newUserRef(user))
 
-	gi = parser.GradesInput{
+	gi := parser.GradesInput{
 		Login:      user.Login,
-		Password:   user.Password,
 		ScheduleId: user.ScheduleId,
 		GradesId:   user.GradesId,
 	}
-	// Тут необязательно возвращать ошибку, поскольку grades input у нас есть,
-	// однако нагрузка на бд возрастет с количеством несохраненных gi в кэш
-	_ = c.SetTempData("grades_input", gi, gradesInputCacheTimeout)
-
-	if gi.Password != "" && decrypt {
-		gi.Password, err = u.Decrypt(gi.Password)
-		if err != nil {
-			return parser.GradesInput{}, err
-		}
+	if user.Token == "" {
+		return gi, nil
 	}
-	return
+	if gi.Token, err = u.Decrypt(c.Context(), user.Token); err != nil {
+		return parser.GradesInput{}, err
+	}
+	return gi, nil
 }
 
 func lookupFriends(c bot.Context, u service.User) (friends []service.FriendOutput, err error) {
-	if err = c.GetData("friends", &friends); err == nil {
+	friends, err = keyFriends.Get(c)
+	observeCache(keyFriends.Name(), err)
+	// Друзья без id закэшированы до того, как у друзей появились id. Кнопки по ним не работают, поэтому перечитываем
+	if err == nil && !slices.ContainsFunc(friends, func(f service.FriendOutput) bool { return f.Id == "" }) {
 		return
 	}
 	user, err := u.Find(c.Context(), c.UserId())
 	if err != nil {
 		return nil, err
 	}
-	_ = c.SetTempData("friends", user.Friends, friendsCacheTimeout)
+	_ = keyFriends.Set(c, user.Friends)
 	return user.Friends, nil
 }
 
 func lookupSemesters(c bot.Context, p parser.Parser, gi parser.GradesInput) ([]parser.Semester, error) {
-	var semesters []parser.Semester
-	if err := c.GetData("semesters", &semesters); err == nil {
+	semesters, err := keySemesters.Get(c)
+	observeCache(keySemesters.Name(), err)
+	if err == nil {
 		return semesters, nil
 	}
-	semesters, err := p.FindAllSemesters(gi)
+	semesters, err = p.FindAllSemesters(c.Context(), gi)
 	if err != nil {
 		return nil, err
 	}
 	if len(semesters) == 0 {
-		return nil, errors.New("lookupSemesters: cannot find semesters from modeus")
+		return nil, parser.ErrSemestersNotFound
 	}
-	_ = c.SetTempData("semesters", semesters, semesterCacheTimeout)
+	_ = keySemesters.Set(c, semesters)
 	return semesters, nil
 }
 
 // Функция ищет семестр по semesterId. Сначала кэш, потом запрос в модеус. Если semesterId не указан (пустая строка), то возвращаем последний (текущий)
 func lookupSemester(c bot.Context, p parser.Parser, gi parser.GradesInput, semesterId string) (semester parser.Semester, err error) {
-	if err = c.GetData("semester:"+semesterId, &semester); err == nil { // Ничего не найдет, если семестр не указан. Важно следить, чтобы Set всегда был с semesterId, иначе фатально
+	// Ничего не найдет, если семестр не указан. Важно следить, чтобы Set всегда был с semesterId, иначе фатально
+	semester, err = keySemester.With(semesterId).Get(c)
+	observeCache(keySemester.Name(), err) // без id, иначе у метрики будет метка на каждый семестр
+	if err == nil {
 		return
 	}
 	semesters, err := lookupSemesters(c, p, gi)
@@ -310,16 +414,16 @@ func lookupSemester(c bot.Context, p parser.Parser, gi parser.GradesInput, semes
 	}
 	if semesterId == "" {
 		semester = semesters[len(semesters)-1]
-		_ = c.SetTempData("semester:"+semester.Id, semester, semesterCacheTimeout)
+		_ = keySemester.With(semester.Id).Set(c, semester)
 		return
 	}
 	for _, s := range semesters {
 		if s.Id == semesterId {
-			_ = c.SetTempData("semester:"+s.Id, s, semesterCacheTimeout)
+			_ = keySemester.With(s.Id).Set(c, s)
 			return s, nil
 		}
 	}
-	return parser.Semester{}, fmt.Errorf("lookupSemester: semester with id %s not found", semesterId)
+	return parser.Semester{}, ErrSemesterNotFound.Wrap(fmt.Errorf("semester id %s", semesterId))
 }
 
 // От модеуса даты приходят в неудобном для чтения виде, поэтому мы приводим их в нормальный вариант
@@ -331,27 +435,21 @@ func parseSemesterDate(d string) string {
 	return t.Format("02.01.2006")
 }
 
-// Функция добавляет/обновляет логин и пароль пользователя.
-// Отправляет сообщения об ошибках ввода.
+// Функция обменивает логин и пароль пользователя на токен сессии (сам пароль не сохраняется).
+// При ошибке ввода возвращает ErrIncorrectLoginPassInput, чтобы состояние не сбрасывалось и пользователь мог ввести заново.
 // Удаляет сообщение от пользователя с введенным логином и паролем
 func addLoginPassword(c bot.Context, u service.User) error {
 	data := strings.Fields(c.Text())
 	if len(data) != 2 {
-		return c.SendMessage(txtIncorrectLoginPassInput)
+		return ErrIncorrectLoginPassInput
 	}
 
-	if err := c.DelData("grades_input"); err != nil { // сначала важно удалить старые данные из кэша
-		return err
-	}
 	err := u.UpdateLoginPassword(c.Context(), service.UserLoginPasswordInput{
 		UserId:   c.UserId(),
 		Login:    data[0],
-		Password: data[1],
+		Password: secret.String(data[1]),
 	})
 	if err != nil {
-		if errors.Is(err, service.ErrUserIncorrectLogin) {
-			return c.SendMessage(txtIncorrectLoginPassInput)
-		}
 		return err
 	}
 	return c.DeleteLastMessage()
@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Результаты поиска в кэше
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheError = "error" // хранилище недоступно, данные запрашиваются заново так же, как при промахе
+)
+
+var cacheLookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: "cache",
+	Name:      "lookups_total",
+	Help:      "Поиск данных пользователей в хранилище бота по ключам",
+}, []string{"key", "result"})
+
+func CacheLookup(key, result string) {
+	cacheLookupsTotal.WithLabelValues(key, result).Inc()
+}
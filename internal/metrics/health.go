@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"context"
+	"github.com/bytedance/sonic"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultCheckTimeout = time.Second * 3
+
+// Check проверяет одну зависимость. Проверка должна уважать ctx, иначе ответ задержится до ее завершения
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Health собирает проверки для /healthz и /readyz.
+//
+// /healthz (liveness) - процесс работает и получает апдейты. Если не проходит, инстанс нужно перезапустить.
+// /readyz (readiness) - доступны зависимости (бд, хранилище, парсер). Перезапуск тут не поможет,
+// поэтому зависимости не входят в liveness, чтобы недоступная бд не приводила к бесконечным перезапускам бота
+type Health struct {
+	liveness  []namedCheck
+	readiness []namedCheck
+	timeout   time.Duration
+}
+
+func NewHealth() *Health {
+	return &Health{timeout: defaultCheckTimeout}
+}
+
+func (h *Health) Liveness(name string, c Check) {
+	h.liveness = append(h.liveness, namedCheck{name: name, check: c})
+}
+
+func (h *Health) Readiness(name string, c Check) {
+	h.readiness = append(h.readiness, namedCheck{name: name, check: c})
+}
+
+const (
+	statusOk   = "ok"
+	statusFail = "fail"
+)
+
+type (
+	healthResponse struct {
+		Status string                 `json:"status"`
+		Checks map[string]checkResult `json:"checks"`
+	}
+	checkResult struct {
+		Status   string  `json:"status"`
+		Duration float64 `json:"duration_seconds"`
+		Error    string  `json:"error,omitempty"`
+	}
+)
+
+// run выполняет проверки параллельно с общим таймаутом
+func (h *Health) run(ctx context.Context, checks []namedCheck) healthResponse {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	resp := healthResponse{
+		Status: statusOk,
+		Checks: make(map[string]checkResult, len(checks)),
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c namedCheck) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := c.check(ctx)
+			result := checkResult{Status: statusOk, Duration: time.Since(start).Seconds()}
+			if err != nil {
+				result.Status, result.Error = statusFail, err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[c.name] = result
+			if err != nil {
+				resp.Status = statusFail
+			}
+		}(c)
+	}
+	wg.Wait()
+	return resp
+}
+
+func (h *Health) handler(checks []namedCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := h.run(r.Context(), checks)
+		b, _ := sonic.Marshal(resp)
+
+		w.Header().Set("Content-Type", "application/json")
+		if resp.Status != statusOk {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write(b)
+	}
+}
+
+// Проверки должны быть добавлены до вызова Listen
+func (h *Health) register(mux *http.ServeMux) {
+	mux.Handle("/healthz", h.handler(h.liveness))
+	mux.Handle("/readyz", h.handler(h.readiness))
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/bytedance/sonic"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	h := NewHealth()
+	h.timeout = time.Millisecond * 50
+
+	h.Liveness("telegram", func(ctx context.Context) error { return nil })
+	h.Readiness("mongo", func(ctx context.Context) error { return nil })
+	h.Readiness("parser", func(ctx context.Context) error { return errors.New("connection refused") })
+	// зависшая проверка прерывается по таймауту и не задерживает ответ
+	h.Readiness("redis", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	mux := http.NewServeMux()
+	h.register(mux)
+
+	testCases := []struct {
+		testName     string
+		path         string
+		expectCode   int
+		expectStatus string
+		expectChecks map[string]string
+	}{
+		{
+			testName:     "liveness",
+			path:         "/healthz",
+			expectCode:   http.StatusOK,
+			expectStatus: statusOk,
+			expectChecks: map[string]string{"telegram": statusOk},
+		},
+		{
+			testName:     "readiness",
+			path:         "/readyz",
+			expectCode:   http.StatusServiceUnavailable,
+			expectStatus: statusFail,
+			expectChecks: map[string]string{"mongo": statusOk, "parser": statusFail, "redis": statusFail},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			assert.Equal(t, tc.expectCode, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var resp healthResponse
+			assert.Nil(t, sonic.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tc.expectStatus, resp.Status)
+
+			checks := make(map[string]string, len(resp.Checks))
+			for name, c := range resp.Checks {
+				checks[name] = c.Status
+				if c.Status == statusFail {
+					assert.NotEmpty(t, c.Error)
+				}
+			}
+			assert.Equal(t, tc.expectChecks, checks)
+		})
+	}
+}
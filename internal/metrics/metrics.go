@@ -46,9 +46,13 @@ func ErrorsTotal(t string) {
 	errorsTotal.WithLabelValues(t).Inc()
 }
 
-func Listen(addr string) error {
+// Listen поднимает http сервер с /metrics и проверками /healthz, /readyz (health может быть nil)
+func Listen(addr string, health *Health) error {
 	mux := http.NewServeMux()
 
 	mux.Handle("/metrics", promhttp.Handler())
+	if health != nil {
+		health.register(mux)
+	}
 	return http.ListenAndServe(addr, mux)
 }
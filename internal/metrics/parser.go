@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"time"
+)
+
+// Метрики клиента парсера. Метка endpoint - путь запроса без query (/schedule, /grades/total, ...), поэтому их количество ограничено
+var (
+	parserRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "parser",
+		Name:      "request_duration",
+		Help:      "Время запроса к парсеру вместе с повторами, в секундах",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20},
+	}, []string{"endpoint"})
+
+	parserResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "parser",
+		Name:      "responses_total",
+		Help:      "Ответы парсера по кодам, включая ответы на повторные запросы",
+	}, []string{"endpoint", "code"})
+
+	parserRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "parser",
+		Name:      "retries_total",
+		Help:      "Повторные запросы к парсеру",
+	}, []string{"endpoint"})
+
+	parserErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "parser",
+		Name:      "errors_total",
+		Help:      "Ошибки запросов к парсеру по классам",
+	}, []string{"endpoint", "class"})
+)
+
+func ParserRequestDuration(endpoint string, d time.Duration) {
+	parserRequestDuration.WithLabelValues(endpoint).Observe(d.Seconds())
+}
+
+func ParserResponse(endpoint string, code int) {
+	parserResponsesTotal.WithLabelValues(endpoint, strconv.Itoa(code)).Inc()
+}
+
+func ParserRetry(endpoint string) {
+	parserRetriesTotal.WithLabelValues(endpoint).Inc()
+}
+
+func ParserError(endpoint, class string) {
+	parserErrorsTotal.WithLabelValues(endpoint, class).Inc()
+}
@@ -62,3 +62,17 @@ func (mr *MockCrypterMockRecorder) Encrypt(text interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Encrypt", reflect.TypeOf((*MockCrypter)(nil).Encrypt), text)
 }
+
+// Outdated mocks base method.
+func (m *MockCrypter) Outdated(text string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Outdated", text)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Outdated indicates an expected call of Outdated.
+func (mr *MockCrypterMockRecorder) Outdated(text interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Outdated", reflect.TypeOf((*MockCrypter)(nil).Outdated), text)
+}
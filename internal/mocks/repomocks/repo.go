@@ -10,7 +10,6 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
-	bson "go.mongodb.org/mongo-driver/bson"
 )
 
 // MockUser is a mock of User interface.
@@ -36,6 +35,20 @@ func (m *MockUser) EXPECT() *MockUserMockRecorder {
 	return m.recorder
 }
 
+// AddFriend mocks base method.
+func (m *MockUser) AddFriend(ctx context.Context, id int64, f dbmodel.Friend, limit int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddFriend", ctx, id, f, limit)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddFriend indicates an expected call of AddFriend.
+func (mr *MockUserMockRecorder) AddFriend(ctx, id, f, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddFriend", reflect.TypeOf((*MockUser)(nil).AddFriend), ctx, id, f, limit)
+}
+
 // Create mocks base method.
 func (m *MockUser) Create(ctx context.Context, u dbmodel.User) error {
 	m.ctrl.T.Helper()
@@ -79,16 +92,115 @@ func (mr *MockUserMockRecorder) FindById(ctx, id interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindById", reflect.TypeOf((*MockUser)(nil).FindById), ctx, id)
 }
 
-// Update mocks base method.
-func (m *MockUser) Update(ctx context.Context, id int64, data bson.D) error {
+// ForEach mocks base method.
+func (m *MockUser) ForEach(ctx context.Context, fn func(dbmodel.User) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ForEach", ctx, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ForEach indicates an expected call of ForEach.
+func (mr *MockUserMockRecorder) ForEach(ctx, fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ForEach", reflect.TypeOf((*MockUser)(nil).ForEach), ctx, fn)
+}
+
+// MoveFriend mocks base method.
+func (m *MockUser) MoveFriend(ctx context.Context, id int64, friendId string, position int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MoveFriend", ctx, id, friendId, position)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MoveFriend indicates an expected call of MoveFriend.
+func (mr *MockUserMockRecorder) MoveFriend(ctx, id, friendId, position interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MoveFriend", reflect.TypeOf((*MockUser)(nil).MoveFriend), ctx, id, friendId, position)
+}
+
+// RemoveFriend mocks base method.
+func (m *MockUser) RemoveFriend(ctx context.Context, id int64, friendId string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveFriend", ctx, id, friendId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveFriend indicates an expected call of RemoveFriend.
+func (mr *MockUserMockRecorder) RemoveFriend(ctx, id, friendId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveFriend", reflect.TypeOf((*MockUser)(nil).RemoveFriend), ctx, id, friendId)
+}
+
+// RenameFriend mocks base method.
+func (m *MockUser) RenameFriend(ctx context.Context, id int64, friendId string, nickname string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Update", ctx, id, data)
+	ret := m.ctrl.Call(m, "RenameFriend", ctx, id, friendId, nickname)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Update indicates an expected call of Update.
-func (mr *MockUserMockRecorder) Update(ctx, id, data interface{}) *gomock.Call {
+// RenameFriend indicates an expected call of RenameFriend.
+func (mr *MockUserMockRecorder) RenameFriend(ctx, id, friendId, nickname interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenameFriend", reflect.TypeOf((*MockUser)(nil).RenameFriend), ctx, id, friendId, nickname)
+}
+
+// SetCredentials mocks base method.
+func (m *MockUser) SetCredentials(ctx context.Context, id int64, c dbmodel.Credentials) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetCredentials", ctx, id, c)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetCredentials indicates an expected call of SetCredentials.
+func (mr *MockUserMockRecorder) SetCredentials(ctx, id, c interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCredentials", reflect.TypeOf((*MockUser)(nil).SetCredentials), ctx, id, c)
+}
+
+// SetProfile mocks base method.
+func (m *MockUser) SetProfile(ctx context.Context, id int64, p dbmodel.Profile) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetProfile", ctx, id, p)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetProfile indicates an expected call of SetProfile.
+func (mr *MockUserMockRecorder) SetProfile(ctx, id, p interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetProfile", reflect.TypeOf((*MockUser)(nil).SetProfile), ctx, id, p)
+}
+
+// SetSettings mocks base method.
+func (m *MockUser) SetSettings(ctx context.Context, id int64, s dbmodel.Settings) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetSettings", ctx, id, s)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetSettings indicates an expected call of SetSettings.
+func (mr *MockUserMockRecorder) SetSettings(ctx, id, s interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSettings", reflect.TypeOf((*MockUser)(nil).SetSettings), ctx, id, s)
+}
+
+// Upsert mocks base method.
+func (m *MockUser) Upsert(ctx context.Context, u dbmodel.User) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Upsert", ctx, u)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Upsert indicates an expected call of Upsert.
+func (mr *MockUserMockRecorder) Upsert(ctx, u interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockUser)(nil).Update), ctx, id, data)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Upsert", reflect.TypeOf((*MockUser)(nil).Upsert), ctx, u)
 }
@@ -1,16 +1,60 @@
 package dbmodel
 
+import (
+	"slices"
+	"time"
+)
+
 type User struct {
-	UserId     int64    `bson:"user_id"`
-	FullName   string   `bson:"full_name"`
-	Login      string   `bson:"login"`
-	Password   string   `bson:"password"`
-	ScheduleId string   `bson:"schedule_id"` // Id пользователя для поиска расписания
-	GradesId   string   `bson:"grades_id"`   // Id пользователя для поиска оценок
-	Friends    []Friend `bson:"friends"`     // Слайс, а не мапа, чтобы гарантировать порядок
+	UserId   int64  `bson:"user_id"`
+	FullName string `bson:"full_name"`
+	Login    string `bson:"login"`
+	// Password - зашифрованный пароль из старых записей. Новые записи хранят только токен,
+	// старые пароли меняются на токен и удаляются (см. service.User.MigrateCredentials)
+	Password       string    `bson:"password,omitempty"`
+	Token          string    `bson:"token,omitempty"`            // Зашифрованный токен сессии модеуса
+	TokenExpiresAt time.Time `bson:"token_expires_at,omitempty"` // Когда истекает токен (нулевое - неизвестно)
+	ScheduleId     string    `bson:"schedule_id"`                // Id пользователя для поиска расписания
+	GradesId       string    `bson:"grades_id"`                  // Id пользователя для поиска оценок
+	Friends        []Friend  `bson:"friends"`                    // Слайс, а не мапа, чтобы гарантировать порядок
+	Settings       Settings  `bson:"settings,omitempty"`         // Настройки пользователя (ключ -> значение)
+}
+
+// Credentials - учетные данные модеуса. Token уже зашифрован, пустой Token означает, что сессии нет
+type Credentials struct {
+	Login          string
+	Token          string
+	TokenExpiresAt time.Time
+}
+
+// Profile - данные пользователя из модеуса, которые он выбирает при регистрации
+type Profile struct {
+	FullName   string
+	ScheduleId string
+	GradesId   string
 }
 
+// Settings хранятся парами ключ-значение, чтобы новые настройки не требовали миграций
+type Settings map[string]string
+
+// Friend - друг пользователя. Id не меняется при переименовании и перестановке, ScheduleId уникален среди друзей пользователя
 type Friend struct {
+	Id         string `bson:"id"`
 	FullName   string `bson:"full_name"`
 	ScheduleId string `bson:"schedule_id"`
+	Nickname   string `bson:"nickname,omitempty"` // Имя, которое задал пользователь. Пустое - показывается ФИО
+}
+
+// MoveFriend возвращает копию friends, в которой друг friendId стоит на месте position.
+// Позиция за пределами списка заменяется ближайшей допустимой. ok - друг найден
+func MoveFriend(friends []Friend, friendId string, position int) (_ []Friend, ok bool) {
+	i := slices.IndexFunc(friends, func(f Friend) bool { return f.Id == friendId })
+	if i < 0 {
+		return nil, false
+	}
+	position = max(0, min(position, len(friends)-1))
+
+	f := friends[i]
+	moved := slices.Delete(slices.Clone(friends), i, i+1)
+	return slices.Insert(moved, position, f), true
 }
@@ -5,16 +5,33 @@ import (
 	"time"
 )
 
-func ChooseFriendAction(scheduleId string) [][]tgbotapi.InlineKeyboardButton {
+// ChooseFriendAction - действия с другом, который стоит на месте position (с нуля) в списке из count друзей.
+// Кнопки перестановки показываются, только если друга есть куда сдвинуть
+func ChooseFriendAction(friendId, scheduleId string, position, count int) [][]tgbotapi.InlineKeyboardButton {
 	now := time.Now().In(defaultLocation)
-	return [][]tgbotapi.InlineKeyboardButton{
+	buttons := [][]tgbotapi.InlineKeyboardButton{
 		{
 			tgbotapi.NewInlineKeyboardButtonData("Расписание на день", formatScheduleButtonsData(now, "day", scheduleId, "friends")),
 			tgbotapi.NewInlineKeyboardButtonData("Расписание на неделю", formatScheduleButtonsData(now, "week", scheduleId, "friends")),
 		},
-		{tgbotapi.NewInlineKeyboardButtonData("Удалить друга", "/friends/delete/"+scheduleId)},
-		{tgbotapi.NewInlineKeyboardButtonData(txtBackButton, "/choose_friend_back")},
+		{tgbotapi.NewInlineKeyboardButtonData("✏️ Переименовать", "/friends/rename/"+friendId)},
 	}
+
+	var move []tgbotapi.InlineKeyboardButton
+	if position > 0 {
+		move = append(move, tgbotapi.NewInlineKeyboardButtonData("⬆️ Выше", "/friends/up/"+friendId))
+	}
+	if position < count-1 {
+		move = append(move, tgbotapi.NewInlineKeyboardButtonData("⬇️ Ниже", "/friends/down/"+friendId))
+	}
+	if len(move) > 0 {
+		buttons = append(buttons, move)
+	}
+
+	return append(buttons,
+		[]tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData("Удалить друга", "/friends/delete/"+friendId)},
+		[]tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData(txtBackButton, "/choose_friend_back")},
+	)
 }
 
 func FriendsButtons(friends map[string]string) [][]tgbotapi.InlineKeyboardButton {
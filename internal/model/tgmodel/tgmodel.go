@@ -33,6 +33,11 @@ var SettingsButtons = [][]tgbotapi.InlineKeyboardButton{
 	{tgbotapi.NewInlineKeyboardButtonData("Добавить логин и пароль", "/add_login_password"), tgbotapi.NewInlineKeyboardButtonData("Изменить ФИО", "/update_full_name")},
 }
 
+// ReLoginButtons предлагает заново ввести логин и пароль, когда сессия модеуса истекла
+var ReLoginButtons = [][]tgbotapi.InlineKeyboardButton{
+	{tgbotapi.NewInlineKeyboardButtonData("Войти заново", "/add_login_password")},
+}
+
 var YesOrNoButtons = [][]tgbotapi.InlineKeyboardButton{
 	{tgbotapi.NewInlineKeyboardButtonData("Да", "да"), tgbotapi.NewInlineKeyboardButtonData("Нет", "нет")},
 }
@@ -167,6 +172,8 @@ var UICommands = []tgbotapi.BotCommand{
 	{Command: "settings", Description: "Настройки"},
 	{Command: "other_student", Description: "Расписание другого студента"},
 	{Command: "kb", Description: "Показать клавиатуру"},
+	{Command: "cancel", Description: "Отменить текущее действие"},
+	{Command: "my_data", Description: "Выгрузить мои данные"},
 	{Command: "stop", Description: "Остановить бота"},
 }
 
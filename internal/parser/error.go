@@ -1,10 +1,17 @@
 package parser
 
-import "errors"
+import "bot_for_modeus/internal/apperrs"
 
 var (
-	ErrStudentsNotFound       = errors.New("students not found")
-	ErrIncorrectLoginPassword = errors.New("incorrect login or password")
-	ErrModeusUnavailable      = errors.New("modeus unavailable")
-	ErrParserUnavailable      = errors.New("parser unavailable")
+	ErrStudentsNotFound       = apperrs.New(apperrs.KindUser, "parser.students_not_found", "students not found")
+	ErrIncorrectLoginPassword = apperrs.New(apperrs.KindAuth, "parser.incorrect_login_password", "incorrect login or password")
+	// ErrTokenExpired - токен сессии истек или отозван, нужно заново ввести логин и пароль
+	ErrTokenExpired      = apperrs.New(apperrs.KindAuth, "parser.token_expired", "token expired")
+	ErrModeusUnavailable = apperrs.New(apperrs.KindTransient, "parser.modeus_unavailable", "modeus unavailable")
+	ErrParserUnavailable = apperrs.New(apperrs.KindTransient, "parser.unavailable", "parser unavailable")
+	// ErrRequestFailed - запрос не дошел до парсера или оборвался (причина в Unwrap)
+	ErrRequestFailed = apperrs.New(apperrs.KindTransient, "parser.request_failed", "parser request failed")
+	// ErrBadResponse - парсер ответил, но ответ не удалось разобрать. Скорее всего, разошлись версии api
+	ErrBadResponse       = apperrs.New(apperrs.KindInternal, "parser.bad_response", "parser bad response")
+	ErrSemestersNotFound = apperrs.New(apperrs.KindInternal, "parser.semesters_not_found", "semesters not found")
 )
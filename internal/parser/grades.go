@@ -1,7 +1,8 @@
 package parser
 
 import (
-	"errors"
+	"bot_for_modeus/pkg/secret"
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -16,13 +17,32 @@ const (
 	findSubjectDetailedInfoUri = "/grades/subjects"
 )
 
+// GradesInput - данные для запросов оценок. Вместо пароля передается токен сессии (см. Tokens).
+// Токен скрывается в логах и json, в запрос к парсеру он попадает через gradesInput
 type GradesInput struct {
+	Login      string        `json:"login"`
+	Token      secret.String `json:"token"`
+	ScheduleId string        `json:"schedule_id"`
+	GradesId   string        `json:"grades_id"`
+}
+
+// gradesInput - GradesInput в теле запроса к парсеру
+type gradesInput struct {
 	Login      string `json:"login"`
-	Password   string `json:"password"`
+	Token      string `json:"token"`
 	ScheduleId string `json:"schedule_id"`
 	GradesId   string `json:"grades_id"`
 }
 
+func (gi GradesInput) request() gradesInput {
+	return gradesInput{
+		Login:      gi.Login,
+		Token:      gi.Token.Reveal(),
+		ScheduleId: gi.ScheduleId,
+		GradesId:   gi.GradesId,
+	}
+}
+
 type Semester struct {
 	Id               string `json:"id"`
 	Number           int    `json:"number"`
@@ -33,7 +53,7 @@ type Semester struct {
 }
 
 type semesterTotalRequest struct {
-	GradesInput
+	gradesInput
 	Semester
 }
 
@@ -47,9 +67,9 @@ type SubjectGrades struct {
 	UndefinedRate  string `json:"undefined_rate"`  // Процент без отметки о посещении
 }
 
-func (p *parser) SemesterTotalGrades(gi GradesInput, semester Semester) ([]SubjectGrades, error) {
-	resp, err := p.makeRequest(http.MethodPost, findSemesterGradesUri, semesterTotalRequest{
-		GradesInput: gi,
+func (p *parser) SemesterTotalGrades(ctx context.Context, gi GradesInput, semester Semester) ([]SubjectGrades, error) {
+	resp, err := p.makeRequest(ctx, http.MethodPost, findSemesterGradesUri, semesterTotalRequest{
+		gradesInput: gi.request(),
 		Semester:    semester,
 	})
 	if err != nil {
@@ -76,8 +96,8 @@ type SemesterRatings struct {
 	GPA           string `json:"gpa"`            // gpa рейтинг
 }
 
-func (p *parser) Ratings(gi GradesInput) (string, []SemesterRatings, error) {
-	resp, err := p.makeRequest(http.MethodPost, findRatingsUri, gi)
+func (p *parser) Ratings(ctx context.Context, gi GradesInput) (string, []SemesterRatings, error) {
+	resp, err := p.makeRequest(ctx, http.MethodPost, findRatingsUri, gi.request())
 	if err != nil {
 		return "", nil, err
 	}
@@ -90,7 +110,7 @@ func (p *parser) Ratings(gi GradesInput) (string, []SemesterRatings, error) {
 }
 
 type dayGradesRequest struct {
-	GradesInput
+	gradesInput
 	Day time.Time `json:"day"`
 }
 
@@ -103,9 +123,9 @@ type DayGrades struct {
 	Grades     string `json:"grades"`     // Баллы, поставленные за пару (может быть несколько)
 }
 
-func (p *parser) DayGrades(day time.Time, gi GradesInput) ([]DayGrades, error) {
-	resp, err := p.makeRequest(http.MethodPost, findDayGradesUri, dayGradesRequest{
-		GradesInput: gi,
+func (p *parser) DayGrades(ctx context.Context, day time.Time, gi GradesInput) ([]DayGrades, error) {
+	resp, err := p.makeRequest(ctx, http.MethodPost, findDayGradesUri, dayGradesRequest{
+		gradesInput: gi.request(),
 		Day:         day,
 	})
 	if err != nil {
@@ -119,8 +139,8 @@ func (p *parser) DayGrades(day time.Time, gi GradesInput) ([]DayGrades, error) {
 	return result, nil
 }
 
-func (p *parser) FindAllSemesters(gi GradesInput) ([]Semester, error) {
-	resp, err := p.makeRequest(http.MethodPost, findSemestersUri, gi)
+func (p *parser) FindAllSemesters(ctx context.Context, gi GradesInput) ([]Semester, error) {
+	resp, err := p.makeRequest(ctx, http.MethodPost, findSemestersUri, gi.request())
 	if err != nil {
 		return nil, err
 	}
@@ -132,21 +152,21 @@ func (p *parser) FindAllSemesters(gi GradesInput) ([]Semester, error) {
 	return semesters, nil
 }
 
-func (p *parser) FindCurrentSemester(gi GradesInput) (Semester, error) {
-	semesters, err := p.FindAllSemesters(gi)
+func (p *parser) FindCurrentSemester(ctx context.Context, gi GradesInput) (Semester, error) {
+	semesters, err := p.FindAllSemesters(ctx, gi)
 	if err != nil {
 		return Semester{}, err
 	}
 
 	if len(semesters) < 1 {
-		return Semester{}, errors.New("semesters not found")
+		return Semester{}, ErrSemestersNotFound
 	}
 	return semesters[len(semesters)-1], nil // в ответе они отсортированы по возрастанию
 }
 
-func (p *parser) FindSemesterSubjects(gi GradesInput, semester Semester) (map[string]string, error) {
-	resp, err := p.makeRequest(http.MethodPost, findSemesterSubjects, semesterTotalRequest{
-		GradesInput: gi,
+func (p *parser) FindSemesterSubjects(ctx context.Context, gi GradesInput, semester Semester) (map[string]string, error) {
+	resp, err := p.makeRequest(ctx, http.MethodPost, findSemesterSubjects, semesterTotalRequest{
+		gradesInput: gi.request(),
 		Semester:    semester,
 	})
 	if err != nil {
@@ -168,10 +188,10 @@ type LessonGrades struct {
 	Grades     string `json:"grades"`     // Оценки (может быть несколько)
 }
 
-func (p *parser) SubjectDetailedInfo(gi GradesInput, semester Semester, subjectId string) ([]LessonGrades, error) {
+func (p *parser) SubjectDetailedInfo(ctx context.Context, gi GradesInput, semester Semester, subjectId string) ([]LessonGrades, error) {
 	uri := fmt.Sprintf("%s?subject_id=%s", findSubjectDetailedInfoUri, subjectId)
-	resp, err := p.makeRequest(http.MethodPost, uri, semesterTotalRequest{
-		GradesInput: gi,
+	resp, err := p.makeRequest(ctx, http.MethodPost, uri, semesterTotalRequest{
+		gradesInput: gi.request(),
 		Semester:    semester,
 	})
 	if err != nil {
@@ -1,6 +1,9 @@
 package parser
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+)
 
 const (
 	findBuildings = "/info/buildings"
@@ -12,8 +15,8 @@ type Building struct {
 	SearchUrl string `json:"search_url"` // https ссылка на яндекс карты
 }
 
-func (p *parser) FindBuildings() ([]Building, error) {
-	resp, err := p.makeRequest(http.MethodGet, findBuildings, nil)
+func (p *parser) FindBuildings(ctx context.Context) ([]Building, error) {
+	resp, err := p.makeRequest(ctx, http.MethodGet, findBuildings, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1,35 +1,48 @@
 package parser
 
 import (
+	"bot_for_modeus/internal/apperrs"
+	"bot_for_modeus/internal/metrics"
+	"bot_for_modeus/pkg/tracing"
 	"bytes"
+	"context"
+	"errors"
 	"github.com/bytedance/sonic"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 	"unsafe"
 )
 
 type Parser interface {
-	FindStudents(fullName string) ([]Student, error)
-	FindStudentById(scheduleId string) (Student, error)
+	FindStudents(ctx context.Context, fullName string) ([]Student, error)
+	FindStudentById(ctx context.Context, scheduleId string) (Student, error)
 
-	DaySchedule(scheduleId string, now time.Time) ([]Lesson, error)
-	WeekSchedule(scheduleId string, now time.Time) (map[int][]Lesson, error)
-	DayGrades(day time.Time, gi GradesInput) ([]DayGrades, error)
+	DaySchedule(ctx context.Context, scheduleId string, now time.Time) ([]Lesson, error)
+	WeekSchedule(ctx context.Context, scheduleId string, now time.Time) (map[int][]Lesson, error)
+	DayGrades(ctx context.Context, day time.Time, gi GradesInput) ([]DayGrades, error)
 
-	SemesterTotalGrades(gi GradesInput, semester Semester) ([]SubjectGrades, error)
-	Ratings(gi GradesInput) (string, []SemesterRatings, error)
+	SemesterTotalGrades(ctx context.Context, gi GradesInput, semester Semester) ([]SubjectGrades, error)
+	Ratings(ctx context.Context, gi GradesInput) (string, []SemesterRatings, error)
 
-	FindCurrentSemester(gi GradesInput) (Semester, error)
-	FindAllSemesters(gi GradesInput) ([]Semester, error)
+	FindCurrentSemester(ctx context.Context, gi GradesInput) (Semester, error)
+	FindAllSemesters(ctx context.Context, gi GradesInput) ([]Semester, error)
 
-	FindSemesterSubjects(gi GradesInput, semester Semester) (map[string]string, error)
-	SubjectDetailedInfo(gi GradesInput, semester Semester, subjectId string) ([]LessonGrades, error)
+	FindSemesterSubjects(ctx context.Context, gi GradesInput, semester Semester) (map[string]string, error)
+	SubjectDetailedInfo(ctx context.Context, gi GradesInput, semester Semester, subjectId string) ([]LessonGrades, error)
 
-	FindBuildings() ([]Building, error)
+	FindBuildings(ctx context.Context) ([]Building, error)
 
-	DeleteToken(login string) error
+	Tokens
+
+	// Ping проверяет, что сервис парсера отвечает. Модеус при этом не запрашивается
+	Ping(ctx context.Context) error
 }
 
 const (
@@ -55,39 +68,86 @@ func NewParserService(host string) Parser {
 	}
 }
 
-func (p *parser) makeRequest(method, uri string, v any) (*http.Response, error) {
+var tracer = otel.Tracer("bot_for_modeus/internal/parser")
+
+func (p *parser) makeRequest(ctx context.Context, method, uri string, v any) (resp *http.Response, err error) {
+	// В названии и атрибутах спана только путь без query: в query бывают ФИО и id студентов
+	path, _, _ := strings.Cut(uri, "?")
+	ctx, span := tracer.Start(ctx, "parser "+method+" "+path, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", method),
+			attribute.String("url.path", path),
+		))
+	start := time.Now()
+	defer func() {
+		metrics.ParserRequestDuration(path, time.Since(start))
+		if err != nil {
+			metrics.ParserError(path, errorClass(err))
+		}
+		tracing.End(span, err)
+	}()
+
+	resp, err = p.doRequest(ctx, method, uri, v)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	return resp, nil
+}
+
+func (p *parser) doRequest(ctx context.Context, method, uri string, v any) (*http.Response, error) {
 	body, err := sonic.Marshal(v)
 	if err != nil {
 		log.Err(err).Msg("parser/makeRequest error marshal input body") // тут тело запроса логировать небезопасно
 		return nil, err
 	}
 
-	r, err := http.NewRequest(method, p.host+uri, bytes.NewBuffer(body))
+	r, err := http.NewRequestWithContext(ctx, method, p.host+uri, bytes.NewBuffer(body))
 	if err != nil {
 		log.Err(err).Str("method", method).Str("uri", uri).Msg("parser/makeRequest error init request")
 		return nil, err
 	}
 	r.Header.Set("Content-Type", "application/json")
+	// Передаем контекст трассировки в сервис парсера (заголовок traceparent), чтобы его спаны попали в тот же трейс
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
 
 	resp, err := p.client.Do(r)
 	if err != nil {
 		// логируем все ошибки, даже типовые
 		log.Err(err).Str("method", method).Str("uri", uri).Msg("parser/makeRequest error make http request")
+		// Ошибки retry (модеус недоступен, неверный пароль) уже типизированы, остальные - сетевые
+		if apperrs.KindOf(err) == apperrs.KindInternal {
+			return nil, ErrRequestFailed.Wrap(err)
+		}
 		return nil, err
 	}
 	return resp, nil
 }
 
+// Для проверки доступности достаточно любого http ответа, поэтому запрос идет в корень и без повторов
+func (p *parser) Ping(ctx context.Context) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, p.host+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
 func parseBody(r *http.Response, v any) error {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Err(err).Msg("parser/parseBody error read response body")
-		return err
+		return ErrRequestFailed.Wrap(err)
 	}
 	_ = r.Body.Close()
 	if err = sonic.UnmarshalString(b2s(body), v); err != nil {
 		log.Err(err).Msg("parser/parseBody error unmarshal body to struct")
-		return err
+		return ErrBadResponse.Wrap(err)
 	}
 	return nil
 }
@@ -96,6 +156,25 @@ func b2s(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
+// errorClass возвращает класс ошибки для метрик. Ошибки клиента (*url.Error) оборачивают исходные, поэтому проверяем через errors.Is
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, ErrIncorrectLoginPassword):
+		return "incorrect_login_password"
+	case errors.Is(err, ErrTokenExpired):
+		return "token_expired"
+	case errors.Is(err, ErrModeusUnavailable):
+		return "modeus_unavailable"
+	case errors.Is(err, ErrParserUnavailable):
+		return "parser_unavailable"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "transport"
+}
+
 type retry struct {
 	next    http.RoundTripper
 	retries int
@@ -104,10 +183,14 @@ type retry struct {
 
 func (rt *retry) RoundTrip(r *http.Request) (resp *http.Response, err error) {
 	for i := 0; i < rt.retries; i++ {
+		if i > 0 {
+			metrics.ParserRetry(r.URL.Path)
+		}
 		resp, err = rt.next.RoundTrip(r)
 		if err != nil {
 			return nil, err
 		}
+		metrics.ParserResponse(r.URL.Path, resp.StatusCode)
 
 		switch resp.StatusCode {
 		case http.StatusOK, http.StatusBadRequest:
@@ -116,6 +199,9 @@ func (rt *retry) RoundTrip(r *http.Request) (resp *http.Response, err error) {
 		case http.StatusForbidden:
 			return nil, ErrIncorrectLoginPassword
 
+		case http.StatusUnauthorized:
+			return nil, ErrTokenExpired
+
 		case http.StatusServiceUnavailable:
 			return nil, ErrModeusUnavailable
 
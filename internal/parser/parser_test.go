@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_retry_RoundTrip(t *testing.T) {
+	testCases := []struct {
+		testName      string
+		statuses      []int
+		expectCalls   int
+		expectStatus  int
+		expectErr     error
+		expectErrKind string
+	}{
+		{
+			testName:     "ok",
+			statuses:     []int{http.StatusOK},
+			expectCalls:  1,
+			expectStatus: http.StatusOK,
+		},
+		{
+			testName:     "bad request is not retried",
+			statuses:     []int{http.StatusBadRequest},
+			expectCalls:  1,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			testName:     "retry after internal error",
+			statuses:     []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK},
+			expectCalls:  3,
+			expectStatus: http.StatusOK,
+		},
+		{
+			testName:      "incorrect login or password",
+			statuses:      []int{http.StatusForbidden},
+			expectCalls:   1,
+			expectErr:     ErrIncorrectLoginPassword,
+			expectErrKind: "incorrect_login_password",
+		},
+		{
+			testName:      "token expired",
+			statuses:      []int{http.StatusUnauthorized},
+			expectCalls:   1,
+			expectErr:     ErrTokenExpired,
+			expectErrKind: "token_expired",
+		},
+		{
+			testName:      "modeus unavailable",
+			statuses:      []int{http.StatusServiceUnavailable},
+			expectCalls:   1,
+			expectErr:     ErrModeusUnavailable,
+			expectErrKind: "modeus_unavailable",
+		},
+		{
+			testName:      "retries exceeded",
+			statuses:      []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			expectCalls:   3,
+			expectErr:     ErrParserUnavailable,
+			expectErrKind: "parser_unavailable",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			var calls int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.statuses[calls])
+				calls++
+			}))
+			defer server.Close()
+
+			p := &parser{
+				host:   server.URL,
+				client: &http.Client{Transport: &retry{next: http.DefaultTransport, retries: defaultRetryCount}},
+			}
+			resp, err := p.makeRequest(context.Background(), http.MethodGet, findScheduleUri, nil)
+
+			assert.Equal(t, tc.expectCalls, calls)
+			if tc.expectErr != nil {
+				assert.True(t, errors.Is(err, tc.expectErr), fmt.Sprintf("unexpected error: %v", err))
+				assert.Equal(t, tc.expectErrKind, errorClass(err))
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectStatus, resp.StatusCode)
+		})
+	}
+}
+
+func Test_errorClass(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := &parser{host: "http://127.0.0.1:1", client: http.DefaultClient}
+	_, err := p.makeRequest(ctx, http.MethodGet, findScheduleUri, nil)
+	assert.Equal(t, "canceled", errorClass(err))
+
+	_, err = p.makeRequest(context.Background(), http.MethodGet, findScheduleUri, nil)
+	assert.Equal(t, "transport", errorClass(err))
+}
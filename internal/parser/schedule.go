@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"context"
 	"net/http"
 	"time"
 )
@@ -26,22 +27,22 @@ type scheduleRequest struct {
 	ScheduleId string    `json:"schedule_id"`
 }
 
-func (p *parser) DaySchedule(scheduleId string, now time.Time) ([]Lesson, error) {
-	return p.parseSchedule(scheduleRequest{
+func (p *parser) DaySchedule(ctx context.Context, scheduleId string, now time.Time) ([]Lesson, error) {
+	return p.parseSchedule(ctx, scheduleRequest{
 		Start:      time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()),
 		End:        time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()),
 		ScheduleId: scheduleId,
 	})
 }
 
-func (p *parser) WeekSchedule(scheduleId string, now time.Time) (map[int][]Lesson, error) {
+func (p *parser) WeekSchedule(ctx context.Context, scheduleId string, now time.Time) (map[int][]Lesson, error) {
 	start := now.Day() - int(now.Weekday()) + 1
 	input := scheduleRequest{
 		Start:      time.Date(now.Year(), now.Month(), start, 0, 0, 0, 0, now.Location()),
 		End:        time.Date(now.Year(), now.Month(), start+6, 0, 0, 0, 0, now.Location()),
 		ScheduleId: scheduleId,
 	}
-	schedule, err := p.parseSchedule(input)
+	schedule, err := p.parseSchedule(ctx, input)
 	if err != nil {
 		return nil, err
 	}
@@ -60,8 +61,8 @@ func (p *parser) WeekSchedule(scheduleId string, now time.Time) (map[int][]Lesso
 	return result, nil
 }
 
-func (p *parser) parseSchedule(input scheduleRequest) ([]Lesson, error) {
-	resp, err := p.makeRequest(http.MethodPost, findScheduleUri, input)
+func (p *parser) parseSchedule(ctx context.Context, input scheduleRequest) ([]Lesson, error) {
+	resp, err := p.makeRequest(ctx, http.MethodPost, findScheduleUri, input)
 	if err != nil {
 		return nil, err
 	}
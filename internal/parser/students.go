@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 )
@@ -18,10 +19,10 @@ type Student struct {
 	GradesId         string `json:"grades_id"`         // Id для поиска оценок
 }
 
-func (p *parser) FindStudents(fullName string) ([]Student, error) {
+func (p *parser) FindStudents(ctx context.Context, fullName string) ([]Student, error) {
 	uri := fmt.Sprintf("%s?full_name=%s", findStudentsUri, fullName)
 
-	resp, err := p.makeRequest(http.MethodGet, uri, nil)
+	resp, err := p.makeRequest(ctx, http.MethodGet, uri, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -36,10 +37,10 @@ func (p *parser) FindStudents(fullName string) ([]Student, error) {
 	return result, nil
 }
 
-func (p *parser) FindStudentById(scheduleId string) (Student, error) {
+func (p *parser) FindStudentById(ctx context.Context, scheduleId string) (Student, error) {
 	uri := fmt.Sprintf("%s?schedule_id=%s", findStudentsUri, scheduleId)
 
-	resp, err := p.makeRequest(http.MethodGet, uri, nil)
+	resp, err := p.makeRequest(ctx, http.MethodGet, uri, nil)
 	if err != nil {
 		return Student{}, err
 	}
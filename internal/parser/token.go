@@ -1,25 +1,82 @@
 package parser
 
 import (
+	"bot_for_modeus/pkg/secret"
+	"context"
 	"fmt"
 	"net/http"
+	"time"
 )
 
 const (
-	deleteTokenUri = "/token"
+	tokenUri        = "/token"
+	refreshTokenUri = "/token/refresh"
 )
 
+// Tokens - работа с токенами сессий модеуса. Логин и пароль передаются парсеру один раз в обмен на токен,
+// дальше запросы оценок идут с токеном (см. GradesInput)
+type Tokens interface {
+	CreateToken(ctx context.Context, login string, password secret.String) (Token, error)
+	// RefreshToken продлевает действующий токен. Для истекшего возвращает ErrTokenExpired
+	RefreshToken(ctx context.Context, token secret.String) (Token, error)
+	DeleteToken(ctx context.Context, login string) error
+}
+
+type Token struct {
+	Token     secret.String `json:"token"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+type createTokenRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+type refreshTokenRequest struct {
+	Token string `json:"token"`
+}
+
 type deleteTokenRequest struct {
 	Login string `json:"login"`
 }
 
-func (p *parser) DeleteToken(login string) error {
-	resp, err := p.makeRequest(http.MethodDelete, deleteTokenUri, deleteTokenRequest{Login: login})
+func (p *parser) CreateToken(ctx context.Context, login string, password secret.String) (Token, error) {
+	resp, err := p.makeRequest(ctx, http.MethodPost, tokenUri, createTokenRequest{Login: login, Password: password.Reveal()})
+	if err != nil {
+		return Token{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Token{}, ErrBadResponse.Wrap(fmt.Errorf("parser/CreateToken unexpected code: %d", resp.StatusCode))
+	}
+	var t Token
+	if err = parseBody(resp, &t); err != nil {
+		return Token{}, err
+	}
+	return t, nil
+}
+
+func (p *parser) RefreshToken(ctx context.Context, token secret.String) (Token, error) {
+	resp, err := p.makeRequest(ctx, http.MethodPost, refreshTokenUri, refreshTokenRequest{Token: token.Reveal()})
+	if err != nil {
+		return Token{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Token{}, ErrBadResponse.Wrap(fmt.Errorf("parser/RefreshToken unexpected code: %d", resp.StatusCode))
+	}
+	var t Token
+	if err = parseBody(resp, &t); err != nil {
+		return Token{}, err
+	}
+	return t, nil
+}
+
+func (p *parser) DeleteToken(ctx context.Context, login string) error {
+	resp, err := p.makeRequest(ctx, http.MethodDelete, tokenUri, deleteTokenRequest{Login: login})
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("parser/DeleteToken unexpected code: %d", resp.StatusCode)
+		return ErrBadResponse.Wrap(fmt.Errorf("parser/DeleteToken unexpected code: %d", resp.StatusCode))
 	}
 	return nil
 }
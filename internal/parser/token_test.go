@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_parser_CreateToken(t *testing.T) {
+	expiresAt := time.Date(2024, time.September, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		testName    string
+		status      int
+		body        string
+		expectToken Token
+		expectErr   error
+	}{
+		{
+			testName:    "correct test",
+			status:      http.StatusOK,
+			body:        `{"token":"abc","expires_at":"2024-09-01T12:00:00Z"}`,
+			expectToken: Token{Token: "abc", ExpiresAt: expiresAt},
+		},
+		{
+			testName:  "incorrect login or password",
+			status:    http.StatusForbidden,
+			expectErr: ErrIncorrectLoginPassword,
+		},
+		{
+			testName:  "bad response",
+			status:    http.StatusOK,
+			body:      `not a json`,
+			expectErr: ErrBadResponse,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, tokenUri, r.URL.Path)
+				assert.JSONEq(t, `{"login":"login","password":"password"}`, string(body))
+
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			p := &parser{
+				host:   server.URL,
+				client: &http.Client{Transport: &retry{next: http.DefaultTransport, retries: defaultRetryCount}},
+			}
+			token, err := p.CreateToken(context.Background(), "login", "password")
+
+			assert.True(t, errors.Is(err, tc.expectErr), fmt.Sprintf("unexpected error: %v", err))
+			assert.Equal(t, tc.expectToken, token)
+		})
+	}
+}
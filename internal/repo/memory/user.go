@@ -0,0 +1,189 @@
+package memory
+
+import (
+	"bot_for_modeus/internal/model/dbmodel"
+	"bot_for_modeus/internal/repo/repoerrs"
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// UserRepo хранит пользователей в памяти процесса. Нужен для тестов и локального запуска без базы,
+// ведет себя так же, как mongodb.UserRepo, включая ошибки repoerrs
+type UserRepo struct {
+	sync.RWMutex
+	users map[int64]dbmodel.User
+}
+
+func NewUserRepo() *UserRepo {
+	return &UserRepo{
+		users: make(map[int64]dbmodel.User),
+	}
+}
+
+func (r *UserRepo) Create(_ context.Context, u dbmodel.User) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.users[u.UserId]; ok {
+		return repoerrs.ErrAlreadyExists
+	}
+	r.users[u.UserId] = clone(u)
+	return nil
+}
+
+func (r *UserRepo) Upsert(_ context.Context, u dbmodel.User) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	existing, ok := r.users[u.UserId]
+	if !ok {
+		r.users[u.UserId] = dbmodel.User{
+			UserId:     u.UserId,
+			FullName:   u.FullName,
+			ScheduleId: u.ScheduleId,
+			GradesId:   u.GradesId,
+			Friends:    []dbmodel.Friend{},
+		}
+		return true, nil
+	}
+	existing.FullName, existing.ScheduleId, existing.GradesId = u.FullName, u.ScheduleId, u.GradesId
+	r.users[u.UserId] = existing
+	return false, nil
+}
+
+func (r *UserRepo) FindById(_ context.Context, id int64) (dbmodel.User, error) {
+	r.RLock()
+	defer r.RUnlock()
+	u, ok := r.users[id]
+	if !ok {
+		return dbmodel.User{}, repoerrs.ErrNotFound
+	}
+	return clone(u), nil
+}
+
+// update изменяет пользователя под блокировкой. fn получает копию, поэтому пользователь, которого fn
+// изменил частично или вернул ошибку, не сохраняется
+func (r *UserRepo) update(id int64, fn func(u *dbmodel.User) error) error {
+	r.Lock()
+	defer r.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return repoerrs.ErrNotFound
+	}
+	u = clone(u)
+	if err := fn(&u); err != nil {
+		return err
+	}
+	r.users[id] = u
+	return nil
+}
+
+func (r *UserRepo) SetCredentials(_ context.Context, id int64, c dbmodel.Credentials) error {
+	return r.update(id, func(u *dbmodel.User) error {
+		u.Login, u.Token, u.TokenExpiresAt, u.Password = c.Login, c.Token, c.TokenExpiresAt, ""
+		return nil
+	})
+}
+
+func (r *UserRepo) SetProfile(_ context.Context, id int64, p dbmodel.Profile) error {
+	return r.update(id, func(u *dbmodel.User) error {
+		u.FullName, u.ScheduleId, u.GradesId = p.FullName, p.ScheduleId, p.GradesId
+		return nil
+	})
+}
+
+func (r *UserRepo) AddFriend(_ context.Context, id int64, f dbmodel.Friend, limit int) error {
+	return r.update(id, func(u *dbmodel.User) error {
+		if slices.ContainsFunc(u.Friends, func(e dbmodel.Friend) bool { return e.ScheduleId == f.ScheduleId }) {
+			return repoerrs.ErrAlreadyExists
+		}
+		if len(u.Friends) >= limit {
+			return repoerrs.ErrLimitExceeded
+		}
+		u.Friends = append(u.Friends, f)
+		return nil
+	})
+}
+
+func (r *UserRepo) RemoveFriend(_ context.Context, id int64, friendId string) error {
+	return r.update(id, func(u *dbmodel.User) error {
+		u.Friends = slices.DeleteFunc(u.Friends, func(f dbmodel.Friend) bool {
+			return f.Id == friendId
+		})
+		return nil
+	})
+}
+
+func (r *UserRepo) RenameFriend(_ context.Context, id int64, friendId, nickname string) error {
+	return r.update(id, func(u *dbmodel.User) error {
+		i := slices.IndexFunc(u.Friends, func(f dbmodel.Friend) bool { return f.Id == friendId })
+		if i < 0 {
+			return repoerrs.ErrNotFound
+		}
+		u.Friends[i].Nickname = nickname
+		return nil
+	})
+}
+
+func (r *UserRepo) MoveFriend(_ context.Context, id int64, friendId string, position int) error {
+	return r.update(id, func(u *dbmodel.User) error {
+		friends, ok := dbmodel.MoveFriend(u.Friends, friendId, position)
+		if !ok {
+			return repoerrs.ErrNotFound
+		}
+		u.Friends = friends
+		return nil
+	})
+}
+
+func (r *UserRepo) SetSettings(_ context.Context, id int64, s dbmodel.Settings) error {
+	return r.update(id, func(u *dbmodel.User) error {
+		if len(s) == 0 {
+			u.Settings = nil
+			return nil
+		}
+		u.Settings = maps.Clone(s)
+		return nil
+	})
+}
+
+func (r *UserRepo) Delete(_ context.Context, id int64) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.users[id]; !ok {
+		return repoerrs.ErrNotFound
+	}
+	delete(r.users, id)
+	return nil
+}
+
+// ForEach обходит снимок пользователей по возрастанию id, поэтому fn может изменять репозиторий
+func (r *UserRepo) ForEach(ctx context.Context, fn func(u dbmodel.User) error) error {
+	r.RLock()
+	users := make([]dbmodel.User, 0, len(r.users))
+	for _, u := range r.users {
+		users = append(users, clone(u))
+	}
+	r.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserId < users[j].UserId
+	})
+	for _, u := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clone копирует слайсы и мапы, чтобы вызывающий не мог изменить данные репозитория в обход методов
+func clone(u dbmodel.User) dbmodel.User {
+	u.Friends = slices.Clone(u.Friends)
+	u.Settings = maps.Clone(u.Settings)
+	return u
+}
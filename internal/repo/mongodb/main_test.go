@@ -23,6 +23,9 @@ func (s *mongodbTestSuite) SetupTest() {
 	}
 	s.mongo = mongodb
 	s.ctx = ctx
+	if _, err = Migrate(ctx, mongodb); err != nil {
+		panic(err)
+	}
 
 	s.user = NewUserRepo(mongodb)
 }
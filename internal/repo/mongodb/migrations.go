@@ -0,0 +1,245 @@
+package mongodb
+
+import (
+	"bot_for_modeus/internal/model/dbmodel"
+	"bot_for_modeus/pkg/mongo"
+	"bot_for_modeus/pkg/tracing"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const (
+	migrationsCollection = "migrations"
+	// Удаленные миграцией uniqueUserId дубликаты пользователей. Хранятся целиком, чтобы их можно было восстановить вручную
+	userDuplicatesCollection = "user_duplicates"
+)
+
+// Migration - изменение схемы бд. Up должен быть идемпотентным: несколько инстансов могут запуститься одновременно,
+// а упавшая на середине миграция повторяется при следующем запуске целиком
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mgo.Database) error
+}
+
+// Примененные версии хранятся в коллекции migrations, по одному документу на версию
+type migrationRecord struct {
+	Version     int       `bson:"version"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// Миграции применяются по возрастанию версии. Уже выпущенные миграции не меняются, только добавляются новые
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "unique index on user.user_id",
+		Up:          uniqueUserId,
+	},
+	{
+		Version:     2,
+		Description: "empty friends for users without friends field",
+		Up:          defaultFriends,
+	},
+	{
+		Version:     3,
+		Description: "friend ids and no duplicate friends",
+		Up:          friendIds,
+	},
+}
+
+// Migrate применяет еще не примененные миграции и возвращает их количество
+func Migrate(ctx context.Context, m *mongo.Mongo) (int, error) {
+	return migrate(ctx, m.Database(), migrations)
+}
+
+func migrate(ctx context.Context, db *mgo.Database, migrations []Migration) (applied int, err error) {
+	ctx, span := tracer.Start(ctx, "mongodb migrate")
+	defer func() { tracing.End(span, err) }()
+
+	coll := db.Collection(migrationsCollection)
+	_, err = coll.Indexes().CreateOne(ctx, mgo.IndexModel{
+		Keys:    bson.D{{Key: "version", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("create migrations index: %w", err)
+	}
+
+	done, err := appliedVersions(ctx, coll)
+	if err != nil {
+		return 0, err
+	}
+	for _, mg := range migrations {
+		if _, ok := done[mg.Version]; ok {
+			continue
+		}
+		if err = mg.Up(ctx, db); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", mg.Version, mg.Description, err)
+		}
+		_, err = coll.InsertOne(ctx, migrationRecord{
+			Version:     mg.Version,
+			Description: mg.Description,
+			AppliedAt:   time.Now(),
+		})
+		if err != nil {
+			// Ту же миграцию успел записать другой инстанс, она не считается примененной этим
+			if mgo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return applied, fmt.Errorf("record migration %d: %w", mg.Version, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+func appliedVersions(ctx context.Context, coll *mgo.Collection) (map[int]struct{}, error) {
+	cur, err := coll.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	done := make(map[int]struct{})
+	for cur.Next(ctx) {
+		var r migrationRecord
+		if err := cur.Decode(&r); err != nil {
+			return nil, err
+		}
+		done[r.Version] = struct{}{}
+	}
+	return done, cur.Err()
+}
+
+// uniqueUserId удаляет дубликаты пользователей, которые могли появиться при одновременной регистрации,
+// и создает уникальный индекс. Из дубликатов остается самый старый документ, остальные перед удалением
+// копируются в коллекцию user_duplicates и пишутся в лог
+func uniqueUserId(ctx context.Context, db *mgo.Database) error {
+	coll := db.Collection(userCollection)
+	cur, err := coll.Aggregate(ctx, mgo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$user_id"},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var dup struct {
+			UserId int64 `bson:"_id"`
+			Ids    []any `bson:"ids"`
+		}
+		if err := cur.Decode(&dup); err != nil {
+			return err
+		}
+		if err := removeDuplicateUsers(ctx, db, dup.UserId, dup.Ids[1:]); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	_, err = coll.Indexes().CreateOne(ctx, mgo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// removeDuplicateUsers копирует документы в user_duplicates и только потом удаляет их из users.
+// Копии с тем же _id уже могли сохраниться при прошлом, упавшем запуске, поэтому ошибки дубликатов игнорируются
+func removeDuplicateUsers(ctx context.Context, db *mgo.Database, userId int64, ids []any) error {
+	coll := db.Collection(userCollection)
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}
+
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var docs []bson.Raw
+	if err = cur.All(ctx, &docs); err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	backup := make([]any, 0, len(docs))
+	for _, d := range docs {
+		backup = append(backup, d)
+	}
+	_, err = db.Collection(userDuplicatesCollection).InsertMany(ctx, backup, options.InsertMany().SetOrdered(false))
+	if err != nil && !mgo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("backup duplicate users: %w", err)
+	}
+
+	if _, err = coll.DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+	log.Warn().Int64("user_id", userId).Interface("removed_ids", ids).Str("backup", userDuplicatesCollection).
+		Msg("mongodb/uniqueUserId removed duplicate users")
+	return nil
+}
+
+// defaultFriends проставляет пустой список друзей старым записям, чтобы $push и $pull работали без проверок на null
+func defaultFriends(ctx context.Context, db *mgo.Database) error {
+	_, err := db.Collection(userCollection).UpdateMany(ctx,
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "friends", Value: bson.D{{Key: "$exists", Value: false}}}},
+			bson.D{{Key: "friends", Value: nil}},
+		}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "friends", Value: bson.A{}}}}},
+	)
+	return err
+}
+
+// friendIds выдает id друзьям из старых записей и удаляет повторно добавленных друзей (первый остается).
+// Документы с уже выданными id не подходят под фильтр, поэтому повторный запуск их не трогает
+func friendIds(ctx context.Context, db *mgo.Database) error {
+	coll := db.Collection(userCollection)
+	cur, err := coll.Find(ctx, bson.D{{Key: "friends", Value: bson.D{
+		{Key: "$elemMatch", Value: bson.D{{Key: "id", Value: bson.D{{Key: "$exists", Value: false}}}}},
+	}}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var u dbmodel.User
+		if err := cur.Decode(&u); err != nil {
+			return err
+		}
+		friends := make([]dbmodel.Friend, 0, len(u.Friends))
+		seen := make(map[string]struct{}, len(u.Friends))
+		for _, f := range u.Friends {
+			if _, ok := seen[f.ScheduleId]; ok {
+				continue
+			}
+			seen[f.ScheduleId] = struct{}{}
+			if f.Id == "" {
+				f.Id = uuid.NewString()
+			}
+			friends = append(friends, f)
+		}
+		_, err := coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: cur.Current.Lookup("_id")}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "friends", Value: friends}}}})
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
@@ -0,0 +1,120 @@
+package mongodb
+
+import (
+	"bot_for_modeus/internal/model/dbmodel"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+)
+
+func (s *mongodbTestSuite) TestMigrate() {
+	// SetupTest уже применил миграции, начинаем с пустой бд
+	s.Require().Nil(s.mongo.Drop(s.ctx))
+
+	db := s.mongo.Database()
+	users := db.Collection(userCollection)
+	_, err := users.InsertMany(s.ctx, []any{
+		bson.D{{"user_id", int64(1)}, {"full_name", "first"}},
+		bson.D{{"user_id", int64(1)}, {"full_name", "duplicate"}},
+		bson.D{{"user_id", int64(2)}, {"full_name", "null friends"}, {"friends", nil}},
+		bson.D{{"user_id", int64(3)}, {"full_name", "old friends"}, {"friends", bson.A{
+			bson.D{{"full_name", "petya"}, {"schedule_id", "abc"}},
+			bson.D{{"full_name", "vasya"}, {"schedule_id", "def"}},
+			bson.D{{"full_name", "petya again"}, {"schedule_id", "abc"}},
+		}}},
+	})
+	s.Require().Nil(err)
+
+	applied, err := Migrate(s.ctx, s.mongo)
+	s.Assert().Nil(err)
+	s.Assert().Equal(len(migrations), applied)
+
+	count, err := users.CountDocuments(s.ctx, bson.D{{"user_id", int64(1)}})
+	s.Assert().Nil(err)
+	s.Assert().Equal(int64(1), count)
+
+	user, err := s.user.FindById(s.ctx, 1)
+	s.Assert().Nil(err)
+	s.Assert().Equal("first", user.FullName)
+
+	// удаленный дубликат сохранен целиком
+	var backup struct {
+		UserId   int64  `bson:"user_id"`
+		FullName string `bson:"full_name"`
+	}
+	s.Assert().Nil(db.Collection(userDuplicatesCollection).FindOne(s.ctx, bson.D{{"user_id", int64(1)}}).Decode(&backup))
+	s.Assert().Equal("duplicate", backup.FullName)
+	s.Assert().Equal([]dbmodel.Friend{}, user.Friends)
+
+	user, err = s.user.FindById(s.ctx, 2)
+	s.Assert().Nil(err)
+	s.Assert().Equal([]dbmodel.Friend{}, user.Friends)
+
+	// у старых друзей появились id, повторно добавленный друг удален
+	user, err = s.user.FindById(s.ctx, 3)
+	s.Assert().Nil(err)
+	s.Require().Len(user.Friends, 2)
+	s.Assert().Equal("petya", user.Friends[0].FullName)
+	s.Assert().Equal("vasya", user.Friends[1].FullName)
+	s.Assert().NotEmpty(user.Friends[0].Id)
+	s.Assert().NotEmpty(user.Friends[1].Id)
+	s.Assert().NotEqual(user.Friends[0].Id, user.Friends[1].Id)
+
+	count, err = db.Collection(migrationsCollection).CountDocuments(s.ctx, bson.D{})
+	s.Assert().Nil(err)
+	s.Assert().Equal(int64(len(migrations)), count)
+
+	// Повторный запуск ничего не применяет
+	applied, err = Migrate(s.ctx, s.mongo)
+	s.Assert().Nil(err)
+	s.Assert().Equal(0, applied)
+}
+
+func (s *mongodbTestSuite) TestMigrate_Failed() {
+	upErr := errors.New("up error")
+	var calls int
+	failing := []Migration{
+		{
+			Version: 100,
+			Up: func(ctx context.Context, db *mgo.Database) error {
+				calls++
+				return nil
+			},
+		},
+		{
+			Version: 101,
+			Up: func(ctx context.Context, db *mgo.Database) error {
+				return upErr
+			},
+		},
+	}
+
+	applied, err := migrate(s.ctx, s.mongo.Database(), failing)
+	s.Assert().ErrorIs(err, upErr)
+	s.Assert().Equal(1, applied)
+
+	// Примененная версия не повторяется, упавшая запускается снова
+	applied, err = migrate(s.ctx, s.mongo.Database(), failing)
+	s.Assert().ErrorIs(err, upErr)
+	s.Assert().Equal(0, applied)
+	s.Assert().Equal(1, calls)
+}
+
+func (s *mongodbTestSuite) TestMigrate_RecordedByOtherInstance() {
+	db := s.mongo.Database()
+	concurrent := []Migration{
+		{
+			Version: 200,
+			// Другой инстанс применил и записал ту же миграцию, пока эта выполнялась
+			Up: func(ctx context.Context, db *mgo.Database) error {
+				_, err := db.Collection(migrationsCollection).InsertOne(ctx, migrationRecord{Version: 200})
+				return err
+			},
+		},
+	}
+
+	applied, err := migrate(s.ctx, db, concurrent)
+	s.Assert().Nil(err)
+	s.Assert().Equal(0, applied)
+}
@@ -2,59 +2,249 @@ package mongodb
 
 import (
 	"bot_for_modeus/internal/model/dbmodel"
-	"bot_for_modeus/internal/repo/mongoerrs"
+	"bot_for_modeus/internal/repo/repoerrs"
 	"bot_for_modeus/pkg/mongo"
+	"bot_for_modeus/pkg/tracing"
 	"context"
 	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	mgo "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"slices"
 )
 
+var tracer = otel.Tracer("bot_for_modeus/internal/repo/mongodb")
+
+const userCollection = "user"
+
+// Сколько раз MoveFriend перечитывает список друзей, если его одновременно изменили
+const moveFriendAttempts = 3
+
+// errConcurrentUpdate - документ постоянно изменяется другими запросами, и обновить его не удалось
+var errConcurrentUpdate = errors.New("concurrent update")
+
+// Атрибуты спанов по соглашениям OpenTelemetry для баз данных. Сам запрос не пишем: в нем бывают зашифрованные пароли
+func startSpan(ctx context.Context, operation string, userId int64) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "mongodb "+operation+" "+userCollection, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.operation", operation),
+			attribute.String("db.mongodb.collection", userCollection),
+			attribute.Int64("user_id", userId),
+		))
+}
+
 type UserRepo struct {
 	pool mongo.Pool
 }
 
 func NewUserRepo(mongo *mongo.Mongo) *UserRepo {
-	return &UserRepo{mongo.Collection("user")}
+	return &UserRepo{mongo.Collection(userCollection)}
 }
 
-func (r *UserRepo) Create(ctx context.Context, u dbmodel.User) error {
+func (r *UserRepo) Create(ctx context.Context, u dbmodel.User) (err error) {
+	ctx, span := startSpan(ctx, "insert", u.UserId)
+	defer func() { tracing.End(span, err) }()
+
 	if _, err := r.pool.InsertOne(ctx, u); err != nil {
+		// Уникальный индекс по user_id создается миграцией (см. Migrate)
+		if mgo.IsDuplicateKeyError(err) {
+			return repoerrs.ErrAlreadyExists
+		}
 		return err
 	}
 	return nil
 }
 
-func (r *UserRepo) FindById(ctx context.Context, id int64) (dbmodel.User, error) {
+// Upsert не трогает учетные данные и друзей существующего пользователя, у нового список друзей пустой.
+// Одновременные upsert одного user_id не создают дубликатов благодаря уникальному индексу (см. Migrate)
+func (r *UserRepo) Upsert(ctx context.Context, u dbmodel.User) (created bool, err error) {
+	ctx, span := startSpan(ctx, "upsert", u.UserId)
+	defer func() { tracing.End(span, err) }()
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "full_name", Value: u.FullName},
+			{Key: "schedule_id", Value: u.ScheduleId},
+			{Key: "grades_id", Value: u.GradesId},
+		}},
+		{Key: "$setOnInsert", Value: bson.D{
+			{Key: "login", Value: ""},
+			{Key: "friends", Value: bson.A{}},
+		}},
+	}
+	filter := bson.D{{Key: "user_id", Value: u.UserId}}
+	opts := options.Update().SetUpsert(true)
+
+	c, err := r.pool.UpdateOne(ctx, filter, update, opts)
+	// Параллельный upsert успел вставить документ: повторяем, теперь это обновление
+	if mgo.IsDuplicateKeyError(err) {
+		c, err = r.pool.UpdateOne(ctx, filter, update, opts)
+	}
+	if err != nil {
+		return false, err
+	}
+	created = c.UpsertedCount > 0
+	span.SetAttributes(attribute.Bool("created", created))
+	return created, nil
+}
+
+func (r *UserRepo) FindById(ctx context.Context, id int64) (_ dbmodel.User, err error) {
+	ctx, span := startSpan(ctx, "findOne", id)
+	defer func() { tracing.End(span, err) }()
+
 	var user dbmodel.User
 
 	if err := r.pool.FindOne(ctx, bson.D{{"user_id", id}}).Decode(&user); err != nil {
 		if errors.Is(err, mgo.ErrNoDocuments) {
-			return dbmodel.User{}, mongoerrs.ErrNotFound
+			return dbmodel.User{}, repoerrs.ErrNotFound
 		}
 		return dbmodel.User{}, err
 	}
 	return user, nil
 }
 
-func (r *UserRepo) Update(ctx context.Context, id int64, data bson.D) error {
-	c, err := r.pool.UpdateOne(ctx, bson.D{{"user_id", id}}, data)
+// update применяет data к пользователю id. Для операций с массивами совпадение без изменений (например, $pull
+// несуществующего друга) не ошибка, поэтому ErrNotFound только если пользователь не найден
+func (r *UserRepo) update(ctx context.Context, id int64, data bson.D) error {
+	return r.updateWhere(ctx, id, nil, data)
+}
+
+// updateWhere как update, но документ дополнительно должен подходить под filter (например, содержать друга).
+// Если подходящего документа нет, возвращает ErrNotFound
+func (r *UserRepo) updateWhere(ctx context.Context, id int64, filter bson.D, data bson.D) (err error) {
+	ctx, span := startSpan(ctx, "update", id)
+	defer func() { tracing.End(span, err) }()
+
+	c, err := r.pool.UpdateOne(ctx, append(bson.D{{Key: "user_id", Value: id}}, filter...), data)
 	if err != nil {
 		return err
 	}
-	if c.MatchedCount == 0 && c.ModifiedCount == 0 {
-		return mongoerrs.ErrNotFound
+	if c.MatchedCount == 0 {
+		return repoerrs.ErrNotFound
 	}
 	return nil
 }
 
-func (r *UserRepo) Delete(ctx context.Context, id int64) error {
+func (r *UserRepo) SetCredentials(ctx context.Context, id int64, c dbmodel.Credentials) error {
+	return r.update(ctx, id, bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "login", Value: c.Login},
+			{Key: "token", Value: c.Token},
+			{Key: "token_expires_at", Value: c.TokenExpiresAt},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "password", Value: ""}}},
+	})
+}
+
+func (r *UserRepo) SetProfile(ctx context.Context, id int64, p dbmodel.Profile) error {
+	return r.update(ctx, id, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "full_name", Value: p.FullName},
+		{Key: "schedule_id", Value: p.ScheduleId},
+		{Key: "grades_id", Value: p.GradesId},
+	}}})
+}
+
+// AddFriend проверяет дубликат и лимит в фильтре, чтобы одновременные добавления не обошли проверки.
+// Если документ не подошел, причину выясняем отдельным запросом
+func (r *UserRepo) AddFriend(ctx context.Context, id int64, f dbmodel.Friend, limit int) error {
+	err := r.updateWhere(ctx, id, bson.D{
+		{Key: "friends.schedule_id", Value: bson.D{{Key: "$ne", Value: f.ScheduleId}}},
+		{Key: fmt.Sprintf("friends.%d", limit-1), Value: bson.D{{Key: "$exists", Value: false}}},
+	}, bson.D{{Key: "$push", Value: bson.D{{Key: "friends", Value: f}}}})
+	if !errors.Is(err, repoerrs.ErrNotFound) {
+		return err
+	}
+
+	u, err := r.FindById(ctx, id)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(u.Friends, func(e dbmodel.Friend) bool { return e.ScheduleId == f.ScheduleId }) {
+		return repoerrs.ErrAlreadyExists
+	}
+	return repoerrs.ErrLimitExceeded
+}
+
+func (r *UserRepo) RemoveFriend(ctx context.Context, id int64, friendId string) error {
+	return r.update(ctx, id, bson.D{{Key: "$pull", Value: bson.D{
+		{Key: "friends", Value: bson.D{{Key: "id", Value: friendId}}},
+	}}})
+}
+
+// Пустое имя удаляется из документа, как при сохранении друга с omitempty, иначе сравнение списков в MoveFriend не совпадет
+func (r *UserRepo) RenameFriend(ctx context.Context, id int64, friendId, nickname string) error {
+	data := bson.D{{Key: "$set", Value: bson.D{{Key: "friends.$.nickname", Value: nickname}}}}
+	if nickname == "" {
+		data = bson.D{{Key: "$unset", Value: bson.D{{Key: "friends.$.nickname", Value: ""}}}}
+	}
+	return r.updateWhere(ctx, id, bson.D{{Key: "friends.id", Value: friendId}}, data)
+}
+
+// MoveFriend переставляет друзей на стороне приложения и сохраняет список, только если он не изменился с момента чтения.
+// Иначе перечитывает и пробует снова
+func (r *UserRepo) MoveFriend(ctx context.Context, id int64, friendId string, position int) error {
+	for i := 0; i < moveFriendAttempts; i++ {
+		u, err := r.FindById(ctx, id)
+		if err != nil {
+			return err
+		}
+		friends, ok := dbmodel.MoveFriend(u.Friends, friendId, position)
+		if !ok {
+			return repoerrs.ErrNotFound
+		}
+		err = r.updateWhere(ctx, id, bson.D{{Key: "friends", Value: u.Friends}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "friends", Value: friends}}}})
+		if !errors.Is(err, repoerrs.ErrNotFound) {
+			return err
+		}
+	}
+	return errConcurrentUpdate
+}
+
+func (r *UserRepo) SetSettings(ctx context.Context, id int64, s dbmodel.Settings) error {
+	if len(s) == 0 {
+		return r.update(ctx, id, bson.D{{Key: "$unset", Value: bson.D{{Key: "settings", Value: ""}}}})
+	}
+	return r.update(ctx, id, bson.D{{Key: "$set", Value: bson.D{{Key: "settings", Value: s}}}})
+}
+
+func (r *UserRepo) Delete(ctx context.Context, id int64) (err error) {
+	ctx, span := startSpan(ctx, "delete", id)
+	defer func() { tracing.End(span, err) }()
+
 	c, err := r.pool.DeleteOne(ctx, bson.D{{"user_id", id}})
 	if err != nil {
 		return err
 	}
 	if c.DeletedCount == 0 {
-		return mongoerrs.ErrNotFound
+		return repoerrs.ErrNotFound
 	}
 	return nil
 }
+
+func (r *UserRepo) ForEach(ctx context.Context, fn func(u dbmodel.User) error) (err error) {
+	ctx, span := startSpan(ctx, "find", 0)
+	defer func() { tracing.End(span, err) }()
+
+	cur, err := r.pool.Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var user dbmodel.User
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
@@ -2,199 +2,87 @@ package mongodb
 
 import (
 	"bot_for_modeus/internal/model/dbmodel"
-	"bot_for_modeus/internal/repo/mongoerrs"
+	"bot_for_modeus/internal/repo/repoerrs"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
-	mgo "go.mongodb.org/mongo-driver/mongo"
+	"sync"
+	"sync/atomic"
 )
 
-func (s *mongodbTestSuite) TestUserRepo_Create() {
-	testCases := []struct {
-		testName  string
-		user      dbmodel.User
-		expectErr error
-	}{
-		{
-			testName: "correct test",
-			user: dbmodel.User{
-				UserId:     1,
-				FullName:   "vasya",
-				Login:      "login",
-				Password:   "password",
-				ScheduleId: "abc",
-				GradesId:   "abc",
-				Friends:    []dbmodel.Friend{},
-			},
-			expectErr: nil,
-		},
-	}
-
-	for _, tc := range testCases {
-		err := s.user.Create(s.ctx, tc.user)
-		s.Assert().Equal(tc.expectErr, err)
-
-		if tc.expectErr == nil {
-			var actualUser dbmodel.User
-			err = s.user.pool.FindOne(s.ctx, bson.D{{"user_id", tc.user.UserId}}).Decode(&actualUser)
+// Общее поведение репозитория проверяется для всех баз в internal/repo (userRepoTestSuite).
+// Здесь только то, что зависит от mongodb: атомарность обновлений и вид документов
+
+func (s *mongodbTestSuite) TestUserRepo_Upsert_Concurrent() {
+	const workers = 10
+
+	var (
+		wg      sync.WaitGroup
+		created atomic.Int32
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := s.user.Upsert(s.ctx, dbmodel.User{UserId: 1, FullName: "vasya"})
 			s.Assert().Nil(err)
-
-			s.Assert().Equal(tc.user, actualUser)
-		}
+			if c {
+				created.Add(1)
+			}
+		}()
 	}
-}
+	wg.Wait()
 
-func (s *mongodbTestSuite) TestUserRepo_FindById() {
-	user := dbmodel.User{
-		UserId:     1,
-		FullName:   "vasya",
-		Login:      "login",
-		Password:   "password",
-		ScheduleId: "abc",
-		GradesId:   "abc",
-		Friends: []dbmodel.Friend{
-			{
-				FullName:   "Иванов Иван Иванович",
-				ScheduleId: "a07bd176-2cea-405a-8f69-baa82c28f089",
-			},
-			{
-				FullName:   "Петров Петр Петрович",
-				ScheduleId: "cecea70d-809b-4b5c-89eb-75de829352ea",
-			},
-		},
-	}
-	if _, err := s.user.pool.InsertOne(s.ctx, user); err != nil {
-		panic(err)
-	}
-
-	testCases := []struct {
-		testName   string
-		userId     int64
-		expectUser dbmodel.User
-		expectErr  error
-	}{
-		{
-			testName:   "correct test",
-			userId:     user.UserId,
-			expectUser: user,
-			expectErr:  nil,
-		},
-		{
-			testName:  "user not exist",
-			userId:    1123123,
-			expectErr: mongoerrs.ErrNotFound,
-		},
-	}
-
-	for _, tc := range testCases {
-		u, err := s.user.FindById(s.ctx, tc.userId)
-		s.Assert().Equal(tc.expectErr, err)
-		s.Assert().Equal(tc.expectUser, u)
-	}
+	s.Assert().Equal(int32(1), created.Load())
+	count, err := s.mongo.Database().Collection(userCollection).CountDocuments(s.ctx, bson.D{{"user_id", int64(1)}})
+	s.Assert().Nil(err)
+	s.Assert().Equal(int64(1), count)
 }
 
-func (s *mongodbTestSuite) TestUserRepo_Update() {
-	user := dbmodel.User{
-		UserId:     1,
-		FullName:   "vasya",
-		Login:      "login",
-		Password:   "password",
-		ScheduleId: "abc",
-		GradesId:   "abc",
-		Friends: []dbmodel.Friend{
-			{
-				FullName:   "Иванов Иван Иванович",
-				ScheduleId: "a07bd176-2cea-405a-8f69-baa82c28f089",
-			},
-			{
-				FullName:   "Петров Петр Петрович",
-				ScheduleId: "cecea70d-809b-4b5c-89eb-75de829352ea",
-			},
-		},
-	}
-	if _, err := s.user.pool.InsertOne(s.ctx, user); err != nil {
-		panic(err)
-	}
-
-	testCases := []struct {
-		testName   string
-		userId     int64
-		update     bson.D
-		expectUser dbmodel.User
-		expectErr  error
-	}{
-		{
-			testName: "correct test",
-			userId:   user.UserId,
-			update:   bson.D{{"$set", bson.D{{"full_name", "petya"}}}},
-			expectUser: dbmodel.User{
-				UserId:     user.UserId,
-				FullName:   "petya",
-				Login:      user.Login,
-				Password:   user.Password,
-				ScheduleId: user.ScheduleId,
-				GradesId:   user.GradesId,
-				Friends:    user.Friends,
-			},
-			expectErr: nil,
-		},
-		{
-			testName:  "user not exist",
-			userId:    13123123,
-			update:    bson.D{{"$set", bson.D{{"full_name", "petya"}}}},
-			expectErr: mongoerrs.ErrNotFound,
-		},
+func (s *mongodbTestSuite) TestUserRepo_AddFriend_Concurrent() {
+	const (
+		workers = 10
+		limit   = 3
+	)
+	_, err := s.user.Upsert(s.ctx, dbmodel.User{UserId: 1, FullName: "vasya"})
+	s.Require().Nil(err)
+
+	var (
+		wg    sync.WaitGroup
+		added atomic.Int32
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.user.AddFriend(s.ctx, 1, dbmodel.Friend{Id: fmt.Sprint(i), ScheduleId: fmt.Sprint(i)}, limit)
+			if err == nil {
+				added.Add(1)
+				return
+			}
+			s.Assert().Equal(repoerrs.ErrLimitExceeded, err)
+		}()
 	}
+	wg.Wait()
 
-	for _, tc := range testCases {
-		err := s.user.Update(s.ctx, tc.userId, tc.update)
-		s.Assert().Equal(tc.expectErr, err)
-
-		if tc.expectErr == nil {
-			var actualUser dbmodel.User
-			err = s.user.pool.FindOne(s.ctx, bson.D{{"user_id", tc.userId}}).Decode(&actualUser)
-			s.Assert().Nil(err)
-			s.Assert().Equal(tc.expectUser, actualUser)
-		}
-	}
+	s.Assert().Equal(int32(limit), added.Load())
+	user, err := s.user.FindById(s.ctx, 1)
+	s.Assert().Nil(err)
+	s.Assert().Len(user.Friends, limit)
 }
 
-func (s *mongodbTestSuite) TestUserRepo_Delete() {
-	user := dbmodel.User{
-		UserId:     1,
-		FullName:   "vasya",
-		Login:      "login",
-		Password:   "password",
-		ScheduleId: "abc",
-		GradesId:   "abc",
-		Friends:    []dbmodel.Friend{},
-	}
-	if _, err := s.user.pool.InsertOne(s.ctx, user); err != nil {
-		panic(err)
-	}
-
-	testCases := []struct {
-		testName  string
-		userId    int64
-		expectErr error
-	}{
-		{
-			testName:  "correct test",
-			userId:    user.UserId,
-			expectErr: nil,
-		},
-		{
-			testName:  "user not exits",
-			userId:    1231231,
-			expectErr: mongoerrs.ErrNotFound,
-		},
-	}
+// Пароль и настройки удаляются из документа ($unset), а не остаются пустыми полями
+func (s *mongodbTestSuite) TestUserRepo_UnsetFields() {
+	_, err := s.user.pool.InsertOne(s.ctx, dbmodel.User{UserId: 1, Login: "login", Password: "password", Friends: []dbmodel.Friend{}})
+	s.Require().Nil(err)
+	s.Require().Nil(s.user.SetSettings(s.ctx, 1, dbmodel.Settings{"foo": "bar"}))
 
-	for _, tc := range testCases {
-		err := s.user.Delete(s.ctx, tc.userId)
-		s.Assert().Equal(tc.expectErr, err)
+	s.Assert().Nil(s.user.SetCredentials(s.ctx, 1, dbmodel.Credentials{Login: "login", Token: "token"}))
+	s.Assert().Nil(s.user.SetSettings(s.ctx, 1, nil))
 
-		if tc.expectErr == nil {
-			err = s.user.pool.FindOne(s.ctx, bson.D{{"user_id", tc.userId}}).Err()
-			s.Assert().Equal(mgo.ErrNoDocuments, err)
-		}
+	coll := s.mongo.Database().Collection(userCollection)
+	for _, field := range []string{"password", "settings"} {
+		n, err := coll.CountDocuments(s.ctx, bson.D{{field, bson.D{{"$exists", true}}}})
+		s.Assert().Nil(err, field)
+		s.Assert().Equal(int64(0), n, field)
 	}
 }
@@ -1,7 +0,0 @@
-package mongoerrs
-
-import "errors"
-
-var (
-	ErrNotFound = errors.New("not found")
-)
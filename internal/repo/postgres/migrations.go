@@ -0,0 +1,137 @@
+package postgres
+
+import (
+	"bot_for_modeus/pkg/postgres"
+	"bot_for_modeus/pkg/tracing"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Миграции лежат в migrations/<версия>_<описание>.sql и применяются по возрастанию версии.
+// Уже выпущенные файлы не меняются, только добавляются новые
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// Ключ pg_advisory_xact_lock: инстансы, запущенные одновременно, применяют миграции по очереди
+const migrationsLock = 20_240_049
+
+var ErrInvalidMigration = errors.New("invalid migration file name")
+
+type migration struct {
+	version     int
+	description string
+	sql         string
+}
+
+// Migrate применяет еще не примененные миграции и возвращает их количество
+func Migrate(ctx context.Context, pg *postgres.Postgres) (int, error) {
+	migrations, err := loadMigrations(migrationsFS, "migrations")
+	if err != nil {
+		return 0, err
+	}
+	return migrate(ctx, pg.Pool, migrations)
+}
+
+func migrate(ctx context.Context, pool *pgxpool.Pool, migrations []migration) (applied int, err error) {
+	ctx, span := tracer.Start(ctx, "postgresql migrate")
+	defer func() { tracing.End(span, err) }()
+
+	_, err = pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     INTEGER PRIMARY KEY,
+		description TEXT        NOT NULL,
+		applied_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return 0, fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		ok, err := applyMigration(ctx, pool, m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		if ok {
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration выполняет миграцию и записывает ее версию в одной транзакции, поэтому упавшая миграция не оставляет следов
+func applyMigration(ctx context.Context, pool *pgxpool.Pool, m migration) (applied bool, err error) {
+	err = pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationsLock); err != nil {
+			return err
+		}
+		var exists bool
+		err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.version).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+		if _, err = tx.Exec(ctx, m.sql); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, description) VALUES ($1, $2)`, m.version, m.description); err != nil {
+			return err
+		}
+		applied = true
+		return nil
+	})
+	return applied, err
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]migration, 0, len(entries))
+	versions := make(map[int]struct{}, len(entries))
+	for _, e := range entries {
+		version, description, err := parseMigrationName(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := versions[version]; ok {
+			return nil, fmt.Errorf("%w: duplicate version %d", ErrInvalidMigration, version)
+		}
+		versions[version] = struct{}{}
+
+		sql, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, description: description, sql: string(sql)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// parseMigrationName разбирает имя вида 0001_users.sql на версию и описание
+func parseMigrationName(name string) (int, string, error) {
+	base, ok := strings.CutSuffix(name, ".sql")
+	if !ok {
+		return 0, "", fmt.Errorf("%w: %s", ErrInvalidMigration, name)
+	}
+	v, description, ok := strings.Cut(base, "_")
+	if !ok || description == "" {
+		return 0, "", fmt.Errorf("%w: %s", ErrInvalidMigration, name)
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version <= 0 {
+		return 0, "", fmt.Errorf("%w: %s", ErrInvalidMigration, name)
+	}
+	return version, description, nil
+}
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS users (
+    user_id          BIGINT PRIMARY KEY,
+    full_name        TEXT        NOT NULL DEFAULT '',
+    login            TEXT        NOT NULL DEFAULT '',
+    -- password - зашифрованный пароль из старых записей, новые записи хранят только токен
+    password         TEXT,
+    token            TEXT        NOT NULL DEFAULT '',
+    token_expires_at TIMESTAMPTZ,
+    schedule_id      TEXT        NOT NULL DEFAULT '',
+    grades_id        TEXT        NOT NULL DEFAULT ''
+);
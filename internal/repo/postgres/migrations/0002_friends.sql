@@ -0,0 +1,8 @@
+-- Друзья в отдельной таблице, порядок задает position (в mongodb это порядок элементов массива)
+CREATE TABLE IF NOT EXISTS friends (
+    user_id     BIGINT  NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    position    INTEGER NOT NULL,
+    full_name   TEXT    NOT NULL,
+    schedule_id TEXT    NOT NULL,
+    PRIMARY KEY (user_id, position)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS settings (
+    user_id BIGINT NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    key     TEXT   NOT NULL,
+    value   TEXT   NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
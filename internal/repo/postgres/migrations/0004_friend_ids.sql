@@ -0,0 +1,14 @@
+-- Постоянные id и имена друзей. Порядок по-прежнему задает position, но он больше не ключ:
+-- при перестановке позиции меняются у нескольких строк сразу
+ALTER TABLE friends ADD COLUMN id TEXT;
+ALTER TABLE friends ADD COLUMN nickname TEXT NOT NULL DEFAULT '';
+UPDATE friends SET id = gen_random_uuid()::TEXT;
+ALTER TABLE friends ALTER COLUMN id SET NOT NULL;
+
+-- Повторно добавленные друзья удаляются, остается первый
+DELETE FROM friends f USING friends d
+WHERE f.user_id = d.user_id AND f.schedule_id = d.schedule_id AND f.position > d.position;
+
+ALTER TABLE friends DROP CONSTRAINT friends_pkey;
+ALTER TABLE friends ADD PRIMARY KEY (user_id, id);
+CREATE UNIQUE INDEX friends_user_id_schedule_id ON friends (user_id, schedule_id);
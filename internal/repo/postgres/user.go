@@ -0,0 +1,369 @@
+package postgres
+
+import (
+	"bot_for_modeus/internal/model/dbmodel"
+	"bot_for_modeus/internal/repo/repoerrs"
+	"bot_for_modeus/pkg/postgres"
+	"bot_for_modeus/pkg/tracing"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+var tracer = otel.Tracer("bot_for_modeus/internal/repo/postgres")
+
+const (
+	usersTable = "users"
+	// Сколько пользователей ForEach читает за один запрос
+	forEachBatchSize = 100
+	// Код ошибки unique_violation
+	uniqueViolation = "23505"
+)
+
+// Атрибуты спанов по соглашениям OpenTelemetry для баз данных. Сам запрос не пишем: в нем бывают зашифрованные токены
+func startSpan(ctx context.Context, operation string, userId int64) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "postgresql "+operation+" "+usersTable, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.operation", operation),
+			attribute.String("db.sql.table", usersTable),
+			attribute.Int64("user_id", userId),
+		))
+}
+
+// UserRepo хранит пользователя в трех таблицах: users, friends и settings (см. migrations).
+// Ошибки те же, что у mongodb.UserRepo (repoerrs), поэтому сервисы не зависят от выбранной базы
+type UserRepo struct {
+	pool *pgxpool.Pool
+}
+
+func NewUserRepo(pg *postgres.Postgres) *UserRepo {
+	return &UserRepo{pg.Pool}
+}
+
+func (r *UserRepo) Create(ctx context.Context, u dbmodel.User) (err error) {
+	ctx, span := startSpan(ctx, "insert", u.UserId)
+	defer func() { tracing.End(span, err) }()
+
+	err = pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `INSERT INTO users (user_id, full_name, login, password, token, token_expires_at, schedule_id, grades_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			u.UserId, u.FullName, u.Login, nullString(u.Password), u.Token, nullTime(u.TokenExpiresAt), u.ScheduleId, u.GradesId)
+		if err != nil {
+			return err
+		}
+		for i, f := range u.Friends {
+			_, err = tx.Exec(ctx, `INSERT INTO friends (user_id, id, position, full_name, schedule_id, nickname) VALUES ($1, $2, $3, $4, $5, $6)`,
+				u.UserId, f.Id, i, f.FullName, f.ScheduleId, f.Nickname)
+			if err != nil {
+				return err
+			}
+		}
+		return insertSettings(ctx, tx, u.UserId, u.Settings)
+	})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return repoerrs.ErrAlreadyExists
+	}
+	return err
+}
+
+// Upsert не трогает учетные данные, друзей и настройки существующего пользователя.
+// xmax = 0 только у строки, которую вставил этот запрос, а не обновил
+func (r *UserRepo) Upsert(ctx context.Context, u dbmodel.User) (created bool, err error) {
+	ctx, span := startSpan(ctx, "upsert", u.UserId)
+	defer func() { tracing.End(span, err) }()
+
+	err = r.pool.QueryRow(ctx, `INSERT INTO users (user_id, full_name, schedule_id, grades_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET full_name = excluded.full_name, schedule_id = excluded.schedule_id, grades_id = excluded.grades_id
+		RETURNING xmax = 0`,
+		u.UserId, u.FullName, u.ScheduleId, u.GradesId).Scan(&created)
+	if err != nil {
+		return false, err
+	}
+	span.SetAttributes(attribute.Bool("created", created))
+	return created, nil
+}
+
+func (r *UserRepo) FindById(ctx context.Context, id int64) (_ dbmodel.User, err error) {
+	ctx, span := startSpan(ctx, "select", id)
+	defer func() { tracing.End(span, err) }()
+
+	users, err := r.findUsers(ctx, `WHERE user_id = $1`, id)
+	if err != nil {
+		return dbmodel.User{}, err
+	}
+	if len(users) == 0 {
+		return dbmodel.User{}, repoerrs.ErrNotFound
+	}
+	return users[0], nil
+}
+
+func (r *UserRepo) SetCredentials(ctx context.Context, id int64, c dbmodel.Credentials) error {
+	return r.exec(ctx, id, `UPDATE users SET login = $2, token = $3, token_expires_at = $4, password = NULL WHERE user_id = $1`,
+		c.Login, c.Token, nullTime(c.TokenExpiresAt))
+}
+
+func (r *UserRepo) SetProfile(ctx context.Context, id int64, p dbmodel.Profile) error {
+	return r.exec(ctx, id, `UPDATE users SET full_name = $2, schedule_id = $3, grades_id = $4 WHERE user_id = $1`,
+		p.FullName, p.ScheduleId, p.GradesId)
+}
+
+// AddFriend блокирует строку пользователя, чтобы одновременные добавления не получили одну и ту же позицию
+// и не обошли проверки дубликата и лимита
+func (r *UserRepo) AddFriend(ctx context.Context, id int64, f dbmodel.Friend, limit int) error {
+	return r.tx(ctx, "update", id, func(tx pgx.Tx) error {
+		var count, duplicates, position int
+		err := tx.QueryRow(ctx, `SELECT COUNT(*), COUNT(*) FILTER (WHERE schedule_id = $2), COALESCE(MAX(position) + 1, 0)
+			FROM friends WHERE user_id = $1`, id, f.ScheduleId).Scan(&count, &duplicates, &position)
+		if err != nil {
+			return err
+		}
+		if duplicates > 0 {
+			return repoerrs.ErrAlreadyExists
+		}
+		if count >= limit {
+			return repoerrs.ErrLimitExceeded
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO friends (user_id, id, position, full_name, schedule_id, nickname) VALUES ($1, $2, $3, $4, $5, $6)`,
+			id, f.Id, position, f.FullName, f.ScheduleId, f.Nickname)
+		return err
+	})
+}
+
+func (r *UserRepo) RemoveFriend(ctx context.Context, id int64, friendId string) error {
+	return r.tx(ctx, "update", id, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `DELETE FROM friends WHERE user_id = $1 AND id = $2`, id, friendId)
+		return err
+	})
+}
+
+func (r *UserRepo) RenameFriend(ctx context.Context, id int64, friendId, nickname string) error {
+	return r.exec(ctx, id, `UPDATE friends SET nickname = $3 WHERE user_id = $1 AND id = $2`, friendId, nickname)
+}
+
+// MoveFriend переставляет друзей на стороне приложения и заново нумерует позиции всего списка
+func (r *UserRepo) MoveFriend(ctx context.Context, id int64, friendId string, position int) error {
+	return r.tx(ctx, "update", id, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT id FROM friends WHERE user_id = $1 ORDER BY position`, id)
+		if err != nil {
+			return err
+		}
+		friends, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (dbmodel.Friend, error) {
+			var f dbmodel.Friend
+			return f, row.Scan(&f.Id)
+		})
+		if err != nil {
+			return err
+		}
+
+		friends, ok := dbmodel.MoveFriend(friends, friendId, position)
+		if !ok {
+			return repoerrs.ErrNotFound
+		}
+		ids := make([]string, 0, len(friends))
+		for _, f := range friends {
+			ids = append(ids, f.Id)
+		}
+		_, err = tx.Exec(ctx, `UPDATE friends f SET position = o.position - 1
+			FROM unnest($2::TEXT[]) WITH ORDINALITY AS o (id, position)
+			WHERE f.user_id = $1 AND f.id = o.id`, id, ids)
+		return err
+	})
+}
+
+func (r *UserRepo) SetSettings(ctx context.Context, id int64, s dbmodel.Settings) error {
+	return r.tx(ctx, "update", id, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM settings WHERE user_id = $1`, id); err != nil {
+			return err
+		}
+		return insertSettings(ctx, tx, id, s)
+	})
+}
+
+// Друзья и настройки удаляются каскадно
+func (r *UserRepo) Delete(ctx context.Context, id int64) (err error) {
+	ctx, span := startSpan(ctx, "delete", id)
+	defer func() { tracing.End(span, err) }()
+
+	c, err := r.pool.Exec(ctx, `DELETE FROM users WHERE user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if c.RowsAffected() == 0 {
+		return repoerrs.ErrNotFound
+	}
+	return nil
+}
+
+// ForEach читает пользователей пачками по user_id, а не одним курсором: fn может долго ходить в парсер
+// и писать в эту же таблицу, а соединение при этом не занято
+func (r *UserRepo) ForEach(ctx context.Context, fn func(u dbmodel.User) error) (err error) {
+	ctx, span := startSpan(ctx, "select", 0)
+	defer func() { tracing.End(span, err) }()
+
+	var last int64
+	for {
+		users, err := r.findUsers(ctx, `WHERE user_id > $1 ORDER BY user_id LIMIT $2`, last, forEachBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			if err := fn(u); err != nil {
+				return err
+			}
+		}
+		if len(users) < forEachBatchSize {
+			return nil
+		}
+		last = users[len(users)-1].UserId
+	}
+}
+
+// exec выполняет обновление одной строки пользователя (users или его друга в friends). Если строки нет, возвращает ErrNotFound
+func (r *UserRepo) exec(ctx context.Context, id int64, sql string, args ...any) (err error) {
+	ctx, span := startSpan(ctx, "update", id)
+	defer func() { tracing.End(span, err) }()
+
+	c, err := r.pool.Exec(ctx, sql, append([]any{id}, args...)...)
+	if err != nil {
+		return err
+	}
+	if c.RowsAffected() == 0 {
+		return repoerrs.ErrNotFound
+	}
+	return nil
+}
+
+// tx выполняет fn в транзакции, предварительно заблокировав строку пользователя. Если строки нет, возвращает ErrNotFound
+func (r *UserRepo) tx(ctx context.Context, operation string, id int64, fn func(tx pgx.Tx) error) (err error) {
+	ctx, span := startSpan(ctx, operation, id)
+	defer func() { tracing.End(span, err) }()
+
+	return pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		var found int64
+		err := tx.QueryRow(ctx, `SELECT user_id FROM users WHERE user_id = $1 FOR UPDATE`, id).Scan(&found)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return repoerrs.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// findUsers читает пользователей по условию where, а затем их друзей и настройки двумя запросами на всю пачку
+func (r *UserRepo) findUsers(ctx context.Context, where string, args ...any) ([]dbmodel.User, error) {
+	rows, err := r.pool.Query(ctx, `SELECT user_id, full_name, login, password, token, token_expires_at, schedule_id, grades_id
+		FROM users `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		users []dbmodel.User
+		ids   []int64
+		index = make(map[int64]int)
+	)
+	for rows.Next() {
+		var (
+			u         dbmodel.User
+			password  *string
+			expiresAt *time.Time
+		)
+		err = rows.Scan(&u.UserId, &u.FullName, &u.Login, &password, &u.Token, &expiresAt, &u.ScheduleId, &u.GradesId)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if password != nil {
+			u.Password = *password
+		}
+		if expiresAt != nil {
+			u.TokenExpiresAt = *expiresAt
+		}
+		u.Friends = []dbmodel.Friend{}
+		index[u.UserId] = len(users)
+		users = append(users, u)
+		ids = append(ids, u.UserId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	rows, err = r.pool.Query(ctx, `SELECT user_id, id, full_name, schedule_id, nickname FROM friends
+		WHERE user_id = ANY($1) ORDER BY user_id, position`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			id int64
+			f  dbmodel.Friend
+		)
+		if err = rows.Scan(&id, &f.Id, &f.FullName, &f.ScheduleId, &f.Nickname); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		u := &users[index[id]]
+		u.Friends = append(u.Friends, f)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = r.pool.Query(ctx, `SELECT user_id, key, value FROM settings WHERE user_id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			id         int64
+			key, value string
+		)
+		if err = rows.Scan(&id, &key, &value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		u := &users[index[id]]
+		if u.Settings == nil {
+			u.Settings = make(dbmodel.Settings)
+		}
+		u.Settings[key] = value
+	}
+	return users, rows.Err()
+}
+
+func insertSettings(ctx context.Context, tx pgx.Tx, id int64, s dbmodel.Settings) error {
+	for k, v := range s {
+		if _, err := tx.Exec(ctx, `INSERT INTO settings (user_id, key, value) VALUES ($1, $2, $3)`, id, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// Нулевое время в модели означает "неизвестно", в базе это NULL
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
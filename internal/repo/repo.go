@@ -2,25 +2,68 @@ package repo
 
 import (
 	"bot_for_modeus/internal/model/dbmodel"
+	"bot_for_modeus/internal/repo/memory"
 	"bot_for_modeus/internal/repo/mongodb"
+	"bot_for_modeus/internal/repo/postgres"
 	"bot_for_modeus/pkg/mongo"
+	pg "bot_for_modeus/pkg/postgres"
 	"context"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 type User interface {
 	Create(ctx context.Context, u dbmodel.User) error
+	// Upsert атомарно создает пользователя или обновляет ФИО и id существующего. created - документ был создан
+	Upsert(ctx context.Context, u dbmodel.User) (created bool, err error)
 	FindById(ctx context.Context, id int64) (dbmodel.User, error)
-	Update(ctx context.Context, id int64, data bson.D) error
+	// SetCredentials сохраняет логин и токен сессии и удаляет пароль из старых записей
+	SetCredentials(ctx context.Context, id int64, c dbmodel.Credentials) error
+	SetProfile(ctx context.Context, id int64, p dbmodel.Profile) error
+	// AddFriend добавляет друга в конец списка. Если друг с таким ScheduleId уже есть, возвращает ErrAlreadyExists,
+	// если друзей уже limit - ErrLimitExceeded
+	AddFriend(ctx context.Context, id int64, f dbmodel.Friend, limit int) error
+	// RemoveFriend удаляет друга по id. Если такого друга нет, это не ошибка
+	RemoveFriend(ctx context.Context, id int64, friendId string) error
+	// RenameFriend задает имя друга, пустое имя сбрасывает его. Если друга нет, возвращает ErrNotFound
+	RenameFriend(ctx context.Context, id int64, friendId, nickname string) error
+	// MoveFriend ставит друга на место position (см. dbmodel.MoveFriend). Если друга нет, возвращает ErrNotFound
+	MoveFriend(ctx context.Context, id int64, friendId string, position int) error
+	// SetSettings заменяет все настройки пользователя
+	SetSettings(ctx context.Context, id int64, s dbmodel.Settings) error
 	Delete(ctx context.Context, id int64) error
+	// ForEach вызывает fn для каждого пользователя, пока fn не вернет ошибку
+	ForEach(ctx context.Context, fn func(u dbmodel.User) error) error
 }
 
 type Repositories struct {
 	User
 }
 
+// Migrate приводит схему бд к актуальной версии. Вызывается при старте до создания репозиториев
+func Migrate(ctx context.Context, mongo *mongo.Mongo) (int, error) {
+	return mongodb.Migrate(ctx, mongo)
+}
+
 func NewRepositories(mongo *mongo.Mongo) *Repositories {
 	return &Repositories{
 		User: mongodb.NewUserRepo(mongo),
 	}
 }
+
+// MigratePostgres создает и обновляет таблицы из встроенных sql миграций
+func MigratePostgres(ctx context.Context, pg *pg.Postgres) (int, error) {
+	return postgres.Migrate(ctx, pg)
+}
+
+func NewPostgresRepositories(pg *pg.Postgres) *Repositories {
+	return &Repositories{
+		User: postgres.NewUserRepo(pg),
+	}
+}
+
+// NewMemoryRepositories хранит данные в памяти процесса: для тестов и локального запуска без базы.
+// После перезапуска все данные теряются
+func NewMemoryRepositories() *Repositories {
+	return &Repositories{
+		User: memory.NewUserRepo(),
+	}
+}
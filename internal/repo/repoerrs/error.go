@@ -0,0 +1,10 @@
+// Ошибки репозиториев, общие для всех баз (mongodb, postgres, memory), чтобы сервисы не зависели от выбранной базы
+package repoerrs
+
+import "errors"
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrLimitExceeded = errors.New("limit exceeded")
+)
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"bot_for_modeus/internal/events"
+	"bot_for_modeus/internal/model/dbmodel"
+	"bot_for_modeus/internal/parser"
+	"bot_for_modeus/internal/repo/repoerrs"
+	"bot_for_modeus/pkg/secret"
+	"bot_for_modeus/pkg/tracing"
+	"context"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+)
+
+// За сколько до истечения продлевать токен сессии
+const tokenRefreshBefore = 24 * time.Hour
+
+// migrateCredentials приводит учетные данные пользователя к актуальному виду:
+//   - старый пароль меняется на токен и удаляется;
+//   - истекший токен удаляется;
+//   - токен, который скоро истечет, продлевается;
+//   - токен, зашифрованный устаревшим ключом, перешифровывается.
+//
+// Сессия удаляется, только если логин и пароль больше не подходят или токен не продлить.
+// Ошибки парсера возвращаются, а данные остаются как есть до следующей попытки.
+// Данные, которые не удалось расшифровать (например, убран ключ из Crypter.Keys), не трогаем: иначе сессия пропадет
+// из-за ошибки конфигурации. changed - данные в бд изменились
+func (s *userService) migrateCredentials(ctx context.Context, u dbmodel.User) (_ dbmodel.User, changed bool, err error) {
+	var t parser.Token
+
+	switch {
+	case u.Password != "":
+		password, err := s.crypter.Decrypt(u.Password)
+		if err != nil {
+			log.Warn().Err(err).Int64("user_id", u.UserId).Msg("user/migrateCredentials error decrypt password")
+			return u, false, nil
+		}
+		if t, err = s.tokens.CreateToken(ctx, u.Login, secret.String(password)); err != nil && !errors.Is(err, parser.ErrIncorrectLoginPassword) {
+			return u, false, err
+		}
+
+	case u.Token == "":
+		return u, false, nil
+
+	case !u.TokenExpiresAt.IsZero() && !time.Now().Before(u.TokenExpiresAt):
+		// Сессия истекла, токен больше не нужен
+
+	case !u.TokenExpiresAt.IsZero() && time.Until(u.TokenExpiresAt) < tokenRefreshBefore:
+		token, err := s.crypter.Decrypt(u.Token)
+		if err != nil {
+			log.Warn().Err(err).Int64("user_id", u.UserId).Msg("user/migrateCredentials error decrypt token")
+			return u, false, nil
+		}
+		if t, err = s.tokens.RefreshToken(ctx, secret.String(token)); err != nil && !errors.Is(err, parser.ErrTokenExpired) {
+			return u, false, err
+		}
+
+	case s.crypter.Outdated(u.Token):
+		token, err := s.crypter.Decrypt(u.Token)
+		if err != nil {
+			log.Warn().Err(err).Int64("user_id", u.UserId).Msg("user/migrateCredentials error decrypt token")
+			return u, false, nil
+		}
+		t = parser.Token{Token: secret.String(token), ExpiresAt: u.TokenExpiresAt}
+
+	default:
+		return u, false, nil
+	}
+
+	var token string
+	if t.Token != "" {
+		if token, err = s.crypter.Encrypt(t.Token.Reveal()); err != nil {
+			return u, false, ErrCrypto.Wrap(err)
+		}
+	}
+	// Пустой токен удаляет сессию, тогда пользователю нужно заново ввести логин и пароль
+	err = s.user.SetCredentials(ctx, u.UserId, dbmodel.Credentials{Login: u.Login, Token: token, TokenExpiresAt: t.ExpiresAt})
+	if err != nil {
+		// Пользователя могли удалить между чтением и обновлением
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return u, false, nil
+		}
+		return u, false, ErrDatabase.Wrap(err)
+	}
+	u.Password, u.Token, u.TokenExpiresAt = "", token, t.ExpiresAt
+	s.publish(ctx, events.CredentialsChanged, u.UserId)
+	return u, true, nil
+}
+
+// MigrateCredentials - единственное место, где обновляются учетные данные: Find только читает,
+// чтобы запросы пользователей не ждали парсер и не писали в бд. Ошибки парсера не прерывают обход, такие пользователи обновятся при следующем запуске
+func (s *userService) MigrateCredentials(ctx context.Context) (updated int, err error) {
+	ctx, span := tracer.Start(ctx, "service.User/MigrateCredentials")
+	defer func() {
+		span.SetAttributes(attribute.Int("updated", updated))
+		tracing.End(span, err)
+	}()
+
+	err = s.user.ForEach(ctx, func(u dbmodel.User) error {
+		_, changed, err := s.migrateCredentials(ctx, u)
+		if err != nil {
+			if errors.Is(err, ErrCrypto) || errors.Is(err, ErrDatabase) {
+				return err
+			}
+			log.Warn().Err(err).Int64("user_id", u.UserId).Msg("user/MigrateCredentials error migrate user credentials")
+			return nil
+		}
+		if changed {
+			updated++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Err(err).Int("updated", updated).Msg("user/MigrateCredentials error migrate credentials")
+		if errors.Is(err, ErrCrypto) || errors.Is(err, ErrDatabase) {
+			return updated, err
+		}
+		return updated, ErrDatabase.Wrap(err)
+	}
+	return updated, nil
+}
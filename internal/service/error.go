@@ -1,9 +1,17 @@
 package service
 
-import "errors"
+import "bot_for_modeus/internal/apperrs"
 
 var (
-	ErrUserAlreadyExists  = errors.New("user already exists")
-	ErrUserNotFound       = errors.New("user not found")
-	ErrUserIncorrectLogin = errors.New("user incorrect login input")
+	ErrUserNotFound       = apperrs.New(apperrs.KindUser, "service.user_not_found", "user not found")
+	ErrUserIncorrectLogin = apperrs.New(apperrs.KindUser, "service.user_incorrect_login", "user incorrect login input")
+
+	ErrFriendNotFound          = apperrs.New(apperrs.KindUser, "service.friend_not_found", "friend not found")
+	ErrFriendAlreadyExists     = apperrs.New(apperrs.KindUser, "service.friend_already_exists", "friend already exists")
+	ErrFriendsLimit            = apperrs.New(apperrs.KindUser, "service.friends_limit", "friends limit exceeded")
+	ErrFriendIncorrectNickname = apperrs.New(apperrs.KindUser, "service.friend_incorrect_nickname", "friend incorrect nickname")
+
+	// ErrDatabase и ErrCrypto оборачивают непредвиденные ошибки репозитория и шифрования (причина в Unwrap)
+	ErrDatabase = apperrs.New(apperrs.KindInternal, "service.database", "database error")
+	ErrCrypto   = apperrs.New(apperrs.KindInternal, "service.crypto", "crypto error")
 )
@@ -1,9 +1,11 @@
 package service
 
 import (
+	"bot_for_modeus/internal/events"
 	"bot_for_modeus/internal/parser"
 	"bot_for_modeus/internal/repo"
 	"bot_for_modeus/pkg/crypter"
+	"bot_for_modeus/pkg/secret"
 	"context"
 )
 
@@ -15,17 +17,19 @@ type (
 		GradesId   string
 	}
 	UserOutput struct {
-		FullName   string
-		Login      string
-		Password   string
+		FullName string
+		Login    string
+		// Token - зашифрованный токен сессии модеуса (см. Decrypt). Пустой, если пользователь не вошел или сессия истекла
+		Token      string
 		ScheduleId string
 		GradesId   string
 		Friends    []FriendOutput
+		Settings   map[string]string
 	}
 	UserLoginPasswordInput struct {
 		UserId   int64
 		Login    string
-		Password string
+		Password secret.String
 	}
 	FriendInput struct {
 		UserId     int64
@@ -33,38 +37,61 @@ type (
 		ScheduleId string
 	}
 	FriendOutput struct {
+		Id         string `json:"id"`
 		FullName   string `json:"full_name"`
 		ScheduleId string `json:"schedule_id"`
+		// Nickname - имя, которое задал пользователь. Если пустое, показывается FullName
+		Nickname string `json:"nickname,omitempty"`
 	}
 )
 
 type User interface {
-	Create(ctx context.Context, input UserInput) error
+	// Create создает пользователя, а если он уже есть (повторный /start), обновляет его ФИО и id. created - пользователь новый
+	Create(ctx context.Context, input UserInput) (created bool, err error)
 	Find(ctx context.Context, userId int64) (UserOutput, error)
 	UpdateLoginPassword(ctx context.Context, input UserLoginPasswordInput) error
 	UpdateInfo(ctx context.Context, input UserInput) error
 	Delete(ctx context.Context, userId int64) error
-	AddFriend(ctx context.Context, input FriendInput) error
-	DeleteFriend(ctx context.Context, input FriendInput) error
+	// AddFriend добавляет друга в конец списка и выдает ему id. Повторно добавить того же студента нельзя,
+	// а друзей не может быть больше MaxFriends
+	AddFriend(ctx context.Context, input FriendInput) (FriendOutput, error)
+	DeleteFriend(ctx context.Context, userId int64, friendId string) error
+	// RenameFriend задает имя друга длиной до MaxNicknameLength символов, пустое имя возвращает ФИО
+	RenameFriend(ctx context.Context, userId int64, friendId, nickname string) error
+	// MoveFriend ставит друга на место position в списке (с нуля), остальные друзья сдвигаются
+	MoveFriend(ctx context.Context, userId int64, friendId string, position int) error
 
-	Decrypt(input string) (string, error)
+	Decrypt(ctx context.Context, input string) (secret.String, error)
+	// MigrateCredentials обходит всех пользователей: меняет старые пароли на токены, продлевает токены
+	// и перешифровывает их текущим ключом. Возвращает количество обновленных пользователей
+	MigrateCredentials(ctx context.Context) (int, error)
 }
 
 type (
 	Services struct {
 		User   User
 		Parser parser.Parser
+		// Events - шина событий об изменении данных пользователей. Сервисы публикуют в нее после записи в бд
+		Events events.Bus
 	}
 	ServicesDependencies struct {
 		Repos      *repo.Repositories
 		Crypter    crypter.Crypter
 		ParserHost string
+		// Events - шина событий. Если не задана, используется шина в памяти процесса
+		Events events.Bus
 	}
 )
 
 func NewServices(d *ServicesDependencies) *Services {
+	bus := d.Events
+	if bus == nil {
+		bus = events.NewLocalBus()
+	}
+	p := parser.NewParserService(d.ParserHost)
 	return &Services{
-		User:   newUserService(d.Repos.User, d.Crypter),
-		Parser: parser.NewParserService(d.ParserHost),
+		User:   newUserService(d.Repos.User, d.Crypter, p, bus),
+		Parser: p,
+		Events: bus,
 	}
 }
@@ -1,170 +1,278 @@
 package service
 
 import (
+	"bot_for_modeus/internal/events"
 	"bot_for_modeus/internal/model/dbmodel"
+	"bot_for_modeus/internal/parser"
 	"bot_for_modeus/internal/repo"
-	"bot_for_modeus/internal/repo/mongoerrs"
+	"bot_for_modeus/internal/repo/repoerrs"
 	"bot_for_modeus/pkg/crypter"
+	"bot_for_modeus/pkg/secret"
+	"bot_for_modeus/pkg/tracing"
 	"context"
 	"errors"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"regexp"
+	"strings"
+	"unicode/utf8"
 )
 
+var tracer = otel.Tracer("bot_for_modeus/internal/service")
+
 // Регулярка для первичной проверки корректности почты.
 var (
 	emailRegex = regexp.MustCompile(`^stud\d{10}@study\.utmn\.ru$`)
 )
 
+const (
+	// MaxFriends - сколько друзей может сохранить пользователь. Каждый друг - отдельная кнопка в списке
+	MaxFriends = 30
+	// MaxNicknameLength - максимальная длина имени друга в символах, чтобы имя помещалось на кнопке
+	MaxNicknameLength = 32
+)
+
 type userService struct {
 	user    repo.User
 	crypter crypter.Crypter
+	tokens  parser.Tokens
+	events  events.Bus
 }
 
-func newUserService(user repo.User, crypter crypter.Crypter) *userService {
+func newUserService(user repo.User, crypter crypter.Crypter, tokens parser.Tokens, bus events.Bus) *userService {
+	if bus == nil {
+		bus = events.NewLocalBus()
+	}
 	return &userService{
 		user:    user,
 		crypter: crypter,
+		tokens:  tokens,
+		events:  bus,
 	}
 }
 
-func (s *userService) Create(ctx context.Context, input UserInput) error {
-	u, err := s.user.FindById(ctx, input.UserId)
-	if u.UserId != 0 && err == nil {
-		return ErrUserAlreadyExists
+// publish сообщает подписчикам об изменении данных пользователя.
+// Данные в бд уже изменены, поэтому ошибка публикации только логируется и не возвращается вызывающему
+func (s *userService) publish(ctx context.Context, t events.Type, userId int64) {
+	if err := s.events.Publish(ctx, events.Event{Type: t, UserId: userId}); err != nil {
+		log.Err(err).Int64("user_id", userId).Str("type", string(t)).Msg("user/publish error publish event")
 	}
+}
 
-	if err != nil {
-		if !errors.Is(err, mongoerrs.ErrNotFound) {
-			log.Err(err).Int64("user_id", input.UserId).Msg("user/Create error find user by id")
-			return err
-		}
-	}
+func (s *userService) Create(ctx context.Context, input UserInput) (created bool, err error) {
+	ctx, span := tracer.Start(ctx, "service.User/Create", trace.WithAttributes(attribute.Int64("user_id", input.UserId)))
+	defer func() { tracing.End(span, err) }()
 
-	err = s.user.Create(ctx, dbmodel.User{
+	created, err = s.user.Upsert(ctx, dbmodel.User{
 		UserId:     input.UserId,
 		FullName:   input.FullName,
 		ScheduleId: input.ScheduleId,
 		GradesId:   input.GradesId,
-		Friends:    []dbmodel.Friend{},
 	})
 	if err != nil {
-		log.Err(err).Interface("input", input).Msg("user/Create error create user in database")
-		return err
+		log.Err(err).Int64("user_id", input.UserId).Str("schedule_id", input.ScheduleId).Msg("user/Create error upsert user in database")
+		return false, ErrDatabase.Wrap(err)
 	}
-	return nil
+	if created {
+		s.publish(ctx, events.UserCreated, input.UserId)
+	} else {
+		s.publish(ctx, events.UserUpdated, input.UserId)
+	}
+	return created, nil
 }
 
-func (s *userService) Find(ctx context.Context, userId int64) (UserOutput, error) {
+func (s *userService) Find(ctx context.Context, userId int64) (_ UserOutput, err error) {
+	ctx, span := tracer.Start(ctx, "service.User/Find", trace.WithAttributes(attribute.Int64("user_id", userId)))
+	defer func() { tracing.End(span, err) }()
+
 	u, err := s.user.FindById(ctx, userId)
 	if err != nil {
-		if errors.Is(err, mongoerrs.ErrNotFound) {
+		if errors.Is(err, repoerrs.ErrNotFound) {
 			return UserOutput{}, ErrUserNotFound
 		}
 		log.Err(err).Int64("user_id", userId).Msg("user/Find error find user by id")
-		return UserOutput{}, err
+		return UserOutput{}, ErrDatabase.Wrap(err)
 	}
 	o := UserOutput{
 		FullName:   u.FullName,
 		Login:      u.Login,
-		Password:   u.Password,
+		Token:      u.Token,
 		ScheduleId: u.ScheduleId,
 		GradesId:   u.GradesId,
 		Friends:    make([]FriendOutput, 0, len(u.Friends)),
+		Settings:   u.Settings,
 	}
 	for _, f := range u.Friends {
-		o.Friends = append(o.Friends, FriendOutput{
-			FullName:   f.FullName,
-			ScheduleId: f.ScheduleId,
-		})
+		o.Friends = append(o.Friends, friendOutput(f))
 	}
 	return o, nil
 }
 
-func (s *userService) UpdateLoginPassword(ctx context.Context, input UserLoginPasswordInput) error {
+// UpdateLoginPassword меняет логин и пароль на токен сессии через парсер и сохраняет только токен.
+// Неверные логин или пароль возвращаются как parser.ErrIncorrectLoginPassword
+func (s *userService) UpdateLoginPassword(ctx context.Context, input UserLoginPasswordInput) (err error) {
+	ctx, span := tracer.Start(ctx, "service.User/UpdateLoginPassword", trace.WithAttributes(attribute.Int64("user_id", input.UserId)))
+	defer func() { tracing.End(span, err) }()
+
 	if !emailRegex.MatchString(input.Login) {
 		return ErrUserIncorrectLogin
 	}
-	password, err := s.crypter.Encrypt(input.Password)
+	t, err := s.tokens.CreateToken(ctx, input.Login, input.Password)
 	if err != nil {
-		log.Err(err).Int64("user_id", input.UserId).Msg("user/UpdateLoginPassword error encrypt password")
 		return err
 	}
-	update := bson.D{{"$set", bson.D{{"login", input.Login}, {"password", password}}}}
-	if err = s.user.Update(ctx, input.UserId, update); err != nil {
-		if errors.Is(err, mongoerrs.ErrNotFound) {
+	token, err := s.crypter.Encrypt(t.Token.Reveal())
+	if err != nil {
+		log.Err(err).Int64("user_id", input.UserId).Msg("user/UpdateLoginPassword error encrypt token")
+		return ErrCrypto.Wrap(err)
+	}
+	err = s.user.SetCredentials(ctx, input.UserId, dbmodel.Credentials{Login: input.Login, Token: token, TokenExpiresAt: t.ExpiresAt})
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
 			return ErrUserNotFound
 		}
-		log.Err(err).Int64("user_id", input.UserId).Msg("user/UpdateLoginPassword error update login and password in database")
-		return err
+		log.Err(err).Int64("user_id", input.UserId).Msg("user/UpdateLoginPassword error update login and token in database")
+		return ErrDatabase.Wrap(err)
 	}
+	s.publish(ctx, events.CredentialsChanged, input.UserId)
 	return nil
 }
 
-func (s *userService) UpdateInfo(ctx context.Context, input UserInput) error {
-	update := bson.D{{"$set", bson.D{
-		{"full_name", input.FullName},
-		{"schedule_id", input.ScheduleId},
-		{"grades_id", input.GradesId},
-	}}}
-	if err := s.user.Update(ctx, input.UserId, update); err != nil {
-		if errors.Is(err, mongoerrs.ErrNotFound) {
+func (s *userService) UpdateInfo(ctx context.Context, input UserInput) (err error) {
+	ctx, span := tracer.Start(ctx, "service.User/UpdateInfo", trace.WithAttributes(attribute.Int64("user_id", input.UserId)))
+	defer func() { tracing.End(span, err) }()
+
+	err = s.user.SetProfile(ctx, input.UserId, dbmodel.Profile{
+		FullName:   input.FullName,
+		ScheduleId: input.ScheduleId,
+		GradesId:   input.GradesId,
+	})
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
 			return ErrUserNotFound
 		}
-		log.Err(err).Interface("input", input).Msg("user/UpdateInfo error update user in database")
-		return err
+		log.Err(err).Int64("user_id", input.UserId).Str("schedule_id", input.ScheduleId).Msg("user/UpdateInfo error update user in database")
+		return ErrDatabase.Wrap(err)
 	}
+	s.publish(ctx, events.UserUpdated, input.UserId)
 	return nil
 }
 
-func (s *userService) Delete(ctx context.Context, userId int64) error {
+func (s *userService) Delete(ctx context.Context, userId int64) (err error) {
+	ctx, span := tracer.Start(ctx, "service.User/Delete", trace.WithAttributes(attribute.Int64("user_id", userId)))
+	defer func() { tracing.End(span, err) }()
+
 	if err := s.user.Delete(ctx, userId); err != nil {
-		if errors.Is(err, mongoerrs.ErrNotFound) {
+		if errors.Is(err, repoerrs.ErrNotFound) {
 			return ErrUserNotFound
 		}
 		log.Err(err).Int64("user_id", userId).Msg("user/Delete error delete user in database")
-		return err
+		return ErrDatabase.Wrap(err)
 	}
+	s.publish(ctx, events.UserDeleted, userId)
 	return nil
 }
 
-func (s *userService) AddFriend(ctx context.Context, input FriendInput) error {
-	update := bson.D{{"$push", bson.M{"friends": dbmodel.Friend{
+func (s *userService) AddFriend(ctx context.Context, input FriendInput) (_ FriendOutput, err error) {
+	ctx, span := tracer.Start(ctx, "service.User/AddFriend", trace.WithAttributes(attribute.Int64("user_id", input.UserId)))
+	defer func() { tracing.End(span, err) }()
+
+	f := dbmodel.Friend{
+		Id:         uuid.NewString(),
 		FullName:   input.FullName,
 		ScheduleId: input.ScheduleId,
-	}}}}
-	if err := s.user.Update(ctx, input.UserId, update); err != nil {
-		if errors.Is(err, mongoerrs.ErrNotFound) {
-			return ErrUserNotFound
+	}
+	if err = s.user.AddFriend(ctx, input.UserId, f, MaxFriends); err != nil {
+		switch {
+		case errors.Is(err, repoerrs.ErrNotFound):
+			return FriendOutput{}, ErrUserNotFound
+		case errors.Is(err, repoerrs.ErrAlreadyExists):
+			return FriendOutput{}, ErrFriendAlreadyExists
+		case errors.Is(err, repoerrs.ErrLimitExceeded):
+			return FriendOutput{}, ErrFriendsLimit
 		}
 		log.Err(err).Int64("user_id", input.UserId).Str("schedule_id", input.ScheduleId).Str("full_name", input.FullName).
 			Msg("user/AddFriend error add friend to user in database")
-		return err
+		return FriendOutput{}, ErrDatabase.Wrap(err)
 	}
-	return nil
+	s.publish(ctx, events.FriendAdded, input.UserId)
+	return friendOutput(f), nil
 }
 
-func (s *userService) DeleteFriend(ctx context.Context, input FriendInput) error {
-	// Нужно удалить объект из массива friends по совпадению schedule_id
-	update := bson.D{{"$pull", bson.M{"friends": bson.M{"schedule_id": input.ScheduleId}}}}
+func (s *userService) DeleteFriend(ctx context.Context, userId int64, friendId string) (err error) {
+	ctx, span := tracer.Start(ctx, "service.User/DeleteFriend", trace.WithAttributes(attribute.Int64("user_id", userId)))
+	defer func() { tracing.End(span, err) }()
 
-	if err := s.user.Update(ctx, input.UserId, update); err != nil {
-		if errors.Is(err, mongoerrs.ErrNotFound) {
+	if err = s.user.RemoveFriend(ctx, userId, friendId); err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
 			return ErrUserNotFound
 		}
-		log.Err(err).Int64("user_id", input.UserId).Str("schedule_id", input.ScheduleId).
+		log.Err(err).Int64("user_id", userId).Str("friend_id", friendId).
 			Msg("user/DeleteFriend error delete user friend in database")
-		return err
+		return ErrDatabase.Wrap(err)
+	}
+	s.publish(ctx, events.FriendRemoved, userId)
+	return nil
+}
+
+func (s *userService) RenameFriend(ctx context.Context, userId int64, friendId, nickname string) (err error) {
+	ctx, span := tracer.Start(ctx, "service.User/RenameFriend", trace.WithAttributes(attribute.Int64("user_id", userId)))
+	defer func() { tracing.End(span, err) }()
+
+	nickname = strings.TrimSpace(nickname)
+	if utf8.RuneCountInString(nickname) > MaxNicknameLength {
+		return ErrFriendIncorrectNickname
 	}
+	if err = s.user.RenameFriend(ctx, userId, friendId, nickname); err != nil {
+		// Пользователя без друга и друга без пользователя не различаем: в обоих случаях кнопка устарела
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrFriendNotFound
+		}
+		log.Err(err).Int64("user_id", userId).Str("friend_id", friendId).
+			Msg("user/RenameFriend error rename user friend in database")
+		return ErrDatabase.Wrap(err)
+	}
+	s.publish(ctx, events.FriendUpdated, userId)
+	return nil
+}
+
+func (s *userService) MoveFriend(ctx context.Context, userId int64, friendId string, position int) (err error) {
+	ctx, span := tracer.Start(ctx, "service.User/MoveFriend", trace.WithAttributes(attribute.Int64("user_id", userId)))
+	defer func() { tracing.End(span, err) }()
+
+	if err = s.user.MoveFriend(ctx, userId, friendId, position); err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrFriendNotFound
+		}
+		log.Err(err).Int64("user_id", userId).Str("friend_id", friendId).Int("position", position).
+			Msg("user/MoveFriend error move user friend in database")
+		return ErrDatabase.Wrap(err)
+	}
+	s.publish(ctx, events.FriendUpdated, userId)
 	return nil
 }
 
-func (s *userService) Decrypt(input string) (string, error) {
+func friendOutput(f dbmodel.Friend) FriendOutput {
+	return FriendOutput{
+		Id:         f.Id,
+		FullName:   f.FullName,
+		ScheduleId: f.ScheduleId,
+		Nickname:   f.Nickname,
+	}
+}
+
+// Decrypt вынесен в отдельный спан: у паролей по старой схеме расшифровка заметно дольше остальных шагов (см. crypter.Outdated)
+func (s *userService) Decrypt(ctx context.Context, input string) (_ secret.String, err error) {
+	_, span := tracer.Start(ctx, "service.User/Decrypt")
+	defer func() { tracing.End(span, err) }()
+
 	d, err := s.crypter.Decrypt(input)
 	if err != nil {
 		log.Err(err).Msg("user/Decrypt error decrypt data")
-		return "", err
+		return "", ErrCrypto.Wrap(err)
 	}
-	return d, nil
+	return secret.String(d), nil
 }
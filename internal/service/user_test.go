@@ -1,18 +1,47 @@
 package service
 
 import (
+	"bot_for_modeus/internal/events"
 	"bot_for_modeus/internal/mocks/cryptermocks"
+	"bot_for_modeus/internal/mocks/parsermocks"
 	"bot_for_modeus/internal/mocks/repomocks"
 	"bot_for_modeus/internal/model/dbmodel"
-	"bot_for_modeus/internal/repo/mongoerrs"
+	"bot_for_modeus/internal/parser"
+	"bot_for_modeus/internal/repo/repoerrs"
+	"bot_for_modeus/pkg/secret"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel/trace"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
+// tracedCtxMatcher проверяет, что в репозиторий передан не исходный контекст вызова, а контекст со спаном сервиса
+type tracedCtxMatcher struct {
+	parent context.Context
+}
+
+func tracedCtx(parent context.Context) gomock.Matcher {
+	return tracedCtxMatcher{parent: parent}
+}
+
+func (m tracedCtxMatcher) Matches(x interface{}) bool {
+	ctx, ok := x.(context.Context)
+	if !ok || ctx == m.parent {
+		return false
+	}
+	return reflect.TypeOf(trace.SpanFromContext(ctx)) != reflect.TypeOf(trace.SpanFromContext(m.parent))
+}
+
+func (m tracedCtxMatcher) String() string {
+	return fmt.Sprintf("is context with span instead of %v", m.parent)
+}
+
 func TestUserService_Create(t *testing.T) {
 	type args struct {
 		ctx   context.Context
@@ -25,6 +54,7 @@ func TestUserService_Create(t *testing.T) {
 		testName      string
 		args          args
 		mockBehaviour mockBehaviour
+		expectCreated bool
 		expectErr     error
 	}{
 		{
@@ -39,16 +69,15 @@ func TestUserService_Create(t *testing.T) {
 				},
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().FindById(a.ctx, a.input.UserId).Return(dbmodel.User{}, mongoerrs.ErrNotFound)
-				u.EXPECT().Create(a.ctx, dbmodel.User{
+				u.EXPECT().Upsert(tracedCtx(a.ctx), dbmodel.User{
 					UserId:     a.input.UserId,
 					FullName:   a.input.FullName,
 					ScheduleId: a.input.ScheduleId,
 					GradesId:   a.input.GradesId,
-					Friends:    []dbmodel.Friend{},
-				}).Return(nil)
+				}).Return(true, nil)
 			},
-			expectErr: nil,
+			expectCreated: true,
+			expectErr:     nil,
 		},
 		{
 			testName: "user already exist",
@@ -62,12 +91,13 @@ func TestUserService_Create(t *testing.T) {
 				},
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().FindById(a.ctx, a.input.UserId).Return(dbmodel.User{UserId: 1}, nil)
+				u.EXPECT().Upsert(tracedCtx(a.ctx), gomock.Any()).Return(false, nil)
 			},
-			expectErr: ErrUserAlreadyExists,
+			expectCreated: false,
+			expectErr:     nil,
 		},
 		{
-			testName: "unexpected user create error",
+			testName: "unexpected user upsert error",
 			args: args{
 				ctx: context.Background(),
 				input: UserInput{
@@ -78,32 +108,10 @@ func TestUserService_Create(t *testing.T) {
 				},
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().FindById(a.ctx, a.input.UserId).Return(dbmodel.User{}, mongoerrs.ErrNotFound)
-				u.EXPECT().Create(a.ctx, dbmodel.User{
-					UserId:     1,
-					FullName:   a.input.FullName,
-					ScheduleId: a.input.ScheduleId,
-					GradesId:   a.input.GradesId,
-					Friends:    []dbmodel.Friend{},
-				}).Return(errors.New("unexpected error"))
+				u.EXPECT().Upsert(tracedCtx(a.ctx), gomock.Any()).Return(false, errors.New("unexpected error"))
 			},
-			expectErr: errors.New("unexpected error"),
-		},
-		{
-			testName: "unexpected user find error",
-			args: args{
-				ctx: context.Background(),
-				input: UserInput{
-					UserId:     1,
-					FullName:   "vasya",
-					ScheduleId: "foobar",
-					GradesId:   "foobar",
-				},
-			},
-			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().FindById(a.ctx, a.input.UserId).Return(dbmodel.User{}, errors.New("unexpected error"))
-			},
-			expectErr: errors.New("unexpected error"),
+			expectCreated: false,
+			expectErr:     ErrDatabase.Wrap(errors.New("unexpected error")),
 		},
 	}
 
@@ -114,10 +122,11 @@ func TestUserService_Create(t *testing.T) {
 			user := repomocks.NewMockUser(ctrl)
 			tc.mockBehaviour(user, tc.args)
 
-			s := newUserService(user, nil)
+			s := newUserService(user, nil, nil, nil)
 
-			err := s.Create(tc.args.ctx, tc.args.input)
+			created, err := s.Create(tc.args.ctx, tc.args.input)
 			assert.Equal(t, tc.expectErr, err)
+			assert.Equal(t, tc.expectCreated, created)
 		})
 	}
 }
@@ -128,7 +137,9 @@ func TestUserService_Find(t *testing.T) {
 		userId int64
 	}
 
-	type mockBehaviour func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args)
+	type mockBehaviour func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args)
+
+	expiresAt := time.Now().Add(7 * 24 * time.Hour).UTC().Truncate(time.Millisecond)
 
 	testCases := []struct {
 		testName      string
@@ -143,14 +154,15 @@ func TestUserService_Find(t *testing.T) {
 				ctx:    context.Background(),
 				userId: 1,
 			},
-			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args) {
-				u.EXPECT().FindById(a.ctx, a.userId).Return(dbmodel.User{
-					UserId:     a.userId,
-					FullName:   "vasya",
-					Login:      "foo",
-					Password:   "crypt_password",
-					ScheduleId: "foobar",
-					GradesId:   "foobar",
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				u.EXPECT().FindById(tracedCtx(a.ctx), a.userId).Return(dbmodel.User{
+					UserId:         a.userId,
+					FullName:       "vasya",
+					Login:          "foo",
+					Token:          "crypt_token",
+					TokenExpiresAt: expiresAt,
+					ScheduleId:     "foobar",
+					GradesId:       "foobar",
 					Friends: []dbmodel.Friend{
 						{
 							FullName:   "Иванов Иван Иванович",
@@ -166,7 +178,7 @@ func TestUserService_Find(t *testing.T) {
 			expectOutput: UserOutput{
 				FullName:   "vasya",
 				Login:      "foo",
-				Password:   "crypt_password",
+				Token:      "crypt_token",
 				ScheduleId: "foobar",
 				GradesId:   "foobar",
 				Friends: []FriendOutput{
@@ -182,25 +194,51 @@ func TestUserService_Find(t *testing.T) {
 			},
 			expectErr: nil,
 		},
+		{
+			testName: "credentials returned as stored",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				// Чтение не ходит в парсер и не пишет в бд: учетные данные обновляет MigrateCredentials
+				u.EXPECT().FindById(tracedCtx(a.ctx), a.userId).Return(dbmodel.User{
+					UserId:         a.userId,
+					FullName:       "vasya",
+					Login:          "foo",
+					Password:       "crypt_password",
+					Token:          "old_crypt_token",
+					TokenExpiresAt: time.Now().Add(time.Hour),
+					Friends:        []dbmodel.Friend{},
+				}, nil)
+			},
+			expectOutput: UserOutput{
+				FullName: "vasya",
+				Login:    "foo",
+				Token:    "old_crypt_token",
+				Friends:  []FriendOutput{},
+			},
+			expectErr: nil,
+		},
 		{
 			testName: "user not exist",
 			args: args{
 				ctx:    context.Background(),
 				userId: 123,
 			},
-			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args) {
-				u.EXPECT().FindById(a.ctx, a.userId).Return(dbmodel.User{}, mongoerrs.ErrNotFound)
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				u.EXPECT().FindById(tracedCtx(a.ctx), a.userId).Return(dbmodel.User{}, repoerrs.ErrNotFound)
 			},
 			expectErr: ErrUserNotFound,
 		},
 		{
-			testName: "correct test user without password",
+			testName: "correct test user without token",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
 			},
-			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args) {
-				u.EXPECT().FindById(a.ctx, a.userId).Return(dbmodel.User{
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				u.EXPECT().FindById(tracedCtx(a.ctx), a.userId).Return(dbmodel.User{
 					UserId:     a.userId,
 					FullName:   "vasya",
 					ScheduleId: "foobar",
@@ -222,10 +260,10 @@ func TestUserService_Find(t *testing.T) {
 				ctx:    context.Background(),
 				userId: 1,
 			},
-			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args) {
-				u.EXPECT().FindById(a.ctx, a.userId).Return(dbmodel.User{}, errors.New("unexpected error"))
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				u.EXPECT().FindById(tracedCtx(a.ctx), a.userId).Return(dbmodel.User{}, errors.New("unexpected error"))
 			},
-			expectErr: errors.New("unexpected error"),
+			expectErr: ErrDatabase.Wrap(errors.New("unexpected error")),
 		},
 	}
 
@@ -235,9 +273,10 @@ func TestUserService_Find(t *testing.T) {
 
 			user := repomocks.NewMockUser(ctrl)
 			crypt := cryptermocks.NewMockCrypter(ctrl)
-			tc.mockBehaviour(user, crypt, tc.args)
+			tokens := parsermocks.NewMockTokens(ctrl)
+			tc.mockBehaviour(user, crypt, tokens, tc.args)
 
-			s := newUserService(user, crypt)
+			s := newUserService(user, crypt, tokens, nil)
 
 			output, err := s.Find(tc.args.ctx, tc.args.userId)
 			assert.Equal(t, tc.expectOutput, output)
@@ -246,13 +285,144 @@ func TestUserService_Find(t *testing.T) {
 	}
 }
 
+func TestUserService_migrateCredentials(t *testing.T) {
+	type mockBehaviour func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, user dbmodel.User)
+
+	ctx := context.Background()
+	expiresAt := time.Now().Add(7 * 24 * time.Hour).UTC().Truncate(time.Millisecond)
+
+	testCases := []struct {
+		testName      string
+		user          dbmodel.User
+		mockBehaviour mockBehaviour
+		expectUser    dbmodel.User
+		expectChanged bool
+		expectErr     error
+	}{
+		{
+			testName: "legacy password exchanged for token",
+			user:     dbmodel.User{UserId: 1, Login: "foo", Password: "crypt_password"},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, user dbmodel.User) {
+				c.EXPECT().Decrypt("crypt_password").Return("password", nil)
+				p.EXPECT().CreateToken(ctx, "foo", secret.String("password")).Return(parser.Token{Token: "token", ExpiresAt: expiresAt}, nil)
+				c.EXPECT().Encrypt("token").Return("crypt_token", nil)
+				u.EXPECT().SetCredentials(ctx, user.UserId, dbmodel.Credentials{Login: "foo", Token: "crypt_token", TokenExpiresAt: expiresAt}).Return(nil)
+			},
+			expectUser:    dbmodel.User{UserId: 1, Login: "foo", Token: "crypt_token", TokenExpiresAt: expiresAt},
+			expectChanged: true,
+			expectErr:     nil,
+		},
+		{
+			testName: "legacy password with incorrect login or password removed",
+			user:     dbmodel.User{UserId: 1, Login: "foo", Password: "crypt_password"},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, user dbmodel.User) {
+				c.EXPECT().Decrypt("crypt_password").Return("password", nil)
+				p.EXPECT().CreateToken(ctx, "foo", secret.String("password")).Return(parser.Token{}, parser.ErrIncorrectLoginPassword)
+				u.EXPECT().SetCredentials(ctx, user.UserId, dbmodel.Credentials{Login: "foo", Token: ""}).Return(nil)
+			},
+			expectUser:    dbmodel.User{UserId: 1, Login: "foo"},
+			expectChanged: true,
+			expectErr:     nil,
+		},
+		{
+			testName: "legacy password exchange error",
+			user:     dbmodel.User{UserId: 1, Login: "foo", Password: "crypt_password"},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, user dbmodel.User) {
+				c.EXPECT().Decrypt("crypt_password").Return("password", nil)
+				p.EXPECT().CreateToken(ctx, "foo", secret.String("password")).Return(parser.Token{}, parser.ErrModeusUnavailable)
+			},
+			expectUser:    dbmodel.User{UserId: 1, Login: "foo", Password: "crypt_password"},
+			expectChanged: false,
+			expectErr:     parser.ErrModeusUnavailable,
+		},
+		{
+			testName: "expiring token refreshed",
+			user:     dbmodel.User{UserId: 1, Login: "foo", Token: "old_crypt_token", TokenExpiresAt: time.Now().Add(time.Hour)},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, user dbmodel.User) {
+				c.EXPECT().Decrypt("old_crypt_token").Return("old_token", nil)
+				p.EXPECT().RefreshToken(ctx, secret.String("old_token")).Return(parser.Token{Token: "token", ExpiresAt: expiresAt}, nil)
+				c.EXPECT().Encrypt("token").Return("crypt_token", nil)
+				u.EXPECT().SetCredentials(ctx, user.UserId, dbmodel.Credentials{Login: "foo", Token: "crypt_token", TokenExpiresAt: expiresAt}).Return(nil)
+			},
+			expectUser:    dbmodel.User{UserId: 1, Login: "foo", Token: "crypt_token", TokenExpiresAt: expiresAt},
+			expectChanged: true,
+			expectErr:     nil,
+		},
+		{
+			testName: "expired token removed",
+			user:     dbmodel.User{UserId: 1, Login: "foo", Token: "crypt_token", TokenExpiresAt: time.Now().Add(-time.Hour)},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, user dbmodel.User) {
+				u.EXPECT().SetCredentials(ctx, user.UserId, dbmodel.Credentials{Login: "foo", Token: ""}).Return(nil)
+			},
+			expectUser:    dbmodel.User{UserId: 1, Login: "foo"},
+			expectChanged: true,
+			expectErr:     nil,
+		},
+		{
+			testName: "outdated token reencrypted",
+			user:     dbmodel.User{UserId: 1, Login: "foo", Token: "old_crypt_token", TokenExpiresAt: expiresAt},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, user dbmodel.User) {
+				c.EXPECT().Outdated("old_crypt_token").Return(true)
+				c.EXPECT().Decrypt("old_crypt_token").Return("token", nil)
+				c.EXPECT().Encrypt("token").Return("crypt_token", nil)
+				u.EXPECT().SetCredentials(ctx, user.UserId, dbmodel.Credentials{Login: "foo", Token: "crypt_token", TokenExpiresAt: expiresAt}).Return(nil)
+			},
+			expectUser:    dbmodel.User{UserId: 1, Login: "foo", Token: "crypt_token", TokenExpiresAt: expiresAt},
+			expectChanged: true,
+			expectErr:     nil,
+		},
+		{
+			testName: "actual token kept",
+			user:     dbmodel.User{UserId: 1, Login: "foo", Token: "crypt_token", TokenExpiresAt: expiresAt},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, user dbmodel.User) {
+				c.EXPECT().Outdated("crypt_token").Return(false)
+			},
+			expectUser:    dbmodel.User{UserId: 1, Login: "foo", Token: "crypt_token", TokenExpiresAt: expiresAt},
+			expectChanged: false,
+			expectErr:     nil,
+		},
+		{
+			testName: "unexpected set credentials error",
+			user:     dbmodel.User{UserId: 1, Login: "foo", Token: "crypt_token", TokenExpiresAt: time.Now().Add(-time.Hour)},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, user dbmodel.User) {
+				u.EXPECT().SetCredentials(ctx, user.UserId, gomock.Any()).Return(errors.New("unexpected error"))
+			},
+			expectUser:    dbmodel.User{UserId: 1, Login: "foo", Token: "crypt_token"},
+			expectChanged: false,
+			expectErr:     ErrDatabase.Wrap(errors.New("unexpected error")),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			user := repomocks.NewMockUser(ctrl)
+			crypt := cryptermocks.NewMockCrypter(ctrl)
+			tokens := parsermocks.NewMockTokens(ctrl)
+			tc.mockBehaviour(user, crypt, tokens, tc.user)
+
+			s := newUserService(user, crypt, tokens, nil)
+
+			u, changed, err := s.migrateCredentials(ctx, tc.user)
+			assert.Equal(t, tc.expectErr, err)
+			assert.Equal(t, tc.expectChanged, changed)
+			if err == nil {
+				assert.Equal(t, tc.expectUser, u)
+			}
+		})
+	}
+}
+
 func TestUserService_UpdateLoginPassword(t *testing.T) {
 	type args struct {
 		ctx   context.Context
 		input UserLoginPasswordInput
 	}
 
-	type mockBehaviour func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args)
+	type mockBehaviour func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args)
+
+	expiresAt := time.Date(2024, time.September, 1, 12, 0, 0, 0, time.UTC)
 
 	testCases := []struct {
 		testName      string
@@ -270,11 +440,11 @@ func TestUserService_UpdateLoginPassword(t *testing.T) {
 					Password: "password",
 				},
 			},
-			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args) {
-				c.EXPECT().Encrypt(a.input.Password).Return("crypt_password", nil)
-				u.EXPECT().Update(a.ctx, a.input.UserId,
-					bson.D{{"$set", bson.D{{"login", a.input.Login}, {"password", "crypt_password"}}}},
-				).Return(nil)
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				p.EXPECT().CreateToken(tracedCtx(a.ctx), a.input.Login, a.input.Password).
+					Return(parser.Token{Token: "token", ExpiresAt: expiresAt}, nil)
+				c.EXPECT().Encrypt("token").Return("crypt_token", nil)
+				u.EXPECT().SetCredentials(tracedCtx(a.ctx), a.input.UserId, dbmodel.Credentials{Login: a.input.Login, Token: "crypt_token", TokenExpiresAt: expiresAt}).Return(nil)
 			},
 			expectErr: nil,
 		},
@@ -288,9 +458,25 @@ func TestUserService_UpdateLoginPassword(t *testing.T) {
 					Password: "password",
 				},
 			},
-			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args) {},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {},
 			expectErr:     ErrUserIncorrectLogin,
 		},
+		{
+			testName: "incorrect login or password",
+			args: args{
+				ctx: context.Background(),
+				input: UserLoginPasswordInput{
+					UserId:   1,
+					Login:    "stud0000000000@study.utmn.ru",
+					Password: "wrong",
+				},
+			},
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				p.EXPECT().CreateToken(tracedCtx(a.ctx), a.input.Login, a.input.Password).
+					Return(parser.Token{}, parser.ErrIncorrectLoginPassword)
+			},
+			expectErr: parser.ErrIncorrectLoginPassword,
+		},
 		{
 			testName: "user not exist",
 			args: args{
@@ -301,11 +487,11 @@ func TestUserService_UpdateLoginPassword(t *testing.T) {
 					Password: "password",
 				},
 			},
-			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args) {
-				c.EXPECT().Encrypt(a.input.Password).Return("crypt_password", nil)
-				u.EXPECT().Update(a.ctx, a.input.UserId,
-					bson.D{{"$set", bson.D{{"login", a.input.Login}, {"password", "crypt_password"}}}},
-				).Return(mongoerrs.ErrNotFound)
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				p.EXPECT().CreateToken(tracedCtx(a.ctx), a.input.Login, a.input.Password).
+					Return(parser.Token{Token: "token", ExpiresAt: expiresAt}, nil)
+				c.EXPECT().Encrypt("token").Return("crypt_token", nil)
+				u.EXPECT().SetCredentials(tracedCtx(a.ctx), a.input.UserId, gomock.Any()).Return(repoerrs.ErrNotFound)
 			},
 			expectErr: ErrUserNotFound,
 		},
@@ -319,13 +505,13 @@ func TestUserService_UpdateLoginPassword(t *testing.T) {
 					Password: "password",
 				},
 			},
-			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args) {
-				c.EXPECT().Encrypt(a.input.Password).Return("crypt_password", nil)
-				u.EXPECT().Update(a.ctx, a.input.UserId,
-					bson.D{{"$set", bson.D{{"login", a.input.Login}, {"password", "crypt_password"}}}},
-				).Return(errors.New("unexpected error"))
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				p.EXPECT().CreateToken(tracedCtx(a.ctx), a.input.Login, a.input.Password).
+					Return(parser.Token{Token: "token", ExpiresAt: expiresAt}, nil)
+				c.EXPECT().Encrypt("token").Return("crypt_token", nil)
+				u.EXPECT().SetCredentials(tracedCtx(a.ctx), a.input.UserId, gomock.Any()).Return(errors.New("unexpected error"))
 			},
-			expectErr: errors.New("unexpected error"),
+			expectErr: ErrDatabase.Wrap(errors.New("unexpected error")),
 		},
 		{
 			testName: "unexpected crypter encrypt error",
@@ -337,10 +523,12 @@ func TestUserService_UpdateLoginPassword(t *testing.T) {
 					Password: "password",
 				},
 			},
-			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, a args) {
-				c.EXPECT().Encrypt(a.input.Password).Return("", errors.New("unexpected error"))
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens, a args) {
+				p.EXPECT().CreateToken(tracedCtx(a.ctx), a.input.Login, a.input.Password).
+					Return(parser.Token{Token: "token", ExpiresAt: expiresAt}, nil)
+				c.EXPECT().Encrypt("token").Return("", errors.New("unexpected error"))
 			},
-			expectErr: errors.New("unexpected error"),
+			expectErr: ErrCrypto.Wrap(errors.New("unexpected error")),
 		},
 	}
 
@@ -350,9 +538,10 @@ func TestUserService_UpdateLoginPassword(t *testing.T) {
 
 			user := repomocks.NewMockUser(ctrl)
 			crypt := cryptermocks.NewMockCrypter(ctrl)
-			tc.mockBehaviour(user, crypt, tc.args)
+			tokens := parsermocks.NewMockTokens(ctrl)
+			tc.mockBehaviour(user, crypt, tokens, tc.args)
 
-			s := newUserService(user, crypt)
+			s := newUserService(user, crypt, tokens, nil)
 
 			err := s.UpdateLoginPassword(tc.args.ctx, tc.args.input)
 			assert.Equal(t, tc.expectErr, err)
@@ -386,11 +575,11 @@ func TestUserService_UpdateInfo(t *testing.T) {
 				},
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Update(a.ctx, a.input.UserId, bson.D{{"$set", bson.D{
-					{"full_name", a.input.FullName},
-					{"schedule_id", a.input.ScheduleId},
-					{"grades_id", a.input.GradesId},
-				}}}).Return(nil)
+				u.EXPECT().SetProfile(tracedCtx(a.ctx), a.input.UserId, dbmodel.Profile{
+					FullName:   a.input.FullName,
+					ScheduleId: a.input.ScheduleId,
+					GradesId:   a.input.GradesId,
+				}).Return(nil)
 			},
 			expectErr: nil,
 		},
@@ -406,11 +595,11 @@ func TestUserService_UpdateInfo(t *testing.T) {
 				},
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Update(a.ctx, a.input.UserId, bson.D{{"$set", bson.D{
-					{"full_name", a.input.FullName},
-					{"schedule_id", a.input.ScheduleId},
-					{"grades_id", a.input.GradesId},
-				}}}).Return(mongoerrs.ErrNotFound)
+				u.EXPECT().SetProfile(tracedCtx(a.ctx), a.input.UserId, dbmodel.Profile{
+					FullName:   a.input.FullName,
+					ScheduleId: a.input.ScheduleId,
+					GradesId:   a.input.GradesId,
+				}).Return(repoerrs.ErrNotFound)
 			},
 			expectErr: ErrUserNotFound,
 		},
@@ -426,13 +615,13 @@ func TestUserService_UpdateInfo(t *testing.T) {
 				},
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Update(a.ctx, a.input.UserId, bson.D{{"$set", bson.D{
-					{"full_name", a.input.FullName},
-					{"schedule_id", a.input.ScheduleId},
-					{"grades_id", a.input.GradesId},
-				}}}).Return(errors.New("unexpected error"))
+				u.EXPECT().SetProfile(tracedCtx(a.ctx), a.input.UserId, dbmodel.Profile{
+					FullName:   a.input.FullName,
+					ScheduleId: a.input.ScheduleId,
+					GradesId:   a.input.GradesId,
+				}).Return(errors.New("unexpected error"))
 			},
-			expectErr: errors.New("unexpected error"),
+			expectErr: ErrDatabase.Wrap(errors.New("unexpected error")),
 		},
 	}
 
@@ -443,7 +632,7 @@ func TestUserService_UpdateInfo(t *testing.T) {
 			user := repomocks.NewMockUser(ctrl)
 			tc.mockBehaviour(user, tc.args)
 
-			s := newUserService(user, nil)
+			s := newUserService(user, nil, nil, nil)
 
 			err := s.UpdateInfo(tc.args.ctx, tc.args.input)
 			assert.Equal(t, tc.expectErr, err)
@@ -472,7 +661,7 @@ func TestUserService_Delete(t *testing.T) {
 				userId: 1,
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Delete(a.ctx, a.userId).Return(nil)
+				u.EXPECT().Delete(tracedCtx(a.ctx), a.userId).Return(nil)
 			},
 			expectErr: nil,
 		},
@@ -483,7 +672,7 @@ func TestUserService_Delete(t *testing.T) {
 				userId: 123132,
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Delete(a.ctx, a.userId).Return(mongoerrs.ErrNotFound)
+				u.EXPECT().Delete(tracedCtx(a.ctx), a.userId).Return(repoerrs.ErrNotFound)
 			},
 			expectErr: ErrUserNotFound,
 		},
@@ -494,9 +683,9 @@ func TestUserService_Delete(t *testing.T) {
 				userId: 1,
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Delete(a.ctx, a.userId).Return(errors.New("unexpected error"))
+				u.EXPECT().Delete(tracedCtx(a.ctx), a.userId).Return(errors.New("unexpected error"))
 			},
-			expectErr: errors.New("unexpected error"),
+			expectErr: ErrDatabase.Wrap(errors.New("unexpected error")),
 		},
 	}
 
@@ -507,7 +696,7 @@ func TestUserService_Delete(t *testing.T) {
 			user := repomocks.NewMockUser(ctrl)
 			tc.mockBehaviour(user, tc.args)
 
-			s := newUserService(user, nil)
+			s := newUserService(user, nil, nil, nil)
 
 			err := s.Delete(tc.args.ctx, tc.args.userId)
 			assert.Equal(t, tc.expectErr, err)
@@ -515,6 +704,28 @@ func TestUserService_Delete(t *testing.T) {
 	}
 }
 
+// friendMatcher сравнивает друга без id: id генерирует сервис, поэтому проверяем только, что он выдан
+type friendMatcher struct {
+	friend dbmodel.Friend
+}
+
+func newFriend(f dbmodel.Friend) gomock.Matcher {
+	return friendMatcher{friend: f}
+}
+
+func (m friendMatcher) Matches(x interface{}) bool {
+	f, ok := x.(dbmodel.Friend)
+	if !ok || f.Id == "" {
+		return false
+	}
+	f.Id = ""
+	return f == m.friend
+}
+
+func (m friendMatcher) String() string {
+	return fmt.Sprintf("is friend %+v with new id", m.friend)
+}
+
 func TestUserService_AddFriend(t *testing.T) {
 	type args struct {
 		ctx   context.Context
@@ -527,6 +738,7 @@ func TestUserService_AddFriend(t *testing.T) {
 		testName      string
 		args          args
 		mockBehaviour mockBehaviour
+		expectOutput  FriendOutput
 		expectErr     error
 	}{
 		{
@@ -540,13 +752,16 @@ func TestUserService_AddFriend(t *testing.T) {
 				},
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Update(a.ctx, a.input.UserId,
-					bson.D{{"$push", bson.M{"friends": dbmodel.Friend{
-						FullName:   a.input.FullName,
-						ScheduleId: a.input.ScheduleId,
-					}}}}).
+				u.EXPECT().AddFriend(tracedCtx(a.ctx), a.input.UserId, newFriend(dbmodel.Friend{
+					FullName:   a.input.FullName,
+					ScheduleId: a.input.ScheduleId,
+				}), MaxFriends).
 					Return(nil)
 			},
+			expectOutput: FriendOutput{
+				FullName:   "petya",
+				ScheduleId: "foobar",
+			},
 			expectErr: nil,
 		},
 		{
@@ -560,15 +775,43 @@ func TestUserService_AddFriend(t *testing.T) {
 				},
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Update(a.ctx, a.input.UserId,
-					bson.D{{"$push", bson.M{"friends": dbmodel.Friend{
-						FullName:   a.input.FullName,
-						ScheduleId: a.input.ScheduleId,
-					}}}}).
-					Return(mongoerrs.ErrNotFound)
+				u.EXPECT().AddFriend(tracedCtx(a.ctx), a.input.UserId, gomock.Any(), MaxFriends).
+					Return(repoerrs.ErrNotFound)
 			},
 			expectErr: ErrUserNotFound,
 		},
+		{
+			testName: "friend already exists",
+			args: args{
+				ctx: context.Background(),
+				input: FriendInput{
+					UserId:     1,
+					FullName:   "petya",
+					ScheduleId: "foobar",
+				},
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().AddFriend(tracedCtx(a.ctx), a.input.UserId, gomock.Any(), MaxFriends).
+					Return(repoerrs.ErrAlreadyExists)
+			},
+			expectErr: ErrFriendAlreadyExists,
+		},
+		{
+			testName: "friends limit",
+			args: args{
+				ctx: context.Background(),
+				input: FriendInput{
+					UserId:     1,
+					FullName:   "petya",
+					ScheduleId: "foobar",
+				},
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().AddFriend(tracedCtx(a.ctx), a.input.UserId, gomock.Any(), MaxFriends).
+					Return(repoerrs.ErrLimitExceeded)
+			},
+			expectErr: ErrFriendsLimit,
+		},
 		{
 			testName: "unexpected error",
 			args: args{
@@ -580,14 +823,10 @@ func TestUserService_AddFriend(t *testing.T) {
 				},
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Update(a.ctx, a.input.UserId,
-					bson.D{{"$push", bson.M{"friends": dbmodel.Friend{
-						FullName:   a.input.FullName,
-						ScheduleId: a.input.ScheduleId,
-					}}}}).
+				u.EXPECT().AddFriend(tracedCtx(a.ctx), a.input.UserId, gomock.Any(), MaxFriends).
 					Return(errors.New("unexpected error"))
 			},
-			expectErr: errors.New("unexpected error"),
+			expectErr: ErrDatabase.Wrap(errors.New("unexpected error")),
 		},
 	}
 
@@ -598,18 +837,26 @@ func TestUserService_AddFriend(t *testing.T) {
 			user := repomocks.NewMockUser(ctrl)
 			tc.mockBehaviour(user, tc.args)
 
-			s := newUserService(user, nil)
+			s := newUserService(user, nil, nil, nil)
 
-			err := s.AddFriend(tc.args.ctx, tc.args.input)
+			output, err := s.AddFriend(tc.args.ctx, tc.args.input)
 			assert.Equal(t, tc.expectErr, err)
+			if err != nil {
+				assert.Equal(t, FriendOutput{}, output)
+				return
+			}
+			assert.NotEmpty(t, output.Id)
+			output.Id = ""
+			assert.Equal(t, tc.expectOutput, output)
 		})
 	}
 }
 
 func TestUserService_DeleteFriend(t *testing.T) {
 	type args struct {
-		ctx   context.Context
-		input FriendInput
+		ctx      context.Context
+		userId   int64
+		friendId string
 	}
 
 	type mockBehaviour func(u *repomocks.MockUser, a args)
@@ -623,15 +870,12 @@ func TestUserService_DeleteFriend(t *testing.T) {
 		{
 			testName: "correct test",
 			args: args{
-				ctx: context.Background(),
-				input: FriendInput{
-					UserId:     1,
-					ScheduleId: "foobar",
-				},
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Update(a.ctx, a.input.UserId,
-					bson.D{{"$pull", bson.M{"friends": bson.M{"schedule_id": a.input.ScheduleId}}}}).
+				u.EXPECT().RemoveFriend(tracedCtx(a.ctx), a.userId, a.friendId).
 					Return(nil)
 			},
 			expectErr: nil,
@@ -639,34 +883,28 @@ func TestUserService_DeleteFriend(t *testing.T) {
 		{
 			testName: "user not exist",
 			args: args{
-				ctx: context.Background(),
-				input: FriendInput{
-					UserId:     123,
-					ScheduleId: "foobar",
-				},
+				ctx:      context.Background(),
+				userId:   123,
+				friendId: "foobar",
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Update(a.ctx, a.input.UserId,
-					bson.D{{"$pull", bson.M{"friends": bson.M{"schedule_id": a.input.ScheduleId}}}}).
-					Return(mongoerrs.ErrNotFound)
+				u.EXPECT().RemoveFriend(tracedCtx(a.ctx), a.userId, a.friendId).
+					Return(repoerrs.ErrNotFound)
 			},
 			expectErr: ErrUserNotFound,
 		},
 		{
 			testName: "unexpected error",
 			args: args{
-				ctx: context.Background(),
-				input: FriendInput{
-					UserId:     1,
-					ScheduleId: "foobar",
-				},
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
 			},
 			mockBehaviour: func(u *repomocks.MockUser, a args) {
-				u.EXPECT().Update(a.ctx, a.input.UserId,
-					bson.D{{"$pull", bson.M{"friends": bson.M{"schedule_id": a.input.ScheduleId}}}}).
+				u.EXPECT().RemoveFriend(tracedCtx(a.ctx), a.userId, a.friendId).
 					Return(errors.New("unexpected error"))
 			},
-			expectErr: errors.New("unexpected error"),
+			expectErr: ErrDatabase.Wrap(errors.New("unexpected error")),
 		},
 	}
 
@@ -676,9 +914,329 @@ func TestUserService_DeleteFriend(t *testing.T) {
 		user := repomocks.NewMockUser(ctrl)
 		tc.mockBehaviour(user, tc.args)
 
-		s := newUserService(user, nil)
+		s := newUserService(user, nil, nil, nil)
 
-		err := s.DeleteFriend(tc.args.ctx, tc.args.input)
+		err := s.DeleteFriend(tc.args.ctx, tc.args.userId, tc.args.friendId)
 		assert.Equal(t, tc.expectErr, err)
 	}
 }
+
+func TestUserService_RenameFriend(t *testing.T) {
+	type args struct {
+		ctx      context.Context
+		userId   int64
+		friendId string
+		nickname string
+	}
+
+	type mockBehaviour func(u *repomocks.MockUser, a args)
+
+	testCases := []struct {
+		testName      string
+		args          args
+		mockBehaviour mockBehaviour
+		expectErr     error
+	}{
+		{
+			testName: "correct test",
+			args: args{
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
+				nickname: "  Петя ",
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().RenameFriend(tracedCtx(a.ctx), a.userId, a.friendId, "Петя").Return(nil)
+			},
+			expectErr: nil,
+		},
+		{
+			testName: "reset nickname",
+			args: args{
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
+				nickname: "",
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().RenameFriend(tracedCtx(a.ctx), a.userId, a.friendId, "").Return(nil)
+			},
+			expectErr: nil,
+		},
+		{
+			testName: "nickname max length",
+			args: args{
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
+				nickname: strings.Repeat("я", MaxNicknameLength),
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().RenameFriend(tracedCtx(a.ctx), a.userId, a.friendId, a.nickname).Return(nil)
+			},
+			expectErr: nil,
+		},
+		{
+			testName: "nickname too long",
+			args: args{
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
+				nickname: strings.Repeat("я", MaxNicknameLength+1),
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {},
+			expectErr:     ErrFriendIncorrectNickname,
+		},
+		{
+			testName: "friend not exist",
+			args: args{
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
+				nickname: "Петя",
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().RenameFriend(tracedCtx(a.ctx), a.userId, a.friendId, a.nickname).Return(repoerrs.ErrNotFound)
+			},
+			expectErr: ErrFriendNotFound,
+		},
+		{
+			testName: "unexpected error",
+			args: args{
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
+				nickname: "Петя",
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().RenameFriend(tracedCtx(a.ctx), a.userId, a.friendId, a.nickname).Return(errors.New("unexpected error"))
+			},
+			expectErr: ErrDatabase.Wrap(errors.New("unexpected error")),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			user := repomocks.NewMockUser(ctrl)
+			tc.mockBehaviour(user, tc.args)
+
+			s := newUserService(user, nil, nil, nil)
+
+			err := s.RenameFriend(tc.args.ctx, tc.args.userId, tc.args.friendId, tc.args.nickname)
+			assert.Equal(t, tc.expectErr, err)
+		})
+	}
+}
+
+func TestUserService_MoveFriend(t *testing.T) {
+	type args struct {
+		ctx      context.Context
+		userId   int64
+		friendId string
+		position int
+	}
+
+	type mockBehaviour func(u *repomocks.MockUser, a args)
+
+	testCases := []struct {
+		testName      string
+		args          args
+		mockBehaviour mockBehaviour
+		expectErr     error
+	}{
+		{
+			testName: "correct test",
+			args: args{
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
+				position: 2,
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().MoveFriend(tracedCtx(a.ctx), a.userId, a.friendId, a.position).Return(nil)
+			},
+			expectErr: nil,
+		},
+		{
+			testName: "friend not exist",
+			args: args{
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
+				position: 2,
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().MoveFriend(tracedCtx(a.ctx), a.userId, a.friendId, a.position).Return(repoerrs.ErrNotFound)
+			},
+			expectErr: ErrFriendNotFound,
+		},
+		{
+			testName: "unexpected error",
+			args: args{
+				ctx:      context.Background(),
+				userId:   1,
+				friendId: "foobar",
+				position: 2,
+			},
+			mockBehaviour: func(u *repomocks.MockUser, a args) {
+				u.EXPECT().MoveFriend(tracedCtx(a.ctx), a.userId, a.friendId, a.position).Return(errors.New("unexpected error"))
+			},
+			expectErr: ErrDatabase.Wrap(errors.New("unexpected error")),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			user := repomocks.NewMockUser(ctrl)
+			tc.mockBehaviour(user, tc.args)
+
+			s := newUserService(user, nil, nil, nil)
+
+			err := s.MoveFriend(tc.args.ctx, tc.args.userId, tc.args.friendId, tc.args.position)
+			assert.Equal(t, tc.expectErr, err)
+		})
+	}
+}
+
+func TestUserService_MigrateCredentials(t *testing.T) {
+	expiresAt := time.Now().Add(7 * 24 * time.Hour).UTC().Truncate(time.Millisecond)
+	users := []dbmodel.User{
+		{UserId: 1, Login: "foo", Password: "crypt_password"},
+		{UserId: 2, Login: "bar", Token: "crypt_token", TokenExpiresAt: expiresAt},
+		{UserId: 3},
+		{UserId: 4, Login: "baz", Password: "other_crypt_password"},
+	}
+
+	type mockBehaviour func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens)
+
+	testCases := []struct {
+		testName      string
+		mockBehaviour mockBehaviour
+		expectUpdated int
+		expectErr     error
+	}{
+		{
+			testName: "correct test",
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens) {
+				u.EXPECT().ForEach(tracedCtx(context.Background()), gomock.Any()).DoAndReturn(
+					func(_ context.Context, fn func(dbmodel.User) error) error {
+						for _, user := range users {
+							if err := fn(user); err != nil {
+								return err
+							}
+						}
+						return nil
+					})
+				c.EXPECT().Decrypt("crypt_password").Return("password", nil)
+				p.EXPECT().CreateToken(gomock.Any(), "foo", secret.String("password")).Return(parser.Token{Token: "token", ExpiresAt: expiresAt}, nil)
+				c.EXPECT().Encrypt("token").Return("new_crypt_token", nil)
+				u.EXPECT().SetCredentials(gomock.Any(), int64(1), gomock.Any()).Return(nil)
+
+				c.EXPECT().Outdated("crypt_token").Return(false)
+
+				// Временная ошибка парсера не прерывает обход
+				c.EXPECT().Decrypt("other_crypt_password").Return("other_password", nil)
+				p.EXPECT().CreateToken(gomock.Any(), "baz", secret.String("other_password")).Return(parser.Token{}, parser.ErrModeusUnavailable)
+			},
+			expectUpdated: 1,
+			expectErr:     nil,
+		},
+		{
+			testName: "decrypt error keeps credentials",
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens) {
+				u.EXPECT().ForEach(tracedCtx(context.Background()), gomock.Any()).DoAndReturn(
+					func(_ context.Context, fn func(dbmodel.User) error) error {
+						for _, user := range []dbmodel.User{
+							{UserId: 1, Login: "foo", Password: "crypt_password"},
+							{UserId: 2, Login: "bar", Token: "expiring_crypt_token", TokenExpiresAt: time.Now().Add(time.Hour)},
+							{UserId: 3, Login: "baz", Token: "outdated_crypt_token", TokenExpiresAt: expiresAt},
+						} {
+							if err := fn(user); err != nil {
+								return err
+							}
+						}
+						return nil
+					})
+				c.EXPECT().Decrypt("crypt_password").Return("", errors.New("unknown key id"))
+				c.EXPECT().Decrypt("expiring_crypt_token").Return("", errors.New("unknown key id"))
+				c.EXPECT().Outdated("outdated_crypt_token").Return(true)
+				c.EXPECT().Decrypt("outdated_crypt_token").Return("", errors.New("unknown key id"))
+				u.EXPECT().SetCredentials(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			},
+			expectUpdated: 0,
+			expectErr:     nil,
+		},
+		{
+			testName: "unexpected error",
+			mockBehaviour: func(u *repomocks.MockUser, c *cryptermocks.MockCrypter, p *parsermocks.MockTokens) {
+				u.EXPECT().ForEach(tracedCtx(context.Background()), gomock.Any()).Return(errors.New("unexpected error"))
+			},
+			expectUpdated: 0,
+			expectErr:     ErrDatabase.Wrap(errors.New("unexpected error")),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+
+			user := repomocks.NewMockUser(ctrl)
+			crypter := cryptermocks.NewMockCrypter(ctrl)
+			tokens := parsermocks.NewMockTokens(ctrl)
+			tc.mockBehaviour(user, crypter, tokens)
+
+			s := newUserService(user, crypter, tokens, nil)
+
+			updated, err := s.MigrateCredentials(context.Background())
+			assert.Equal(t, tc.expectErr, err)
+			assert.Equal(t, tc.expectUpdated, updated)
+		})
+	}
+}
+
+func TestUserService_Events(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	user := repomocks.NewMockUser(ctrl)
+
+	bus := events.NewLocalBus()
+	var published []events.Event
+	bus.Subscribe(func(ctx context.Context, e events.Event) {
+		published = append(published, e)
+	})
+	s := newUserService(user, nil, nil, bus)
+
+	user.EXPECT().Upsert(tracedCtx(ctx), gomock.Any()).Return(true, nil)
+	_, err := s.Create(ctx, UserInput{UserId: 1})
+	assert.Nil(t, err)
+
+	user.EXPECT().Upsert(tracedCtx(ctx), gomock.Any()).Return(false, nil)
+	_, err = s.Create(ctx, UserInput{UserId: 1})
+	assert.Nil(t, err)
+
+	user.EXPECT().AddFriend(tracedCtx(ctx), int64(1), gomock.Any(), MaxFriends).Return(nil)
+	_, err = s.AddFriend(ctx, FriendInput{UserId: 1, ScheduleId: "foobar"})
+	assert.Nil(t, err)
+
+	user.EXPECT().RenameFriend(tracedCtx(ctx), int64(1), "foobar", "Петя").Return(nil)
+	assert.Nil(t, s.RenameFriend(ctx, 1, "foobar", "Петя"))
+
+	// при ошибке записи в бд событие не публикуется
+	user.EXPECT().RemoveFriend(tracedCtx(ctx), int64(1), gomock.Any()).Return(repoerrs.ErrNotFound)
+	assert.Equal(t, ErrUserNotFound, s.DeleteFriend(ctx, 1, "foobar"))
+
+	user.EXPECT().Delete(tracedCtx(ctx), int64(1)).Return(nil)
+	assert.Nil(t, s.Delete(ctx, 1))
+
+	assert.Equal(t, []events.Event{
+		{Type: events.UserCreated, UserId: 1},
+		{Type: events.UserUpdated, UserId: 1},
+		{Type: events.FriendAdded, UserId: 1},
+		{Type: events.FriendUpdated, UserId: 1},
+		{Type: events.UserDeleted, UserId: 1},
+	}, published)
+}
@@ -2,12 +2,15 @@ package bot
 
 import (
 	"bot_for_modeus/pkg/singleflight"
+	"bot_for_modeus/pkg/tracing"
 	"context"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"log"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Default settings
@@ -15,6 +18,10 @@ const (
 	defaultParseMode = "HTML"
 )
 
+// stateMarkerKey - ключ данных пользователя, который есть, пока у него было выставлено состояние (см. Context.SetTempState).
+// Без времени жизни, поэтому переживает истекшее состояние
+const stateMarkerKey = "bot:state"
+
 type Logger interface {
 	Printf(format string, args ...any)
 }
@@ -28,10 +35,18 @@ type Bot struct {
 	middleware    []MiddlewareFunc
 	premiddleware []MiddlewareFunc
 	storage       storage
+	codec         Codec
+	stateTTL      time.Duration
+	callbackTTL   time.Duration
+	pagesTTL      time.Duration
+	fallback      HandlerFunc
 	logger        Logger
 	stop          chan bool
 	once          *singleflight.Flight
 	isWebhook     bool
+
+	// Время получения последнего апдейта (unix nano), см. LastUpdate
+	lastUpdate atomic.Int64
 }
 
 type Settings struct {
@@ -49,26 +64,34 @@ func NewBot(s *Settings, opts ...Option) (*Bot, error) {
 		s.Ctx = context.Background()
 	}
 	b := &Bot{
-		client:    client,
-		wg:        new(sync.WaitGroup),
-		ctx:       s.Ctx,
-		parseMode: defaultParseMode,
-		routers:   newRouter(),
-		storage:   newMemoryStorage(),
-		logger:    log.New(os.Stdout, "/bot", 4),
-		stop:      make(chan bool),
-		once:      singleflight.NewFlight(),
-		isWebhook: s.IsWebhook,
+		client:      client,
+		wg:          new(sync.WaitGroup),
+		ctx:         s.Ctx,
+		parseMode:   defaultParseMode,
+		routers:     newRouter(),
+		storage:     newMemoryStorage(),
+		callbackTTL: defaultCallbackTTL,
+		pagesTTL:    defaultPagesTTL,
+		logger:      log.New(os.Stdout, "/bot", 4),
+		stop:        make(chan bool),
+		once:        singleflight.NewFlight(),
+		isWebhook:   s.IsWebhook,
 	}
 	for _, option := range opts {
 		if err = option(b); err != nil {
 			return nil, err
 		}
 	}
+	// Кодек применяется после всех опций, потому что хранилище тоже задается опцией и порядок опций не должен влиять на результат
+	if b.codec != nil {
+		b.storage.setCodec(b.codec)
+	}
 	return b, nil
 }
 
 func (b *Bot) ListenAndServe() {
+	b.lastUpdate.Store(time.Now().UnixNano())
+
 	var updates tgbotapi.UpdatesChannel
 	if b.isWebhook {
 		updates = b.client.ListenForWebhook("/")
@@ -85,6 +108,7 @@ func (b *Bot) ListenAndServe() {
 	for {
 		select {
 		case u := <-updates:
+			b.lastUpdate.Store(time.Now().UnixNano())
 			b.wg.Add(1)
 			go b.processMessage(u)
 		case <-b.stop:
@@ -93,21 +117,42 @@ func (b *Bot) ListenAndServe() {
 	}
 }
 
+// LastUpdate возвращает время получения последнего апдейта (до первого апдейта - время запуска ListenAndServe).
+// Нужен для проверки живости: если апдейты долго не приходят, получение апдейтов могло зависнуть
+func (b *Bot) LastUpdate() time.Time {
+	return time.Unix(0, b.lastUpdate.Load())
+}
+
 func (b *Bot) processMessage(u tgbotapi.Update) {
 	defer b.wg.Done()
-	c := b.NewContext(u)
+
+	var err error
+	ctx, span := b.startUpdateSpan(u)
+	defer func() { tracing.End(span, err) }()
 
 	// на коллбэк (нажатие инлайн кнопки) нужно ответить пустым, чтобы убрать анимацию "ожидания" на кнопке
 	if u.CallbackQuery != nil {
 		b.answerEmptyCallback(u.CallbackQuery)
+
+		// Декодируем данные до маршрутизации, чтобы хэндлеры (и c.Text()) работали с исходными данными (см. callback.go)
+		var data string
+		if data, err = b.decodeCallback(u.CallbackQuery.Data); err != nil {
+			b.logger.Printf("/processMessage decode callback data err: %s", err)
+		} else {
+			u.CallbackQuery.Data = data
+		}
 	}
+	c := b.NewContext(u)
+	c.SetContext(ctx)
 
 	f, ok := b.handle(c, u)
 	if !ok {
 		return
 	}
 
-	if err := f(c); err != nil {
+	// Ошибка декодирования коллбэка остается на спане, если хэндлер отработал без ошибки
+	if handleErr := f(c); handleErr != nil {
+		err = handleErr
 		b.logger.Printf("/processMessage handle message func err: %s", err)
 	}
 }
@@ -116,8 +161,10 @@ func (b *Bot) processMessage(u tgbotapi.Update) {
 func (b *Bot) handle(c Context, u tgbotapi.Update) (HandlerFunc, bool) {
 	if u.Message != nil {
 		if u.Message.IsCommand() {
-			f, ok := b.routers[OnCommand].find(c, u.Message.Text)
-			return f, ok
+			if f, ok := b.routers[OnCommand].find(c, u.Message.Text); ok {
+				return f, ok
+			}
+			return nil, false
 		}
 		// Может быть нажатие с обычной клавиатуры
 		if f, ok := b.routers[OnMessage].find(c, u.Message.Text); ok {
@@ -132,15 +179,62 @@ func (b *Bot) handle(c Context, u tgbotapi.Update) (HandlerFunc, bool) {
 	// Если условия выше ничего не вернули, значит это либо обычное сообщение от пользователя (не /команда) (попросили его что-то ввести),
 	// либо в инлайн кнопке на коллбэк есть какое-то значение, которое надо обработать отдельно от ручки коллбэков.
 	// Соответственно, при таких вариантах это какое-то состояние пользователя
-	state, _ := b.storage.getState(c.UserId())
-	f, ok := b.routers[OnState].find(c, state)
-	return f, ok
+	id := c.UserId()
+	state, err := b.storage.getState(id)
+	if err == nil {
+		if f, ok := b.routers[OnState].find(c, state); ok {
+			return f, ok
+		}
+		// Состояние есть, но обработчика для него нет (например, осталось от старой версии бота).
+		// Такое состояние "зависло", поэтому сбрасываем его
+		_ = b.storage.delState(id)
+		_ = b.storage.delData(id, stateMarkerKey)
+		return b.fallback, b.fallback != nil
+	}
+	// Состояния нет. Если оно было и истекло (осталась отметка), пользователь, скорее всего, отвечает на старый вопрос,
+	// поэтому подсказываем через fallback. Если состояния не было вовсе, обновление игнорируем, как и раньше
+	var marked bool
+	if b.storage.getData(id, stateMarkerKey, &marked) != nil {
+		return nil, false
+	}
+	_ = b.storage.delData(id, stateMarkerKey)
+	return b.fallback, b.fallback != nil
+}
+
+// Cancel регистрирует команду, которая сбрасывает состояние и все данные пользователя, а затем вызывает h (может быть nil).
+// Нужна, чтобы пользователь всегда мог выйти из любого сценария
+func (b *Bot) Cancel(command string, h HandlerFunc, m ...MiddlewareFunc) {
+	b.Command(command, func(c Context) error {
+		if err := c.Clear(); err != nil {
+			return err
+		}
+		if h != nil {
+			return h(c)
+		}
+		return nil
+	}, m...)
+}
+
+// Fallback регистрирует обработчик для обновлений, которым не подошел ни один маршрут, а состояние пользователя устарело:
+// истекло или для него нет обработчика. Обновления пользователей без состояния игнорируются
+func (b *Bot) Fallback(h HandlerFunc, m ...MiddlewareFunc) {
+	stack := append(b.middleware, m...)
+	b.fallback = applyMiddleware(traceHandler("fallback", h), append(stack, b.premiddleware...)...)
+}
+
+// DelData удаляет данные пользователя по ключам вне обработки апдейта.
+// Нужно, например, для инвалидации кэша по событиям, пришедшим от других реплик
+func (b *Bot) DelData(id int64, keys ...string) error {
+	return b.storage.delData(id, keys...)
 }
 
 func (b *Bot) Shutdown() {
 	b.stop <- true
 	b.client.StopReceivingUpdates()
 	b.wg.Wait()
+	if err := b.storage.close(); err != nil {
+		b.logger.Printf("/Shutdown close storage err: %s", err)
+	}
 }
 
 func (b *Bot) answerEmptyCallback(c *tgbotapi.CallbackQuery) {
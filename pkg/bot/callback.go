@@ -0,0 +1,144 @@
+package bot
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+	"time"
+)
+
+// Кодек callback data.
+// Телеграм ограничивает callback data 64 байтами, а маршруты вида /friends/:type/:date/:schedule_id с uuid едва в него влезают.
+// Поэтому перед отправкой клавиатуры данные кодируются:
+//   - uuid в сегментах пути упаковываются в base64 (16 байт вместо 36 символов) с префиксом packedUUIDPrefix;
+//   - если и после этого данные не влезают, то они целиком сохраняются в хранилище под коротким ключом с префиксом storedPrefix.
+//
+// Входящие коллбэки декодируются до маршрутизации, поэтому хэндлеры работают с исходными данными
+const (
+	maxCallbackDataSize = 64
+	defaultCallbackTTL  = time.Hour * 24 * 30
+
+	packedUUIDPrefix = '~'
+	storedPrefix     = '#'
+	storedKeySize    = 12
+	uuidSize         = 36
+)
+
+// encodeCallback сжимает данные, если они не влезают в лимит телеграма
+func (b *Bot) encodeCallback(data string) (string, error) {
+	if !needEscape(data) {
+		if len(data) <= maxCallbackDataSize {
+			return data, nil
+		}
+		if packed := packUUIDs(data); len(packed) <= maxCallbackDataSize {
+			return packed, nil
+		}
+	}
+
+	// Ключ детерминированный, поэтому одни и те же данные не плодят новые записи в хранилище
+	sum := sha256.Sum256([]byte(data))
+	key := base64.RawURLEncoding.EncodeToString(sum[:storedKeySize])
+	if err := b.storage.setCommonData(callbackKey(key), data, b.callbackTTL); err != nil {
+		return "", err
+	}
+	return string(storedPrefix) + key, nil
+}
+
+// decodeCallback восстанавливает исходные данные коллбэка
+func (b *Bot) decodeCallback(data string) (string, error) {
+	if data == "" {
+		return data, nil
+	}
+	if data[0] == storedPrefix {
+		var original string
+		if err := b.storage.getCommonData(callbackKey(data[1:]), &original); err != nil {
+			return "", err
+		}
+		return original, nil
+	}
+	if strings.IndexByte(data, packedUUIDPrefix) == -1 {
+		return data, nil
+	}
+	return unpackUUIDs(data), nil
+}
+
+// encodeKeyboard кодирует callback data всех кнопок. Исходная клавиатура не изменяется,
+// потому что часто это глобальные переменные (см. tgmodel), которые используются конкурентно
+func (b *Bot) encodeKeyboard(kb [][]tgbotapi.InlineKeyboardButton) ([][]tgbotapi.InlineKeyboardButton, error) {
+	result := make([][]tgbotapi.InlineKeyboardButton, len(kb))
+	for i, row := range kb {
+		result[i] = make([]tgbotapi.InlineKeyboardButton, len(row))
+		for j, button := range row {
+			if button.CallbackData != nil {
+				data, err := b.encodeCallback(*button.CallbackData)
+				if err != nil {
+					return nil, err
+				}
+				button.CallbackData = &data
+			}
+			result[i][j] = button
+		}
+	}
+	return result, nil
+}
+
+// Исходные данные, которые сами начинаются с префикса хранилища или содержат сегмент с префиксом упакованного uuid,
+// тоже нужно сохранить, иначе при декодировании их не отличить от ключа или упакованного uuid
+func needEscape(data string) bool {
+	if data == "" {
+		return false
+	}
+	return data[0] == storedPrefix || data[0] == packedUUIDPrefix || strings.Contains(data, "/"+string(packedUUIDPrefix))
+}
+
+func callbackKey(key string) string {
+	return "callback:" + key
+}
+
+// packUUIDs заменяет сегменты пути в формате uuid на ~base64
+func packUUIDs(data string) string {
+	segments := strings.Split(data, "/")
+	for i, seg := range segments {
+		if b, ok := parseUUID(seg); ok {
+			segments[i] = string(packedUUIDPrefix) + base64.RawURLEncoding.EncodeToString(b)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func unpackUUIDs(data string) string {
+	segments := strings.Split(data, "/")
+	for i, seg := range segments {
+		if len(seg) == 0 || seg[0] != packedUUIDPrefix {
+			continue
+		}
+		b, err := base64.RawURLEncoding.DecodeString(seg[1:])
+		if err != nil || len(b) != 16 {
+			continue
+		}
+		segments[i] = formatUUID(b)
+	}
+	return strings.Join(segments, "/")
+}
+
+// parseUUID разбирает uuid только в каноническом виде (нижний регистр), иначе при распаковке получим другую строку
+func parseUUID(s string) ([]byte, bool) {
+	if len(s) != uuidSize || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return nil, false
+	}
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s[:8] + s[9:13] + s[14:18] + s[19:23] + s[24:])
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+func formatUUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
@@ -0,0 +1,108 @@
+package bot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func Test_Bot_encodeCallback(t *testing.T) {
+	b := &Bot{
+		storage:     newMemoryStorage(),
+		callbackTTL: defaultCallbackTTL,
+	}
+
+	testCases := []struct {
+		testName     string
+		data         string
+		expectSame   bool
+		expectStored bool
+	}{
+		{
+			testName:   "short data",
+			data:       "/friends/action/5608b53c-8568-4fbe-b72d-c4f278b3f4b6",
+			expectSame: true,
+		},
+		{
+			testName: "2 uuid",
+			data:     "/grades/subjects/5608b53c-8568-4fbe-b72d-c4f278b3f4b6/a07bd176-2cea-405a-8f69-baa82c28f089",
+		},
+		{
+			testName:     "too long data without uuid",
+			data:         "/some/" + strings.Repeat("a", 100),
+			expectStored: true,
+		},
+		{
+			testName:     "data starts with stored prefix",
+			data:         "#foobar",
+			expectStored: true,
+		},
+		{
+			testName:     "data with packed uuid prefix",
+			data:         "/search/~AAAAAAAAAAAAAAAAAAAAAA",
+			expectStored: true,
+		},
+		{
+			testName:     "data starts with packed uuid prefix",
+			data:         "~AAAAAAAAAAAAAAAAAAAAAA",
+			expectStored: true,
+		},
+		{
+			testName:     "uppercase uuid is not packed",
+			data:         "/grades/subjects/5608B53C-8568-4FBE-B72D-C4F278B3F4B6/A07BD176-2CEA-405A-8F69-BAA82C28F089",
+			expectStored: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			encoded, err := b.encodeCallback(tc.data)
+			assert.Nil(t, err)
+			assert.LessOrEqual(t, len(encoded), maxCallbackDataSize)
+			assert.Equal(t, tc.expectSame, encoded == tc.data)
+			assert.Equal(t, tc.expectStored, encoded[0] == storedPrefix)
+
+			decoded, err := b.decodeCallback(encoded)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.data, decoded)
+		})
+	}
+}
+
+func Test_Bot_decodeCallback_expired(t *testing.T) {
+	b := &Bot{
+		storage: newMemoryStorage(),
+	}
+	_, err := b.decodeCallback("#not_exist_key")
+	assert.Equal(t, ErrKeyNotExists, err)
+}
+
+func Test_Bot_encodeKeyboard(t *testing.T) {
+	b := &Bot{
+		storage:     newMemoryStorage(),
+		callbackTTL: defaultCallbackTTL,
+	}
+	long := "/grades/subjects/5608b53c-8568-4fbe-b72d-c4f278b3f4b6/a07bd176-2cea-405a-8f69-baa82c28f089"
+	kb := [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("subject", long)},
+		{tgbotapi.NewInlineKeyboardButtonURL("link", "https://utmn.modeus.org")},
+	}
+
+	encoded, err := b.encodeKeyboard(kb)
+	assert.Nil(t, err)
+	assert.NotEqual(t, long, *encoded[0][0].CallbackData)
+	assert.Nil(t, encoded[1][0].CallbackData)
+
+	// исходная клавиатура не должна измениться
+	assert.Equal(t, long, *kb[0][0].CallbackData)
+}
+
+func Benchmark_packUUIDs(b *testing.B) {
+	data := "/grades/subjects/5608b53c-8568-4fbe-b72d-c4f278b3f4b6/a07bd176-2cea-405a-8f69-baa82c28f089"
+	for i := 0; i < b.N; i++ {
+		if unpackUUIDs(packUUIDs(data)) != data {
+			b.Fatalf("pack/unpack result is not equal to source data")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bytedance/sonic"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec сериализует данные пользователей перед сохранением в хранилище.
+// Выбирается через опцию StorageCodec и одинаков для всех хранилищ, поэтому тесты с memory storage ведут себя так же, как redis
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSONCodec    Codec = jsonCodec{}
+	SonicCodec   Codec = sonicCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+
+	// Sonic совместим с encoding/json по формату, но быстрее. Раньше redis хранилище использовало именно его
+	defaultCodec = SonicCodec
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type sonicCodec struct{}
+
+func (sonicCodec) Marshal(v any) ([]byte, error) {
+	return sonic.Marshal(v)
+}
+
+func (sonicCodec) Unmarshal(data []byte, v any) error {
+	return sonic.Unmarshal(data, v)
+}
+
+// msgpackCodec использует json теги структур, чтобы сторонние типы (например, кнопки tgbotapi) сохранялись так же, как в json
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+
+	enc.Reset(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(dec)
+
+	dec.Reset(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// zstd кадр всегда начинается с этих байтов. Ни json, ни msgpack значение так начинаться не может,
+// поэтому сжатые и несжатые (в том числе сохраненные до включения сжатия) данные различаются без отдельного флага
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+type compressedCodec struct {
+	Codec
+	threshold int
+}
+
+// Compressed оборачивает codec: значения больше threshold байт сжимаются zstd.
+// Полезно для больших значений, например, закэшированных текстов с оценками за семестр
+func Compressed(codec Codec, threshold int) Codec {
+	return compressedCodec{
+		Codec:     codec,
+		threshold: threshold,
+	}
+}
+
+func (c compressedCodec) Marshal(v any) ([]byte, error) {
+	b, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) <= c.threshold {
+		return b, nil
+	}
+	return zstdEncoder.EncodeAll(b, make([]byte, 0, len(b)/2)), nil
+}
+
+func (c compressedCodec) Unmarshal(data []byte, v any) error {
+	if bytes.HasPrefix(data, zstdMagic) {
+		b, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return err
+		}
+		data = b
+	}
+	return c.Codec.Unmarshal(data, v)
+}
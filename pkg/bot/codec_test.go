@@ -0,0 +1,94 @@
+package bot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+type codecTestData struct {
+	ScheduleId string            `json:"schedule_id"`
+	Login      string            `json:"login,omitempty"`
+	Subjects   map[string]string `json:"subjects"`
+	Numbers    []int             `json:"numbers"`
+}
+
+func Test_Codec(t *testing.T) {
+	testCases := []struct {
+		testName string
+		codec    Codec
+	}{
+		{
+			testName: "json",
+			codec:    JSONCodec,
+		},
+		{
+			testName: "sonic",
+			codec:    SonicCodec,
+		},
+		{
+			testName: "msgpack",
+			codec:    MsgpackCodec,
+		},
+		{
+			testName: "compressed json",
+			codec:    Compressed(JSONCodec, 64),
+		},
+		{
+			testName: "compressed msgpack",
+			codec:    Compressed(MsgpackCodec, 64),
+		},
+	}
+
+	data := codecTestData{
+		ScheduleId: "5608b53c-8568-4fbe-b72d-c4f278b3f4b6",
+		Subjects:   map[string]string{"a07bd176-2cea-405a-8f69-baa82c28f089": "Математический анализ"},
+		Numbers:    []int{1, 2, 3},
+	}
+	text := strings.Repeat("<b>Математический анализ</b>: 5\n", 100)
+	kb := [][]tgbotapi.InlineKeyboardButton{{tgbotapi.NewInlineKeyboardButtonData("Назад", "/back")}}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			b, err := tc.codec.Marshal(data)
+			assert.Nil(t, err)
+			var actualData codecTestData
+			assert.Nil(t, tc.codec.Unmarshal(b, &actualData))
+			assert.Equal(t, data, actualData)
+
+			b, err = tc.codec.Marshal(text)
+			assert.Nil(t, err)
+			var actualText string
+			assert.Nil(t, tc.codec.Unmarshal(b, &actualText))
+			assert.Equal(t, text, actualText)
+
+			b, err = tc.codec.Marshal(kb)
+			assert.Nil(t, err)
+			var actualKB [][]tgbotapi.InlineKeyboardButton
+			assert.Nil(t, tc.codec.Unmarshal(b, &actualKB))
+			assert.Equal(t, kb, actualKB)
+		})
+	}
+}
+
+func Test_Compressed(t *testing.T) {
+	codec := Compressed(SonicCodec, 64)
+	text := strings.Repeat("<b>Математический анализ</b>: 5\n", 100)
+
+	plain, err := SonicCodec.Marshal(text)
+	assert.Nil(t, err)
+	compressed, err := codec.Marshal(text)
+	assert.Nil(t, err)
+	assert.Less(t, len(compressed), len(plain))
+
+	// маленькие значения не сжимаются
+	b, err := codec.Marshal("short")
+	assert.Nil(t, err)
+	assert.Equal(t, `"short"`, string(b))
+
+	// данные, сохраненные до включения сжатия, читаются без ошибок
+	var actual string
+	assert.Nil(t, codec.Unmarshal(plain, &actual))
+	assert.Equal(t, text, actual)
+}
@@ -1,34 +1,55 @@
 package bot
 
 import (
+	"bot_for_modeus/pkg/tracing"
 	"context"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel/trace"
+	"strconv"
 	"time"
 )
 
 type Context interface {
 	Bot() *Bot
 	Update() tgbotapi.Update
+	// Context возвращает контекст обработки апдейта. В нем спан трассировки, поэтому его нужно передавать в сервисы
 	Context() context.Context
+	SetContext(ctx context.Context)
 
 	UserId() int64
 	Text() string
 
 	// Param возвращает значение параметра в маршруте
 	Param(name string) string
+	// ParamInt и ParamDate возвращают значения типизированных параметров (:name<int>, :name<date>).
+	// Для таких параметров маршрут уже проверил формат, поэтому ошибка возможна только для нетипизированных
+	ParamInt(name string) (int, error)
+	ParamDate(name string) (time.Time, error)
 
 	SendMessage(text string) error
 	SendMessageWithInlineKB(text string, kb [][]tgbotapi.InlineKeyboardButton) error
 	SendMessageWithReplyKB(text string, kb [][]tgbotapi.KeyboardButton) error
 
+	// SendDocument отправляет data файлом с именем name, caption - подпись к файлу
+	SendDocument(name string, data []byte, caption string) error
+
 	EditMessage(text string) error
 	EditMessageWithInlineKB(text string, kb [][]tgbotapi.InlineKeyboardButton) error
 
+	// SendLongMessage отправляет текст несколькими сообщениями, если он не влезает в одно. Клавиатура прикрепляется к последнему
+	SendLongMessage(text string, kb [][]tgbotapi.InlineKeyboardButton) error
+	// SendPages и EditPages показывают длинный текст одним сообщением с постраничной навигацией (см. Bot.Pagination)
+	SendPages(text string, kb [][]tgbotapi.InlineKeyboardButton) error
+	EditPages(text string, kb [][]tgbotapi.InlineKeyboardButton) error
+
 	DeleteLastMessage() error
 	DeleteInlineKB() error
 
+	// SetState устанавливает состояние со временем жизни по умолчанию (см. StateTTL)
 	SetState(state string) error
+	SetTempState(state string, d time.Duration) error
 	GetState() (string, error)
+	DelState() error
 
 	SetData(key string, v any) error
 	SetTempData(key string, v any, d time.Duration) error
@@ -40,6 +61,8 @@ type Context interface {
 	DelData(keys ...string) error
 	DelCommonData(keys ...string) error
 	Clear() error
+	// Keys возвращает ключи всех данных пользователя, например, для выгрузки его персональных данных
+	Keys() ([]string, error)
 
 	// DoOnce implements singleflight pattern
 	DoOnce(ctx context.Context, key string, f func() (any, error)) (any, error)
@@ -47,6 +70,7 @@ type Context interface {
 
 type nativeContext struct {
 	bot    *Bot
+	ctx    context.Context
 	update tgbotapi.Update
 	params map[string]string
 }
@@ -54,6 +78,7 @@ type nativeContext struct {
 func (b *Bot) NewContext(u tgbotapi.Update) Context {
 	return &nativeContext{
 		bot:    b,
+		ctx:    b.ctx,
 		update: u,
 		params: map[string]string{},
 	}
@@ -68,7 +93,14 @@ func (c *nativeContext) Update() tgbotapi.Update {
 }
 
 func (c *nativeContext) Context() context.Context {
-	return c.bot.ctx
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+func (c *nativeContext) SetContext(ctx context.Context) {
+	c.ctx = ctx
 }
 
 func (c *nativeContext) UserId() int64 {
@@ -98,6 +130,14 @@ func (c *nativeContext) Param(name string) string {
 	return c.params[name]
 }
 
+func (c *nativeContext) ParamInt(name string) (int, error) {
+	return strconv.Atoi(c.params[name])
+}
+
+func (c *nativeContext) ParamDate(name string) (time.Time, error) {
+	return time.Parse(time.DateOnly, c.params[name])
+}
+
 func (c *nativeContext) SendMessage(text string) error {
 	msg := tgbotapi.NewMessage(c.UserId(), text)
 	msg.ParseMode = c.bot.parseMode
@@ -105,6 +145,10 @@ func (c *nativeContext) SendMessage(text string) error {
 }
 
 func (c *nativeContext) SendMessageWithInlineKB(text string, kb [][]tgbotapi.InlineKeyboardButton) error {
+	kb, err := c.bot.encodeKeyboard(kb)
+	if err != nil {
+		return err
+	}
 	msg := tgbotapi.NewMessage(c.UserId(), text)
 	msg.ParseMode = c.bot.parseMode
 	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(kb...)
@@ -125,6 +169,10 @@ func (c *nativeContext) EditMessage(text string) error {
 }
 
 func (c *nativeContext) EditMessageWithInlineKB(text string, kb [][]tgbotapi.InlineKeyboardButton) error {
+	kb, err := c.bot.encodeKeyboard(kb)
+	if err != nil {
+		return err
+	}
 	msg := tgbotapi.NewEditMessageText(c.UserId(), c.lastMessageId(), text)
 	msg.ParseMode = c.bot.parseMode
 
@@ -134,6 +182,13 @@ func (c *nativeContext) EditMessageWithInlineKB(text string, kb [][]tgbotapi.Inl
 	return c.request(msg)
 }
 
+func (c *nativeContext) SendDocument(name string, data []byte, caption string) error {
+	msg := tgbotapi.NewDocument(c.UserId(), tgbotapi.FileBytes{Name: name, Bytes: data})
+	msg.Caption = caption
+	msg.ParseMode = c.bot.parseMode
+	return c.request(msg)
+}
+
 func (c *nativeContext) DeleteLastMessage() error {
 	msg := tgbotapi.NewDeleteMessage(c.UserId(), c.lastMessageId())
 	return c.request(msg)
@@ -145,8 +200,11 @@ func (c *nativeContext) DeleteInlineKB() error {
 	return c.request(msg)
 }
 
-func (c *nativeContext) request(msg tgbotapi.Chattable) error {
-	if _, err := c.bot.client.Request(msg); err != nil {
+func (c *nativeContext) request(msg tgbotapi.Chattable) (err error) {
+	_, span := tracer.Start(c.Context(), "bot.telegram", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	if _, err = c.bot.client.Request(msg); err != nil {
 		c.bot.logger.Printf("/Context/request error send message to user: %s", err)
 		return err
 	}
@@ -165,43 +223,99 @@ func (c *nativeContext) lastMessageId() int {
 }
 
 func (c *nativeContext) SetState(state string) error {
-	return c.bot.storage.setState(c.UserId(), state)
+	return c.SetTempState(state, c.bot.stateTTL)
+}
+
+// SetTempState вместе с состоянием сохраняет бессрочную отметку stateMarkerKey:
+// по ней handle отличает истекшее состояние от состояния, которого не было вовсе
+func (c *nativeContext) SetTempState(state string, d time.Duration) error {
+	end := c.traceStorage("setState")
+	err := c.bot.storage.setState(c.UserId(), state, d)
+	if err == nil {
+		err = c.bot.storage.setData(c.UserId(), stateMarkerKey, true)
+	}
+	end(err)
+	return err
 }
 
 func (c *nativeContext) GetState() (string, error) {
-	return c.bot.storage.getState(c.UserId())
+	end := c.traceStorage("getState")
+	state, err := c.bot.storage.getState(c.UserId())
+	end(err)
+	return state, err
+}
+
+func (c *nativeContext) DelState() error {
+	end := c.traceStorage("delState")
+	err := c.bot.storage.delState(c.UserId())
+	if err == nil {
+		err = c.bot.storage.delData(c.UserId(), stateMarkerKey)
+	}
+	end(err)
+	return err
 }
 
 func (c *nativeContext) SetData(key string, v any) error {
-	return c.bot.storage.setData(c.UserId(), key, v)
+	end := c.traceStorage("setData", key)
+	err := c.bot.storage.setData(c.UserId(), key, v)
+	end(err)
+	return err
 }
 
 func (c *nativeContext) SetTempData(key string, v any, d time.Duration) error {
-	return c.bot.storage.setTempData(c.UserId(), key, v, d)
+	end := c.traceStorage("setData", key)
+	err := c.bot.storage.setTempData(c.UserId(), key, v, d)
+	end(err)
+	return err
 }
 
 func (c *nativeContext) SetCommonData(key string, v any, d time.Duration) error {
-	return c.bot.storage.setCommonData(key, v, d)
+	end := c.traceStorage("setCommonData", key)
+	err := c.bot.storage.setCommonData(key, v, d)
+	end(err)
+	return err
 }
 
 func (c *nativeContext) GetData(key string, v any) error {
-	return c.bot.storage.getData(c.UserId(), key, v)
+	end := c.traceStorage("getData", key)
+	err := c.bot.storage.getData(c.UserId(), key, v)
+	end(err)
+	return err
 }
 
 func (c *nativeContext) GetCommonData(key string, v any) error {
-	return c.bot.storage.getCommonData(key, v)
+	end := c.traceStorage("getCommonData", key)
+	err := c.bot.storage.getCommonData(key, v)
+	end(err)
+	return err
 }
 
 func (c *nativeContext) DelData(keys ...string) error {
-	return c.bot.storage.delData(c.UserId(), keys...)
+	end := c.traceStorage("delData", keys...)
+	err := c.bot.storage.delData(c.UserId(), keys...)
+	end(err)
+	return err
 }
 
 func (c *nativeContext) DelCommonData(keys ...string) error {
-	return c.bot.storage.delCommonData(keys...)
+	end := c.traceStorage("delCommonData", keys...)
+	err := c.bot.storage.delCommonData(keys...)
+	end(err)
+	return err
 }
 
 func (c *nativeContext) Clear() error {
-	return c.bot.storage.clear(c.UserId())
+	end := c.traceStorage("clear")
+	err := c.bot.storage.clear(c.UserId())
+	end(err)
+	return err
+}
+
+func (c *nativeContext) Keys() ([]string, error) {
+	end := c.traceStorage("keys")
+	keys, err := c.bot.storage.keys(c.UserId())
+	end(err)
+	return keys, err
 }
 
 func (c *nativeContext) DoOnce(ctx context.Context, key string, f func() (any, error)) (any, error) {
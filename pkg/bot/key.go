@@ -0,0 +1,98 @@
+package bot
+
+import "time"
+
+// Key типизированный ключ пользовательских данных.
+// Объявляется один раз (обычно глобальной переменной) вместе с типом значения и временем хранения,
+// поэтому опечатка в имени ключа или несовпадение типа при чтении становятся ошибкой компиляции, а не промахом кэша
+type Key[T any] struct {
+	name string
+	ttl  time.Duration
+	// codec - собственный кодек ключа (см. KeyCodec). nil - кодек хранилища
+	codec Codec
+}
+
+// KeyOption настраивает ключ при создании
+type KeyOption func(o *keyOptions)
+
+type keyOptions struct {
+	codec Codec
+}
+
+// KeyCodec задает ключу собственный кодек вместо кодека хранилища (см. StorageCodec).
+// Значение сериализуется этим кодеком и сохраняется как массив байтов, поэтому ключ читается одинаково
+// при любом кодеке хранилища. Например, большие срезы удобно хранить в MsgpackCodec, даже если хранилище в JSONCodec
+func KeyCodec(c Codec) KeyOption {
+	return func(o *keyOptions) {
+		o.codec = c
+	}
+}
+
+// NewKey создает ключ. Если ttl равен 0, то данные хранятся бессрочно (как Context.SetData)
+func NewKey[T any](name string, ttl time.Duration, opts ...KeyOption) Key[T] {
+	var o keyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return Key[T]{
+		name:  name,
+		ttl:   ttl,
+		codec: o.codec,
+	}
+}
+
+// Name возвращает имя ключа в хранилище. Удобно для SceneData и Context.DelData
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// With возвращает производный ключ name:id с теми же типом, временем хранения и кодеком (например, семестр по его id)
+func (k Key[T]) With(id string) Key[T] {
+	return Key[T]{
+		name:  k.name + ":" + id,
+		ttl:   k.ttl,
+		codec: k.codec,
+	}
+}
+
+// Get возвращает значение по ключу. Если значения нет, то вернется ErrKeyNotExists
+func (k Key[T]) Get(c Context) (T, error) {
+	var v T
+	if k.codec == nil {
+		if err := c.GetData(k.name, &v); err != nil {
+			var zero T
+			return zero, err
+		}
+		return v, nil
+	}
+
+	var raw []byte
+	if err := c.GetData(k.name, &raw); err != nil {
+		return v, err
+	}
+	if err := k.codec.Unmarshal(raw, &v); err != nil {
+		var zero T
+		return zero, err
+	}
+	return v, nil
+}
+
+// Set сохраняет значение с временем хранения ключа
+func (k Key[T]) Set(c Context, v T) error {
+	var data any = v
+	if k.codec != nil {
+		raw, err := k.codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data = raw
+	}
+	if k.ttl == 0 {
+		return c.SetData(k.name, data)
+	}
+	return c.SetTempData(k.name, data, k.ttl)
+}
+
+func (k Key[T]) Del(c Context) error {
+	return c.DelData(k.name)
+}
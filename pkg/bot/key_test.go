@@ -0,0 +1,81 @@
+package bot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_Key(t *testing.T) {
+	type semester struct {
+		Id     string
+		Number int
+	}
+
+	b := &Bot{
+		storage: newMemoryStorage(),
+	}
+	c := b.NewContext(tgbotapi.Update{Message: &tgbotapi.Message{From: &tgbotapi.User{ID: 1}}})
+
+	key := NewKey[semester]("semester", time.Hour)
+	first, second := key.With("1"), key.With("2")
+	assert.Equal(t, "semester:1", first.Name())
+
+	_, err := first.Get(c)
+	assert.Equal(t, ErrKeyNotExists, err)
+
+	assert.Nil(t, first.Set(c, semester{Id: "1", Number: 1}))
+	assert.Nil(t, second.Set(c, semester{Id: "2", Number: 2}))
+
+	v, err := first.Get(c)
+	assert.Nil(t, err)
+	assert.Equal(t, semester{Id: "1", Number: 1}, v)
+
+	// производный ключ хранится отдельно, поэтому удаление не затрагивает соседние
+	assert.Nil(t, first.Del(c))
+	_, err = first.Get(c)
+	assert.Equal(t, ErrKeyNotExists, err)
+	v, err = second.Get(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, v.Number)
+
+	// ключ без времени хранения сохраняется через SetData и читается так же, как обычные данные
+	students := NewKey[[]string]("students", 0)
+	assert.Nil(t, students.Set(c, []string{"Иванов Иван Иванович"}))
+	var raw []string
+	assert.Nil(t, c.GetData(students.Name(), &raw))
+	assert.Equal(t, []string{"Иванов Иван Иванович"}, raw)
+}
+
+func Test_Key_codec(t *testing.T) {
+	type semester struct {
+		Id     string
+		Number int
+	}
+
+	storage := newMemoryStorage()
+	storage.setCodec(JSONCodec)
+	b := &Bot{
+		storage: storage,
+	}
+	c := b.NewContext(tgbotapi.Update{Message: &tgbotapi.Message{From: &tgbotapi.User{ID: 1}}})
+
+	key := NewKey[semester]("semester", time.Hour, KeyCodec(MsgpackCodec))
+	assert.Nil(t, key.With("1").Set(c, semester{Id: "1", Number: 1}))
+
+	v, err := key.With("1").Get(c)
+	assert.Nil(t, err)
+	assert.Equal(t, semester{Id: "1", Number: 1}, v)
+
+	// в хранилище лежат байты msgpack, а не json самого значения
+	var raw []byte
+	assert.Nil(t, c.GetData("semester:1", &raw))
+	var decoded semester
+	assert.Nil(t, MsgpackCodec.Unmarshal(raw, &decoded))
+	assert.Equal(t, semester{Id: "1", Number: 1}, decoded)
+	assert.NotNil(t, JSONCodec.Unmarshal(raw, &decoded))
+
+	_, err = key.With("2").Get(c)
+	assert.Equal(t, ErrKeyNotExists, err)
+}
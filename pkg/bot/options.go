@@ -4,6 +4,7 @@ import (
 	"context"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/redis/go-redis/v9"
+	"time"
 )
 
 type Option func(bot *Bot) error
@@ -25,9 +26,66 @@ func RedisStorage(ctx context.Context, redis *redis.Client) Option {
 	}
 }
 
+// MemoryStorage хранит данные в памяти процесса (используется по умолчанию).
+// limit ограничивает количество ключей: при превышении вытесняются давно не используемые. 0 - без ограничений
+func MemoryStorage(limit int) Option {
+	return func(bot *Bot) error {
+		s := newMemoryStorage()
+		s.limit = limit
+		bot.storage = s
+		return nil
+	}
+}
+
+// BoltStorage хранит данные во встроенной базе bbolt в файле path. Подходит для инсталляции в единственном экземпляре без redis
+func BoltStorage(path string) Option {
+	return func(bot *Bot) error {
+		s, err := newBoltStorage(path, defaultBoltSweepInterval)
+		if err != nil {
+			return err
+		}
+		bot.storage = s
+		return nil
+	}
+}
+
 func SetLogger(logger Logger) Option {
 	return func(bot *Bot) error {
 		bot.logger = logger
 		return nil
 	}
 }
+
+// StateTTL задает время жизни состояний, установленных через Context.SetState.
+// По умолчанию состояния бессрочные, поэтому пользователь, бросивший сценарий на середине, навсегда остается в нем
+func StateTTL(d time.Duration) Option {
+	return func(bot *Bot) error {
+		bot.stateTTL = d
+		return nil
+	}
+}
+
+// CallbackTTL задает время хранения callback data, которые не влезли в лимит телеграма и были сохранены в хранилище
+func CallbackTTL(d time.Duration) Option {
+	return func(bot *Bot) error {
+		bot.callbackTTL = d
+		return nil
+	}
+}
+
+// PagesTTL задает время хранения страниц длинных сообщений (см. Context.SendPages)
+func PagesTTL(d time.Duration) Option {
+	return func(bot *Bot) error {
+		bot.pagesTTL = d
+		return nil
+	}
+}
+
+// StorageCodec задает сериализацию данных в хранилище (см. JSONCodec, SonicCodec, MsgpackCodec и Compressed).
+// По умолчанию используется SonicCodec
+func StorageCodec(c Codec) Option {
+	return func(bot *Bot) error {
+		bot.codec = c
+		return nil
+	}
+}
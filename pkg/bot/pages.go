@@ -0,0 +1,271 @@
+package bot
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Длинные сообщения.
+// Телеграм не принимает сообщения длиннее 4096 символов, поэтому длинный HTML текст нужно делить.
+// Символы телеграм считает в UTF-16: эмодзи и другие символы вне BMP занимают два.
+// Резать текст где попало нельзя: разрыв внутри тега или между открывающим и закрывающим тегом телеграм отклонит.
+// SplitHTML делит текст по строкам, закрывает незакрытые теги в конце части и заново открывает их в начале следующей.
+//
+// Части можно отправить отдельными сообщениями (SendLongMessage) или одним сообщением с постраничной
+// навигацией "◀ 1/3 ▶" (SendPages, EditPages). Во втором случае страницы хранятся в хранилище пользователя,
+// а переключение обрабатывается коллбэком, который регистрирует Bot.Pagination
+const (
+	maxMessageSize  = 4096
+	defaultPagesTTL = time.Hour * 24
+
+	pagesCallbackPrefix = "/pages/"
+	pagesNoopCallback   = pagesCallbackPrefix + "noop"
+	pagesKeySize        = 12
+)
+
+type pages struct {
+	Pages    []string                          `json:"pages"`
+	Keyboard [][]tgbotapi.InlineKeyboardButton `json:"keyboard"`
+}
+
+type htmlToken struct {
+	text string
+	// tag имя тега, если токен является тегом
+	tag   string
+	open  bool
+	close bool
+	size  int
+}
+
+// SplitHTML делит HTML текст на части не длиннее limit символов UTF-16 (с учетом тегов), как их считает телеграм.
+// Предпочтительно текст делится по переносам строк, иначе - по границе символа или сущности (&amp;).
+// Каждая часть содержит сбалансированные теги
+func SplitHTML(text string, limit int) []string {
+	tokens := tokenizeHTML(text)
+	var (
+		chunks []string
+		stack  []htmlToken
+	)
+	for start := 0; start < len(tokens); {
+		prefix := openingTags(stack)
+		size := utf16Len(prefix)
+
+		var (
+			st       = stack
+			cut      = -1
+			cutStack []htmlToken
+			j        = start
+		)
+		for ; j < len(tokens); j++ {
+			next := applyTag(st, tokens[j])
+			if size+tokens[j].size+closingTagsSize(next) > limit {
+				break
+			}
+			size += tokens[j].size
+			st = next
+			if tokens[j].text == "\n" {
+				cut, cutStack = j+1, st
+			}
+		}
+
+		end, endStack := j, st
+		switch {
+		case j == len(tokens):
+		case cut > start:
+			end, endStack = cut, cutStack
+		case j == start:
+			// Даже один токен не влезает (слишком маленький лимит) - берем его, чтобы не зациклиться
+			end, endStack = j+1, applyTag(stack, tokens[j])
+		}
+
+		var b strings.Builder
+		for _, t := range tokens[start:end] {
+			b.WriteString(t.text)
+		}
+		if body := b.String(); strings.TrimSpace(body) != "" {
+			chunks = append(chunks, prefix+strings.Trim(body, "\n")+closingTags(endStack))
+		}
+		stack, start = endStack, end
+	}
+	return chunks
+}
+
+func tokenizeHTML(text string) []htmlToken {
+	tokens := make([]htmlToken, 0, len(text))
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '<':
+			if end := strings.IndexByte(text[i:], '>'); end != -1 {
+				t := htmlToken{text: text[i : i+end+1]}
+				t.size = utf16Len(t.text)
+				name := strings.TrimPrefix(t.text[1:len(t.text)-1], "/")
+				if n := strings.IndexAny(name, " \t\n"); n != -1 {
+					name = name[:n]
+				}
+				t.tag = name
+				t.close = strings.HasPrefix(t.text, "</")
+				t.open = !t.close
+				tokens = append(tokens, t)
+				i += end + 1
+				continue
+			}
+		case '&':
+			// Сущность не длиннее &#x10FFFF;
+			if end := strings.IndexByte(text[i:], ';'); end != -1 && end <= 10 && !strings.ContainsAny(text[i+1:i+end], " \n<&") {
+				tokens = append(tokens, htmlToken{text: text[i : i+end+1], size: end + 1})
+				i += end + 1
+				continue
+			}
+		}
+		r, n := utf8.DecodeRuneInString(text[i:])
+		tokens = append(tokens, htmlToken{text: text[i : i+n], size: utf16RuneLen(r)})
+		i += n
+	}
+	return tokens
+}
+
+// applyTag возвращает новый стек открытых тегов. Исходный стек не изменяется,
+// потому что он может понадобиться при откате к последнему переносу строки
+func applyTag(stack []htmlToken, t htmlToken) []htmlToken {
+	switch {
+	case t.open:
+		next := make([]htmlToken, len(stack), len(stack)+1)
+		copy(next, stack)
+		return append(next, t)
+	case t.close:
+		for i := len(stack) - 1; i >= 0; i-- {
+			if stack[i].tag == t.tag {
+				return stack[:i:i]
+			}
+		}
+	}
+	return stack
+}
+
+func openingTags(stack []htmlToken) string {
+	var b strings.Builder
+	for _, t := range stack {
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+func closingTags(stack []htmlToken) string {
+	var b strings.Builder
+	for i := len(stack) - 1; i >= 0; i-- {
+		b.WriteString("</" + stack[i].tag + ">")
+	}
+	return b.String()
+}
+
+func closingTagsSize(stack []htmlToken) int {
+	size := 0
+	for _, t := range stack {
+		size += utf16Len(t.tag) + 3
+	}
+	return size
+}
+
+// utf16Len - длина строки в символах UTF-16, в которых телеграм считает лимит сообщения
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16RuneLen(r)
+	}
+	return n
+}
+
+// Символы вне BMP кодируются суррогатной парой. Некорректный UTF-8 телеграм получит как U+FFFD, это один символ
+func utf16RuneLen(r rune) int {
+	if r > 0xFFFF && r <= utf8.MaxRune {
+		return 2
+	}
+	return 1
+}
+
+// Pagination регистрирует коллбэки переключения страниц (см. SendPages).
+// expired вызывается, если страницы уже удалены из хранилища (может быть nil)
+func (b *Bot) Pagination(expired HandlerFunc, m ...MiddlewareFunc) {
+	b.Callback(pagesNoopCallback, func(c Context) error { return nil }, m...)
+	b.AddTree(OnCallback, pagesCallbackPrefix+":key/:n<int>", func(c Context) error {
+		var p pages
+		if err := c.GetData(pagesDataKey(c.Param("key")), &p); err != nil {
+			if errors.Is(err, ErrKeyNotExists) && expired != nil {
+				return expired(c)
+			}
+			return err
+		}
+		n, err := c.ParamInt("n")
+		if err != nil {
+			return err
+		}
+		if n < 0 || n >= len(p.Pages) {
+			return errors.New("page " + strconv.Itoa(n) + " out of range")
+		}
+		return c.EditMessageWithInlineKB(p.Pages[n], pagesKeyboard(c.Param("key"), n, len(p.Pages), p.Keyboard))
+	}, m...)
+}
+
+// sendPages отправляет (или редактирует) одно сообщение с первой страницей текста.
+// Если текст влезает в одно сообщение, то страницы не сохраняются и клавиатура остается как есть
+func (c *nativeContext) sendPages(text string, kb [][]tgbotapi.InlineKeyboardButton, edit bool) error {
+	send := c.SendMessageWithInlineKB
+	if edit {
+		send = c.EditMessageWithInlineKB
+	}
+	chunks := SplitHTML(text, maxMessageSize)
+	if len(chunks) <= 1 {
+		return send(text, kb)
+	}
+
+	// Ключ детерминированный, поэтому повторные запросы одного и того же текста не плодят новые записи
+	sum := sha256.Sum256([]byte(text))
+	key := base64.RawURLEncoding.EncodeToString(sum[:pagesKeySize])
+	if err := c.SetTempData(pagesDataKey(key), pages{Pages: chunks, Keyboard: kb}, c.bot.pagesTTL); err != nil {
+		return err
+	}
+	return send(chunks[0], pagesKeyboard(key, 0, len(chunks), kb))
+}
+
+func (c *nativeContext) SendPages(text string, kb [][]tgbotapi.InlineKeyboardButton) error {
+	return c.sendPages(text, kb, false)
+}
+
+func (c *nativeContext) EditPages(text string, kb [][]tgbotapi.InlineKeyboardButton) error {
+	return c.sendPages(text, kb, true)
+}
+
+func (c *nativeContext) SendLongMessage(text string, kb [][]tgbotapi.InlineKeyboardButton) error {
+	chunks := SplitHTML(text, maxMessageSize)
+	if len(chunks) == 0 {
+		return c.SendMessageWithInlineKB(text, kb)
+	}
+	for _, chunk := range chunks[:len(chunks)-1] {
+		if err := c.SendMessage(chunk); err != nil {
+			return err
+		}
+	}
+	return c.SendMessageWithInlineKB(chunks[len(chunks)-1], kb)
+}
+
+// pagesKeyboard добавляет строку навигации над клавиатурой. Переключение зациклено: с последней страницы "▶" ведет на первую
+func pagesKeyboard(key string, n, total int, kb [][]tgbotapi.InlineKeyboardButton) [][]tgbotapi.InlineKeyboardButton {
+	prefix := pagesCallbackPrefix + key + "/"
+	result := make([][]tgbotapi.InlineKeyboardButton, 0, len(kb)+1)
+	result = append(result, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("◀", prefix+strconv.Itoa((n-1+total)%total)),
+		tgbotapi.NewInlineKeyboardButtonData(strconv.Itoa(n+1)+"/"+strconv.Itoa(total), pagesNoopCallback),
+		tgbotapi.NewInlineKeyboardButtonData("▶", prefix+strconv.Itoa((n+1)%total)),
+	})
+	return append(result, kb...)
+}
+
+func pagesDataKey(key string) string {
+	return "pages:" + key
+}
@@ -0,0 +1,106 @@
+package bot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func Test_SplitHTML(t *testing.T) {
+	testCases := []struct {
+		testName     string
+		text         string
+		limit        int
+		expectChunks []string
+	}{
+		{
+			testName:     "text fits",
+			text:         "<b>Расписание</b>:\nЗанятий нет",
+			limit:        100,
+			expectChunks: []string{"<b>Расписание</b>:\nЗанятий нет"},
+		},
+		{
+			testName:     "split by lines",
+			text:         "first line\nsecond line\nthird line",
+			limit:        24,
+			expectChunks: []string{"first line\nsecond line", "third line"},
+		},
+		{
+			testName:     "tags are balanced",
+			text:         "<b>first line\n<i>second</i> line\nthird line</b>",
+			limit:        30,
+			expectChunks: []string{"<b>first line</b>", "<b><i>second</i> line</b>", "<b>third line</b>"},
+		},
+		{
+			testName:     "long line without newlines",
+			text:         "<i>abcdefghij</i>",
+			limit:        12,
+			expectChunks: []string{"<i>abcde</i>", "<i>fghij</i>"},
+		},
+		{
+			testName:     "entity is not split",
+			text:         "abc&amp;def",
+			limit:        6,
+			expectChunks: []string{"abc", "&amp;d", "ef"},
+		},
+		{
+			testName:     "runes are counted, not bytes",
+			text:         "привет\nмир",
+			limit:        7,
+			expectChunks: []string{"привет", "мир"},
+		},
+		{
+			testName:     "emoji take two utf-16 units",
+			text:         "😀😀😀\n😀😀",
+			limit:        5,
+			expectChunks: []string{"😀😀", "😀", "😀😀"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			chunks := SplitHTML(tc.text, tc.limit)
+			assert.Equal(t, tc.expectChunks, chunks)
+			for _, chunk := range chunks {
+				assert.LessOrEqual(t, utf16Len(chunk), tc.limit)
+			}
+		})
+	}
+}
+
+func Test_SplitHTML_message(t *testing.T) {
+	// Так выглядит подробная информация по предмету: много однотипных строк с тегами
+	line := "<b>Лекция</b> <i>12.09 10:00</i>: присутствовал, оценки: <b>5</b>"
+	text := strings.Repeat(line+"\n", 200)
+
+	chunks := SplitHTML(text, maxMessageSize)
+	assert.Greater(t, len(chunks), 1)
+
+	// Ни одна строка не потерялась и не разрезана
+	total := 0
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, utf16Len(chunk), maxMessageSize)
+		for _, l := range strings.Split(chunk, "\n") {
+			assert.Equal(t, line, l)
+			total++
+		}
+	}
+	assert.Equal(t, 200, total)
+}
+
+func Test_pagesKeyboard(t *testing.T) {
+	kb := pagesKeyboard("key", 0, 3, [][]tgbotapi.InlineKeyboardButton{{tgbotapi.NewInlineKeyboardButtonData("Назад", "/back")}})
+	assert.Len(t, kb, 2)
+	assert.Equal(t, "/pages/key/2", *kb[0][0].CallbackData)
+	assert.Equal(t, "1/3", kb[0][1].Text)
+	assert.Equal(t, pagesNoopCallback, *kb[0][1].CallbackData)
+	assert.Equal(t, "/pages/key/1", *kb[0][2].CallbackData)
+	assert.Equal(t, "/back", *kb[1][0].CallbackData)
+
+	kb = pagesKeyboard("key", 2, 3, nil)
+	assert.Len(t, kb, 1)
+	assert.Equal(t, "/pages/key/1", *kb[0][0].CallbackData)
+	assert.Equal(t, "3/3", kb[0][1].Text)
+	assert.Equal(t, "/pages/key/0", *kb[0][2].CallbackData)
+}
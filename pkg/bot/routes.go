@@ -1,7 +1,11 @@
 package bot
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type HandlerFunc func(c Context) error
@@ -37,9 +41,13 @@ type Router interface {
 	Callback(name string, h HandlerFunc, m ...MiddlewareFunc)
 	State(name string, h HandlerFunc, m ...MiddlewareFunc)
 
-	// AddTree регистрирует обработчик в дерево с возможностью задавать сегменты пути в виде параметрических переменных
+	// AddTree регистрирует обработчик в дерево с возможностью задавать сегменты пути в виде параметрических переменных.
+	// Поддерживаются параметры :name, типизированные параметры :name<int>, :name<date>, :name<uuid> и catch-all *name
 	AddTree(m method, path string, h HandlerFunc, middleware ...MiddlewareFunc)
 
+	// Scene регистрирует все шаги сцены как состояния, а также коллбэк кнопки "назад" сцены
+	Scene(s *Scene, m ...MiddlewareFunc)
+
 	// Use добавляет новый мидлварь в конец стека
 	Use(middleware ...MiddlewareFunc)
 
@@ -53,9 +61,12 @@ type Router interface {
 	Group(m ...MiddlewareFunc) Router
 }
 
+// Add и AddTree паникуют при конфликте маршрутов: регистрация происходит при старте, и такую ошибку лучше увидеть сразу
 func (b *Bot) Add(m method, p string, h HandlerFunc, middleware ...MiddlewareFunc) {
 	stack := append(b.middleware, middleware...)
-	b.routers[m].static[p] = applyMiddleware(h, append(stack, b.premiddleware...)...)
+	if err := b.routers[m].addStatic(p, applyMiddleware(traceHandler(m.String()+" "+p, h), append(stack, b.premiddleware...)...)); err != nil {
+		panic(fmt.Sprintf("bot: %s route conflict: %s", m, err))
+	}
 }
 
 func (b *Bot) Command(name string, h HandlerFunc, m ...MiddlewareFunc) {
@@ -76,7 +87,13 @@ func (b *Bot) State(name string, h HandlerFunc, m ...MiddlewareFunc) {
 
 func (b *Bot) AddTree(m method, path string, h HandlerFunc, middleware ...MiddlewareFunc) {
 	stack := append(b.middleware, middleware...)
-	b.routers[m].addTree(path, applyMiddleware(h, append(stack, b.premiddleware...)...))
+	if err := b.routers[m].addTree(path, applyMiddleware(traceHandler(m.String()+" "+path, h), append(stack, b.premiddleware...)...)); err != nil {
+		panic(fmt.Sprintf("bot: %s route conflict: %s", m, err))
+	}
+}
+
+func (b *Bot) Scene(s *Scene, m ...MiddlewareFunc) {
+	registerScene(b, s, m...)
 }
 
 func (b *Bot) Use(middleware ...MiddlewareFunc) {
@@ -126,6 +143,10 @@ func (g *group) AddTree(m method, path string, h HandlerFunc, middleware ...Midd
 	g.parent.AddTree(m, path, h, append(stack, g.premiddleware...)...)
 }
 
+func (g *group) Scene(s *Scene, m ...MiddlewareFunc) {
+	registerScene(g, s, m...)
+}
+
 func (g *group) Use(middleware ...MiddlewareFunc) {
 	g.middleware = append(g.middleware, middleware...)
 }
@@ -160,22 +181,58 @@ type kind uint8
 const (
 	staticKind kind = iota
 	paramKind
+	catchAllKind
 )
 
+// Валидаторы типизированных параметров маршрута в формате :name<type>.
+// Значение, которое не прошло проверку, не совпадает с узлом, поэтому в хэндлер попадают только корректные данные
+var paramTypes = map[string]func(seg string) bool{
+	"int": func(seg string) bool {
+		_, err := strconv.Atoi(seg)
+		return err == nil
+	},
+	"date": func(seg string) bool {
+		_, err := time.Parse(time.DateOnly, seg)
+		return err == nil
+	},
+	"uuid": isUUID,
+}
+
 // Узел для динамической маршрутизации.
 // Изначально была потребность в гибких коллбэках с параметрами.
 // Это был переход от fsm и состояний к гибкости и скорости (в кэш смотреть, очевидно, дольше, чем гибкий коллбэк)
-// Текущий вариант поддерживает как статический сегмент пути, так и параметрический (который может меняться)
+// Текущий вариант поддерживает статический сегмент пути, параметрический (:name или типизированный :name<type>)
+// и catch-all (*name), который забирает весь оставшийся путь и может быть только последним сегментом
 type node struct {
-	kind    kind
-	handler HandlerFunc
-	static  map[string]*node
-	param   *node
-	path    string
+	kind      kind
+	handler   HandlerFunc
+	static    map[string]*node
+	params    []*node // сначала типизированные параметры, нетипизированный (если есть) всегда последний
+	catchAll  *node
+	path      string
+	name      string // имя параметра
+	paramType string
+	validate  func(seg string) bool
+	route     string // полный путь, по которому зарегистрирован хэндлер
+}
+
+// Параметр, найденный при обходе дерева. Записываем в контекст только после полного совпадения, потому что возможен откат
+type param struct {
+	name  string
+	value string
 }
 
-func (r *route) addTree(path string, h HandlerFunc) {
+func (r *route) addStatic(path string, h HandlerFunc) error {
+	if _, ok := r.static[path]; ok {
+		return fmt.Errorf("path %s already registered", path)
+	}
+	r.static[path] = h
+	return nil
+}
+
+func (r *route) addTree(path string, h HandlerFunc) error {
 	currNode := r.tree
+	route := path
 
 	for len(path) > 0 {
 		seg := path
@@ -189,16 +246,19 @@ func (r *route) addTree(path string, h HandlerFunc) {
 			continue
 		}
 
-		var c *node
-		if seg[0] == ':' {
-			if currNode.param == nil {
-				currNode.param = &node{
-					path: seg,
-					kind: paramKind,
-				}
+		var (
+			c   *node
+			err error
+		)
+		switch seg[0] {
+		case ':':
+			c, err = currNode.paramChild(seg)
+		case '*':
+			if strings.Trim(path, "/") != "" {
+				return fmt.Errorf("path %s: catch-all segment %s must be the last", route, seg)
 			}
-			c = currNode.param
-		} else { // Это статический узел
+			c, err = currNode.catchAllChild(seg)
+		default: // Это статический узел
 			if currNode.static == nil {
 				currNode.static = make(map[string]*node)
 			}
@@ -211,48 +271,137 @@ func (r *route) addTree(path string, h HandlerFunc) {
 				currNode.static[seg] = c
 			}
 		}
+		if err != nil {
+			return fmt.Errorf("path %s: %w", route, err)
+		}
 		currNode = c
 	}
+	if currNode.handler != nil {
+		return fmt.Errorf("path %s conflicts with already registered %s", route, currNode.route)
+	}
 	currNode.handler = h
+	currNode.route = route
+	return nil
 }
 
-func (r *route) findTree(c Context, path string) (HandlerFunc, bool) {
-	ctx := c.(*nativeContext)
-	currNode := r.tree
-
-	for len(path) > 0 {
-		seg := path
-		if index := strings.IndexByte(path, '/'); index != -1 {
-			seg, path = path[:index], path[index+1:]
-		} else {
-			path = ""
+func (n *node) paramChild(seg string) (*node, error) {
+	name, paramType := seg[1:], ""
+	if i := strings.IndexByte(name, '<'); i != -1 {
+		if name[len(name)-1] != '>' {
+			return nil, fmt.Errorf("invalid param segment %s", seg)
 		}
+		name, paramType = name[:i], name[i+1:len(name)-1]
+	}
+	validate, ok := paramTypes[paramType]
+	if paramType != "" && !ok {
+		return nil, fmt.Errorf("unknown param type %s", paramType)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("param segment %s without name", seg)
+	}
 
-		if seg == "" {
+	for _, p := range n.params {
+		if p.paramType != paramType {
 			continue
 		}
-
-		child := r.findChild(currNode, seg)
-		if child == nil {
-			return nil, false
+		// Параметры одного типа на одной позиции неразличимы, поэтому и имена у них должны совпадать
+		if p.name != name {
+			return nil, fmt.Errorf("param %s conflicts with %s", seg, p.path)
 		}
+		return p, nil
+	}
+
+	c := &node{
+		path:      seg,
+		kind:      paramKind,
+		name:      name,
+		paramType: paramType,
+		validate:  validate,
+	}
+	if paramType == "" {
+		n.params = append(n.params, c)
+		return c, nil
+	}
+	// Типизированные параметры проверяются до нетипизированного
+	i := len(n.params)
+	if i > 0 && n.params[i-1].paramType == "" {
+		i--
+	}
+	n.params = append(n.params[:i], append([]*node{c}, n.params[i:]...)...)
+	return c, nil
+}
 
-		if child.kind == paramKind {
-			ctx.setParam(child.path[1:], seg)
+func (n *node) catchAllChild(seg string) (*node, error) {
+	name := seg[1:]
+	if name == "" {
+		return nil, fmt.Errorf("catch-all segment %s without name", seg)
+	}
+	if n.catchAll != nil {
+		if n.catchAll.name != name {
+			return nil, fmt.Errorf("catch-all %s conflicts with %s", seg, n.catchAll.path)
 		}
-		currNode = child
+		return n.catchAll, nil
+	}
+	n.catchAll = &node{
+		path: seg,
+		kind: catchAllKind,
+		name: name,
+	}
+	return n.catchAll, nil
+}
+
+func (r *route) findTree(c Context, path string) (HandlerFunc, bool) {
+	ctx := c.(*nativeContext)
+
+	var params []param
+	n := r.match(r.tree, path, &params)
+	if n == nil {
+		return nil, false
+	}
+	for _, p := range params {
+		ctx.setParam(p.name, p.value)
 	}
-	return currNode.handler, currNode.handler != nil
+	return n.handler, true
 }
 
-func (r *route) findChild(n *node, seg string) *node {
+// match ищет узел с хэндлером. Приоритет: статический сегмент -> типизированные параметры -> параметр -> catch-all.
+// Если ветка не привела к хэндлеру, то откатываемся и пробуем следующую
+func (r *route) match(n *node, path string, params *[]param) *node {
+	for len(path) > 0 && path[0] == '/' {
+		path = path[1:]
+	}
+	if path == "" {
+		if n.handler != nil {
+			return n
+		}
+		return nil
+	}
+
+	seg, rest := path, ""
+	if index := strings.IndexByte(path, '/'); index != -1 {
+		seg, rest = path[:index], path[index+1:]
+	}
+
 	if n.static != nil {
 		if c, ok := n.static[seg]; ok {
-			return c
+			if m := r.match(c, rest, params); m != nil {
+				return m
+			}
+		}
+	}
+	for _, c := range n.params {
+		if c.validate != nil && !c.validate(seg) {
+			continue
 		}
+		*params = append(*params, param{name: c.name, value: seg})
+		if m := r.match(c, rest, params); m != nil {
+			return m
+		}
+		*params = (*params)[:len(*params)-1]
 	}
-	if n.param != nil {
-		return n.param
+	if n.catchAll != nil && n.catchAll.handler != nil {
+		*params = append(*params, param{name: n.catchAll.name, value: strings.TrimRight(path, "/")})
+		return n.catchAll
 	}
 	return nil
 }
@@ -264,12 +413,91 @@ func (r *route) find(c Context, path string) (HandlerFunc, bool) {
 	return r.findTree(c, path)
 }
 
+// Маршрут для отладки: тип входящего запроса и путь
+type Route struct {
+	Method string
+	Path   string
+}
+
+func (m method) String() string {
+	switch m {
+	case OnCommand:
+		return "command"
+	case OnMessage:
+		return "message"
+	case OnCallback:
+		return "callback"
+	case OnState:
+		return "state"
+	}
+	return "unknown"
+}
+
+// Routes возвращает все зарегистрированные маршруты, отсортированные по типу запроса и пути
+func (b *Bot) Routes() []Route {
+	var routes []Route
+	for m, r := range b.routers {
+		for path := range r.static {
+			routes = append(routes, Route{Method: m.String(), Path: path})
+		}
+		r.tree.walk(func(n *node) {
+			routes = append(routes, Route{Method: m.String(), Path: n.route})
+		})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Method != routes[j].Method {
+			return routes[i].Method < routes[j].Method
+		}
+		return routes[i].Path < routes[j].Path
+	})
+	return routes
+}
+
+func (n *node) walk(f func(n *node)) {
+	if n.handler != nil {
+		f(n)
+	}
+	for _, c := range n.static {
+		c.walk(f)
+	}
+	for _, c := range n.params {
+		c.walk(f)
+	}
+	if n.catchAll != nil {
+		n.catchAll.walk(f)
+	}
+}
+
+// isUUID проверяет uuid в каноническом виде xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx (регистр не важен)
+func isUUID(s string) bool {
+	if len(s) != uuidSize {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHex(s[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
 // applyMiddleware функция, которая "навешивает" на хэндлер мидлвари.
 // Важно понимать, что добавляет она их по принципу стека,
 // т.е самый первый из слайса будет добавлен последним (станет внешним), а последний - первым (внутренним)
 func applyMiddleware(h HandlerFunc, middleware ...MiddlewareFunc) HandlerFunc {
 	for i := len(middleware) - 1; i >= 0; i-- {
-		h = middleware[i](h)
+		h = traceMiddleware(middlewareName(middleware[i]), middleware[i](h))
 	}
 	return h
 }
@@ -3,10 +3,9 @@ package bot
 import (
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"testing"
+	"time"
 )
 
-// TODO тесты для добавления деревьев
-
 func Test_route_findTree(t *testing.T) {
 	mockFunc := func(c Context) error { return nil }
 	r := newRoute()
@@ -48,6 +47,215 @@ func Test_route_findTree(t *testing.T) {
 	}
 }
 
+func Test_route_addTree(t *testing.T) {
+	mockFunc := func(c Context) error { return nil }
+
+	testCases := []struct {
+		testName  string
+		paths     []string
+		expectErr bool
+	}{
+		{
+			testName: "params with same name",
+			paths:    []string{"/grades/semester/:semester_id", "/grades/semester/:semester_id/subjects"},
+		},
+		{
+			testName: "typed and untyped params on same position",
+			paths:    []string{"/item/:n<int>", "/item/:id<uuid>", "/item/:name"},
+		},
+		{
+			testName:  "duplicate path",
+			paths:     []string{"/friends/choose/:schedule_id", "/friends/choose/:schedule_id"},
+			expectErr: true,
+		},
+		{
+			testName:  "same path with other param name",
+			paths:     []string{"/friends/choose/:schedule_id", "/friends/choose/:id"},
+			expectErr: true,
+		},
+		{
+			testName:  "typed params with other names",
+			paths:     []string{"/item/:n<int>", "/item/:count<int>/abc"},
+			expectErr: true,
+		},
+		{
+			testName:  "unknown param type",
+			paths:     []string{"/item/:n<float>"},
+			expectErr: true,
+		},
+		{
+			testName:  "catch-all is not last",
+			paths:     []string{"/files/*rest/abc"},
+			expectErr: true,
+		},
+		{
+			testName:  "catch-all with other names",
+			paths:     []string{"/files/*rest", "/files/*path"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			r := newRoute()
+			var err error
+			for _, p := range tc.paths {
+				if err = r.addTree(p, mockFunc); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tc.expectErr {
+				t.Errorf("not equal error flag: expect %t got err %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func Test_route_findTree_typed(t *testing.T) {
+	r := newRoute()
+	handler := func(name string) HandlerFunc {
+		return func(c Context) error {
+			c.(*nativeContext).setParam("handler", name)
+			return nil
+		}
+	}
+	_ = r.addTree("/item/:n<int>", handler("int"))
+	_ = r.addTree("/item/:id<uuid>", handler("uuid"))
+	_ = r.addTree("/item/:name", handler("any"))
+	_ = r.addTree("/schedule/:date<date>/:id<uuid>", handler("schedule"))
+	_ = r.addTree("/files/*rest", handler("files"))
+	_ = r.addTree("/files/static/info", handler("static"))
+
+	testCases := []struct {
+		testName      string
+		path          string
+		expectFlag    bool
+		expectHandler string
+		expectParams  map[string]string
+	}{
+		{
+			testName:      "int param",
+			path:          "/item/10",
+			expectFlag:    true,
+			expectHandler: "int",
+			expectParams:  map[string]string{"n": "10"},
+		},
+		{
+			testName:      "uuid param",
+			path:          "/item/5608b53c-8568-4fbe-b72d-c4f278b3f4b6",
+			expectFlag:    true,
+			expectHandler: "uuid",
+			expectParams:  map[string]string{"id": "5608b53c-8568-4fbe-b72d-c4f278b3f4b6"},
+		},
+		{
+			testName:      "untyped param",
+			path:          "/item/foobar",
+			expectFlag:    true,
+			expectHandler: "any",
+			expectParams:  map[string]string{"name": "foobar"},
+		},
+		{
+			testName:   "invalid date",
+			path:       "/schedule/2024-13-01/5608b53c-8568-4fbe-b72d-c4f278b3f4b6",
+			expectFlag: false,
+		},
+		{
+			testName:   "invalid uuid",
+			path:       "/schedule/2024-01-01/foobar",
+			expectFlag: false,
+		},
+		{
+			testName:      "date and uuid",
+			path:          "/schedule/2024-01-01/5608b53c-8568-4fbe-b72d-c4f278b3f4b6",
+			expectFlag:    true,
+			expectHandler: "schedule",
+			expectParams:  map[string]string{"date": "2024-01-01", "id": "5608b53c-8568-4fbe-b72d-c4f278b3f4b6"},
+		},
+		{
+			testName:      "catch-all",
+			path:          "/files/a/b/c",
+			expectFlag:    true,
+			expectHandler: "files",
+			expectParams:  map[string]string{"rest": "a/b/c"},
+		},
+		{
+			testName:      "static has priority over catch-all",
+			path:          "/files/static/info",
+			expectFlag:    true,
+			expectHandler: "static",
+		},
+		{
+			testName:      "catch-all after static dead end",
+			path:          "/files/static/other",
+			expectFlag:    true,
+			expectHandler: "files",
+			expectParams:  map[string]string{"rest": "static/other"},
+		},
+		{
+			testName:   "catch-all without rest",
+			path:       "/files",
+			expectFlag: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			ctx := &nativeContext{
+				params: map[string]string{},
+			}
+			f, ok := r.findTree(ctx, tc.path)
+			if ok != tc.expectFlag {
+				t.Fatalf("not equal flag: expect %t got %t on path %s", tc.expectFlag, ok, tc.path)
+			}
+			if !ok {
+				return
+			}
+			_ = f(ctx)
+			if ctx.Param("handler") != tc.expectHandler {
+				t.Errorf("not equal handler: expect %s got %s", tc.expectHandler, ctx.Param("handler"))
+			}
+			for k, v := range tc.expectParams {
+				if ctx.Param(k) != v {
+					t.Errorf("not equal param %s: expect %s got %s", k, v, ctx.Param(k))
+				}
+			}
+		})
+	}
+}
+
+func Test_Bot_Routes(t *testing.T) {
+	mockFunc := func(c Context) error { return nil }
+	b := &Bot{
+		routers: newRouter(),
+		storage: newMemoryStorage(),
+	}
+	b.Command("/start", mockFunc)
+	b.AddTree(OnCallback, "/friends/choose/:schedule_id<uuid>", mockFunc)
+	b.Callback("/add_friend", mockFunc)
+
+	expect := []Route{
+		{Method: "callback", Path: "/add_friend"},
+		{Method: "callback", Path: "/friends/choose/:schedule_id<uuid>"},
+		{Method: "command", Path: "/start"},
+	}
+	routes := b.Routes()
+	if len(routes) != len(expect) {
+		t.Fatalf("not equal routes count: expect %d got %d", len(expect), len(routes))
+	}
+	for i := range expect {
+		if routes[i] != expect[i] {
+			t.Errorf("not equal route: expect %v got %v", expect[i], routes[i])
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expect panic on route conflict")
+		}
+	}()
+	b.Command("/start", mockFunc)
+}
+
 func Benchmark_route_findTree_3Params(b *testing.B) {
 	mockFunc := func(c Context) error { return nil }
 	r := newRoute()
@@ -224,3 +432,160 @@ func Test_Bot_handle(t *testing.T) {
 		})
 	}
 }
+
+func Test_Bot_handle_fallback(t *testing.T) {
+	mockFunc := func(c Context) error { return nil }
+	var fallbackCalled bool
+
+	b := &Bot{
+		routers: newRouter(),
+		storage: newMemoryStorage(),
+	}
+	b.State("someState", mockFunc)
+	b.Fallback(func(c Context) error {
+		fallbackCalled = true
+		return nil
+	})
+
+	message := tgbotapi.Update{
+		Message: &tgbotapi.Message{
+			From: &tgbotapi.User{
+				ID: 1,
+			},
+			Text: "some text",
+		},
+	}
+
+	ctx := &nativeContext{
+		bot:    b,
+		update: message,
+		params: map[string]string{},
+	}
+
+	testCases := []struct {
+		testName       string
+		setup          func()
+		expectFallback bool
+		expectIgnored  bool
+		expectState    bool
+	}{
+		{
+			testName: "actual state",
+			setup: func() {
+				_ = ctx.SetTempState("someState", time.Hour)
+			},
+			expectFallback: false,
+			expectState:    true,
+		},
+		{
+			testName: "expired state",
+			setup: func() {
+				_ = ctx.SetTempState("someState", time.Nanosecond)
+				time.Sleep(time.Millisecond)
+			},
+			expectFallback: true,
+			expectState:    false,
+		},
+		{
+			testName: "state without handler",
+			setup: func() {
+				_ = ctx.SetTempState("oldState", 0)
+			},
+			expectFallback: true,
+			expectState:    false,
+		},
+		{
+			testName: "no state",
+			setup: func() {
+				_ = b.storage.clear(1)
+			},
+			expectIgnored: true,
+			expectState:   false,
+		},
+		{
+			testName: "state deleted by handler",
+			setup: func() {
+				_ = ctx.SetTempState("someState", time.Hour)
+				_ = ctx.DelState()
+			},
+			expectIgnored: true,
+			expectState:   false,
+		},
+		{
+			testName: "expired state handled by fallback once",
+			setup: func() {
+				_ = ctx.SetTempState("someState", time.Nanosecond)
+				time.Sleep(time.Millisecond)
+				_, _ = b.handle(ctx, message)
+			},
+			expectIgnored: true,
+			expectState:   false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			fallbackCalled = false
+			tc.setup()
+
+			f, ok := b.handle(ctx, message)
+			if ok == tc.expectIgnored {
+				t.Fatalf("not equal handler existence: expect %t got %t", !tc.expectIgnored, ok)
+			}
+			if ok {
+				_ = f(ctx)
+			}
+
+			if fallbackCalled != tc.expectFallback {
+				t.Errorf("not equal fallback flag: expect %t got %t", tc.expectFallback, fallbackCalled)
+			}
+			if _, err := b.storage.getState(1); (err == nil) != tc.expectState {
+				t.Errorf("not equal state existence: expect %t got err %v", tc.expectState, err)
+			}
+		})
+	}
+}
+
+func Test_Bot_Cancel(t *testing.T) {
+	b := &Bot{
+		routers: newRouter(),
+		storage: newMemoryStorage(),
+	}
+	b.Cancel("/cancel", nil)
+
+	u := tgbotapi.Update{
+		Message: &tgbotapi.Message{
+			From: &tgbotapi.User{
+				ID: 1,
+			},
+			Text: "/cancel",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "bot_command",
+					Offset: 0,
+				},
+			},
+		},
+	}
+	ctx := &nativeContext{
+		bot:    b,
+		update: u,
+		params: map[string]string{},
+	}
+	_ = ctx.SetState("someState")
+	_ = ctx.SetData("students", []int{1, 2, 3})
+
+	f, ok := b.handle(ctx, u)
+	if !ok {
+		t.Fatalf("cancel command not found")
+	}
+	if err := f(ctx); err != nil {
+		t.Fatalf("cancel command error: %s", err)
+	}
+	if _, err := ctx.GetState(); err != ErrKeyNotExists {
+		t.Errorf("state must be deleted, got err %v", err)
+	}
+	if err := ctx.GetData("students", new([]int)); err != ErrKeyNotExists {
+		t.Errorf("data must be deleted, got err %v", err)
+	}
+}
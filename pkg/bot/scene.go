@@ -0,0 +1,225 @@
+package bot
+
+import (
+	"errors"
+	"time"
+)
+
+// Scene описывает многошаговый сценарий (wizard) поверх машины состояний.
+// Шаги, их валидация, возврат назад, таймаут и данные, которые нужно удалить при выходе, объявляются в одном месте.
+// Состояние шага хранится в формате scene:step, поэтому имена шагов разных сцен не пересекаются
+type Scene struct {
+	name      string
+	steps     []*step
+	index     map[string]int
+	timeout   time.Duration
+	onTimeout HandlerFunc
+	keys      []string
+}
+
+type step struct {
+	name     string
+	handler  HandlerFunc
+	validate HandlerFunc
+	prompt   HandlerFunc
+}
+
+type SceneOption func(s *Scene)
+
+// SceneTimeout задает время жизни сцены. Каждый переход между шагами продлевает его.
+// Если пользователь вернулся после таймаута, то данные сцены удаляются, а вместо шага вызывается h (может быть nil)
+func SceneTimeout(d time.Duration, h HandlerFunc) SceneOption {
+	return func(s *Scene) {
+		s.timeout = d
+		s.onTimeout = h
+	}
+}
+
+// SceneData перечисляет ключи пользовательских данных, которые удаляются при входе и выходе из сцены
+func SceneData(keys ...string) SceneOption {
+	return func(s *Scene) {
+		s.keys = append(s.keys, keys...)
+	}
+}
+
+type StepOption func(s *step)
+
+// Validate проверяет ввод пользователя до вызова обработчика шага. Ошибка валидации возвращается как ошибка хэндлера
+func Validate(f HandlerFunc) StepOption {
+	return func(s *step) {
+		s.validate = f
+	}
+}
+
+// Prompt вызывается при возврате на шаг через Back, чтобы заново показать пользователю приглашение к вводу
+func Prompt(f HandlerFunc) StepOption {
+	return func(s *step) {
+		s.prompt = f
+	}
+}
+
+func NewScene(name string, opts ...SceneOption) *Scene {
+	s := &Scene{
+		name:  name,
+		index: make(map[string]int),
+	}
+	for _, option := range opts {
+		option(s)
+	}
+	return s
+}
+
+// Step добавляет шаг в конец сцены. Порядок добавления определяет порядок Next и Back
+func (s *Scene) Step(name string, h HandlerFunc, opts ...StepOption) *Scene {
+	st := &step{
+		name:    name,
+		handler: h,
+	}
+	for _, option := range opts {
+		option(st)
+	}
+	s.index[name] = len(s.steps)
+	s.steps = append(s.steps, st)
+	return s
+}
+
+// Enter начинает сцену с первого шага. Оставшиеся от прошлого прохода данные удаляются
+func (s *Scene) Enter(c Context) error {
+	if len(s.steps) == 0 {
+		return errors.New("scene " + s.name + " has no steps")
+	}
+	if err := c.DelData(s.dataKeys()...); err != nil {
+		return err
+	}
+	return s.set(c, s.steps[0])
+}
+
+// Goto переводит пользователя на указанный шаг сцены
+func (s *Scene) Goto(c Context, name string) error {
+	i, ok := s.index[name]
+	if !ok {
+		return errors.New("scene " + s.name + " has no step " + name)
+	}
+	return s.set(c, s.steps[i])
+}
+
+// Next переводит пользователя на следующий шаг. На последнем шаге сцена завершается
+func (s *Scene) Next(c Context) error {
+	i, ok := s.current(c)
+	if !ok {
+		return s.Enter(c)
+	}
+	if i+1 >= len(s.steps) {
+		return s.Leave(c)
+	}
+	return s.set(c, s.steps[i+1])
+}
+
+// Back возвращает пользователя на предыдущий шаг и вызывает его Prompt.
+// Если пользователь не находится в сцене (например, нажал кнопку старого сообщения), то сцена начинается заново
+func (s *Scene) Back(c Context) error {
+	i, ok := s.current(c)
+	if !ok || i == 0 {
+		if err := s.Enter(c); err != nil {
+			return err
+		}
+		return s.prompt(c, s.steps[0])
+	}
+	st := s.steps[i-1]
+	if err := s.set(c, st); err != nil {
+		return err
+	}
+	return s.prompt(c, st)
+}
+
+// Leave завершает сцену: удаляет состояние и все объявленные данные сцены
+func (s *Scene) Leave(c Context) error {
+	if err := c.DelData(s.dataKeys()...); err != nil {
+		return err
+	}
+	return c.DelState()
+}
+
+// BackCallback коллбэк кнопки "назад", который обрабатывается самой сценой (см. Back)
+func (s *Scene) BackCallback() string {
+	return "/scene/" + s.name + "/back"
+}
+
+func (s *Scene) set(c Context, st *step) error {
+	if s.timeout > 0 {
+		if err := c.SetTempData(s.activeKey(), true, s.timeout); err != nil {
+			return err
+		}
+	}
+	return c.SetState(s.state(st.name))
+}
+
+func (s *Scene) current(c Context) (int, bool) {
+	state, err := c.GetState()
+	if err != nil {
+		return 0, false
+	}
+	for i, st := range s.steps {
+		if s.state(st.name) == state {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Scene) prompt(c Context, st *step) error {
+	if st.prompt == nil {
+		return nil
+	}
+	return st.prompt(c)
+}
+
+// handler оборачивает обработчик шага: проверка таймаута сцены -> валидация -> обработчик
+func (s *Scene) handler(st *step) HandlerFunc {
+	return func(c Context) error {
+		if s.timeout > 0 {
+			var active bool
+			if err := c.GetData(s.activeKey(), &active); err != nil {
+				if !errors.Is(err, ErrKeyNotExists) {
+					return err
+				}
+				if err = s.Leave(c); err != nil {
+					return err
+				}
+				if s.onTimeout != nil {
+					return s.onTimeout(c)
+				}
+				return nil
+			}
+		}
+		if st.validate != nil {
+			if err := st.validate(c); err != nil {
+				return err
+			}
+		}
+		return st.handler(c)
+	}
+}
+
+func (s *Scene) state(name string) string {
+	return s.name + ":" + name
+}
+
+func (s *Scene) activeKey() string {
+	return "scene:" + s.name
+}
+
+// Всегда отдаем копию, потому что хранилище может изменять переданный слайс ключей (см. redisStorage.delData)
+func (s *Scene) dataKeys() []string {
+	keys := make([]string, 0, len(s.keys)+1)
+	keys = append(keys, s.keys...)
+	return append(keys, s.activeKey())
+}
+
+// registerScene регистрирует все шаги сцены как состояния, а также коллбэк кнопки "назад"
+func registerScene(r Router, s *Scene, m ...MiddlewareFunc) {
+	for _, st := range s.steps {
+		r.State(s.state(st.name), s.handler(st), m...)
+	}
+	r.Callback(s.BackCallback(), s.Back, m...)
+}
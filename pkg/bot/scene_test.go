@@ -0,0 +1,155 @@
+package bot
+
+import (
+	"errors"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newSceneTestContext(b *Bot, u tgbotapi.Update) *nativeContext {
+	return &nativeContext{
+		bot:    b,
+		update: u,
+		params: map[string]string{},
+	}
+}
+
+func Test_Scene_navigation(t *testing.T) {
+	b := &Bot{
+		routers: newRouter(),
+		storage: newMemoryStorage(),
+	}
+	var prompted []string
+	prompt := func(name string) HandlerFunc {
+		return func(c Context) error {
+			prompted = append(prompted, name)
+			return nil
+		}
+	}
+	mockFunc := func(c Context) error { return nil }
+
+	s := NewScene("registration", SceneTimeout(time.Hour, nil), SceneData("students")).
+		Step("first", mockFunc, Prompt(prompt("first"))).
+		Step("second", mockFunc, Prompt(prompt("second"))).
+		Step("third", mockFunc)
+
+	c := newSceneTestContext(b, tgbotapi.Update{Message: &tgbotapi.Message{From: &tgbotapi.User{ID: 1}}})
+
+	// данные прошлого прохода сцены должны удалиться при входе
+	assert.Nil(t, c.SetData("students", []int{1, 2}))
+	assert.Nil(t, s.Enter(c))
+	state, err := c.GetState()
+	assert.Nil(t, err)
+	assert.Equal(t, "registration:first", state)
+	assert.Equal(t, ErrKeyNotExists, c.GetData("students", new([]int)))
+
+	assert.Nil(t, s.Next(c))
+	assert.Nil(t, s.Next(c))
+	state, _ = c.GetState()
+	assert.Equal(t, "registration:third", state)
+
+	assert.Nil(t, s.Back(c))
+	state, _ = c.GetState()
+	assert.Equal(t, "registration:second", state)
+	assert.Equal(t, []string{"second"}, prompted)
+
+	assert.Nil(t, s.Goto(c, "third"))
+	assert.NotNil(t, s.Goto(c, "not_exist"))
+
+	// на последнем шаге Next завершает сцену и чистит данные
+	assert.Nil(t, c.SetData("students", []int{1}))
+	assert.Nil(t, s.Next(c))
+	_, err = c.GetState()
+	assert.Equal(t, ErrKeyNotExists, err)
+	assert.Equal(t, ErrKeyNotExists, c.GetData("students", new([]int)))
+
+	// вне сцены Back начинает ее заново
+	assert.Nil(t, s.Back(c))
+	state, _ = c.GetState()
+	assert.Equal(t, "registration:first", state)
+	assert.Equal(t, []string{"second", "first"}, prompted)
+}
+
+func Test_Scene_handler(t *testing.T) {
+	errValidation := errors.New("validation error")
+
+	var (
+		handled  bool
+		timedOut bool
+	)
+	s := NewScene("friend", SceneTimeout(time.Hour, func(c Context) error {
+		timedOut = true
+		return nil
+	}), SceneData("students")).
+		Step("input", func(c Context) error {
+			handled = true
+			return nil
+		}, Validate(func(c Context) error {
+			if c.Text() == "" {
+				return errValidation
+			}
+			return nil
+		}))
+
+	b := &Bot{
+		routers: newRouter(),
+		storage: newMemoryStorage(),
+	}
+	b.Scene(s)
+
+	testCases := []struct {
+		testName      string
+		text          string
+		expire        bool
+		expectErr     error
+		expectHandled bool
+		expectTimeout bool
+	}{
+		{
+			testName:      "correct input",
+			text:          "Иванов Иван Иванович",
+			expectHandled: true,
+		},
+		{
+			testName:  "invalid input",
+			text:      "",
+			expectErr: errValidation,
+		},
+		{
+			testName:      "scene expired",
+			text:          "Иванов Иван Иванович",
+			expire:        true,
+			expectTimeout: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			handled, timedOut = false, false
+			u := tgbotapi.Update{Message: &tgbotapi.Message{From: &tgbotapi.User{ID: 1}, Text: tc.text}}
+			c := newSceneTestContext(b, u)
+
+			assert.Nil(t, s.Enter(c))
+			if tc.expire {
+				assert.Nil(t, c.DelData(s.activeKey()))
+			}
+
+			f, ok := b.handle(c, u)
+			assert.True(t, ok)
+			assert.Equal(t, tc.expectErr, f(c))
+			assert.Equal(t, tc.expectHandled, handled)
+			assert.Equal(t, tc.expectTimeout, timedOut)
+
+			if tc.expectTimeout {
+				_, err := c.GetState()
+				assert.Equal(t, ErrKeyNotExists, err)
+			}
+		})
+	}
+
+	// кнопка "назад" сцены зарегистрирована как коллбэк
+	_, ok := b.routers[OnCallback].find(&nativeContext{params: map[string]string{}}, s.BackCallback())
+	assert.True(t, ok)
+}
@@ -1,16 +1,12 @@
 package bot
 
 import (
-	"context"
-	"encoding/json"
+	"container/heap"
+	"container/list"
 	"errors"
-	"github.com/bytedance/sonic"
-	"github.com/redis/go-redis/v9"
-	"strconv"
-	"strings"
+	"sort"
 	"sync"
 	"time"
-	"unsafe"
 )
 
 var (
@@ -21,8 +17,9 @@ var (
 // для удобства состояния хранятся в строках, а все данные - в виде мапы, где ключ - строка для удобства поиска,
 // а значение - массив байтов для гибкого хранения разных структур
 type storage interface {
-	setState(id int64, state string) error
+	setState(id int64, state string, d time.Duration) error
 	getState(id int64) (string, error)
+	delState(id int64) error
 	setData(id int64, key string, v any) error
 	setTempData(id int64, key string, v any, d time.Duration) error
 	setCommonData(key string, v any, d time.Duration) error
@@ -31,275 +28,327 @@ type storage interface {
 	delData(id int64, keys ...string) error
 	delCommonData(keys ...string) error
 	clear(id int64) error
+	// keys возвращает ключи данных пользователя (без состояния) в отсортированном порядке
+	keys(id int64) ([]string, error)
+	setCodec(c Codec)
+	close() error
 }
 
-// Чтобы был для удобства
+// memoryStorage хранит данные в памяти процесса. Подходит для инстанса в единственном экземпляре.
+// Время жизни ключей отслеживается одной кучей (min-heap по времени истечения) и одним таймером,
+// а размер хранилища можно ограничить (см. MemoryStorage): при превышении вытесняются давно не используемые ключи (LRU)
 type memoryStorage struct {
-	sync.RWMutex
-	state  map[int64]string
-	data   map[int64]map[string][]byte
-	common map[string][]byte
+	sync.Mutex
+	items map[memoryKey]*memoryItem
+	// users индекс ключей пользователя для clear
+	users  map[int64]map[memoryKey]struct{}
+	expiry memoryExpiry
+	lru    *list.List
+	limit  int
+	codec  Codec
+
+	wake      chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+const (
+	memoryKindState uint8 = iota
+	memoryKindData
+	memoryKindCommon
+)
+
+type memoryKey struct {
+	kind uint8
+	id   int64
+	key  string
+}
+
+type memoryItem struct {
+	key   memoryKey
+	value []byte
+	// Нулевое время - ключ бессрочный
+	expire time.Time
+	// index позиция в куче истечений, -1 если ключ бессрочный
+	index int
+	elem  *list.Element
 }
 
 func newMemoryStorage() *memoryStorage {
 	return &memoryStorage{
-		state:  map[int64]string{},
-		data:   make(map[int64]map[string][]byte),
-		common: make(map[string][]byte),
+		items: make(map[memoryKey]*memoryItem),
+		users: make(map[int64]map[memoryKey]struct{}),
+		lru:   list.New(),
+		codec: defaultCodec,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
 	}
 }
 
-func (s *memoryStorage) setState(id int64, state string) error {
+func (s *memoryStorage) setCodec(c Codec) {
+	s.codec = c
+}
+
+// set сохраняет значение. Перезапись ключа заменяет и его время жизни, поэтому старый таймаут больше не удалит новое значение
+func (s *memoryStorage) set(k memoryKey, value []byte, d time.Duration) {
 	s.Lock()
 	defer s.Unlock()
-	s.state[id] = state
-	return nil
+
+	var expire time.Time
+	if d > 0 {
+		expire = time.Now().Add(d)
+	}
+
+	item, ok := s.items[k]
+	if !ok {
+		item = &memoryItem{key: k, index: -1}
+		item.elem = s.lru.PushFront(item)
+		s.items[k] = item
+		if k.kind != memoryKindCommon {
+			if s.users[k.id] == nil {
+				s.users[k.id] = make(map[memoryKey]struct{})
+			}
+			s.users[k.id][k] = struct{}{}
+		}
+	} else {
+		s.lru.MoveToFront(item.elem)
+	}
+	item.value = value
+	item.expire = expire
+
+	switch {
+	case expire.IsZero() && item.index != -1:
+		heap.Remove(&s.expiry, item.index)
+	case !expire.IsZero() && item.index == -1:
+		heap.Push(&s.expiry, item)
+	case !expire.IsZero():
+		heap.Fix(&s.expiry, item.index)
+	}
+
+	for s.limit > 0 && len(s.items) > s.limit {
+		s.remove(s.lru.Back().Value.(*memoryItem))
+	}
+
+	if !expire.IsZero() && len(s.expiry) > 0 && s.expiry[0] == item {
+		s.startOnce.Do(func() { go s.sweep() })
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
 }
 
-func (s *memoryStorage) getState(id int64) (string, error) {
-	s.RLock()
-	defer s.RUnlock()
-	state, ok := s.state[id]
+func (s *memoryStorage) get(k memoryKey) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	item, ok := s.items[k]
 	if !ok {
-		return "", ErrKeyNotExists
+		return nil, false
+	}
+	// Таймер мог еще не сработать
+	if !item.expire.IsZero() && !time.Now().Before(item.expire) {
+		s.remove(item)
+		return nil, false
 	}
-	return state, nil
+	s.lru.MoveToFront(item.elem)
+	return item.value, true
 }
 
-func (s *memoryStorage) __setData(id int64, data map[string][]byte) {
+func (s *memoryStorage) del(keys ...memoryKey) {
 	s.Lock()
 	defer s.Unlock()
-	s.data[id] = data
+	for _, k := range keys {
+		if item, ok := s.items[k]; ok {
+			s.remove(item)
+		}
+	}
 }
 
-func (s *memoryStorage) __getData(id int64) map[string][]byte {
-	s.RLock()
-	defer s.RUnlock()
-	data, ok := s.data[id]
-	if !ok {
-		return map[string][]byte{}
+// remove вызывается под блокировкой
+func (s *memoryStorage) remove(item *memoryItem) {
+	delete(s.items, item.key)
+	if item.key.kind != memoryKindCommon {
+		delete(s.users[item.key.id], item.key)
+		if len(s.users[item.key.id]) == 0 {
+			delete(s.users, item.key.id)
+		}
+	}
+	if item.index != -1 {
+		heap.Remove(&s.expiry, item.index)
 	}
-	return data
+	s.lru.Remove(item.elem)
 }
 
-func (s *memoryStorage) setData(id int64, key string, v any) error {
-	data := s.__getData(id)
-	b, err := json.Marshal(v)
-	if err != nil {
-		return err
+// sweep удаляет истекшие ключи. Запускается при первом ключе с временем жизни и работает до close
+func (s *memoryStorage) sweep() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.Lock()
+		now := time.Now()
+		for len(s.expiry) > 0 && !now.Before(s.expiry[0].expire) {
+			s.remove(s.expiry[0])
+		}
+		next := time.Duration(-1)
+		if len(s.expiry) > 0 {
+			next = s.expiry[0].expire.Sub(now)
+		}
+		s.Unlock()
+
+		var c <-chan time.Time
+		if next >= 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(next)
+			c = timer.C
+		}
+		select {
+		case <-c:
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
 	}
-	data[key] = b
-	s.__setData(id, data)
+}
+
+func (s *memoryStorage) close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *memoryStorage) setState(id int64, state string, d time.Duration) error {
+	s.set(memoryKey{kind: memoryKindState, id: id}, []byte(state), d)
+	return nil
+}
+
+func (s *memoryStorage) getState(id int64) (string, error) {
+	b, ok := s.get(memoryKey{kind: memoryKindState, id: id})
+	if !ok {
+		return "", ErrKeyNotExists
+	}
+	return string(b), nil
+}
+
+func (s *memoryStorage) delState(id int64) error {
+	s.del(memoryKey{kind: memoryKindState, id: id})
 	return nil
 }
 
+func (s *memoryStorage) setData(id int64, key string, v any) error {
+	return s.setTempData(id, key, v, 0)
+}
+
 func (s *memoryStorage) setTempData(id int64, key string, v any, d time.Duration) error {
-	data := s.__getData(id)
-	b, err := json.Marshal(v)
+	b, err := s.codec.Marshal(v)
 	if err != nil {
 		return err
 	}
-	data[key] = b
-	s.__setData(id, data)
-	go func() {
-		time.Sleep(d)
-		data := s.__getData(id)
-		delete(data, key)
-		s.__setData(id, data)
-	}()
+	s.set(memoryKey{kind: memoryKindData, id: id, key: key}, b, d)
 	return nil
 }
 
 func (s *memoryStorage) setCommonData(key string, v any, d time.Duration) error {
-	b, err := json.Marshal(v)
+	b, err := s.codec.Marshal(v)
 	if err != nil {
 		return err
 	}
-	s.Lock()
-	defer s.Unlock()
-	s.common[key] = b
-	if d > 0 {
-		go func() {
-			time.Sleep(d)
-			s.Lock()
-			delete(s.common, key)
-			s.Unlock()
-		}()
-	}
+	s.set(memoryKey{kind: memoryKindCommon, key: key}, b, d)
 	return nil
 }
 
 func (s *memoryStorage) getData(id int64, key string, v any) error {
-	data := s.__getData(id)
-	b, ok := data[key]
+	b, ok := s.get(memoryKey{kind: memoryKindData, id: id, key: key})
 	if !ok {
 		return ErrKeyNotExists
 	}
-	return json.Unmarshal(b, v)
+	return s.codec.Unmarshal(b, v)
 }
 
 func (s *memoryStorage) getCommonData(key string, v any) error {
-	s.RLock()
-	defer s.RUnlock()
-	b, ok := s.common[key]
+	b, ok := s.get(memoryKey{kind: memoryKindCommon, key: key})
 	if !ok {
 		return ErrKeyNotExists
 	}
-	return json.Unmarshal(b, v)
+	return s.codec.Unmarshal(b, v)
 }
 
 func (s *memoryStorage) delData(id int64, keys ...string) error {
-	data := s.__getData(id)
+	mk := make([]memoryKey, 0, len(keys))
 	for _, k := range keys {
-		delete(data, k)
+		mk = append(mk, memoryKey{kind: memoryKindData, id: id, key: k})
 	}
-	s.__setData(id, data)
+	s.del(mk...)
 	return nil
 }
 
 func (s *memoryStorage) delCommonData(keys ...string) error {
-	s.Lock()
-	defer s.Unlock()
+	mk := make([]memoryKey, 0, len(keys))
 	for _, k := range keys {
-		delete(s.common, k)
+		mk = append(mk, memoryKey{kind: memoryKindCommon, key: k})
 	}
+	s.del(mk...)
 	return nil
 }
 
 func (s *memoryStorage) clear(id int64) error {
 	s.Lock()
 	defer s.Unlock()
-	delete(s.state, id)
-	delete(s.data, id)
-	return nil
-}
-
-type redisStorage struct {
-	*redis.Client
-	ctx context.Context
-}
-
-func newRedisStorage(ctx context.Context, redis *redis.Client) *redisStorage {
-	if ctx == nil {
-		ctx = context.Background()
-	}
-	return &redisStorage{
-		Client: redis,
-		ctx:    ctx,
-	}
-}
-
-func (s *redisStorage) setState(id int64, state string) error {
-	return s.Set(s.ctx, s.stateKey(id), state, 0).Err()
-}
-
-func (s *redisStorage) getState(id int64) (string, error) {
-	state, err := s.Get(s.ctx, s.stateKey(id)).Result()
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return "", ErrKeyNotExists
-		}
-		return "", err
-	}
-	return state, nil
-}
-
-func (s *redisStorage) setData(id int64, key string, v any) error {
-	return s.setCommonData(s.dataKey(id, key), v, 0)
-}
-
-func (s *redisStorage) setTempData(id int64, key string, v any, d time.Duration) error {
-	return s.setCommonData(s.dataKey(id, key), v, d)
-}
-
-func (s *redisStorage) setCommonData(key string, v any, d time.Duration) error {
-	b, err := sonic.Marshal(v)
-	if err != nil {
-		return err
+	for k := range s.users[id] {
+		s.remove(s.items[k])
 	}
-	return s.Set(s.ctx, s.normalizeKey(key), b, d).Err()
-}
-
-func (s *redisStorage) getData(id int64, key string, v any) error {
-	return s.getCommonData(s.dataKey(id, key), v)
+	return nil
 }
 
-func (s *redisStorage) getCommonData(key string, v any) error {
-	b, err := s.Get(s.ctx, s.normalizeKey(key)).Result()
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return ErrKeyNotExists
+func (s *memoryStorage) keys(id int64) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	var keys []string
+	for k := range s.users[id] {
+		item := s.items[k]
+		if k.kind != memoryKindData || (!item.expire.IsZero() && !now.Before(item.expire)) {
+			continue
 		}
-		return err
+		keys = append(keys, k.key)
 	}
-	return sonic.UnmarshalString(b, v)
+	sort.Strings(keys)
+	return keys, nil
 }
 
-// Удаляет данные по заданному ключу. Не работает с паттернами по типу fsm:id:*. Нужно точное соответствие.
-// Не возвращает ошибку redis.Nil
-func (s *redisStorage) delData(id int64, keys ...string) error {
-	for i, k := range keys {
-		keys[i] = s.dataKey(id, k)
-	}
-	return s.Del(s.ctx, keys...).Err()
-}
+// memoryExpiry куча ключей по времени истечения (container/heap)
+type memoryExpiry []*memoryItem
 
-func (s *redisStorage) delCommonData(keys ...string) error {
-	for i, k := range keys {
-		keys[i] = s.normalizeKey(k)
-	}
-	return s.Del(s.ctx, keys...).Err()
+func (e memoryExpiry) Len() int {
+	return len(e)
 }
 
-// Работает достаточно медленно, потому что стираются все пользовательские ключи, поэтому преимущественно использовать delData.
-// Не возвращает ошибку redis.Nil
-func (s *redisStorage) clear(id int64) error {
-	var (
-		cursor uint64
-		keys   []string
-	)
-
-	for {
-		k, nc, err := s.Scan(s.ctx, cursor, s.dataKey(id, "*"), 20).Result()
-		if err != nil {
-			return err
-		}
-
-		keys = append(keys, k...)
-		cursor = nc
-
-		if cursor == 0 {
-			break
-		}
-	}
-
-	if len(keys) == 0 {
-		return nil
-	}
-	return s.Del(s.ctx, keys...).Err()
+func (e memoryExpiry) Less(i, j int) bool {
+	return e[i].expire.Before(e[j].expire)
 }
 
-func (s *redisStorage) stateKey(id int64) string {
-	return s.dataKey(id, "state")
+func (e memoryExpiry) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+	e[i].index = i
+	e[j].index = j
 }
 
-// Ключ в формате fsm:id:key
-// Создаем буфер размером 24 + len(key) из которых 4 байта на префикс "fsm:", 19 на int64 (не 20, потому что только числа > 0) и еще 1 на символ ":" = 24
-// Уменьшаем аллокации и стреляем в ногу - делаем строку через unsafe.
-func (s *redisStorage) dataKey(id int64, key string) string {
-	buf := make([]byte, 0, 24+len(key)) // fsm: (4) + int64 (19, т.к. id > 0, поэтому не включаем -) + : (1) = 24
-
-	buf = append(buf, "fsm:"...)
-	buf = strconv.AppendInt(buf, id, 10)
-	buf = append(buf, ':')
-	buf = append(buf, key...)
-
-	return *(*string)(unsafe.Pointer(&buf))
+func (e *memoryExpiry) Push(x any) {
+	item := x.(*memoryItem)
+	item.index = len(*e)
+	*e = append(*e, item)
 }
 
-func (s *redisStorage) normalizeKey(key string) string {
-	if strings.HasPrefix(key, "fsm:") {
-		return key
-	}
-	return "fsm:" + key
+func (e *memoryExpiry) Pop() any {
+	old := *e
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*e = old[:n-1]
+	return item
 }
@@ -0,0 +1,272 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+// boltStorage хранит состояния и данные во встроенной базе bbolt (один файл на диске).
+// Нужна небольшим инсталляциям, которым не хочется поднимать redis ради машины состояний.
+//
+// Данные пользователя лежат под ключом id (8 байт big endian) + key, поэтому clear удаляет их одним проходом курсора по префиксу.
+// Значение начинается с 8 байт времени истечения (unix nano, 0 - бессрочно). Истекшие значения не отдаются при чтении,
+// а физически удаляются периодической очисткой
+type boltStorage struct {
+	db    *bbolt.DB
+	codec Codec
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+const (
+	defaultBoltSweepInterval = time.Minute
+	boltExpireSize           = 8
+	boltIdSize               = 8
+)
+
+var (
+	boltStateBucket  = []byte("state")
+	boltDataBucket   = []byte("data")
+	boltCommonBucket = []byte("common")
+)
+
+func newBoltStorage(path string, sweepInterval time.Duration) (*boltStorage, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{boltStateBucket, boltDataBucket, boltCommonBucket} {
+			if _, e := tx.CreateBucketIfNotExists(bucket); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	s := &boltStorage{
+		db:    db,
+		codec: defaultCodec,
+		done:  make(chan struct{}),
+	}
+	go s.sweep(sweepInterval)
+	return s, nil
+}
+
+func (s *boltStorage) setCodec(c Codec) {
+	s.codec = c
+}
+
+func (s *boltStorage) close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.db.Close()
+	})
+	return err
+}
+
+func (s *boltStorage) put(bucket, key, value []byte, d time.Duration) error {
+	v := make([]byte, boltExpireSize, boltExpireSize+len(value))
+	if d > 0 {
+		binary.BigEndian.PutUint64(v, uint64(time.Now().Add(d).UnixNano()))
+	}
+	v = append(v, value...)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Put(key, v)
+	})
+}
+
+// get копирует значение, потому что память bbolt валидна только внутри транзакции
+func (s *boltStorage) get(bucket, key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(bucket).Get(key)
+		if v == nil || boltExpired(v, time.Now()) {
+			return ErrKeyNotExists
+		}
+		value = append([]byte(nil), v[boltExpireSize:]...)
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStorage) del(bucket []byte, keys ...[]byte) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStorage) setState(id int64, state string, d time.Duration) error {
+	return s.put(boltStateBucket, boltUserKey(id, ""), []byte(state), d)
+}
+
+func (s *boltStorage) getState(id int64) (string, error) {
+	b, err := s.get(boltStateBucket, boltUserKey(id, ""))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (s *boltStorage) delState(id int64) error {
+	return s.del(boltStateBucket, boltUserKey(id, ""))
+}
+
+func (s *boltStorage) setData(id int64, key string, v any) error {
+	return s.setTempData(id, key, v, 0)
+}
+
+func (s *boltStorage) setTempData(id int64, key string, v any, d time.Duration) error {
+	b, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.put(boltDataBucket, boltUserKey(id, key), b, d)
+}
+
+func (s *boltStorage) setCommonData(key string, v any, d time.Duration) error {
+	b, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.put(boltCommonBucket, []byte(key), b, d)
+}
+
+func (s *boltStorage) getData(id int64, key string, v any) error {
+	b, err := s.get(boltDataBucket, boltUserKey(id, key))
+	if err != nil {
+		return err
+	}
+	return s.codec.Unmarshal(b, v)
+}
+
+func (s *boltStorage) getCommonData(key string, v any) error {
+	b, err := s.get(boltCommonBucket, []byte(key))
+	if err != nil {
+		return err
+	}
+	return s.codec.Unmarshal(b, v)
+}
+
+func (s *boltStorage) delData(id int64, keys ...string) error {
+	bk := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		bk = append(bk, boltUserKey(id, k))
+	}
+	return s.del(boltDataBucket, bk...)
+}
+
+func (s *boltStorage) delCommonData(keys ...string) error {
+	bk := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		bk = append(bk, []byte(k))
+	}
+	return s.del(boltCommonBucket, bk...)
+}
+
+// clear удаляет состояние и все данные пользователя в одной транзакции
+func (s *boltStorage) clear(id int64) error {
+	prefix := boltUserKey(id, "")
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(boltStateBucket).Delete(prefix); err != nil {
+			return err
+		}
+		// Удалять во время обхода курсором нельзя (курсор пропускает элементы), поэтому сначала собираем ключи
+		b := tx.Bucket(boltDataBucket)
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStorage) keys(id int64) ([]string, error) {
+	prefix := boltUserKey(id, "")
+	now := time.Now()
+	var keys []string
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(boltDataBucket).Cursor()
+		// Ключи в bbolt отсортированы, поэтому результат уже упорядочен
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if !boltExpired(v, now) {
+				keys = append(keys, string(k[boltIdSize:]))
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// sweep периодически удаляет истекшие значения из всех бакетов
+func (s *boltStorage) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = s.deleteExpired(time.Now())
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *boltStorage) deleteExpired(now time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{boltStateBucket, boltDataBucket, boltCommonBucket} {
+			b := tx.Bucket(bucket)
+			var keys [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				if boltExpired(v, now) {
+					keys = append(keys, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err = b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func boltExpired(v []byte, now time.Time) bool {
+	if len(v) < boltExpireSize {
+		return true
+	}
+	expire := binary.BigEndian.Uint64(v[:boltExpireSize])
+	return expire != 0 && now.UnixNano() >= int64(expire)
+}
+
+func boltUserKey(id int64, key string) []byte {
+	b := make([]byte, boltIdSize, boltIdSize+len(key))
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return append(b, key...)
+}
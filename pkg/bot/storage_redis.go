@@ -0,0 +1,359 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// Раскладка данных в redis.
+// Состояние и все данные пользователя лежат в одном хэше fsm:user:id (поле s - состояние, d:key - данные),
+// поэтому clear - это один атомарный DEL, а не SCAN по fsm:id:* с последующим удалением.
+//
+// Redis (до 7.4) не умеет истекать отдельные поля хэша, поэтому время истечения полей хранится в sorted set fsm:user:id:exp
+// (member - поле, score - время истечения в мс). Истекшие поля удаляются при чтении и при каждой записи в хэш,
+// а если бессрочных полей не осталось, то весь хэш истекает вместе с последним полем.
+// Запись и чтение с проверкой истечения выполняются lua скриптами, чтобы хэш и индекс не расходились.
+//
+// Общие данные хранятся как раньше, отдельными ключами fsm:key с обычным TTL
+const (
+	redisUserPrefix  = "fsm:user:"
+	redisExpirySufix = ":exp"
+	redisStateField  = "s"
+	redisDataPrefix  = "d:"
+)
+
+// KEYS[1] - хэш пользователя, KEYS[2] - индекс истечений.
+// ARGV[1] - поле, ARGV[2] - значение, ARGV[3] - время истечения в мс (0 - бессрочно), ARGV[4] - текущее время в мс
+var redisSetField = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[4])
+if #expired > 0 then
+	redis.call('HDEL', KEYS[1], unpack(expired))
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[4])
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+else
+	redis.call('ZREM', KEYS[2], ARGV[1])
+end
+if redis.call('ZCARD', KEYS[2]) == redis.call('HLEN', KEYS[1]) then
+	local last = redis.call('ZRANGE', KEYS[2], -1, -1, 'WITHSCORES')
+	redis.call('PEXPIREAT', KEYS[1], last[2])
+	redis.call('PEXPIREAT', KEYS[2], last[2])
+else
+	redis.call('PERSIST', KEYS[1])
+	redis.call('PERSIST', KEYS[2])
+end
+return 1
+`)
+
+// KEYS[1] - хэш пользователя, KEYS[2] - индекс истечений. ARGV - удаляемые поля.
+// После удаления время жизни хэша пересчитывается так же, как при записи: если остались только временные поля,
+// хэш истекает вместе с последним из них, иначе (или если полей не осталось) становится бессрочным
+var redisDelFields = redis.NewScript(`
+redis.call('HDEL', KEYS[1], unpack(ARGV))
+redis.call('ZREM', KEYS[2], unpack(ARGV))
+local left = redis.call('ZCARD', KEYS[2])
+if left > 0 and left == redis.call('HLEN', KEYS[1]) then
+	local last = redis.call('ZRANGE', KEYS[2], -1, -1, 'WITHSCORES')
+	redis.call('PEXPIREAT', KEYS[1], last[2])
+	redis.call('PEXPIREAT', KEYS[2], last[2])
+else
+	redis.call('PERSIST', KEYS[1])
+	redis.call('PERSIST', KEYS[2])
+end
+return 1
+`)
+
+// KEYS[1] - хэш пользователя, KEYS[2] - индекс истечений. ARGV[1] - поле, ARGV[2] - текущее время в мс
+var redisGetField = redis.NewScript(`
+local expire = redis.call('ZSCORE', KEYS[2], ARGV[1])
+if expire and tonumber(expire) <= tonumber(ARGV[2]) then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('ZREM', KEYS[2], ARGV[1])
+	return false
+end
+return redis.call('HGET', KEYS[1], ARGV[1])
+`)
+
+type redisStorage struct {
+	*redis.Client
+	ctx   context.Context
+	codec Codec
+}
+
+func newRedisStorage(ctx context.Context, redis *redis.Client) *redisStorage {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &redisStorage{
+		Client: redis,
+		ctx:    ctx,
+		codec:  defaultCodec,
+	}
+}
+
+func (s *redisStorage) setCodec(c Codec) {
+	s.codec = c
+}
+
+// Клиент редиса создается и закрывается снаружи, поэтому здесь закрывать нечего
+func (s *redisStorage) close() error {
+	return nil
+}
+
+func (s *redisStorage) setField(id int64, field string, value []byte, d time.Duration) error {
+	now := time.Now()
+	var expire int64
+	if d > 0 {
+		expire = now.Add(d).UnixMilli()
+	}
+	return redisSetField.Run(s.ctx, s.Client, []string{s.userKey(id), s.expiryKey(id)}, field, value, expire, now.UnixMilli()).Err()
+}
+
+func (s *redisStorage) getField(id int64, field string) ([]byte, error) {
+	b, err := redisGetField.Run(s.ctx, s.Client, []string{s.userKey(id), s.expiryKey(id)}, field, time.Now().UnixMilli()).Text()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrKeyNotExists
+		}
+		return nil, err
+	}
+	return []byte(b), nil
+}
+
+func (s *redisStorage) delFields(id int64, fields ...string) error {
+	args := make([]any, 0, len(fields))
+	for _, f := range fields {
+		args = append(args, f)
+	}
+	return redisDelFields.Run(s.ctx, s.Client, []string{s.userKey(id), s.expiryKey(id)}, args...).Err()
+}
+
+func (s *redisStorage) setState(id int64, state string, d time.Duration) error {
+	return s.setField(id, redisStateField, []byte(state), d)
+}
+
+func (s *redisStorage) getState(id int64) (string, error) {
+	b, err := s.getField(id, redisStateField)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Не возвращает ошибку redis.Nil
+func (s *redisStorage) delState(id int64) error {
+	return s.delFields(id, redisStateField)
+}
+
+func (s *redisStorage) setData(id int64, key string, v any) error {
+	return s.setTempData(id, key, v, 0)
+}
+
+func (s *redisStorage) setTempData(id int64, key string, v any, d time.Duration) error {
+	b, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.setField(id, s.dataField(key), b, d)
+}
+
+func (s *redisStorage) setCommonData(key string, v any, d time.Duration) error {
+	b, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Set(s.ctx, s.normalizeKey(key), b, d).Err()
+}
+
+func (s *redisStorage) getData(id int64, key string, v any) error {
+	b, err := s.getField(id, s.dataField(key))
+	if err != nil {
+		return err
+	}
+	return s.codec.Unmarshal(b, v)
+}
+
+func (s *redisStorage) getCommonData(key string, v any) error {
+	b, err := s.Get(s.ctx, s.normalizeKey(key)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrKeyNotExists
+		}
+		return err
+	}
+	return s.codec.Unmarshal(b, v)
+}
+
+// Удаляет данные по заданным ключам. Нужно точное соответствие ключа.
+// Не возвращает ошибку redis.Nil
+func (s *redisStorage) delData(id int64, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, s.dataField(k))
+	}
+	return s.delFields(id, fields...)
+}
+
+func (s *redisStorage) delCommonData(keys ...string) error {
+	normalized := make([]string, 0, len(keys))
+	for _, k := range keys {
+		normalized = append(normalized, s.normalizeKey(k))
+	}
+	return s.Del(s.ctx, normalized...).Err()
+}
+
+// Удаляет состояние и все данные пользователя одной атомарной командой.
+// Не возвращает ошибку redis.Nil
+func (s *redisStorage) clear(id int64) error {
+	return s.Del(s.ctx, s.userKey(id), s.expiryKey(id)).Err()
+}
+
+// Истекшие, но еще не удаленные поля отбрасываются по индексу истечений
+func (s *redisStorage) keys(id int64) ([]string, error) {
+	var (
+		fields  *redis.StringSliceCmd
+		expired *redis.StringSliceCmd
+	)
+	_, err := s.TxPipelined(s.ctx, func(p redis.Pipeliner) error {
+		fields = p.HKeys(s.ctx, s.userKey(id))
+		expired = p.ZRangeByScore(s.ctx, s.expiryKey(id), &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(time.Now().UnixMilli(), 10),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	skip := make(map[string]struct{}, len(expired.Val()))
+	for _, f := range expired.Val() {
+		skip[f] = struct{}{}
+	}
+	var keys []string
+	for _, f := range fields.Val() {
+		if _, ok := skip[f]; ok || !strings.HasPrefix(f, redisDataPrefix) {
+			continue
+		}
+		keys = append(keys, strings.TrimPrefix(f, redisDataPrefix))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Ключ в формате fsm:user:id
+// Создаем буфер размером 28 из которых 9 байт на префикс "fsm:user:" и 19 на int64 (не 20, потому что только числа > 0).
+// Уменьшаем аллокации и стреляем в ногу - делаем строку через unsafe.
+func (s *redisStorage) userKey(id int64) string {
+	buf := make([]byte, 0, len(redisUserPrefix)+19)
+
+	buf = append(buf, redisUserPrefix...)
+	buf = strconv.AppendInt(buf, id, 10)
+
+	return *(*string)(unsafe.Pointer(&buf))
+}
+
+func (s *redisStorage) expiryKey(id int64) string {
+	return s.userKey(id) + redisExpirySufix
+}
+
+func (s *redisStorage) dataField(key string) string {
+	return redisDataPrefix + key
+}
+
+func (s *redisStorage) normalizeKey(key string) string {
+	if strings.HasPrefix(key, "fsm:") {
+		return key
+	}
+	return "fsm:" + key
+}
+
+// MigrateRedisStorage переносит данные пользователей из старой раскладки (отдельные ключи fsm:id:key, состояние в fsm:id:state)
+// в хэши fsm:user:id с сохранением оставшегося времени жизни. Возвращает количество перенесенных ключей.
+// Значения переносятся как есть, без пересериализации. Повторный запуск безопасен: старый ключ удаляется только после записи нового
+func MigrateRedisStorage(ctx context.Context, rdb *redis.Client) (int, error) {
+	s := newRedisStorage(ctx, rdb)
+
+	var (
+		cursor   uint64
+		migrated int
+	)
+	for {
+		keys, nc, err := rdb.Scan(ctx, cursor, "fsm:*", 100).Result()
+		if err != nil {
+			return migrated, err
+		}
+		for _, key := range keys {
+			id, field, ok := parseLegacyRedisKey(key)
+			if !ok {
+				continue
+			}
+			ok, err = s.migrateKey(key, id, field)
+			if err != nil {
+				return migrated, err
+			}
+			if ok {
+				migrated++
+			}
+		}
+		if cursor = nc; cursor == 0 {
+			return migrated, nil
+		}
+	}
+}
+
+func (s *redisStorage) migrateKey(key string, id int64, field string) (bool, error) {
+	// Хэши новой раскладки и общие данные (например, fsm:full_name:...) под шаблон тоже попадают, их пропускаем
+	t, err := s.Type(s.ctx, key).Result()
+	if err != nil || t != "string" {
+		return false, err
+	}
+	value, err := s.Get(s.ctx, key).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return false, nil
+		}
+		return false, err
+	}
+	ttl, err := s.PTTL(s.ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case ttl == -2: // ключ истек, пока мы его читали
+		return false, nil
+	case ttl < 0:
+		ttl = 0
+	}
+	if err = s.setField(id, field, value, ttl); err != nil {
+		return false, err
+	}
+	return true, s.Del(s.ctx, key).Err()
+}
+
+// Старый ключ имеет вид fsm:id:key, где id - число. Ключ state - состояние пользователя
+func parseLegacyRedisKey(key string) (int64, string, bool) {
+	rest := strings.TrimPrefix(key, "fsm:")
+	i := strings.IndexByte(rest, ':')
+	if i == -1 {
+		return 0, "", false
+	}
+	id, err := strconv.ParseInt(rest[:i], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	if rest[i+1:] == "state" {
+		return id, redisStateField, true
+	}
+	return id, redisDataPrefix + rest[i+1:], true
+}
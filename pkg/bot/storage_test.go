@@ -3,606 +3,495 @@ package bot
 import (
 	"context"
 	"fmt"
-	"github.com/bytedance/sonic"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/suite"
+	"reflect"
 	"testing"
 	"time"
 )
 
-type redisStorageTestSuite struct {
-	suite.Suite
-	ctx     context.Context
-	redis   *redis.Client
-	storage *redisStorage
-}
+// Тесты redis работают в отдельной базе и удаляют только ключи fsm:*, чтобы не задеть данные локального бота
+const (
+	testRedisUrl = "127.0.0.1:6379"
+	testRedisDB  = 15
+)
 
-func (s *redisStorageTestSuite) SetupTest() {
-	testRedisUrl := "127.0.0.1:6379"
-	ctx := context.Background()
-	rdb := redis.NewClient(&redis.Options{
+func newTestRedis() *redis.Client {
+	return redis.NewClient(&redis.Options{
 		Addr: testRedisUrl,
+		DB:   testRedisDB,
 	})
-	s.ctx = ctx
-	s.storage = newRedisStorage(ctx, rdb)
-	s.redis = rdb
 }
 
-func (s *redisStorageTestSuite) TearDownTest() {
-	_ = s.redis.Del(s.ctx, "*")
-	_ = s.redis.Close()
+// cleanTestRedis удаляет ключи хранилища, оставшиеся от предыдущих тестов
+func cleanTestRedis(ctx context.Context, rdb *redis.Client) error {
+	iter := rdb.Scan(ctx, 0, "fsm:*", 100).Iterator()
+	for iter.Next(ctx) {
+		if err := rdb.Del(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
 }
 
-func TestRedisStorage(t *testing.T) {
-	if testing.Short() {
-		t.Skip()
+func Benchmark_userKey(b *testing.B) {
+	s := &redisStorage{}
+
+	for i := 0; i < b.N; i++ {
+		key := s.userKey(10000000000000)
+		if key != "fsm:user:10000000000000" {
+			b.Fatalf("not equal expect fsm:user:10000000000000, got %s", key)
+		}
 	}
-	suite.Run(t, new(redisStorageTestSuite))
 }
 
-func (s *redisStorageTestSuite) Test_setState() {
-	testCases := []struct {
-		testName  string
-		id        int64
-		state     string
-		expectErr error
-	}{
-		{
-			testName:  "correct test",
-			id:        123,
-			state:     "someState",
-			expectErr: nil,
-		},
+// Старый вариант создания ключа для redis storage. (через fmt Sprintf)
+func Benchmark_oldUserKey(b *testing.B) {
+	f := func(id int64) string {
+		return fmt.Sprintf("fsm:user:%d", id)
 	}
 
-	for _, tc := range testCases {
-		err := s.storage.setState(tc.id, tc.state)
-		s.Assert().Equal(tc.expectErr, err)
-
-		actualState, err := s.redis.Get(s.ctx, s.storage.stateKey(tc.id)).Result()
-		s.Assert().Nil(err)
-
-		s.Assert().Equal(tc.state, actualState)
+	for i := 0; i < b.N; i++ {
+		key := f(10000000000000)
+		if key != "fsm:user:10000000000000" {
+			b.Fatalf("not equal expect fsm:user:10000000000000, got %s", key)
+		}
 	}
 }
 
-func (s *redisStorageTestSuite) Test_getState() {
-	var (
-		defaultState       = "foobar"
-		defaultId    int64 = 123
-	)
-	if err := s.redis.Set(s.ctx, s.storage.stateKey(defaultId), defaultState, 0).Err(); err != nil {
-		s.T().Fatalf("setup test data err: %s", err)
-	}
-
+func Test_parseLegacyRedisKey(t *testing.T) {
 	testCases := []struct {
-		testName    string
-		id          int64
-		expectState string
-		expectErr   error
+		key         string
+		expectId    int64
+		expectField string
+		expectOk    bool
 	}{
-		{
-			testName:    "correct test",
-			id:          defaultId,
-			expectState: defaultState,
-			expectErr:   nil,
-		},
-		{
-			testName:    "id with state not exist",
-			id:          999,
-			expectState: "",
-			expectErr:   ErrKeyNotExists,
-		},
+		{key: "fsm:123:state", expectId: 123, expectField: redisStateField, expectOk: true},
+		{key: "fsm:123:semester:abc", expectId: 123, expectField: "d:semester:abc", expectOk: true},
+		{key: "fsm:full_name:abc"},
+		{key: "fsm:callback:abc"},
+		{key: "fsm:user:123"},
+		{key: "fsm:user:123:exp"},
 	}
 
 	for _, tc := range testCases {
-		state, err := s.storage.getState(tc.id)
-		s.Assert().Equal(tc.expectState, state)
-		s.Assert().Equal(tc.expectErr, err)
+		id, field, ok := parseLegacyRedisKey(tc.key)
+		if id != tc.expectId || field != tc.expectField || ok != tc.expectOk {
+			t.Errorf("key %s: expect (%d, %s, %t) got (%d, %s, %t)", tc.key, tc.expectId, tc.expectField, tc.expectOk, id, field, ok)
+		}
 	}
 }
 
-func (s *redisStorageTestSuite) Test_setData() {
-	var (
-		defaultId  int64 = 1
-		defaultKey       = "foobar"
-	)
+func Test_memoryStorage_ttl(t *testing.T) {
+	s := newMemoryStorage()
+	defer func() { _ = s.close() }()
 
-	testCases := []struct {
-		testName string
-		data     any
-	}{
-		{
-			testName: "test string",
-			data:     "hello world",
-		},
-		{
-			testName: "test int",
-			data:     123,
-		},
-		{
-			testName: "test array",
-			data:     []int{1, 2, 3, 4},
-		},
-		{
-			testName: "test map",
-			data: map[string]string{
-				"foo":     "bar",
-				"message": "hello world",
-			},
-		},
-		{
-			testName: "test some structure",
-			data: struct {
-				Name string
-				Age  int
-			}{
-				Name: "Petya",
-				Age:  25,
-			},
-		},
+	if err := s.setTempData(1, "short", "value", time.Millisecond*20); err != nil {
+		t.Fatal(err)
+	}
+	// перезапись с новым временем жизни: старый таймаут не должен удалить новое значение
+	if err := s.setTempData(1, "overwritten", "old", time.Millisecond*20); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setTempData(1, "overwritten", "new", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// перезапись без времени жизни делает ключ бессрочным
+	if err := s.setCommonData("common", "old", time.Millisecond*20); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setCommonData("common", "new", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setState(1, "state", time.Millisecond*20); err != nil {
+		t.Fatal(err)
 	}
 
-	for _, tc := range testCases {
-		err := s.storage.setData(defaultId, defaultKey, tc.data)
-		s.Assert().Nil(err)
-
-		b, err := s.redis.Get(s.ctx, s.storage.dataKey(defaultId, defaultKey)).Bytes()
-		s.Assert().Nil(err)
-
-		var actual, expect any
-
-		expectData, err := sonic.Marshal(tc.data)
-		s.Assert().Nil(err)
-		s.Assert().Nil(sonic.Unmarshal(expectData, &expect))
+	time.Sleep(time.Millisecond * 60)
 
-		s.Assert().Nil(sonic.Unmarshal(b, &actual))
-		s.Assert().NotNil(actual)
+	var v string
+	if err := s.getData(1, "short", &v); err != ErrKeyNotExists {
+		t.Errorf("expect expired key, got err %v", err)
+	}
+	if err := s.getData(1, "overwritten", &v); err != nil || v != "new" {
+		t.Errorf("expect overwritten value, got %s err %v", v, err)
+	}
+	if err := s.getCommonData("common", &v); err != nil || v != "new" {
+		t.Errorf("expect common value without ttl, got %s err %v", v, err)
+	}
+	if _, err := s.getState(1); err != ErrKeyNotExists {
+		t.Errorf("expect expired state, got err %v", err)
+	}
 
-		s.Assert().Equal(expect, actual)
+	// истекшие ключи удаляет таймер, а не только чтение
+	s.Lock()
+	items, expiry := len(s.items), len(s.expiry)
+	s.Unlock()
+	if items != 2 || expiry != 1 {
+		t.Errorf("expect 2 items and 1 expiring key, got %d and %d", items, expiry)
 	}
 }
 
-func (s *redisStorageTestSuite) Test_setTempData() {
-	var (
-		defaultId  int64 = 1
-		defaultKey       = "foobar"
-	)
+func Test_memoryStorage_limit(t *testing.T) {
+	s := newMemoryStorage()
+	s.limit = 3
 
-	testCases := []struct {
-		testName string
-		data     any
-		ttl      time.Duration
-	}{
-		{
-			testName: "test string",
-			data:     "hello world",
-			ttl:      time.Minute,
-		},
-		{
-			testName: "test int",
-			data:     123,
-			ttl:      time.Hour,
-		},
-		{
-			testName: "test slice",
-			data:     []int{1, 2, 10, 3},
-			ttl:      time.Minute * 10,
-		},
-		{
-			testName: "test map",
-			data: map[int]string{
-				2: "world",
-				1: "hello",
-			},
-			ttl: time.Hour * 10,
-		},
+	for i, key := range []string{"a", "b", "c"} {
+		if err := s.setData(1, key, i); err != nil {
+			t.Fatal(err)
+		}
 	}
-
-	for _, tc := range testCases {
-		err := s.storage.setTempData(defaultId, defaultKey, tc.data, tc.ttl)
-		s.Assert().Nil(err)
-
-		actualTTL, err := s.redis.TTL(s.ctx, s.storage.dataKey(defaultId, defaultKey)).Result()
-		s.Assert().Nil(err)
-
-		// проверка булевая, потому что может быть задержка между записью в бд
-		s.Assert().True(tc.ttl-actualTTL <= time.Second*2, tc.testName)
+	// чтение "a" делает его недавно использованным, поэтому вытеснен будет "b"
+	var v int
+	if err := s.getData(1, "a", &v); err != nil {
+		t.Fatal(err)
 	}
-}
-
-func (s *redisStorageTestSuite) Test_setCommonData() {
-	testCases := []struct {
-		testName string
-		key      string
-		data     any
-		ttl      time.Duration
-	}{
-		{
-			testName: "test string",
-			key:      "foobar",
-			data:     "hello_world",
-			ttl:      time.Minute,
-		},
-		{
-			testName: "test int",
-			data:     123,
-			key:      "abc",
-			ttl:      time.Hour,
-		},
-		{
-			testName: "test slice",
-			key:      "foo",
-			data:     []int{1, 2, 10, 3},
-			ttl:      time.Minute * 10,
-		},
-		{
-			testName: "test map",
-			key:      "bar",
-			data: map[int]string{
-				2: "world",
-				1: "hello",
-			},
-			ttl: time.Hour * 10,
-		},
-		{
-			testName: "test struct",
-			key:      "some_struct",
-			data: struct {
-				Name string
-				Age  int
-			}{
-				Name: "Petya",
-				Age:  18,
-			},
-			ttl: time.Second * 50,
-		},
+	if err := s.setData(1, "d", 3); err != nil {
+		t.Fatal(err)
 	}
 
-	for _, tc := range testCases {
-		err := s.storage.setCommonData(tc.key, tc.data, tc.ttl)
-		s.Assert().Nil(err)
-
-		b, err := s.redis.Get(s.ctx, s.storage.normalizeKey(tc.key)).Bytes()
-		s.Assert().Nil(err)
-
-		var actual, expect any
-
-		expectData, err := sonic.Marshal(tc.data)
-		s.Assert().Nil(err)
-		s.Assert().Nil(sonic.Unmarshal(expectData, &expect))
-
-		s.Assert().Nil(sonic.Unmarshal(b, &actual))
-		s.Assert().NotNil(actual)
-
-		s.Assert().Equal(expect, actual)
-
-		if tc.ttl > 0 {
-			actualTTL, err := s.redis.TTL(s.ctx, s.storage.normalizeKey(tc.key)).Result()
-			s.Assert().Nil(err)
-			s.Assert().True(tc.ttl-actualTTL <= time.Second*2)
+	for key, expect := range map[string]error{"a": nil, "b": ErrKeyNotExists, "c": nil, "d": nil} {
+		if err := s.getData(1, key, &v); err != expect {
+			t.Errorf("key %s: expect err %v got %v", key, expect, err)
 		}
 	}
 }
 
-func (s *redisStorageTestSuite) Test_getData() {
-	var (
-		defaultId   int64 = 1
-		defaultKey        = "foobar"
-		defaultData       = map[string]string{
-			"message": "hello world",
-		}
-	)
+func Test_memoryStorage_clear(t *testing.T) {
+	s := newMemoryStorage()
+	defer func() { _ = s.close() }()
 
-	b, err := sonic.Marshal(defaultData)
-	if err != nil {
-		s.T().Fatalf("marhsall test data err: %s", err)
-	}
+	_ = s.setState(1, "state", 0)
+	_ = s.setData(1, "a", 1)
+	_ = s.setTempData(1, "b", 2, time.Hour)
+	_ = s.setData(2, "a", 1)
+	_ = s.setCommonData("a", 1, 0)
 
-	if err = s.redis.Set(s.ctx, s.storage.dataKey(defaultId, defaultKey), b, 0).Err(); err != nil {
-		s.T().Fatalf("setup test data into redis err: %s", err)
+	if err := s.clear(1); err != nil {
+		t.Fatal(err)
 	}
 
-	testCases := []struct {
-		testName   string
-		id         int64
-		key        string
-		expectErr  error
-		expectData map[string]string
-	}{
-		{
-			testName:   "correct test",
-			id:         defaultId,
-			key:        defaultKey,
-			expectErr:  nil,
-			expectData: defaultData,
-		},
-		{
-			testName:  "id not exist",
-			id:        999,
-			key:       defaultKey,
-			expectErr: ErrKeyNotExists,
-		},
-		{
-			testName:  "key not exist",
-			id:        defaultId,
-			key:       "not_exist_key",
-			expectErr: ErrKeyNotExists,
-		},
+	var v int
+	if _, err := s.getState(1); err != ErrKeyNotExists {
+		t.Errorf("expect cleared state, got err %v", err)
 	}
-
-	for _, tc := range testCases {
-		var actualData map[string]string
-
-		err = s.storage.getData(tc.id, tc.key, &actualData)
-
-		s.Assert().Equal(tc.expectErr, err)
-		s.Assert().Equal(tc.expectData, actualData)
+	if err := s.getData(1, "b", &v); err != ErrKeyNotExists {
+		t.Errorf("expect cleared data, got err %v", err)
 	}
-}
-
-func (s *redisStorageTestSuite) Test_getCommonData() {
-	var (
-		defaultKey  = "foobar"
-		defaultData = map[string]string{
-			"message": "hello world",
-		}
-	)
-
-	b, err := sonic.Marshal(defaultData)
-	if err != nil {
-		s.T().Fatalf("marhsal test data err: %s", err)
+	if err := s.getData(2, "a", &v); err != nil {
+		t.Errorf("expect data of other user, got err %v", err)
 	}
-
-	if err = s.redis.Set(s.ctx, s.storage.normalizeKey(defaultKey), b, 0).Err(); err != nil {
-		s.T().Fatalf("setup test data into redis err: %s", err)
+	if err := s.getCommonData("a", &v); err != nil {
+		t.Errorf("expect common data, got err %v", err)
 	}
-
-	testCases := []struct {
-		testName   string
-		key        string
-		expectErr  error
-		expectData map[string]string
-	}{
-		{
-			testName:   "correct test",
-			key:        defaultKey,
-			expectErr:  nil,
-			expectData: defaultData,
-		},
-		{
-			testName:   "key not exist",
-			key:        "not_exist_key",
-			expectErr:  ErrKeyNotExists,
-			expectData: nil,
-		},
+	if len(s.expiry) != 0 {
+		t.Errorf("expect empty expiry heap, got %d", len(s.expiry))
 	}
+}
 
-	for _, tc := range testCases {
-		var actualData map[string]string
-
-		err = s.storage.getCommonData(tc.key, &actualData)
-
-		s.Assert().Equal(tc.expectErr, err)
-		s.Assert().Equal(tc.expectData, actualData)
+func Benchmark_memoryStorage_setTempData(b *testing.B) {
+	s := newMemoryStorage()
+	defer func() { _ = s.close() }()
+	for i := 0; i < b.N; i++ {
+		_ = s.setTempData(int64(i%1000), "key", i, time.Minute)
 	}
 }
 
-func (s *redisStorageTestSuite) Test_delData() {
-	var (
-		defaultId  int64 = 1
-		defaultKey       = "foobar"
-	)
+// storageTestSuite проверяет поведение хранилища через интерфейс storage,
+// поэтому один и тот же набор тестов запускается для всех реализаций.
+// Тесты раскладки данных в redis запускаются только для redis хранилища (см. redisStorage)
+type storageTestSuite struct {
+	suite.Suite
+	newStorage func() storage
+	storage    storage
+	// redis - клиент redis хранилища, nil для остальных реализаций
+	redis *redis.Client
+}
 
-	if err := s.redis.Set(s.ctx, s.storage.dataKey(defaultId, defaultKey), "hello world", 0).Err(); err != nil {
-		s.T().Fatalf("setup test data (data) into redis err: %s", err)
+func (s *storageTestSuite) SetupTest() {
+	s.storage = s.newStorage()
+	if rs, ok := s.storage.(*redisStorage); ok {
+		s.redis = rs.Client
 	}
+}
 
-	// set other user data
-	if err := s.redis.Set(s.ctx, s.storage.dataKey(2, "other_user"), "hello world", 0).Err(); err != nil {
-		s.T().Fatalf("setup test data (data) into redis err: %s", err)
+// redis хранилище не закрывает клиент (он создается снаружи), поэтому закрываем его здесь
+func (s *storageTestSuite) TearDownTest() {
+	_ = s.storage.close()
+	if s.redis != nil {
+		_ = cleanTestRedis(context.Background(), s.redis)
+		_ = s.redis.Close()
+		s.redis = nil
 	}
+}
 
-	testCases := []struct {
-		testName  string
-		id        int64
-		key       string
-		expectErr error
-	}{
-		{
-			testName:  "correct test",
-			id:        defaultId,
-			key:       defaultKey,
-			expectErr: nil,
-		},
-		{
-			testName:  "id not exist",
-			id:        999,
-			key:       defaultKey,
-			expectErr: nil,
-		},
-		{
-			testName:  "key not exist",
-			id:        defaultId,
-			key:       "key_not_exist",
-			expectErr: nil,
-		},
-		{
-			testName:  "id and key not exist",
-			id:        999,
-			key:       "key_not_exist",
-			expectErr: nil,
-		},
+// redisStorage возвращает хранилище для тестов раскладки данных в redis, для остальных реализаций тест пропускается
+func (s *storageTestSuite) redisStorage() *redisStorage {
+	if s.redis == nil {
+		s.T().Skip("redis only test")
 	}
+	return s.storage.(*redisStorage)
+}
 
-	for _, tc := range testCases {
-		err := s.storage.delData(tc.id, tc.key)
-		s.Assert().Equal(tc.expectErr, err)
-
-		if tc.expectErr == nil {
-			var exist int64
-			exist, err = s.redis.Exists(s.ctx, s.storage.dataKey(tc.id, tc.key)).Result()
-			s.Assert().Nil(err)
-
-			s.Assert().Zero(exist)
-
-			// also check other user data. It must not be deleted
-			exist, err = s.redis.Exists(s.ctx, s.storage.dataKey(2, "other_user")).Result()
-			s.Assert().Nil(err)
+// fieldTTL возвращает оставшееся время жизни поля хэша пользователя по индексу истечений
+func (s *storageTestSuite) fieldTTL(id int64, field string) (time.Duration, error) {
+	expire, err := s.redis.ZScore(context.Background(), s.redisStorage().expiryKey(id), field).Result()
+	if err != nil {
+		return 0, err
+	}
+	return time.Until(time.UnixMilli(int64(expire))), nil
+}
 
-			s.Assert().NotZero(exist)
+func TestStorage(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		suite.Run(t, &storageTestSuite{newStorage: func() storage { return newMemoryStorage() }})
+	})
+	t.Run("bolt", func(t *testing.T) {
+		suite.Run(t, &storageTestSuite{newStorage: func() storage {
+			st, err := newBoltStorage(t.TempDir()+"/bot.db", time.Millisecond*10)
+			if err != nil {
+				t.Fatalf("open bolt storage err: %s", err)
+			}
+			return st
+		}})
+	})
+	t.Run("redis", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip()
 		}
-	}
+		suite.Run(t, &storageTestSuite{newStorage: func() storage {
+			rdb := newTestRedis()
+			if err := cleanTestRedis(context.Background(), rdb); err != nil {
+				t.Fatalf("clean redis err: %s", err)
+			}
+			return newRedisStorage(context.Background(), rdb)
+		}})
+	})
 }
 
-func (s *redisStorageTestSuite) Test_delCommonData() {
-	var (
-		defaultKey   = "foobar"
-		otherDataKey = "other_data"
-	)
+func (s *storageTestSuite) Test_state() {
+	_, err := s.storage.getState(1)
+	s.Assert().Equal(ErrKeyNotExists, err)
 
-	if err := s.redis.Set(s.ctx, s.storage.normalizeKey(defaultKey), "hello world", 0).Err(); err != nil {
-		s.T().Fatalf("setup test data into redis err: %s", err)
-	}
+	s.Assert().Nil(s.storage.setState(1, "first", 0))
+	s.Assert().Nil(s.storage.setState(1, "second", time.Hour))
+	state, err := s.storage.getState(1)
+	s.Assert().Nil(err)
+	s.Assert().Equal("second", state)
 
-	if err := s.redis.Set(s.ctx, s.storage.normalizeKey(otherDataKey), "hello world 2", 0).Err(); err != nil {
-		s.T().Fatalf("setup test data into redis err: %s", err)
-	}
+	s.Assert().Nil(s.storage.delState(1))
+	_, err = s.storage.getState(1)
+	s.Assert().Equal(ErrKeyNotExists, err)
 
+	// удаление несуществующего состояния не ошибка
+	s.Assert().Nil(s.storage.delState(999))
+}
+
+func (s *storageTestSuite) Test_data() {
 	testCases := []struct {
 		testName string
-		key      string
+		data     any
+		actual   any
 	}{
 		{
-			testName: "correct test",
-			key:      defaultKey,
-		},
-		{
-			testName: "key not exist",
-			key:      "key_not_exist",
+			testName: "test string",
+			data:     "hello world",
+			actual:   new(string),
 		},
-	}
-
-	for _, tc := range testCases {
-		err := s.storage.delCommonData(tc.key)
-		s.Assert().Nil(err)
-
-		exist, err := s.redis.Exists(s.ctx, s.storage.normalizeKey(tc.key)).Result()
-		s.Assert().Nil(err)
-
-		s.Assert().Zero(exist)
-
-		exist, err = s.redis.Exists(s.ctx, s.storage.normalizeKey(otherDataKey)).Result()
-		s.Assert().Nil(err)
-		s.Assert().NotZero(exist)
-	}
-}
-
-func (s *redisStorageTestSuite) Test_clear() {
-	var (
-		defaultId  int64 = 1
-		defaultKey       = "foobar"
-	)
-
-	if err := s.redis.Set(s.ctx, s.storage.dataKey(defaultId, defaultKey), "hello world", 0).Err(); err != nil {
-		s.T().Fatalf("setup test data (data) into redis err: %s", err)
-	}
-	if err := s.redis.Set(s.ctx, s.storage.stateKey(defaultId), "someState", 0).Err(); err != nil {
-		s.T().Fatalf("setup test data (state) into redis err: %s", err)
-	}
-
-	// set other user data
-	if err := s.redis.Set(s.ctx, s.storage.dataKey(2, "other_user"), "hello world", 0).Err(); err != nil {
-		s.T().Fatalf("setup test data (data) into redis err: %s", err)
-	}
-	if err := s.redis.Set(s.ctx, s.storage.stateKey(2), "someState", 0).Err(); err != nil {
-		s.T().Fatalf("setup test data (state) into redis err: %s", err)
-	}
-
-	testCases := []struct {
-		testName  string
-		id        int64
-		key       string
-		expectErr error
-	}{
 		{
-			testName:  "correct test",
-			id:        defaultId,
-			key:       defaultKey,
-			expectErr: nil,
+			testName: "test int",
+			data:     123,
+			actual:   new(int),
 		},
 		{
-			testName:  "id not exist",
-			id:        999,
-			key:       defaultKey,
-			expectErr: nil,
+			testName: "test slice",
+			data:     []int{1, 2, 3, 4},
+			actual:   new([]int),
 		},
 		{
-			testName:  "key not exist",
-			id:        defaultId,
-			key:       "key_not_exist",
-			expectErr: nil,
+			testName: "test map",
+			data:     map[string]string{"foo": "bar", "message": "hello world"},
+			actual:   new(map[string]string),
 		},
 		{
-			testName:  "id and key not exist",
-			id:        999,
-			key:       "key_not_exist",
-			expectErr: nil,
+			testName: "test some structure",
+			data:     codecTestData{ScheduleId: "id", Numbers: []int{1}},
+			actual:   new(codecTestData),
 		},
 	}
 
 	for _, tc := range testCases {
-		err := s.storage.clear(tc.id)
-		s.Assert().Equal(tc.expectErr, err)
+		s.Assert().Nil(s.storage.setData(1, "foobar", tc.data), tc.testName)
+		s.Assert().Nil(s.storage.getData(1, "foobar", tc.actual), tc.testName)
+		s.Assert().Equal(tc.data, reflect.ValueOf(tc.actual).Elem().Interface(), tc.testName)
 
-		if tc.expectErr == nil {
-			var exist int64
-			exist, err = s.redis.Exists(s.ctx, s.storage.dataKey(tc.id, tc.key)).Result()
-			s.Assert().Nil(err)
+		s.Assert().Nil(s.storage.setCommonData("foobar", tc.data, time.Hour), tc.testName)
+		s.Assert().Nil(s.storage.getCommonData("foobar", tc.actual), tc.testName)
+		s.Assert().Equal(tc.data, reflect.ValueOf(tc.actual).Elem().Interface(), tc.testName)
+	}
 
-			s.Assert().Zero(exist)
+	var v string
+	s.Assert().Equal(ErrKeyNotExists, s.storage.getData(999, "foobar", &v))
+	s.Assert().Equal(ErrKeyNotExists, s.storage.getData(1, "not_exist_key", &v))
+	s.Assert().Equal(ErrKeyNotExists, s.storage.getCommonData("not_exist_key", &v))
+}
 
-			exist, err = s.redis.Exists(s.ctx, s.storage.stateKey(tc.id)).Result()
-			s.Assert().Nil(err)
+func (s *storageTestSuite) Test_ttl() {
+	s.Assert().Nil(s.storage.setState(1, "state", time.Millisecond*100))
+	s.Assert().Nil(s.storage.setTempData(1, "temp", "value", time.Millisecond*100))
+	s.Assert().Nil(s.storage.setCommonData("temp", "value", time.Millisecond*100))
+	// перезапись продлевает время жизни
+	s.Assert().Nil(s.storage.setTempData(1, "overwritten", "old", time.Millisecond*100))
+	s.Assert().Nil(s.storage.setTempData(1, "overwritten", "new", time.Hour))
+
+	time.Sleep(time.Millisecond * 200)
+
+	var v string
+	_, err := s.storage.getState(1)
+	s.Assert().Equal(ErrKeyNotExists, err)
+	s.Assert().Equal(ErrKeyNotExists, s.storage.getData(1, "temp", &v))
+	s.Assert().Equal(ErrKeyNotExists, s.storage.getCommonData("temp", &v))
+	s.Assert().Nil(s.storage.getData(1, "overwritten", &v))
+	s.Assert().Equal("new", v)
+}
 
-			s.Assert().Zero(exist)
+func (s *storageTestSuite) Test_delData() {
+	s.Assert().Nil(s.storage.setData(1, "a", 1))
+	s.Assert().Nil(s.storage.setData(1, "b", 2))
+	s.Assert().Nil(s.storage.setData(2, "a", 1))
+	s.Assert().Nil(s.storage.setCommonData("a", 1, 0))
+	s.Assert().Nil(s.storage.setCommonData("b", 2, 0))
+
+	keys := []string{"a", "not_exist_key"}
+	s.Assert().Nil(s.storage.delData(1, keys...))
+	s.Assert().Nil(s.storage.delCommonData("b"))
+
+	var v int
+	s.Assert().Equal(ErrKeyNotExists, s.storage.getData(1, "a", &v))
+	s.Assert().Nil(s.storage.getData(1, "b", &v))
+	s.Assert().Nil(s.storage.getData(2, "a", &v))
+	s.Assert().Nil(s.storage.getCommonData("a", &v))
+	s.Assert().Equal(ErrKeyNotExists, s.storage.getCommonData("b", &v))
+}
 
-			// also check other user data
-			exist, err = s.redis.Exists(s.ctx, s.storage.dataKey(2, "other_user")).Result()
-			s.Assert().Nil(err)
+func (s *storageTestSuite) Test_clear() {
+	s.Assert().Nil(s.storage.setState(1, "state", 0))
+	s.Assert().Nil(s.storage.setData(1, "a", 1))
+	s.Assert().Nil(s.storage.setTempData(1, "b", 2, time.Hour))
+	s.Assert().Nil(s.storage.setState(2, "state", 0))
+	s.Assert().Nil(s.storage.setData(2, "a", 1))
+	// id 10 начинается с той же цифры, что и 1: clear по префиксу не должен задеть его данные
+	s.Assert().Nil(s.storage.setData(10, "a", 1))
+	s.Assert().Nil(s.storage.setCommonData("a", 1, 0))
+
+	s.Assert().Nil(s.storage.clear(1))
+	s.Assert().Nil(s.storage.clear(999))
+
+	var v int
+	_, err := s.storage.getState(1)
+	s.Assert().Equal(ErrKeyNotExists, err)
+	s.Assert().Equal(ErrKeyNotExists, s.storage.getData(1, "a", &v))
+	s.Assert().Equal(ErrKeyNotExists, s.storage.getData(1, "b", &v))
+
+	_, err = s.storage.getState(2)
+	s.Assert().Nil(err)
+	s.Assert().Nil(s.storage.getData(2, "a", &v))
+	s.Assert().Nil(s.storage.getData(10, "a", &v))
+	s.Assert().Nil(s.storage.getCommonData("a", &v))
+}
 
-			s.Assert().NotZero(exist)
+func (s *storageTestSuite) Test_keys() {
+	keys, err := s.storage.keys(1)
+	s.Assert().Nil(err)
+	s.Assert().Empty(keys)
 
-			exist, err = s.redis.Exists(s.ctx, s.storage.stateKey(2)).Result()
-			s.Assert().Nil(err)
+	s.Assert().Nil(s.storage.setState(1, "state", 0))
+	s.Assert().Nil(s.storage.setData(1, "b", 1))
+	s.Assert().Nil(s.storage.setData(1, "a", 1))
+	s.Assert().Nil(s.storage.setTempData(1, "temp", 1, time.Millisecond*50))
+	s.Assert().Nil(s.storage.setData(10, "other", 1))
+	s.Assert().Nil(s.storage.setCommonData("common", 1, 0))
 
-			s.Assert().NotZero(exist)
+	time.Sleep(time.Millisecond * 100)
 
-		}
-	}
+	keys, err = s.storage.keys(1)
+	s.Assert().Nil(err)
+	s.Assert().Equal([]string{"a", "b"}, keys)
 }
 
-func Benchmark_dataKey(b *testing.B) {
-	s := &redisStorage{}
+// После удаления последнего бессрочного поля хэш должен истечь вместе с оставшимися временными полями,
+// а после удаления последнего временного - стать бессрочным
+func (s *storageTestSuite) Test_redisDelDataExpiry() {
+	var (
+		ctx        = context.Background()
+		st         = s.redisStorage()
+		persistKey = "persist"
+		tempKey    = "temp"
+		ttl        = time.Minute
+	)
 
-	for i := 0; i < b.N; i++ {
-		key := s.dataKey(10000000000000, "state")
-		if key != "fsm:10000000000000:state" {
-			b.Fatalf("not equal expect fsm:10000000000000:state, got %s", key)
-		}
-	}
-}
+	s.Require().Nil(st.setData(1, persistKey, "hello world"))
+	s.Require().Nil(st.setTempData(1, tempKey, "hello world", ttl))
 
-// Старый вариант создания ключа для redis storage. (через fmt Sprintf)
-func Benchmark_oldDataKey(b *testing.B) {
-	f := func(id int64, key string) string {
-		return fmt.Sprintf("fsm:%d:%s", id, key)
-	}
+	actualTTL, err := s.redis.PTTL(ctx, st.userKey(1)).Result()
+	s.Require().Nil(err)
+	s.Assert().Equal(time.Duration(-1), actualTTL, "hash with persist field must not expire")
 
-	for i := 0; i < b.N; i++ {
-		key := f(10000000000000, "state")
-		if key != "fsm:10000000000000:state" {
-			b.Fatalf("not equal expect fsm:10000000000000:state, got %s", key)
-		}
+	s.Require().Nil(st.delData(1, persistKey))
+
+	for _, key := range []string{st.userKey(1), st.expiryKey(1)} {
+		actualTTL, err = s.redis.PTTL(ctx, key).Result()
+		s.Require().Nil(err)
+		s.Assert().True(actualTTL > 0 && ttl-actualTTL <= time.Second*2, "key %s ttl %s", key, actualTTL)
 	}
+
+	s.Require().Nil(st.setData(1, persistKey, "hello world"))
+	s.Require().Nil(st.delData(1, tempKey))
+
+	actualTTL, err = s.redis.PTTL(ctx, st.userKey(1)).Result()
+	s.Require().Nil(err)
+	s.Assert().Equal(time.Duration(-1), actualTTL, "hash without temp fields must not expire")
+}
+
+func (s *storageTestSuite) Test_MigrateRedisStorage() {
+	ctx := context.Background()
+	st := s.redisStorage()
+
+	// данные в старой раскладке: отдельные ключи fsm:id:key
+	s.Require().Nil(s.redis.Set(ctx, "fsm:1:state", "someState", 0).Err())
+	s.Require().Nil(s.redis.Set(ctx, "fsm:1:friends", `["foo"]`, time.Hour).Err())
+	s.Require().Nil(s.redis.Set(ctx, "fsm:2:grades_input", `{"login":"foo"}`, 0).Err())
+	// общие данные не переносятся
+	s.Require().Nil(s.redis.Set(ctx, "fsm:full_name:abc", `"Иванов Иван Иванович"`, 0).Err())
+
+	migrated, err := MigrateRedisStorage(ctx, s.redis)
+	s.Assert().Nil(err)
+	s.Assert().Equal(3, migrated)
+
+	state, err := st.getState(1)
+	s.Assert().Nil(err)
+	s.Assert().Equal("someState", state)
+
+	var friends []string
+	s.Assert().Nil(st.getData(1, "friends", &friends))
+	s.Assert().Equal([]string{"foo"}, friends)
+	ttl, err := s.fieldTTL(1, st.dataField("friends"))
+	s.Assert().Nil(err)
+	s.Assert().True(time.Hour-ttl <= time.Second*2)
+
+	var gi map[string]string
+	s.Assert().Nil(st.getData(2, "grades_input", &gi))
+	s.Assert().Equal("foo", gi["login"])
+
+	exist, err := s.redis.Exists(ctx, "fsm:1:state", "fsm:1:friends", "fsm:2:grades_input").Result()
+	s.Assert().Nil(err)
+	s.Assert().Zero(exist)
+
+	var fullName string
+	s.Assert().Nil(st.getCommonData("full_name:abc", &fullName))
+
+	// повторный запуск ничего не переносит
+	migrated, err = MigrateRedisStorage(ctx, s.redis)
+	s.Assert().Nil(err)
+	s.Assert().Zero(migrated)
 }
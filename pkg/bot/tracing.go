@@ -0,0 +1,111 @@
+package bot
+
+import (
+	"bot_for_modeus/pkg/tracing"
+	"context"
+	"errors"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// Трассировка обработки апдейта. Если провайдер трассировки не настроен (otel.SetTracerProvider), все спаны - noop и почти ничего не стоят.
+//
+// Дерево спанов одного апдейта:
+//
+//	bot.update                 - весь апдейт, от получения до ответа
+//	└── bot.middleware <name>  - каждая мидлварь (включает в себя все вложенные)
+//	    └── bot.handler <path> - хэндлер маршрута
+//	        ├── bot.storage <op>
+//	        └── ...            - спаны сервисов, репозиториев и парсера через c.Context()
+var tracer = otel.Tracer("bot_for_modeus/pkg/bot")
+
+// Спан апдейта дополнительно кладется в контекст под своим ключом, чтобы хэндлер мог дописать в него маршрут через любые вложенные спаны
+type updateSpanKey struct{}
+
+func (b *Bot) startUpdateSpan(u tgbotapi.Update) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("bot.update.type", updateType(u))}
+	if from := u.SentFrom(); from != nil {
+		attrs = append(attrs, attribute.Int64("user_id", from.ID))
+	}
+	ctx, span := tracer.Start(b.ctx, "bot.update", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+	return context.WithValue(ctx, updateSpanKey{}, span), span
+}
+
+func updateType(u tgbotapi.Update) string {
+	switch {
+	case u.Message != nil && u.Message.IsCommand():
+		return "command"
+	case u.Message != nil:
+		return "message"
+	case u.CallbackQuery != nil:
+		return "callback"
+	}
+	return "other"
+}
+
+// traceHandler оборачивает хэндлер маршрута. Шаблон маршрута (без значений параметров) также записывается в спан апдейта,
+// чтобы медленные апдейты можно было искать по маршруту
+func traceHandler(route string, h HandlerFunc) HandlerFunc {
+	return func(c Context) (err error) {
+		parent := c.Context()
+		if span, ok := parent.Value(updateSpanKey{}).(trace.Span); ok {
+			span.SetAttributes(attribute.String("bot.route", route))
+		}
+
+		ctx, span := tracer.Start(parent, "bot.handler "+route)
+		defer func() { tracing.End(span, err) }()
+
+		c.SetContext(ctx)
+		defer c.SetContext(parent)
+		return h(c)
+	}
+}
+
+func traceMiddleware(name string, h HandlerFunc) HandlerFunc {
+	return func(c Context) (err error) {
+		parent := c.Context()
+		ctx, span := tracer.Start(parent, "bot.middleware "+name)
+		defer func() { tracing.End(span, err) }()
+
+		c.SetContext(ctx)
+		defer c.SetContext(parent)
+		return h(c)
+	}
+}
+
+// middlewareName возвращает имя функции мидлвари без пути пакета и суффиксов замыканий,
+// например, v2.loggingMiddleware вместо bot_for_modeus/internal/handler/v2.loggingMiddleware.func1.
+// Если замыкание заинлайнено в вызывающую функцию, ее имя тоже отбрасывается
+func middlewareName(m MiddlewareFunc) string {
+	f := runtime.FuncForPC(reflect.ValueOf(m).Pointer())
+	if f == nil {
+		return "unknown"
+	}
+	name := f.Name()
+	if i := strings.LastIndexByte(name, '/'); i != -1 {
+		name = name[i+1:]
+	}
+	parts := strings.Split(name, ".")
+	for len(parts) > 2 && strings.HasPrefix(parts[len(parts)-1], "func") {
+		parts = parts[:len(parts)-1]
+	}
+	return parts[0] + "." + parts[len(parts)-1]
+}
+
+// traceStorage начинает спан операции с хранилищем, возвращаемая функция его завершает.
+// Отсутствие ключа - это промах кэша, а не ошибка, поэтому такой спан не помечается ошибочным
+func (c *nativeContext) traceStorage(op string, keys ...string) func(err error) {
+	_, span := tracer.Start(c.Context(), "bot.storage "+op, trace.WithAttributes(attribute.StringSlice("bot.storage.keys", keys)))
+	return func(err error) {
+		if errors.Is(err, ErrKeyNotExists) {
+			span.SetAttributes(attribute.Bool("bot.storage.miss", true))
+			err = nil
+		}
+		tracing.End(span, err)
+	}
+}
@@ -0,0 +1,138 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func tracingTestMiddleware(next HandlerFunc) HandlerFunc {
+	return func(c Context) error {
+		return next(c)
+	}
+}
+
+// Трейсер пакета привязывается к первому глобальному провайдеру, поэтому провайдер с записью спанов один на все тесты.
+// Спаны копятся между тестами, тесты берут последние по имени
+var testSpanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	return rec
+})
+
+func Test_tracing(t *testing.T) {
+	rec := testSpanRecorder()
+
+	b := &Bot{
+		ctx:     context.Background(),
+		wg:      new(sync.WaitGroup),
+		routers: newRouter(),
+		storage: newMemoryStorage(),
+		logger:  log.New(io.Discard, "", 0),
+	}
+	b.Use(tracingTestMiddleware)
+	b.Command("/test", func(c Context) error {
+		var v string
+		_ = c.GetData("key", &v)
+		return errors.New("handler error")
+	})
+
+	b.wg.Add(1)
+	b.processMessage(tgbotapi.Update{Message: &tgbotapi.Message{
+		From:     &tgbotapi.User{ID: 1},
+		Text:     "/test",
+		Entities: []tgbotapi.MessageEntity{{Type: "bot_command", Length: 5}},
+	}})
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+	}
+	update := spans["bot.update"]
+	middleware := spans["bot.middleware bot.tracingTestMiddleware"]
+	handler := spans["bot.handler command /test"]
+	storage := spans["bot.storage getData"]
+	if !assert.NotNil(t, update) || !assert.NotNil(t, middleware) || !assert.NotNil(t, handler) || !assert.NotNil(t, storage) {
+		return
+	}
+
+	// спаны вложены друг в друга в порядке вызова
+	assert.Equal(t, update.SpanContext().SpanID(), middleware.Parent().SpanID())
+	assert.Equal(t, middleware.SpanContext().SpanID(), handler.Parent().SpanID())
+	assert.Equal(t, handler.SpanContext().SpanID(), storage.Parent().SpanID())
+
+	assert.Contains(t, update.Attributes(), attribute.String("bot.route", "command /test"))
+	assert.Contains(t, update.Attributes(), attribute.Int64("user_id", 1))
+	assert.Equal(t, codes.Error, update.Status().Code)
+	assert.Equal(t, codes.Error, handler.Status().Code)
+
+	// промах кэша не ошибка
+	assert.Contains(t, storage.Attributes(), attribute.Bool("bot.storage.miss", true))
+	assert.Equal(t, codes.Unset, storage.Status().Code)
+}
+
+// Ошибка декодирования коллбэка (например, сохраненные данные кнопки истекли) должна попасть на спан апдейта
+func Test_tracing_decodeCallbackError(t *testing.T) {
+	rec := testSpanRecorder()
+
+	b := &Bot{
+		ctx:     context.Background(),
+		wg:      new(sync.WaitGroup),
+		routers: newRouter(),
+		storage: newMemoryStorage(),
+		logger:  log.New(io.Discard, "", 0),
+		// Ответ на коллбэк уходит в никуда
+		client: &tgbotapi.BotAPI{Client: &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("no network in tests")
+		})}},
+	}
+	b.Callback("/test", func(c Context) error {
+		return nil
+	})
+
+	b.wg.Add(1)
+	b.processMessage(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		From: &tgbotapi.User{ID: 1},
+		Data: string(storedPrefix) + "not_exists",
+	}})
+
+	var update sdktrace.ReadOnlySpan
+	for _, s := range rec.Ended() {
+		if s.Name() == "bot.update" {
+			update = s
+		}
+	}
+	if !assert.NotNil(t, update) {
+		return
+	}
+	assert.Equal(t, codes.Error, update.Status().Code)
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Мидлварь с параметрами - замыкание, как loggingMiddleware в хэндлерах
+func tracingTestMiddlewareFactory() MiddlewareFunc {
+	return func(next HandlerFunc) HandlerFunc {
+		return next
+	}
+}
+
+func Test_middlewareName(t *testing.T) {
+	assert.Equal(t, "bot.tracingTestMiddleware", middlewareName(tracingTestMiddleware))
+	assert.Equal(t, "bot.tracingTestMiddlewareFactory", middlewareName(tracingTestMiddlewareFactory()))
+}
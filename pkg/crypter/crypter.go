@@ -7,27 +7,70 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/pbkdf2"
 	"io"
+	"strings"
 )
 
 type Crypter interface {
 	Encrypt(text string) (string, error)
 	Decrypt(text string) (string, error)
+	// Outdated сообщает, что текст зашифрован устаревшим ключом или по устаревшей схеме
+	Outdated(text string) bool
 }
 
-const defaultSaltBlockSize = 16
+const (
+	defaultSaltBlockSize = 16
+	keySize              = 32
+	pbkdf2Iterations     = 100000
 
+	// Префикс шифротекстов, ключ которых получен через HKDF. В base64url нет точки,
+	// поэтому старые шифротексты (ключ через PBKDF2 с солью записи) его не содержат
+	hkdfPrefix = "h."
+)
+
+var (
+	// Соль мастер-ключа постоянная: уникальность ключей записей обеспечивает соль в HKDF
+	masterSalt = []byte("bot_for_modeus/crypter/master")
+	hkdfInfo   = []byte("bot_for_modeus/crypter/record")
+)
+
+// crypter шифрует AES-GCM ключом, который выводится из мастер-ключа через HKDF с солью записи.
+// Мастер-ключ считается через PBKDF2 один раз при создании, поэтому шифрование и дешифрование быстрые.
+// Старые шифротексты, где PBKDF2 считался от соли каждой записи, по-прежнему расшифровываются (см. Outdated)
 type crypter struct {
 	secret string
+	master []byte
 }
 
 func NewCrypter(secret string) Crypter {
-	return &crypter{secret: secret}
+	return newCrypter(secret)
+}
+
+func newCrypter(secret string) *crypter {
+	return &crypter{
+		secret: secret,
+		master: pbkdf2.Key([]byte(secret), masterSalt, pbkdf2Iterations, keySize, sha256.New),
+	}
+}
+
+// Ключ для старой схемы: 100k итераций PBKDF2 (~14.5 мс) на каждую запись
+func (c *crypter) createKey(salt []byte) ([]byte, error) {
+	return pbkdf2.Key([]byte(c.secret), salt, pbkdf2Iterations, keySize, sha256.New), nil
+}
+
+func (c *crypter) recordKey(salt []byte) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.master, salt, hkdfInfo), key); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
-func (c *crypter) createKey(salt []byte) []byte {
-	return pbkdf2.Key([]byte(c.secret), salt, 100000, 32, sha256.New)
+// Outdated сообщает, что текст зашифрован по старой схеме и его стоит перешифровать
+func (c *crypter) Outdated(text string) bool {
+	return !strings.HasPrefix(text, hkdfPrefix)
 }
 
 func (c *crypter) Encrypt(text string) (string, error) {
@@ -35,7 +78,11 @@ func (c *crypter) Encrypt(text string) (string, error) {
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return "", err
 	}
-	block, err := aes.NewCipher(c.createKey(salt))
+	key, err := c.recordKey(salt)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
@@ -51,10 +98,16 @@ func (c *crypter) Encrypt(text string) (string, error) {
 	}
 
 	cipherText := aesGCM.Seal(nonce, nonce, []byte(text), nil)
-	return base64.URLEncoding.EncodeToString(append(salt, cipherText...)), nil
+	return hkdfPrefix + base64.URLEncoding.EncodeToString(append(salt, cipherText...)), nil
 }
 
 func (c *crypter) Decrypt(text string) (string, error) {
+	deriveKey := c.createKey
+	if strings.HasPrefix(text, hkdfPrefix) {
+		deriveKey = c.recordKey
+		text = text[len(hkdfPrefix):]
+	}
+
 	cipherText, err := base64.URLEncoding.DecodeString(text)
 	if err != nil {
 		return "", err
@@ -66,7 +119,11 @@ func (c *crypter) Decrypt(text string) (string, error) {
 
 	salt, cipherText := cipherText[:defaultSaltBlockSize], cipherText[defaultSaltBlockSize:]
 
-	block, err := aes.NewCipher(c.createKey(salt))
+	key, err := deriveKey(salt)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
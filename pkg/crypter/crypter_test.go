@@ -1,12 +1,48 @@
 package crypter
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"testing"
 )
 
+// encryptLegacy шифрует по старой схеме (PBKDF2 с солью записи), чтобы проверить обратную совместимость
+func encryptLegacy(c *crypter, text string) (string, error) {
+	salt := make([]byte, defaultSaltBlockSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	key, err := c.createKey(salt)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aesGCM.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	cipherText := aesGCM.Seal(nonce, nonce, []byte(text), nil)
+	return base64.URLEncoding.EncodeToString(append(salt, cipherText...)), nil
+}
+
+func BenchmarkNewCrypter(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		NewCrypter("hello_world")
+	}
+}
+
 func BenchmarkCrypter_Encrypt(b *testing.B) {
 	c := NewCrypter("hello_world")
 	text := "some text for encrypt. Foo bar hello world abc"
@@ -41,6 +77,28 @@ func BenchmarkCrypter_Decrypt(b *testing.B) {
 	}
 }
 
+// Дешифрование по старой схеме для сравнения с BenchmarkCrypter_Decrypt
+func BenchmarkCrypter_DecryptLegacy(b *testing.B) {
+	c := newCrypter("hello_world")
+	defaultText := "some text for encrypt. Foo bar hello world abc"
+
+	benchText, err := encryptLegacy(c, defaultText)
+	if err != nil {
+		b.Fatalf("encrypt error: %s", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		actualText, err := c.Decrypt(benchText)
+		if err != nil {
+			b.Fatalf("decrypt error: %s", err)
+		}
+		if actualText != defaultText {
+			b.Errorf("dectypted text is not equal to default, expect %s, got: %s", defaultText, actualText)
+		}
+	}
+}
+
 func TestCrypter_Encrypt(t *testing.T) {
 	c := NewCrypter("someSecretFoobar")
 
@@ -101,7 +159,7 @@ func TestCrypter_Decrypt(t *testing.T) {
 		},
 		{
 			testName:     "not a cipher",
-			text:         defaultCipher[:defaultSaltBlockSize+1],
+			text:         defaultCipher[:len(hkdfPrefix)+defaultSaltBlockSize+1],
 			expectErr:    base64.CorruptInputError(16),
 			expectOutput: "",
 		},
@@ -116,3 +174,46 @@ func TestCrypter_Decrypt(t *testing.T) {
 		})
 	}
 }
+
+func TestCrypter_Outdated(t *testing.T) {
+	c := newCrypter("someSecretFoobar")
+
+	legacyCipher, err := encryptLegacy(c, "legacyText")
+	if err != nil {
+		t.Fatalf("setup test error: %s", err)
+	}
+	currentCipher, err := c.Encrypt("currentText")
+	if err != nil {
+		t.Fatalf("setup test error: %s", err)
+	}
+
+	testCases := []struct {
+		testName       string
+		text           string
+		expectOutput   string
+		expectOutdated bool
+	}{
+		{
+			testName:       "current scheme",
+			text:           currentCipher,
+			expectOutput:   "currentText",
+			expectOutdated: false,
+		},
+		{
+			testName:       "legacy scheme",
+			text:           legacyCipher,
+			expectOutput:   "legacyText",
+			expectOutdated: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			decrypted, err := c.Decrypt(tc.text)
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectOutput, decrypted)
+			assert.Equal(t, tc.expectOutdated, c.Outdated(tc.text))
+		})
+	}
+}
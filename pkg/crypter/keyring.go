@@ -0,0 +1,130 @@
+package crypter
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Шифротекст с версией ключа имеет вид "<key id>:<base64>". В base64url нет двоеточия,
+// поэтому шифротексты без префикса однозначно относятся к старому формату (legacy ключ)
+const keyIdSeparator = ":"
+
+var keyIdRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var (
+	ErrNoKeys       = errors.New("no keys in keyring")
+	ErrInvalidKeyId = errors.New("invalid key id")
+	ErrUnknownKey   = errors.New("unknown key id")
+	ErrInvalidKeys  = errors.New("invalid keys")
+)
+
+// Keyring шифрует текущим ключом и расшифровывает любым из известных.
+// Позволяет сменить секрет: старые ключи остаются для расшифровки, пока данные не перешифрованы (см. Outdated)
+type Keyring struct {
+	current string
+	keys    map[string]*crypter
+}
+
+type KeyringOption func(*Keyring)
+
+// Legacy задает ключ для шифротекстов без id ключа, которые были зашифрованы до появления версий
+func Legacy(secret string) KeyringOption {
+	return func(k *Keyring) {
+		if secret != "" {
+			k.keys[""] = newCrypter(secret)
+		}
+	}
+}
+
+// NewKeyring создает связку ключей keys (id -> секрет), шифрование идет ключом current.
+// Пустой current означает шифрование legacy ключом в старом формате без id
+func NewKeyring(current string, keys map[string]string, opts ...KeyringOption) (*Keyring, error) {
+	k := &Keyring{
+		current: current,
+		keys:    make(map[string]*crypter, len(keys)+1),
+	}
+	for id, secret := range keys {
+		if !keyIdRegex.MatchString(id) || secret == "" {
+			return nil, ErrInvalidKeyId
+		}
+		k.keys[id] = newCrypter(secret)
+	}
+	for _, opt := range opts {
+		opt(k)
+	}
+	if len(k.keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	if _, ok := k.keys[current]; !ok {
+		return nil, ErrUnknownKey
+	}
+	return k, nil
+}
+
+func (k *Keyring) Encrypt(text string) (string, error) {
+	cipherText, err := k.keys[k.current].Encrypt(text)
+	if err != nil {
+		return "", err
+	}
+	if k.current == "" {
+		return cipherText, nil
+	}
+	return k.current + keyIdSeparator + cipherText, nil
+}
+
+func (k *Keyring) Decrypt(text string) (string, error) {
+	id, cipherText := splitKeyId(text)
+	c, ok := k.keys[id]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	return c.Decrypt(cipherText)
+}
+
+// Outdated сообщает, что текст зашифрован не текущим ключом или по старой схеме и его стоит перешифровать
+func (k *Keyring) Outdated(text string) bool {
+	id, cipherText := splitKeyId(text)
+	return id != k.current || k.keys[id].Outdated(cipherText)
+}
+
+// ParseKeys разбирает ключи в формате "id:base64(секрет),id:base64(секрет)".
+// Секрет в base64, потому что в нем могут быть запятые и двоеточия, а в base64 их нет и разбор однозначный.
+// Любая некорректная запись - ошибка: молча потерянный или обрезанный ключ не расшифрует токены
+func ParseKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return keys, nil
+	}
+	for i, entry := range strings.Split(s, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), keyIdSeparator)
+		if !ok {
+			return nil, fmt.Errorf("%w: entry %d: expected id:base64 secret", ErrInvalidKeys, i+1)
+		}
+		if !keyIdRegex.MatchString(id) {
+			return nil, fmt.Errorf("%w: entry %d: invalid key id %q", ErrInvalidKeys, i+1, id)
+		}
+		if _, ok = keys[id]; ok {
+			return nil, fmt.Errorf("%w: duplicate key id %q", ErrInvalidKeys, id)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: secret is not base64: %s", ErrInvalidKeys, id, err)
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%w: key %q: empty secret", ErrInvalidKeys, id)
+		}
+		keys[id] = string(secret)
+	}
+	return keys, nil
+}
+
+func splitKeyId(text string) (string, string) {
+	id, cipherText, ok := strings.Cut(text, keyIdSeparator)
+	if !ok {
+		return "", text
+	}
+	return id, cipherText
+}
@@ -0,0 +1,211 @@
+package crypter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	testCases := []struct {
+		testName   string
+		value      string
+		expectKeys map[string]string
+		expectErr  bool
+	}{
+		{
+			testName:   "correct test",
+			value:      "1:Zmlyc3Q=,2:c2Vjb25k",
+			expectKeys: map[string]string{"1": "first", "2": "second"},
+		},
+		{
+			testName:   "secret with separators",
+			value:      "1:c2UsY3I6ZXQ=",
+			expectKeys: map[string]string{"1": "se,cr:et"},
+		},
+		{
+			testName:   "empty value",
+			value:      "",
+			expectKeys: map[string]string{},
+		},
+		{
+			testName:  "raw secret with comma",
+			value:     "1:se,cr:et",
+			expectErr: true,
+		},
+		{
+			testName:  "entry without id",
+			value:     "1:Zmlyc3Q=,c2Vjb25k",
+			expectErr: true,
+		},
+		{
+			testName:  "invalid key id",
+			value:     "a b:Zmlyc3Q=",
+			expectErr: true,
+		},
+		{
+			testName:  "duplicate key id",
+			value:     "1:Zmlyc3Q=,1:c2Vjb25k",
+			expectErr: true,
+		},
+		{
+			testName:  "empty secret",
+			value:     "1:",
+			expectErr: true,
+		},
+		{
+			testName:  "trailing separator",
+			value:     "1:Zmlyc3Q=,",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			keys, err := ParseKeys(tc.value)
+			if tc.expectErr {
+				assert.ErrorIs(t, err, ErrInvalidKeys)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectKeys, keys)
+		})
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	testCases := []struct {
+		testName  string
+		current   string
+		keys      map[string]string
+		opts      []KeyringOption
+		expectErr error
+	}{
+		{
+			testName:  "correct test",
+			current:   "2",
+			keys:      map[string]string{"1": "first", "2": "second"},
+			expectErr: nil,
+		},
+		{
+			testName:  "legacy only",
+			current:   "",
+			opts:      []KeyringOption{Legacy("legacy")},
+			expectErr: nil,
+		},
+		{
+			testName:  "no keys",
+			current:   "",
+			expectErr: ErrNoKeys,
+		},
+		{
+			testName:  "unknown current key",
+			current:   "3",
+			keys:      map[string]string{"1": "first"},
+			expectErr: ErrUnknownKey,
+		},
+		{
+			testName:  "key id with separator",
+			current:   "a:b",
+			keys:      map[string]string{"a:b": "first"},
+			expectErr: ErrInvalidKeyId,
+		},
+		{
+			testName:  "empty secret",
+			current:   "1",
+			keys:      map[string]string{"1": ""},
+			expectErr: ErrInvalidKeyId,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			_, err := NewKeyring(tc.current, tc.keys, tc.opts...)
+			assert.Equal(t, tc.expectErr, err)
+		})
+	}
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	legacyCipher, err := NewCrypter("legacy").Encrypt("legacy text")
+	if err != nil {
+		t.Fatalf("setup test error: %s", err)
+	}
+	old, err := NewKeyring("1", map[string]string{"1": "first"})
+	if err != nil {
+		t.Fatalf("setup test error: %s", err)
+	}
+	oldCipher, err := old.Encrypt("old text")
+	if err != nil {
+		t.Fatalf("setup test error: %s", err)
+	}
+
+	k, err := NewKeyring("2", map[string]string{"1": "first", "2": "second"}, Legacy("legacy"))
+	if err != nil {
+		t.Fatalf("setup test error: %s", err)
+	}
+	newCipher, err := k.Encrypt("new text")
+	if err != nil {
+		t.Fatalf("setup test error: %s", err)
+	}
+	assert.True(t, strings.HasPrefix(newCipher, "2:"))
+	staleCipher, err := encryptLegacy(k.keys["2"], "stale text")
+	if err != nil {
+		t.Fatalf("setup test error: %s", err)
+	}
+	staleCipher = "2:" + staleCipher
+
+	testCases := []struct {
+		testName       string
+		text           string
+		expectErr      error
+		expectOutput   string
+		expectOutdated bool
+	}{
+		{
+			testName:       "current key",
+			text:           newCipher,
+			expectErr:      nil,
+			expectOutput:   "new text",
+			expectOutdated: false,
+		},
+		{
+			testName:       "previous key",
+			text:           oldCipher,
+			expectErr:      nil,
+			expectOutput:   "old text",
+			expectOutdated: true,
+		},
+		{
+			testName:       "legacy cipher without key id",
+			text:           legacyCipher,
+			expectErr:      nil,
+			expectOutput:   "legacy text",
+			expectOutdated: true,
+		},
+		{
+			testName:       "current key with legacy scheme",
+			text:           staleCipher,
+			expectErr:      nil,
+			expectOutput:   "stale text",
+			expectOutdated: true,
+		},
+		{
+			testName:       "unknown key",
+			text:           "3:" + strings.TrimPrefix(newCipher, "2:"),
+			expectErr:      ErrUnknownKey,
+			expectOutput:   "",
+			expectOutdated: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			decrypted, err := k.Decrypt(tc.text)
+
+			assert.Equal(t, tc.expectErr, err)
+			assert.Equal(t, tc.expectOutput, decrypted)
+			assert.Equal(t, tc.expectOutdated, k.Outdated(tc.text))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"time"
 )
 
@@ -12,7 +13,7 @@ const defaultDisconnectTimeout = time.Second * 5
 type Pool interface {
 	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
 	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
-	//Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (cur *mongo.Cursor, err error)
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (cur *mongo.Cursor, err error)
 
 	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
 	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
@@ -40,10 +41,20 @@ func (m *Mongo) Disconnect() {
 	_ = m.client.Disconnect(ctx)
 }
 
+// Ping проверяет доступность primary ноды
+func (m *Mongo) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, readpref.Primary())
+}
+
 func (m *Mongo) Drop(ctx context.Context) error {
 	return m.database.Drop(ctx)
 }
 
+// Database нужна для операций вне Pool: индексов, агрегаций и миграций
+func (m *Mongo) Database() *mongo.Database {
+	return m.database
+}
+
 func (m *Mongo) Collection(name string) Pool {
 	return m.database.Collection(name)
 }
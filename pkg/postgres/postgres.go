@@ -0,0 +1,19 @@
+package postgres
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Postgres struct {
+	*pgxpool.Pool
+}
+
+// NewPostgres создает пул соединений. Соединения открываются лениво, доступность базы проверяет Ping
+func NewPostgres(ctx context.Context, url string) (*Postgres, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return &Postgres{pool}, nil
+}
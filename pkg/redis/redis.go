@@ -18,6 +18,7 @@ type Redis interface {
 	Del(ctx context.Context, keys ...string) *redis.IntCmd
 	Exists(ctx context.Context, keys ...string) *redis.IntCmd
 	Conn() *redis.Client
+	Ping(ctx context.Context) error
 	Close()
 }
 
@@ -42,6 +43,10 @@ func (r *rdb) Conn() *redis.Client {
 	return r.Client
 }
 
+func (r *rdb) Ping(ctx context.Context) error {
+	return r.Client.Ping(ctx).Err()
+}
+
 func (r *rdb) Close() {
 	_ = r.Client.Close()
 }
@@ -0,0 +1,32 @@
+// Package secret - строки с учетными данными (пароли, токены), которые не попадают в логи.
+package secret
+
+const redacted = "[REDACTED]"
+
+// String скрывает значение при выводе через fmt, json и текстовые кодировщики (в том числе zerolog Interface и Stringer).
+// Само значение доступно только через Reveal, поэтому каждое место, где секрет уходит наружу, видно явно.
+// Пустая строка выводится как есть, чтобы в логах было видно, задан секрет или нет
+type String string
+
+func (s String) Reveal() string {
+	return string(s)
+}
+
+func (s String) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s String) GoString() string {
+	return `secret.String("` + s.String() + `")`
+}
+
+func (s String) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s String) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
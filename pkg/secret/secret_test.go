@@ -0,0 +1,55 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	type input struct {
+		Login    string `json:"login"`
+		Password String `json:"password"`
+	}
+
+	testCases := []struct {
+		testName     string
+		secret       String
+		expectOutput string
+	}{
+		{
+			testName:     "secret redacted",
+			secret:       "p@ssw0rd",
+			expectOutput: redacted,
+		},
+		{
+			testName:     "empty secret",
+			secret:       "",
+			expectOutput: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			v := input{Login: "login", Password: tc.secret}
+
+			assert.Equal(t, tc.expectOutput, fmt.Sprint(tc.secret))
+			assert.Equal(t, fmt.Sprintf("{login %s}", tc.expectOutput), fmt.Sprintf("%v", v))
+			assert.NotContains(t, fmt.Sprintf("%#v", v), "p@ssw0rd")
+
+			b, err := json.Marshal(v)
+			assert.Nil(t, err)
+			assert.JSONEq(t, fmt.Sprintf(`{"login":"login","password":%q}`, tc.expectOutput), string(b))
+
+			var buf bytes.Buffer
+			logger := zerolog.New(&buf)
+			logger.Info().Interface("input", v).Stringer("password", tc.secret).Msg("")
+			assert.NotContains(t, buf.String(), "p@ssw0rd")
+
+			assert.Equal(t, string(tc.secret), tc.secret.Reveal())
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/url"
+	"strings"
+)
+
+const (
+	defaultServiceName = "bot_for_modeus"
+	// Путь, который по спецификации OTLP дописывается к базовому адресу из OTEL_EXPORTER_OTLP_ENDPOINT
+	tracesPath = "/v1/traces"
+)
+
+type options struct {
+	serviceName string
+	sampleRatio float64
+}
+
+type Option func(o *options)
+
+func ServiceName(name string) Option {
+	return func(o *options) {
+		o.serviceName = name
+	}
+}
+
+// SampleRatio доля сохраняемых трейсов от 0 до 1. Решение о сэмплировании наследуется от родительского спана
+func SampleRatio(ratio float64) Option {
+	return func(o *options) {
+		o.sampleRatio = ratio
+	}
+}
+
+// NewProvider создает провайдер, который пачками отправляет спаны в OTLP коллектор по HTTP.
+// Endpoint - базовый URL коллектора, как в OTEL_EXPORTER_OTLP_ENDPOINT, например, http://otel-collector:4318.
+// Схема http отключает TLS
+func NewProvider(ctx context.Context, endpoint string, opts ...Option) (*sdktrace.TracerProvider, error) {
+	o := &options{
+		serviceName: defaultServiceName,
+		sampleRatio: 1,
+	}
+	for _, option := range opts {
+		option(o)
+	}
+
+	tracesURL, err := tracesEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(tracesURL))
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", o.serviceName))),
+	), nil
+}
+
+// Экспортер молча игнорирует некорректный URL и шлет спаны на localhost, поэтому проверяем адрес сами
+func tracesEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("tracing endpoint: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("tracing endpoint %q: expected URL like http://otel-collector:4318", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + tracesPath
+	return u.String(), nil
+}
+
+// End завершает спан и, если операция закончилась ошибкой, помечает его ошибочным
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}